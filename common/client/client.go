@@ -0,0 +1,155 @@
+// Package client lets apps supervised by gracevisord report their status.
+//
+// The daemon injects everything needed to report into the app environment,
+// so most apps only need:
+//
+//	c, err := client.NewFromEnv()
+//	...
+//	c.Serving("ready")
+//
+// Wire protocol is described in PROTOCOL.md.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/hamaxx/gracevisor/common/report"
+)
+
+const (
+	EnvApp         = "GRACEVISOR_APP"
+	EnvInstanceId  = "GRACEVISOR_INSTANCE_ID"
+	EnvReportUrl   = "GRACEVISOR_REPORT_URL"
+	EnvReportToken = "GRACEVISOR_REPORT_TOKEN"
+
+	defaultTimeout = 5 * time.Second
+)
+
+var (
+	ErrNotSupervised = errors.New("Not running under gracevisord")
+)
+
+type Client struct {
+	Url        string
+	Token      string
+	App        string
+	InstanceId uint32
+
+	HttpClient *http.Client
+}
+
+// NewFromEnv creates a client from environment variables injected by gracevisord.
+// ErrNotSupervised is returned if the app was not started by gracevisord.
+func NewFromEnv() (*Client, error) {
+	url := os.Getenv(EnvReportUrl)
+	if url == "" {
+		return nil, ErrNotSupervised
+	}
+
+	instanceId, err := strconv.ParseUint(os.Getenv(EnvInstanceId), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s: %s", EnvInstanceId, err)
+	}
+
+	return &Client{
+		Url:        url,
+		Token:      os.Getenv(EnvReportToken),
+		App:        os.Getenv(EnvApp),
+		InstanceId: uint32(instanceId),
+		HttpClient: &http.Client{Timeout: defaultTimeout},
+	}, nil
+}
+
+// Report sends a single heartbeat with status and message
+func (c *Client) Report(status, message string) error {
+	return c.send(&report.Heartbeat{
+		Status:  status,
+		Message: message,
+	})
+}
+
+// Ready reports serving status with readiness, not ready instance is taken out
+// of rotation until it reports ready again
+func (c *Client) Ready(ready bool, message string) error {
+	return c.send(&report.Heartbeat{
+		Status:  report.HeartbeatServing,
+		Message: message,
+		Ready:   &ready,
+	})
+}
+
+// RequestReplace asks gracevisord to gracefully replace this instance with a new one,
+// for example after a code reload or when memory grows too large. It fails if the
+// instance is not active or another restart of the app is in progress.
+func (c *Client) RequestReplace(message string) error {
+	return c.send(&report.Heartbeat{
+		Status:  report.HeartbeatServing,
+		Message: message,
+		Replace: true,
+	})
+}
+
+func (c *Client) send(heartbeat *report.Heartbeat) error {
+	heartbeat.App = c.App
+	heartbeat.InstanceId = c.InstanceId
+	heartbeat.Token = c.Token
+
+	body, err := json.Marshal(heartbeat)
+	if err != nil {
+		return err
+	}
+
+	httpClient := c.HttpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Post(c.Url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Report failed: %s", resp.Status)
+	}
+	return nil
+}
+
+func (c *Client) Starting(message string) error {
+	return c.Report(report.HeartbeatStarting, message)
+}
+
+func (c *Client) Serving(message string) error {
+	return c.Report(report.HeartbeatServing, message)
+}
+
+func (c *Client) Stopping(message string) error {
+	return c.Report(report.HeartbeatStopping, message)
+}
+
+// Heartbeat reports status every interval until stop is closed.
+// Errors are passed to onError if it is not nil.
+func (c *Client) Heartbeat(interval time.Duration, status func() (string, string), stop <-chan struct{}, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.Report(status()); err != nil && onError != nil {
+			onError(err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,92 @@
+"""Gracevisor self report client, see ../PROTOCOL.md."""
+
+import json
+import os
+import threading
+import urllib.request
+
+STARTING = "starting"
+SERVING = "serving"
+STOPPING = "stopping"
+
+
+class NotSupervised(Exception):
+    pass
+
+
+class Client(object):
+    def __init__(self, url, token, app, instance_id, timeout=5):
+        self.url = url
+        self.token = token
+        self.app = app
+        self.instance_id = instance_id
+        self.timeout = timeout
+
+    @classmethod
+    def from_env(cls, environ=os.environ):
+        url = environ.get("GRACEVISOR_REPORT_URL")
+        if not url:
+            raise NotSupervised("Not running under gracevisord")
+        return cls(
+            url,
+            environ.get("GRACEVISOR_REPORT_TOKEN", ""),
+            environ.get("GRACEVISOR_APP", ""),
+            int(environ["GRACEVISOR_INSTANCE_ID"]),
+        )
+
+    def report(self, status, message="", ready=None, replace=False):
+        heartbeat = {
+            "app": self.app,
+            "instance_id": self.instance_id,
+            "token": self.token,
+            "status": status,
+            "message": message,
+        }
+        if ready is not None:
+            heartbeat["ready"] = bool(ready)
+        if replace:
+            heartbeat["replace"] = True
+        body = json.dumps(heartbeat).encode("utf-8")
+        request = urllib.request.Request(
+            self.url, data=body, headers={"Content-Type": "application/json"})
+        with urllib.request.urlopen(request, timeout=self.timeout) as response:
+            if response.status not in (200, 204):
+                raise IOError("Report failed: %d" % response.status)
+
+    def starting(self, message=""):
+        self.report(STARTING, message)
+
+    def serving(self, message=""):
+        self.report(SERVING, message)
+
+    def ready(self, ready, message=""):
+        """Report readiness, not ready instance is taken out of rotation."""
+        self.report(SERVING, message, ready)
+
+    def request_replace(self, message=""):
+        """Ask gracevisord to gracefully replace this instance with a new one."""
+        self.report(SERVING, message, replace=True)
+
+    def stopping(self, message=""):
+        self.report(STOPPING, message)
+
+    def heartbeat(self, interval, status=lambda: (SERVING, "")):
+        """Report status() every interval seconds from a daemon thread.
+
+        Returns an event, set it to stop reporting.
+        """
+        stop = threading.Event()
+
+        def run():
+            while True:
+                try:
+                    self.report(*status())
+                except Exception:
+                    pass
+                if stop.wait(interval):
+                    return
+
+        thread = threading.Thread(target=run)
+        thread.daemon = True
+        thread.start()
+        return stop
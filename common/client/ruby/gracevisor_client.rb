@@ -0,0 +1,84 @@
+# Gracevisor self report client, see ../PROTOCOL.md.
+
+require 'json'
+require 'net/http'
+require 'uri'
+
+module Gracevisor
+  STARTING = 'starting'.freeze
+  SERVING = 'serving'.freeze
+  STOPPING = 'stopping'.freeze
+
+  class NotSupervised < StandardError; end
+
+  class Client
+    attr_reader :url, :token, :app, :instance_id
+
+    def initialize(url, token, app, instance_id, timeout: 5)
+      @url = URI(url)
+      @token = token
+      @app = app
+      @instance_id = instance_id
+      @timeout = timeout
+    end
+
+    def self.from_env(env = ENV)
+      url = env['GRACEVISOR_REPORT_URL']
+      raise NotSupervised, 'Not running under gracevisord' if url.nil? || url.empty?
+
+      new(url, env.fetch('GRACEVISOR_REPORT_TOKEN', ''), env.fetch('GRACEVISOR_APP', ''),
+          Integer(env.fetch('GRACEVISOR_INSTANCE_ID')))
+    end
+
+    def report(status, message = '', ready: nil, replace: false)
+      heartbeat = { app: @app, instance_id: @instance_id, token: @token,
+                    status: status, message: message }
+      heartbeat[:ready] = ready ? true : false unless ready.nil?
+      heartbeat[:replace] = true if replace
+      body = JSON.generate(heartbeat)
+      response = Net::HTTP.start(@url.host, @url.port,
+                                 open_timeout: @timeout, read_timeout: @timeout) do |http|
+        http.post(@url.path, body, 'Content-Type' => 'application/json')
+      end
+      raise IOError, "Report failed: #{response.code}" unless %w[200 204].include?(response.code)
+    end
+
+    def starting(message = '')
+      report(STARTING, message)
+    end
+
+    def serving(message = '')
+      report(SERVING, message)
+    end
+
+    # Reports readiness, not ready instance is taken out of rotation.
+    def ready(ready, message = '')
+      report(SERVING, message, ready: ready)
+    end
+
+    # Asks gracevisord to gracefully replace this instance with a new one.
+    def request_replace(message = '')
+      report(SERVING, message, replace: true)
+    end
+
+    def stopping(message = '')
+      report(STOPPING, message)
+    end
+
+    # Reports the result of the block ([status, message]) every interval
+    # seconds from a background thread. Kill the returned thread to stop.
+    def heartbeat(interval, &status)
+      status ||= -> { [SERVING, ''] }
+      Thread.new do
+        loop do
+          begin
+            report(*status.call)
+          rescue StandardError
+            nil
+          end
+          sleep interval
+        end
+      end
+    end
+  end
+end
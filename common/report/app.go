@@ -5,5 +5,32 @@ type App struct {
 	Host string
 	Port uint16
 
+	Version string
+
+	Operation      string
+	OperationSince uint64
+
+	Paused      bool
+	PausedSince uint64
+
+	// Quarantined apps used up retries and retry again after QuarantineCooldown seconds
+	Quarantined        bool
+	QuarantinedSince   uint64
+	QuarantineCooldown uint64
+
+	WaitingForPort      bool
+	WaitingForPortSince uint64
+
+	// Connections are open client connections of external and preview listeners,
+	// connections over MaxConnections are rejected
+	Connections         int64
+	AcceptedConnections int64
+	RejectedConnections int64
+	MaxConnections      int
+
+	// Certificate of tls listeners that expires first, in seconds, negative when expired
+	Certificate          string
+	CertificateExpiresIn int64
+
 	Instances []*Instance
 }
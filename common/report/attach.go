@@ -0,0 +1,23 @@
+package report
+
+// Attach selects output of an instance for rpc attach command, Since is the
+// sequence of the last line seen, 0 starts at current output
+type Attach struct {
+	App        string
+	InstanceId uint32
+	Since      uint64
+}
+
+type OutputLine struct {
+	Stderr bool
+	Line   string
+}
+
+// AttachOutput are instance output lines after Since, Dropped counts lines
+// that were overwritten before the client read them
+type AttachOutput struct {
+	Lines   []*OutputLine
+	Next    uint64
+	Dropped uint64
+	Ended   bool
+}
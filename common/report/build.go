@@ -0,0 +1,56 @@
+package report
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// BuildInfo describes a gracevisord or gracevisorctl binary, version, commit and
+// build date are set with -ldflags at build time
+type BuildInfo struct {
+	Version   string
+	Commit    string
+	BuildDate string
+	GoVersion string
+	Platform  string
+}
+
+// NewBuildInfo completes build info with the go toolchain and platform, commit
+// falls back to vcs revision that go build embeds only in module mode, GOPATH
+// builds have to set it with -ldflags
+func NewBuildInfo(version string, commit string, buildDate string) *BuildInfo {
+	info := &BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	return info
+}
+
+func (b *BuildInfo) String() string {
+	commit := b.Commit
+	if commit == "" {
+		commit = "unknown"
+	}
+	if len(commit) > 12 {
+		commit = commit[:12]
+	}
+	s := fmt.Sprintf("%s (commit %s", b.Version, commit)
+	if b.BuildDate != "" {
+		s += ", built " + b.BuildDate
+	}
+	return s + fmt.Sprintf(", %s %s)", b.GoVersion, b.Platform)
+}
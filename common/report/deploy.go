@@ -0,0 +1,27 @@
+package report
+
+import "time"
+
+type Deploy struct {
+	App     string
+	Hold    bool
+	Version string
+	// Force deploys outside deploy windows of the app
+	Force bool
+}
+
+type Rollback struct {
+	App string
+	To  string
+}
+
+// DeployRecord describes one deployed version of an app
+type DeployRecord struct {
+	Version     string
+	Command     string
+	Args        []string
+	Environment []string
+	Time        time.Time
+	RequestedBy string
+	Rollback    bool
+}
@@ -0,0 +1,16 @@
+package report
+
+import "time"
+
+// Exec is a command run with the environment of app active instance
+type Exec struct {
+	App     string
+	Command []string
+	Timeout time.Duration
+}
+
+type ExecResult struct {
+	Output   string
+	ExitCode int
+	TimedOut bool
+}
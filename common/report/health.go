@@ -0,0 +1,14 @@
+package report
+
+// Health overrides set with set-health
+const (
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+	HealthAuto      = "auto"
+)
+
+type HealthOverride struct {
+	App        string
+	InstanceId uint32
+	Health     string
+}
@@ -0,0 +1,24 @@
+package report
+
+// Self reported instance statuses
+const (
+	HeartbeatStarting = "starting"
+	HeartbeatServing  = "serving"
+	HeartbeatStopping = "stopping"
+)
+
+// Heartbeat is sent by instances to gracevisord as json over http POST
+// to GRACEVISOR_REPORT_URL, authenticated with GRACEVISOR_REPORT_TOKEN
+type Heartbeat struct {
+	App        string `json:"app"`
+	InstanceId uint32 `json:"instance_id"`
+	Token      string `json:"token"`
+	Status     string `json:"status,omitempty"`
+	Message    string `json:"message,omitempty"`
+
+	// Ready takes instance in or out of rotation, nil leaves readiness unchanged
+	Ready *bool `json:"ready,omitempty"`
+
+	// Replace asks for graceful replacement of the active instance that reports
+	Replace bool `json:"replace,omitempty"`
+}
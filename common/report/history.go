@@ -0,0 +1,16 @@
+package report
+
+import "time"
+
+// HistoryRecord describes lifecycle of one finished instance
+type HistoryRecord struct {
+	InstanceId  uint32
+	StartTime   time.Time
+	ExitTime    time.Time
+	ExitCode    int
+	Status      string
+	Reason      string
+	RequestedBy string
+	CoreFile    string
+	Version     string
+}
@@ -1,11 +1,39 @@
 package report
 
+import "time"
+
 type Instance struct {
 	Id                uint32
 	Active            bool
 	Host              string
 	Port              uint16
 	Status            string
+	Version           string
 	SinceStatusChange uint64
+	StartTime         time.Time
+	Uptime            uint64
+	Pid               int
+	Memory            uint64
+	ExitCode          int
+	ExitSignal        string
+	StopReason        string
 	Error             string
+	Unhealthy         bool
+	NotReady          bool
+	Canary            bool
+	Held              bool
+	Standby           bool
+	SlowStart         float64
+	HealthOverride    string
+	ReportedStatus    string
+	ReportedMessage   string
+	CoreDumped        bool
+	CoreFile          string
+	Connections       int32
+	Requests          int64
+	Errors            int64
+	AvgLatency        time.Duration
+	P50Latency        time.Duration
+	P95Latency        time.Duration
+	P99Latency        time.Duration
 }
@@ -0,0 +1,10 @@
+package report
+
+// LogQuery selects app log lines for rpc logs command
+type LogQuery struct {
+	App        string
+	InstanceId uint32
+	Since      int64
+	Lines      int
+	Stderr     bool
+}
@@ -0,0 +1,15 @@
+package report
+
+// PortPool is utilization of internal port range
+type PortPool struct {
+	From uint16
+	To   uint16
+	Size int
+
+	// Used ports belong to running instances, Reclaimable ones to exited instances
+	Used        int
+	Reclaimable int
+
+	// Waiting are apps with a new instance waiting for a free port
+	Waiting []string
+}
@@ -0,0 +1,14 @@
+package report
+
+// ProtocolVersion is the rpc protocol spoken between gracevisorctl and gracevisord,
+// it is bumped when rpc methods or their arguments change incompatibly.
+// MinProtocolVersion is the oldest protocol the other side may speak.
+// Both are exchanged in headers of rpc CONNECT request and response, a missing
+// header means protocol 1 from before versioning.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+
+	ProtocolHeader = "X-Gracevisor-Protocol"
+	VersionHeader  = "X-Gracevisor-Version"
+)
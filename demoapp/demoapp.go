@@ -8,6 +8,11 @@ import (
 	"os"
 	"os/user"
 	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/hamaxx/gracevisor/common/client"
+	"github.com/hamaxx/gracevisor/common/report"
 )
 
 var portFlag = flag.Int("port", 8080, "port")
@@ -37,7 +42,26 @@ func main() {
 		fmt.Printf("New request to %d\n", port)
 	})
 
+	var notReady int32
+	http.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&notReady) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	http.HandleFunc("/toggle-ready", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "not ready: %d", atomic.AddInt32(&notReady, 1)%2)
+		atomic.CompareAndSwapInt32(&notReady, 2, 0)
+	})
+
 	log.Println("This is stderr")
 
+	if c, err := client.NewFromEnv(); err == nil {
+		go c.Heartbeat(time.Second, func() (string, string) {
+			return report.HeartbeatServing, fmt.Sprintf("port %d", port)
+		}, nil, func(err error) {
+			log.Println("Report failed:", err)
+		})
+	}
+
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
 }
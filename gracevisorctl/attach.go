@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"os"
+	"os/signal"
+
+	"github.com/hamaxx/gracevisor/common/report"
+)
+
+// attach streams output of app instance until it exits, Ctrl-C only detaches and
+// leaves the instance running, instance 0 is the active one
+func attach(client *rpc.Client, appName string, instanceId uint32) error {
+	if instanceId == 0 {
+		appReport, err := appStatus(client, appName)
+		if err != nil {
+			return err
+		}
+		for _, instanceReport := range appReport.Instances {
+			if instanceReport.Active {
+				instanceId = instanceReport.Id
+			}
+		}
+		if instanceId == 0 {
+			return errors.New("no active instance of " + appName)
+		}
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		fmt.Fprintf(os.Stderr, "detached from %s instance %d\n", appName, instanceId)
+		os.Exit(0)
+	}()
+
+	query := &report.Attach{App: appName, InstanceId: instanceId}
+	attached := false
+	for {
+		var output report.AttachOutput
+		if err := client.Call("Rpc.Attach", query, &output); err != nil {
+			return err
+		}
+		if !attached {
+			fmt.Fprintf(os.Stderr, "attached to %s instance %d, Ctrl-C detaches\n", appName, instanceId)
+			attached = true
+		}
+		if output.Dropped > 0 {
+			fmt.Fprintf(os.Stderr, "... %d lines skipped\n", output.Dropped)
+		}
+		for _, line := range output.Lines {
+			if line.Stderr {
+				fmt.Fprintln(os.Stderr, line.Line)
+			} else {
+				fmt.Println(line.Line)
+			}
+		}
+		if output.Ended {
+			fmt.Fprintf(os.Stderr, "%s instance %d output ended\n", appName, instanceId)
+			return nil
+		}
+		query.Since = output.Next
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/hamaxx/gracevisor/deps/cli"
+)
+
+// daemonAddresses returns addresses of all daemons from --host flags and --hosts-file,
+// hosts without port use --port
+func daemonAddresses(c *cli.Context) []string {
+	hosts := append([]string{}, c.GlobalStringSlice("host")...)
+
+	if hostsFile := c.GlobalString("hosts-file"); hostsFile != "" {
+		file, err := os.Open(hostsFile)
+		if err != nil {
+			log.Fatal("hosts file:", err)
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			hosts = append(hosts, line)
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			log.Fatal("hosts file:", err)
+		}
+	}
+
+	if len(hosts) == 0 {
+		hosts = []string{defaultHost}
+	}
+
+	addresses := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, strconv.Itoa(c.GlobalInt("port")))
+		}
+		addresses = append(addresses, host)
+	}
+	return addresses
+}
+
+// clusterCall runs call against every daemon, failures on one daemon don't stop
+// the others. With more than one daemon output of each is prefixed with its address.
+func clusterCall(c *cli.Context, call func(client *rpc.Client) error) {
+	addresses := daemonAddresses(c)
+	if len(addresses) == 1 {
+		if err := call(getRpcClient(c)); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	failed := 0
+	code := 0
+	for _, address := range addresses {
+		fmt.Printf("== %s ==\n", address)
+
+		client, err := dialRpc(address, c.GlobalString("token"))
+		daemonCode := ExitUnreachable
+		if err == nil {
+			err = call(client)
+			client.Close()
+			daemonCode = exitCode(err)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: error: %s\n", address, err)
+			failed++
+			// daemons failing differently exit with generic error
+			if code == 0 {
+				code = daemonCode
+			} else if code != daemonCode {
+				code = ExitError
+			}
+		}
+	}
+
+	if failed > 0 {
+		log.Printf("%d of %d daemons failed", failed, len(addresses))
+		os.Exit(code)
+	}
+}
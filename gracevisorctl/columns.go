@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hamaxx/gracevisor/common/report"
+)
+
+// statusColumn is a column of instance table in status output
+type statusColumn struct {
+	header string
+	value  func(instanceReport *report.Instance) string
+}
+
+var statusColumns = map[string]*statusColumn{
+	"status": {"STATUS", func(r *report.Instance) string {
+		return r.Status
+	}},
+	"version": {"VERSION", func(r *report.Instance) string {
+		return r.Version
+	}},
+	"since": {"SINCE", func(r *report.Instance) string {
+		return (time.Duration(r.SinceStatusChange) * time.Second).String()
+	}},
+	"pid": {"PID", func(r *report.Instance) string {
+		if r.Pid == 0 {
+			return "-"
+		}
+		return strconv.Itoa(r.Pid)
+	}},
+	"uptime": {"UPTIME", func(r *report.Instance) string {
+		return (time.Duration(r.Uptime) * time.Second).String()
+	}},
+	"started": {"STARTED", func(r *report.Instance) string {
+		return r.StartTime.Format(time.RFC3339)
+	}},
+	"mem": {"MEM", func(r *report.Instance) string {
+		if r.Memory == 0 {
+			return "-"
+		}
+		return formatBytes(r.Memory)
+	}},
+	"exit": {"EXIT", func(r *report.Instance) string {
+		if r.ExitSignal != "" {
+			return r.ExitSignal
+		}
+		if r.ExitCode < 0 {
+			return "-"
+		}
+		return strconv.Itoa(r.ExitCode)
+	}},
+	"connections": {"CONNS", func(r *report.Instance) string {
+		return strconv.Itoa(int(r.Connections))
+	}},
+	"requests": {"REQUESTS", func(r *report.Instance) string {
+		return strconv.FormatInt(r.Requests, 10)
+	}},
+	"errors": {"ERRORS", func(r *report.Instance) string {
+		return strconv.FormatInt(r.Errors, 10)
+	}},
+	"latency": {"LATENCY", func(r *report.Instance) string {
+		return r.AvgLatency.String()
+	}},
+	"p99": {"P99", func(r *report.Instance) string {
+		return r.P99Latency.String()
+	}},
+	"flags": {"FLAGS", instanceFlags},
+}
+
+var (
+	defaultStatusColumns = []string{"status", "version", "since", "flags"}
+	wideStatusColumns    = []string{"status", "version", "since", "pid", "uptime", "mem", "started", "exit",
+		"connections", "requests", "errors", "latency", "p99", "flags"}
+)
+
+// parseStatusColumns checks comma separated column names, empty list is the default compact set
+func parseStatusColumns(list string, wide bool) ([]string, error) {
+	if list == "" {
+		if wide {
+			return wideStatusColumns, nil
+		}
+		return defaultStatusColumns, nil
+	}
+
+	columns := strings.Split(list, ",")
+	for i, column := range columns {
+		columns[i] = strings.TrimSpace(column)
+		if _, ok := statusColumns[columns[i]]; !ok {
+			return nil, fmt.Errorf("unknown column %s, available are %s", columns[i], strings.Join(wideStatusColumns, ","))
+		}
+	}
+	return columns, nil
+}
+
+// instanceFlags describes instance state, health and exit details, with error last
+func instanceFlags(r *report.Instance) string {
+	flags := ""
+	if r.Unhealthy {
+		flags += "unhealthy "
+	}
+	if r.Canary {
+		flags += "canary "
+	}
+	if r.SlowStart > 0 {
+		flags += fmt.Sprintf("slow start %.0f%% ", r.SlowStart)
+	}
+	if r.Held {
+		flags += "held "
+	}
+	if r.Standby {
+		flags += "standby "
+	}
+	if r.NotReady {
+		flags += "not ready "
+	}
+	if r.HealthOverride != "" {
+		flags += fmt.Sprintf("forced %s ", r.HealthOverride)
+	}
+	if r.ReportedStatus != "" || r.ReportedMessage != "" {
+		flags += fmt.Sprintf("reported: %s %s ", r.ReportedStatus, r.ReportedMessage)
+	}
+	uptime := time.Duration(r.Uptime) * time.Second
+	if r.ExitCode >= 0 || r.ExitSignal != "" {
+		flags += fmt.Sprintf("ran %s ", uptime)
+		if r.ExitSignal != "" {
+			flags += fmt.Sprintf("signal %s ", r.ExitSignal)
+		} else {
+			flags += fmt.Sprintf("exit %d ", r.ExitCode)
+		}
+		if r.StopReason != "" {
+			flags += fmt.Sprintf("stopped: %s ", r.StopReason)
+		} else if r.ExitSignal != "" || r.ExitCode != 0 {
+			flags += "crashed "
+		}
+	} else if r.Pid != 0 {
+		flags += fmt.Sprintf("pid %d up %s ", r.Pid, uptime)
+	}
+	if r.CoreDumped {
+		flags += fmt.Sprintf("core dumped: %s ", r.CoreFile)
+	}
+	return flags + r.Error
+}
+
+// formatBytes formats size in bytes with binary unit
+func formatBytes(size uint64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%dB", size)
+	}
+	div, exp := uint64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log"
+	"os"
+)
+
+// exit codes of gracevisorctl, so scripts can branch on results
+const (
+	ExitError       = 1 // command failed or was rejected by gracevisord
+	ExitUnreachable = 2 // gracevisord could not be reached
+	ExitNotServing  = 3 // status found an app without serving active instance
+	ExitTimeout     = 4 // --wait timed out before new instance was serving
+	ExitFailed      = 5 // --wait saw new instance fail
+)
+
+// exitError makes gracevisorctl exit with code instead of ExitError
+type exitError struct {
+	code int
+	msg  string
+}
+
+func (e *exitError) Error() string {
+	return e.msg
+}
+
+func exitCode(err error) int {
+	if e, ok := err.(*exitError); ok {
+		return e.code
+	}
+	return ExitError
+}
+
+// fatal prints err and exits with its exit code
+func fatal(err error) {
+	log.Print("error:", err)
+	os.Exit(exitCode(err))
+}
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"net/rpc"
 	"os"
+	"strconv"
+	"strings"
 	"text/tabwriter"
 	"time"
 
@@ -19,36 +27,162 @@ const (
 
 var version = "dev"
 var commit = ""
+var buildDate = ""
 
 func getRpcClient(c *cli.Context) *rpc.Client {
-	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.GlobalString("host"), c.GlobalInt("port")))
+	addresses := daemonAddresses(c)
+	if len(addresses) > 1 {
+		log.Fatal("multiple hosts are supported only by status, restart and deploy")
+	}
+	client, err := dialRpc(addresses[0], c.GlobalString("token"))
 	if err != nil {
-		log.Fatal("dialing:", err)
+		log.Print("dialing:", err)
+		os.Exit(ExitUnreachable)
 	}
 	return client
 }
 
+// dialRpc connects to gracevisord like rpc.DialHTTP, authenticating with token if set
+// and checking both sides speak compatible protocol
+func dialRpc(address string, token string) (*rpc.Client, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("CONNECT", rpc.DefaultRPCPath, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req.Header.Set(report.ProtocolHeader, strconv.Itoa(report.ProtocolVersion))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		conn.Close()
+		if len(message) > 0 {
+			return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+		}
+		return nil, errors.New(resp.Status)
+	}
+
+	protocol, daemonVersion, err := daemonProtocol(resp)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rpc.NewClientWithCodec(newClientCodec(conn, daemonVersion, protocol)), nil
+}
+
 func basicRpcCall(client *rpc.Client, method string, args interface{}) {
+	if err := rpcCall(client, method, args); err != nil {
+		log.Fatal("error:", err)
+	}
+}
+
+func rpcCall(client *rpc.Client, method string, args interface{}) error {
 	var reply string
 	err := client.Call(fmt.Sprintf("Rpc.%s", method), args, &reply)
 	if err != nil {
-		log.Fatal("error:", err)
+		return err
 	}
 	if reply != "" {
 		fmt.Println(reply)
 	}
+	return nil
 }
 
-func statusRpcCall(client *rpc.Client, args interface{}) {
+func statusRpcCall(client *rpc.Client, target string, verbose bool, columns []string, header bool) error {
 	var reply []*report.App
-	err := client.Call("Rpc.Status", args, &reply)
-	if err != nil {
-		log.Fatal("error:", err)
+	if target == "" {
+		if err := client.Call("Rpc.Status", "", &reply); err != nil {
+			return err
+		}
+	} else {
+		apps, err := resolveApps(client, target)
+		if err != nil {
+			return err
+		}
+		for _, appName := range apps {
+			var appReply []*report.App
+			if err := client.Call("Rpc.Status", appName, &appReply); err != nil {
+				return err
+			}
+			reply = append(reply, appReply...)
+		}
 	}
 
+	notServing := []string{}
 	tabWriter := tabwriter.NewWriter(os.Stdout, 2, 2, 1, ' ', 0)
 	for _, appReport := range reply {
-		fmt.Fprintf(tabWriter, "[%s/%s:%d]\n", appReport.Name, appReport.Host, appReport.Port)
+		if !appServing(appReport) {
+			notServing = append(notServing, appReport.Name)
+		}
+
+		// apps without proxy have no external port
+		name := appReport.Name
+		if appReport.Port != 0 {
+			name = appReport.Name + "/" + net.JoinHostPort(appReport.Host, strconv.Itoa(int(appReport.Port)))
+		}
+		if appReport.Version != "" {
+			fmt.Fprintf(tabWriter, "[%s %s]\n", name, appReport.Version)
+		} else {
+			fmt.Fprintf(tabWriter, "[%s]\n", name)
+		}
+		if appReport.Operation != "" {
+			fmt.Fprintf(tabWriter, "  in progress: %s %s\n", appReport.Operation, time.Duration(appReport.OperationSince)*time.Second)
+		}
+		if appReport.Paused {
+			fmt.Fprintf(tabWriter, "  paused: no automatic restarts %s\n", time.Duration(appReport.PausedSince)*time.Second)
+		}
+		if appReport.Quarantined {
+			retryIn := time.Duration(appReport.QuarantineCooldown-appReport.QuarantinedSince) * time.Second
+			if appReport.QuarantinedSince > appReport.QuarantineCooldown {
+				retryIn = 0
+			}
+			fmt.Fprintf(tabWriter, "  quarantined: retries failed %s ago, retrying in %s\n", time.Duration(appReport.QuarantinedSince)*time.Second, retryIn)
+		}
+		if appReport.WaitingForPort {
+			fmt.Fprintf(tabWriter, "  waiting for port: port pool exhausted %s\n", time.Duration(appReport.WaitingForPortSince)*time.Second)
+		}
+		if appReport.Port != 0 {
+			open := strconv.FormatInt(appReport.Connections, 10)
+			if appReport.MaxConnections > 0 {
+				open += "/" + strconv.Itoa(appReport.MaxConnections)
+			}
+			fmt.Fprintf(tabWriter, "  connections: %s open, %d accepted", open, appReport.AcceptedConnections)
+			if appReport.RejectedConnections > 0 {
+				fmt.Fprintf(tabWriter, ", %d rejected", appReport.RejectedConnections)
+			}
+			fmt.Fprint(tabWriter, "\n")
+		}
+		if appReport.Certificate != "" {
+			if appReport.CertificateExpiresIn > 0 {
+				fmt.Fprintf(tabWriter, "  certificate: %s expires in %s\n", appReport.Certificate, time.Duration(appReport.CertificateExpiresIn)*time.Second)
+			} else {
+				fmt.Fprintf(tabWriter, "  certificate: %s expired %s ago\n", appReport.Certificate, time.Duration(-appReport.CertificateExpiresIn)*time.Second)
+			}
+		}
+
+		if header {
+			fmt.Fprint(tabWriter, "\tINSTANCE")
+			for _, column := range columns {
+				fmt.Fprintf(tabWriter, "\t%s", statusColumns[column].header)
+			}
+			fmt.Fprint(tabWriter, "\n")
+		}
 
 		for _, instanceReport := range appReport.Instances {
 			if instanceReport.Active {
@@ -57,15 +191,119 @@ func statusRpcCall(client *rpc.Client, args interface{}) {
 				fmt.Fprint(tabWriter, "\t")
 			}
 
-			fmt.Fprintf(tabWriter, "%d/%s:%d\t", instanceReport.Id, instanceReport.Host, instanceReport.Port)
+			fmt.Fprintf(tabWriter, "%d/%s", instanceReport.Id, net.JoinHostPort(instanceReport.Host, strconv.Itoa(int(instanceReport.Port))))
+
+			for _, column := range columns {
+				fmt.Fprintf(tabWriter, "\t%s", statusColumns[column].value(instanceReport))
+			}
+			fmt.Fprint(tabWriter, "\n")
 
-			fmt.Fprintf(tabWriter, "%s\t", instanceReport.Status)
+			if verbose {
+				errorRate := 0.0
+				if instanceReport.Requests > 0 {
+					errorRate = float64(instanceReport.Errors) * 100 / float64(instanceReport.Requests)
+				}
+				fmt.Fprintf(tabWriter, "\t\tstarted %s requests %d errors %d (%.1f%%) connections %d latency avg %s p50 %s p95 %s p99 %s\n",
+					instanceReport.StartTime.Format(time.RFC3339),
+					instanceReport.Requests,
+					instanceReport.Errors,
+					errorRate,
+					instanceReport.Connections,
+					instanceReport.AvgLatency,
+					instanceReport.P50Latency,
+					instanceReport.P95Latency,
+					instanceReport.P99Latency,
+				)
+			}
+		}
+	}
 
-			fmt.Fprintf(tabWriter, "%s\t", time.Duration(instanceReport.SinceStatusChange)*time.Second)
+	tabWriter.Flush()
 
-			fmt.Fprintf(tabWriter, "%s\n", instanceReport.Error)
+	// older daemons don't report the port pool
+	var pool report.PortPool
+	if target == "" && client.Call("Rpc.Ports", "", &pool) == nil {
+		fmt.Printf("ports %d-%d: %d/%d used, %d reclaimable\n", pool.From, pool.To, pool.Used, pool.Size, pool.Reclaimable)
+		if len(pool.Waiting) > 0 {
+			fmt.Printf("waiting for port: %s\n", strings.Join(pool.Waiting, ", "))
 		}
 	}
+	var build report.BuildInfo
+	if target == "" && client.Call("Rpc.Version", "", &build) == nil {
+		fmt.Printf("gracevisord %s\n", &build)
+	}
+
+	if len(notServing) > 0 {
+		return &exitError{ExitNotServing, "not serving: " + strings.Join(notServing, ", ")}
+	}
+	return nil
+}
+
+// appServing reports if app has an active serving instance
+func appServing(appReport *report.App) bool {
+	for _, instanceReport := range appReport.Instances {
+		if instanceReport.Active && instanceReport.Status == "serving" {
+			return true
+		}
+	}
+	return false
+}
+
+func logsRpcCall(client *rpc.Client, query *report.LogQuery) {
+	var reply []string
+	err := client.Call("Rpc.Logs", query, &reply)
+	if err != nil {
+		log.Fatal("error:", err)
+	}
+
+	for _, line := range reply {
+		fmt.Println(line)
+	}
+}
+
+func historyRpcCall(client *rpc.Client, args interface{}) {
+	var reply []*report.HistoryRecord
+	err := client.Call("Rpc.History", args, &reply)
+	if err != nil {
+		log.Fatal("error:", err)
+	}
+
+	tabWriter := tabwriter.NewWriter(os.Stdout, 2, 2, 1, ' ', 0)
+	fmt.Fprint(tabWriter, "ID\tVERSION\tSTARTED\tEXITED\tSTATUS\tCODE\tREASON\tREQUESTED BY\tCORE\n")
+	for _, record := range reply {
+		fmt.Fprintf(tabWriter, "%d\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			record.InstanceId,
+			record.Version,
+			record.StartTime.Format(time.RFC3339),
+			record.ExitTime.Format(time.RFC3339),
+			record.Status,
+			record.ExitCode,
+			record.Reason,
+			record.RequestedBy,
+			record.CoreFile,
+		)
+	}
+
+	tabWriter.Flush()
+}
+
+func deploysRpcCall(client *rpc.Client, args interface{}) {
+	var reply []*report.DeployRecord
+	err := client.Call("Rpc.Deploys", args, &reply)
+	if err != nil {
+		log.Fatal("error:", err)
+	}
+
+	tabWriter := tabwriter.NewWriter(os.Stdout, 2, 2, 1, ' ', 0)
+	fmt.Fprint(tabWriter, "VERSION\tDEPLOYED\tREQUESTED BY\tCOMMAND\n")
+	for _, record := range reply {
+		fmt.Fprintf(tabWriter, "%s\t%s\t%s\t%s\n",
+			record.Version,
+			record.Time.Format(time.RFC3339),
+			record.RequestedBy,
+			record.Command,
+		)
+	}
 
 	tabWriter.Flush()
 }
@@ -75,47 +313,238 @@ func main() {
 	app.Name = "gracevisorctl"
 	app.Usage = "Manage gracevisord"
 	app.Email = "jure@hamsworld.net"
-	app.Version = version
+	app.Version = report.NewBuildInfo(version, commit, buildDate).String()
 	app.Flags = []cli.Flag{
-		cli.StringFlag{
+		cli.StringSliceFlag{
 			Name:  "host",
-			Value: defaultHost,
-			Usage: "daemon host",
+			Value: &cli.StringSlice{},
+			Usage: "daemon host or host:port, repeat for multiple daemons (default: localhost)",
+		},
+		cli.StringFlag{
+			Name:  "hosts-file",
+			Usage: "file with one daemon host or host:port per line",
 		},
 		cli.IntFlag{
 			Name:  "port",
 			Value: defaultPort,
 			Usage: "daemon port",
 		},
+		cli.StringFlag{
+			Name:   "token",
+			Usage:  "daemon rpc token",
+			EnvVar: "GRACEVISOR_TOKEN",
+		},
 	}
 
 	app.Commands = []cli.Command{
 		{
 			Name:  "status",
 			Usage: "display application status",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "verbose, v",
+					Usage: "show request, error, connection and latency metrics of instances",
+				},
+				cli.StringFlag{
+					Name:  "columns",
+					Usage: "comma separated instance columns: " + strings.Join(wideStatusColumns, ","),
+				},
+				cli.BoolFlag{
+					Name:  "wide",
+					Usage: "show all instance columns",
+				},
+			},
 			Action: func(c *cli.Context) {
-				statusRpcCall(getRpcClient(c), c.Args().First())
+				columns, err := parseStatusColumns(c.String("columns"), c.Bool("wide"))
+				if err != nil {
+					log.Fatal("error:", err)
+				}
+				header := c.String("columns") != "" || c.Bool("wide")
+				clusterCall(c, func(client *rpc.Client) error {
+					return statusRpcCall(client, c.Args().First(), c.Bool("verbose"), columns, header)
+				})
 			},
 		},
 		{
 			Name:  "restart",
-			Usage: "restart application",
+			Usage: "restart application, with --force also outside its deploy windows",
+			Flags: append([]cli.Flag{forceFlag}, waitFlags...),
+			Action: func(c *cli.Context) {
+				method := "Restart"
+				if c.Bool("force") {
+					method = "ForceRestart"
+				}
+				clusterCall(c, func(client *rpc.Client) error {
+					return eachApp(client, c.Args().First(), func(appName string) error {
+						return startCall(c, client, method, appName, appName)
+					})
+				})
+			},
+		},
+		{
+			Name:  "reload",
+			Usage: "send reload_signal to active instance instead of restarting it",
 			Action: func(c *cli.Context) {
-				basicRpcCall(getRpcClient(c), "Restart", c.Args().First())
+				clusterCall(c, func(client *rpc.Client) error {
+					return eachApp(client, c.Args().First(), func(appName string) error {
+						return rpcCall(client, "Reload", appName)
+					})
+				})
 			},
 		},
 		{
 			Name:  "start",
 			Usage: "start application",
+			Flags: waitFlags,
 			Action: func(c *cli.Context) {
-				basicRpcCall(getRpcClient(c), "Start", c.Args().First())
+				client := getRpcClient(c)
+				err := eachApp(client, c.Args().First(), func(appName string) error {
+					return startCall(c, client, "Start", appName, appName)
+				})
+				if err != nil {
+					fatal(err)
+				}
+			},
+		},
+		{
+			Name:  "deploy",
+			Usage: "start new instance of application, with --hold keep it on preview port until promote",
+			Flags: append([]cli.Flag{
+				cli.BoolFlag{
+					Name:  "hold",
+					Usage: "keep old instance active and expose new one on preview port",
+				},
+				cli.StringFlag{
+					Name:  "version",
+					Usage: "version substituted for {version} badge, default is current version",
+				},
+				forceFlag,
+			}, waitFlags...),
+			Action: func(c *cli.Context) {
+				deploy := &report.Deploy{
+					App:     c.Args().First(),
+					Hold:    c.Bool("hold"),
+					Version: c.String("version"),
+					Force:   c.Bool("force"),
+				}
+				clusterCall(c, func(client *rpc.Client) error {
+					return eachApp(client, deploy.App, func(appName string) error {
+						appDeploy := *deploy
+						appDeploy.App = appName
+						return startCall(c, client, "Deploy", appName, &appDeploy)
+					})
+				})
+			},
+		},
+		{
+			Name:  "rollback",
+			Usage: "restart application with previously deployed version",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "version to roll back to, default is the one before current",
+				},
+			},
+			Action: func(c *cli.Context) {
+				basicRpcCall(getRpcClient(c), "Rollback", &report.Rollback{
+					App: c.Args().First(),
+					To:  c.String("to"),
+				})
+			},
+		},
+		{
+			Name:  "deploys",
+			Usage: "display recently deployed versions of application",
+			Action: func(c *cli.Context) {
+				deploysRpcCall(getRpcClient(c), c.Args().First())
+			},
+		},
+		{
+			Name:  "config",
+			Usage: "display resolved config daemon is running with, secrets are masked",
+			Action: func(c *cli.Context) {
+				basicRpcCall(getRpcClient(c), "Config", c.Args().First())
+			},
+		},
+		{
+			Name:  "promote",
+			Usage: "switch traffic to held instance",
+			Action: func(c *cli.Context) {
+				basicRpcCall(getRpcClient(c), "Promote", c.Args().First())
 			},
 		},
 		{
 			Name:  "stop",
 			Usage: "stop running instances",
 			Action: func(c *cli.Context) {
-				basicRpcCall(getRpcClient(c), "Stop", c.Args().First())
+				client := getRpcClient(c)
+				err := eachApp(client, c.Args().First(), func(appName string) error {
+					return rpcCall(client, "Stop", appName)
+				})
+				if err != nil {
+					fatal(err)
+				}
+			},
+		},
+		{
+			Name:  "exec",
+			Usage: "run command with user, directory and environment of active instance: exec [--timeout 30s] <app> -- <cmd>",
+			// flags are parsed only before app so command keeps its own flags
+			SkipFlagParsing: true,
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:  "timeout",
+					Value: 30 * time.Second,
+					Usage: "kill command after timeout",
+				},
+			},
+			Action: func(c *cli.Context) {
+				command := c.Args().Tail()
+				if len(command) > 0 && command[0] == "--" {
+					command = command[1:]
+				}
+
+				var result report.ExecResult
+				err := getRpcClient(c).Call("Rpc.Exec", &report.Exec{
+					App:     c.Args().First(),
+					Command: command,
+					Timeout: c.Duration("timeout"),
+				}, &result)
+				if err != nil {
+					fatal(err)
+				}
+
+				fmt.Print(result.Output)
+				if result.TimedOut {
+					fatal(fmt.Errorf("command timed out after %s", c.Duration("timeout")))
+				}
+				os.Exit(result.ExitCode)
+			},
+		},
+		{
+			Name:  "pause",
+			Usage: "suspend automatic restarts and replacements of unhealthy instances",
+			Action: func(c *cli.Context) {
+				client := getRpcClient(c)
+				err := eachApp(client, c.Args().First(), func(appName string) error {
+					return rpcCall(client, "Pause", appName)
+				})
+				if err != nil {
+					fatal(err)
+				}
+			},
+		},
+		{
+			Name:  "resume",
+			Usage: "re-enable automatic restarts and replacements",
+			Action: func(c *cli.Context) {
+				client := getRpcClient(c)
+				err := eachApp(client, c.Args().First(), func(appName string) error {
+					return rpcCall(client, "Resume", appName)
+				})
+				if err != nil {
+					fatal(err)
+				}
 			},
 		},
 		{
@@ -125,6 +554,109 @@ func main() {
 				basicRpcCall(getRpcClient(c), "Kill", c.Args().First())
 			},
 		},
+		{
+			Name:  "set-health",
+			Usage: "force instance in or out of rotation: set-health <app> <instance> healthy|unhealthy|auto",
+			Action: func(c *cli.Context) {
+				if len(c.Args()) != 3 {
+					log.Fatal("usage: set-health <app> <instance> healthy|unhealthy|auto")
+				}
+				instanceId, err := strconv.ParseUint(c.Args().Get(1), 10, 32)
+				if err != nil {
+					log.Fatal("invalid instance id:", err)
+				}
+				basicRpcCall(getRpcClient(c), "SetHealth", &report.HealthOverride{
+					App:        c.Args().First(),
+					InstanceId: uint32(instanceId),
+					Health:     c.Args().Get(2),
+				})
+			},
+		},
+		{
+			Name:  "debug",
+			Usage: "diagnose gracevisord itself",
+			Subcommands: []cli.Command{
+				{
+					Name:  "dump-goroutines",
+					Usage: "print stacks of all gracevisord goroutines",
+					Action: func(c *cli.Context) {
+						var reply string
+						if err := getRpcClient(c).Call("Rpc.Goroutines", "", &reply); err != nil {
+							fatal(err)
+						}
+						fmt.Print(reply)
+					},
+				},
+			},
+		},
+		{
+			Name:  "attach",
+			Usage: "stream live stdout and stderr of instance, active one by default: attach <app> [instance]",
+			Action: func(c *cli.Context) {
+				instanceId := uint64(0)
+				if c.Args().Get(1) != "" {
+					var err error
+					instanceId, err = strconv.ParseUint(c.Args().Get(1), 10, 32)
+					if err != nil {
+						log.Fatal("invalid instance id:", err)
+					}
+				}
+				if err := attach(getRpcClient(c), c.Args().First(), uint32(instanceId)); err != nil {
+					fatal(err)
+				}
+			},
+		},
+		{
+			Name:  "version",
+			Usage: "display build info of gracevisorctl and gracevisord",
+			Action: func(c *cli.Context) {
+				fmt.Println("gracevisorctl", report.NewBuildInfo(version, commit, buildDate))
+				var build report.BuildInfo
+				if err := getRpcClient(c).Call("Rpc.Version", "", &build); err != nil {
+					fatal(err)
+				}
+				fmt.Println("gracevisord", &build)
+			},
+		},
+		{
+			Name:  "history",
+			Usage: "display restart and exit history of application",
+			Action: func(c *cli.Context) {
+				historyRpcCall(getRpcClient(c), c.Args().First())
+			},
+		},
+		{
+			Name:  "logs",
+			Usage: "display application logs, including rotated logs",
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:  "since",
+					Usage: "only show lines newer than duration, e.g. 1h",
+				},
+				cli.IntFlag{
+					Name:  "lines",
+					Value: 100,
+					Usage: "number of last lines to show",
+				},
+				cli.IntFlag{
+					Name:  "instance",
+					Usage: "only show lines of instance id",
+				},
+				cli.BoolFlag{
+					Name:  "stderr",
+					Usage: "show stderr log instead of stdout",
+				},
+			},
+			Action: func(c *cli.Context) {
+				logsRpcCall(getRpcClient(c), &report.LogQuery{
+					App:        c.Args().First(),
+					InstanceId: uint32(c.Int("instance")),
+					Since:      int64(c.Duration("since")),
+					Lines:      c.Int("lines"),
+					Stderr:     c.Bool("stderr"),
+				})
+			},
+		},
 	}
 
 	app.Run(os.Args)
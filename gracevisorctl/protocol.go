@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net/http"
+	"net/rpc"
+	"strconv"
+	"strings"
+
+	"github.com/hamaxx/gracevisor/common/report"
+)
+
+// daemonProtocol checks protocol of gracevisord from its connect response,
+// daemons from before versioning send none and speak protocol 1
+func daemonProtocol(resp *http.Response) (int, string, error) {
+	daemonVersion := resp.Header.Get(report.VersionHeader)
+	if daemonVersion == "" {
+		daemonVersion = "unknown"
+	}
+
+	protocol := 1
+	if header := resp.Header.Get(report.ProtocolHeader); header != "" {
+		var err error
+		if protocol, err = strconv.Atoi(header); err != nil {
+			return 0, "", fmt.Errorf("invalid protocol %q of gracevisord version %s", header, daemonVersion)
+		}
+	}
+	if protocol < report.MinProtocolVersion {
+		return 0, "", fmt.Errorf("gracevisord version %s speaks protocol %d, gracevisorctl version %s needs protocol %d or newer, upgrade gracevisord",
+			daemonVersion, protocol, version, report.MinProtocolVersion)
+	}
+	return protocol, daemonVersion, nil
+}
+
+// clientCodec is the gob codec of net/rpc that explains methods missing on
+// older gracevisord with versions of both sides instead of the bare rpc error
+type clientCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+
+	daemonVersion  string
+	daemonProtocol int
+}
+
+func newClientCodec(conn io.ReadWriteCloser, daemonVersion string, daemonProtocol int) *clientCodec {
+	encBuf := bufio.NewWriter(conn)
+	return &clientCodec{
+		rwc:            conn,
+		dec:            gob.NewDecoder(conn),
+		enc:            gob.NewEncoder(encBuf),
+		encBuf:         encBuf,
+		daemonVersion:  daemonVersion,
+		daemonProtocol: daemonProtocol,
+	}
+}
+
+func (c *clientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *clientCodec) ReadResponseHeader(r *rpc.Response) error {
+	if err := c.dec.Decode(r); err != nil {
+		return err
+	}
+	if strings.HasPrefix(r.Error, "rpc: can't find method ") {
+		r.Error = fmt.Sprintf("gracevisord version %s (protocol %d) doesn't support %s, upgrade it to match gracevisorctl version %s (protocol %d)",
+			c.daemonVersion, c.daemonProtocol, r.ServiceMethod, version, report.ProtocolVersion)
+	}
+	return nil
+}
+
+func (c *clientCodec) ReadResponseBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *clientCodec) Close() error {
+	return c.rwc.Close()
+}
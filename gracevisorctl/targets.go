@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/rpc"
+	"os"
+)
+
+// resolveApps asks gracevisord which apps target names, target is an app name,
+// glob pattern like "web-*" or group from config
+func resolveApps(client *rpc.Client, target string) ([]string, error) {
+	var apps []string
+	if err := client.Call("Rpc.Resolve", target, &apps); err != nil {
+		return nil, err
+	}
+	return apps, nil
+}
+
+// eachApp runs call for every app target names, one failing app doesn't stop the
+// others and exit code is the one of the last failure
+func eachApp(client *rpc.Client, target string, call func(appName string) error) error {
+	apps, err := resolveApps(client, target)
+	if err != nil {
+		return err
+	}
+	if len(apps) == 1 {
+		return call(apps[0])
+	}
+
+	failed := 0
+	code := 0
+	for _, appName := range apps {
+		if err := call(appName); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: error: %s\n", appName, err)
+			failed++
+			code = exitCode(err)
+		}
+	}
+	if failed > 0 {
+		return &exitError{code, fmt.Sprintf("%d of %d apps failed", failed, len(apps))}
+	}
+	return nil
+}
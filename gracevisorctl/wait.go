@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"time"
+
+	"github.com/hamaxx/gracevisor/common/report"
+	"github.com/hamaxx/gracevisor/deps/cli"
+)
+
+const (
+	// waitPoll is how often --wait checks status of new instance
+	waitPoll = 500 * time.Millisecond
+
+	defaultWaitTimeout = 60 * time.Second
+)
+
+var waitFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name:  "wait",
+		Usage: "wait until new instance is serving or fails, printing its status changes",
+	},
+	cli.DurationFlag{
+		Name:  "timeout",
+		Value: defaultWaitTimeout,
+		Usage: "how long --wait waits for new instance",
+	},
+}
+
+var forceFlag = cli.BoolFlag{
+	Name:  "force",
+	Usage: "restart or deploy even outside deploy_windows of the app",
+}
+
+// startCall calls rpc method that starts a new instance of app, with --wait it blocks
+// until the new instance serves traffic, is held or is a canary, or until it fails
+func startCall(c *cli.Context, client *rpc.Client, method string, appName string, args interface{}) error {
+	if !c.Bool("wait") {
+		return rpcCall(client, method, args)
+	}
+	if appName == "" {
+		return errors.New("app is required with --wait")
+	}
+
+	before, err := appStatus(client, appName)
+	if err != nil {
+		return err
+	}
+	lastId := uint32(0)
+	for _, instanceReport := range before.Instances {
+		if instanceReport.Id > lastId {
+			lastId = instanceReport.Id
+		}
+	}
+
+	if err := rpcCall(client, method, args); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(c.Duration("timeout"))
+	lastState := ""
+	endedPolls := 0
+	for {
+		appReport, err := appStatus(client, appName)
+		if err != nil {
+			return err
+		}
+
+		// retries start newer instances, follow the latest one
+		var instance *report.Instance
+		for _, instanceReport := range appReport.Instances {
+			if instanceReport.Id > lastId && (instance == nil || instanceReport.Id > instance.Id) {
+				instance = instanceReport
+			}
+		}
+
+		if instance != nil {
+			state := instanceState(instance)
+			if state != lastState {
+				fmt.Printf("%s: instance %d %s\n", appName, instance.Id, state)
+				lastState = state
+			}
+
+			switch instance.Status {
+			case "serving":
+				endedPolls = 0
+				if instance.Active || instance.Held || instance.Canary {
+					return nil
+				}
+			case "starting", "stopping":
+				endedPolls = 0
+			default:
+				// give retry a poll to start before reporting failure
+				endedPolls++
+				if endedPolls > 1 && appReport.Operation == "" {
+					return &exitError{ExitFailed, fmt.Sprintf("instance %d %s", instance.Id, state)}
+				}
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return &exitError{ExitTimeout, fmt.Sprintf("new instance of %s not serving after %s", appName, c.Duration("timeout"))}
+		}
+		time.Sleep(waitPoll)
+	}
+}
+
+func appStatus(client *rpc.Client, appName string) (*report.App, error) {
+	var reply []*report.App
+	if err := client.Call("Rpc.Status", appName, &reply); err != nil {
+		return nil, err
+	}
+	if len(reply) == 0 {
+		return nil, errors.New("no status for " + appName)
+	}
+	return reply[0], nil
+}
+
+// instanceState describes instance status with traffic it gets and readiness
+func instanceState(instanceReport *report.Instance) string {
+	state := instanceReport.Status
+	switch {
+	case instanceReport.Active:
+		state += " active"
+	case instanceReport.Held:
+		state += " held"
+	case instanceReport.Canary:
+		state += " canary"
+	}
+	if instanceReport.NotReady {
+		state += " not ready"
+	}
+	if instanceReport.Error != "" {
+		state += ": " + instanceReport.Error
+	}
+	return state
+}
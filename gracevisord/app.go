@@ -1,13 +1,16 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
-	"net/http/httputil"
+	"regexp"
 	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,8 +19,25 @@ import (
 )
 
 var (
-	ErrNoActiveInstances  = errors.New("No active instances")
-	ErrInstanceNotRunning = errors.New("Instance is not running")
+	ErrNoActiveInstances   = errors.New("No active instances")
+	ErrInstanceNotRunning  = errors.New("Instance is not running")
+	ErrInvalidInstance     = errors.New("Invalid instance")
+	ErrInvalidHealth       = errors.New("Health must be healthy, unhealthy or auto")
+	ErrPreviewPortRequired = errors.New("Preview port must be configured to hold deploys")
+	ErrNoHeldInstance      = errors.New("No held instance to promote")
+	ErrBackendApp          = errors.New("Backend app instances are not managed by gracevisor")
+	ErrTooManyRequests     = errors.New("Too many concurrent requests")
+	ErrInvalidVersion      = errors.New("Version must start with a letter or digit and contain only letters, digits, ., _ and -")
+)
+
+// versionPattern is what deployed versions may contain, they are substituted into
+// commands, which run through shell for shell apps, into fetch urls and git refs
+var versionPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// headers routing a request to a specific instance when app has routing token
+const (
+	InstanceHeader     = "X-Gracevisor-Instance"
+	RoutingTokenHeader = "X-Gracevisor-Token"
 )
 
 type InstanceStatusSort []*Instance
@@ -38,38 +58,105 @@ func (v InstanceStatusSort) Less(i, j int) bool {
 }
 
 type App struct {
-	config *AppConfig
-
-	instances          []*Instance
-	activeInstance     *Instance
+	// configValue is current *AppConfig, replaced on config reload while proxy and
+	// updater read it
+	configValue atomic.Value
+
+	instances       []*Instance
+	activeInstance  *Instance
+	canaryInstance  *Instance
+	heldInstance    *Instance
+	standbyInstance *Instance
+	rampInstance    *Instance
+
+	operation          *operation
+	operationLock      sync.Mutex
 	activeInstanceLock sync.Mutex
 
-	rp       *httputil.ReverseProxy
-	portPool *PortPool
+	rp          atomic.Value
+	middleware  chainHandler
+	runningApps map[string]*App
+	portPool    *PortPool
+	events      *Events
+	history     *History
+	deploys     *Deploys
+	secrets     *Secrets
+	backends    *BackendPool
+
+	reportUrl string
 
 	externalHostPort string
 
 	instanceId uint32
 
-	appLogger *AppLogger
+	// paused disables retries and health driven replacements, since when in unix time
+	paused int64
+
+	// quarantined is since when crash looping app waits for quarantine_cooldown, in unix time
+	quarantined int64
+
+	conns connStats
+	tls   *tlsState
+
+	// shadowCount is number of mirrored requests in flight to held instance
+	shadowCount int32
+
+	// queue holds requests over max_concurrent_requests until an instance slot frees
+	queue requestQueue
+
+	// portWait is new instance start waiting for a port of exhausted pool
+	portWait     *portWait
+	portWaitLock sync.Mutex
+
+	// version, command and environment of new instances, changed by deploys and rollbacks
+	version     string
+	command     string
+	args        []string
+	environment []string
+
+	appLogger  *AppLogger
+	requestLog *RequestLog
+	cache      *responseCache
 }
 
-func NewApp(config *AppConfig, portPool *PortPool) *App {
+func NewApp(config *AppConfig, portPool *PortPool, events *Events, history *History, deploys *Deploys, secrets *Secrets, reportUrl string) *App {
 	app := &App{
-		config:           config,
 		instances:        make([]*Instance, 0, 10),
 		portPool:         portPool,
-		externalHostPort: fmt.Sprintf("%s:%d", config.ExternalHost, config.ExternalPort),
+		events:           events,
+		history:          history,
+		deploys:          deploys,
+		secrets:          secrets,
+		reportUrl:        reportUrl,
+		version:          config.Version,
+		command:          config.Command,
+		args:             config.Args,
+		environment:      config.Environment,
+		externalHostPort: hostPort(config.ExternalHost, config.ExternalPort),
 	}
+	app.configValue.Store(config)
+
+	app.recordDeploy(RequestedByAutostart, false)
 
 	app.appLogger = NewAppLogger(app)
-	app.rp = &httputil.ReverseProxy{Director: func(req *http.Request) {}}
+	app.requestLog = NewRequestLog(config)
+	app.cache = newResponseCache()
+	app.updateProxy()
+	app.updateMiddleware()
+	if config.TLS != nil {
+		app.tls = newTLSState(app, config.TLS.Config)
+		go app.watchCertificates()
+	}
 
 	app.startInstanceUpdater()
 
 	return app
 }
 
+func (a *App) config() *AppConfig {
+	return a.configValue.Load().(*AppConfig)
+}
+
 func (a *App) startInstanceUpdater() {
 	ticker := time.NewTicker(time.Second)
 
@@ -80,6 +167,8 @@ func (a *App) startInstanceUpdater() {
 		for {
 			lastStatus := -1
 
+			a.startWaiting()
+
 			for _, instance := range a.instances {
 				status := instance.UpdateStatus()
 				lastStatus = status
@@ -87,26 +176,43 @@ func (a *App) startInstanceUpdater() {
 				if instance == a.activeInstance {
 					if status != InstanceStatusServing {
 						a.activeInstance = nil
-					}
-				} else {
-					if status == InstanceStatusServing {
-						restartCount = 0
-						a.activeInstanceLock.Lock()
-						currentActive := a.activeInstance
-						a.activeInstance = instance
-						a.activeInstanceLock.Unlock()
-
-						if currentActive != nil {
-							currentActive.Stop()
+					} else if !a.isPaused() && !instance.unhealthy {
+						if instance.heartbeatMissed() {
+							a.replaceUnhealthy(instance, EventHeartbeatMissed, RequestedByHeartbeat)
+						} else if instance.probedUnhealthy() {
+							a.replaceUnhealthy(instance, EventHealthCheckFailed, RequestedByHealthCheck)
 						}
 					}
+				} else if instance == a.canaryInstance {
+					a.checkCanary(instance, status)
+				} else if instance == a.rampInstance {
+					a.checkSlowStart(instance, status)
+				} else if instance == a.heldInstance {
+					if status != InstanceStatusServing {
+						a.clearInstance(&a.heldInstance, instance)
+					}
+				} else if instance == a.standbyInstance {
+					if status != InstanceStatusServing {
+						a.clearInstance(&a.standbyInstance, instance)
+					}
+				} else if status == InstanceStatusServing {
+					restartCount = 0
+					a.endQuarantine("instance serving")
+					if instance.held {
+						a.hold(instance)
+					} else if !a.startCanary(instance) {
+						a.promote(instance)
+					}
 				}
 			}
 
 			if lastStatus == InstanceStatusExited || lastStatus == InstanceStatusFailed || lastStatus == InstanceStatusTimedOut {
-				if restartCount < a.config.MaxRetries {
+				if restartCount >= a.config().MaxRetries && a.config().QuarantineCooldown > 0 && !a.isPaused() && a.quarantine() {
+					restartCount = 0
+				}
+				if restartCount < a.config().MaxRetries && !a.isPaused() && a.waitingForPort() == nil {
 					restartCount++
-					err := a.StartNewInstance()
+					err := a.StartNewInstance(RequestedByRetry)
 					if err != nil {
 						log.Print(err)
 					}
@@ -118,31 +224,406 @@ func (a *App) startInstanceUpdater() {
 	}()
 }
 
+// clearInstance empties held or standby slot if it still holds instance
+func (a *App) clearInstance(slot **Instance, instance *Instance) {
+	a.activeInstanceLock.Lock()
+	if *slot == instance {
+		*slot = nil
+	}
+	a.activeInstanceLock.Unlock()
+}
+
+// promote makes instance active and stops previous active instance
+// with verify configured, healthy previous instance is kept on standby until verification
+func (a *App) promote(instance *Instance) {
+	a.activeInstanceLock.Lock()
+	currentActive := a.activeInstance
+	a.activeInstance = instance
+
+	previousStandby := a.standbyInstance
+	a.standbyInstance = nil
+	previousRamp := a.rampInstance
+	a.rampInstance = nil
+	if a.config().SlowStart != nil && currentActive != nil && !currentActive.unhealthy && currentActive.inRotation() {
+		a.rampInstance = currentActive
+		instance.slowStart = time.Now()
+	}
+	if a.config().Verify != nil && currentActive != nil && !currentActive.unhealthy {
+		a.standbyInstance = currentActive
+	}
+	standby := a.standbyInstance
+	ramp := a.rampInstance
+	a.activeInstanceLock.Unlock()
+	// queued requests get slots of the new instance
+	a.queue.release()
+
+	if previousStandby != nil {
+		previousStandby.Stop(StopReasonReplaced)
+	}
+	if previousRamp != nil && previousRamp != previousStandby {
+		previousRamp.Stop(StopReasonReplaced)
+	}
+	if currentActive != nil && currentActive != standby && currentActive != ramp {
+		currentActive.Stop(StopReasonReplaced)
+	}
+	if a.config().Verify != nil {
+		go a.verifyPromotion(instance, standby)
+	}
+}
+
+// replaceUnhealthy marks active instance unhealthy and starts a replacement,
+// the instance keeps serving until replacement is serving
+func (a *App) replaceUnhealthy(instance *Instance, eventType, requestedBy string) {
+	instance.unhealthy = true
+	a.events.Emit(&Event{
+		Type:       eventType,
+		App:        a.config().Name,
+		InstanceId: instance.id,
+	})
+	if err := a.StartNewInstance(requestedBy); err != nil {
+		log.Print(err)
+	}
+}
+
 // reserveInstance reserves active instance for an active http request
 func (a *App) reserveInstance() (*Instance, error) {
 	a.activeInstanceLock.Lock()
 	defer a.activeInstanceLock.Unlock()
 
 	instance := a.activeInstance
-	if instance == nil {
+	if a.config().Canary != nil && a.useCanary() {
+		instance = a.canaryInstance
+	} else if a.config().SlowStart != nil && a.useRampInstance() {
+		instance = a.rampInstance
+	}
+	if instance == nil || !instance.inRotation() {
 		return nil, ErrNoActiveInstances
 	}
+	if max := a.config().MaxConcurrentRequests; max > 0 && atomic.LoadInt32(&instance.connCount) >= int32(max) {
+		return nil, ErrTooManyRequests
+	}
 	instance.Serve()
 
 	return instance, nil
 }
 
-func (a *App) StartNewInstance() error {
-	newInstance, err := NewInstance(a, atomic.AddUint32(&a.instanceId, 1))
+// reserveHeldInstance reserves held instance for requests of route_held rules, without
+// a held instance they are served like other requests
+func (a *App) reserveHeldInstance() (*Instance, error) {
+	a.activeInstanceLock.Lock()
+	instance := a.heldInstance
+	if instance != nil && instance.status == InstanceStatusServing {
+		if max := a.config().MaxConcurrentRequests; max > 0 && atomic.LoadInt32(&instance.connCount) >= int32(max) {
+			a.activeInstanceLock.Unlock()
+			return nil, ErrTooManyRequests
+		}
+		instance.Serve()
+		a.activeInstanceLock.Unlock()
+		return instance, nil
+	}
+	a.activeInstanceLock.Unlock()
+	return a.reserveInstance()
+}
+
+// reserveRequestedInstance reserves instance picked with instance header, request
+// must carry app routing token, instance doesn't need to be active or in rotation
+func (a *App) reserveRequestedInstance(id string, token string) (*Instance, error) {
+	if subtle.ConstantTimeCompare([]byte(a.config().RoutingToken), []byte(token)) != 1 {
+		return nil, ErrUnauthorized
+	}
+	instanceId, err := strconv.ParseUint(id, 10, 32)
 	if err != nil {
-		return err
+		return nil, ErrInvalidInstance
 	}
 
+	a.activeInstanceLock.Lock()
+	defer a.activeInstanceLock.Unlock()
+
+	instance := a.findInstance(uint32(instanceId))
+	if instance == nil {
+		return nil, ErrInvalidInstance
+	}
+	if instance.status != InstanceStatusServing {
+		return nil, ErrInstanceNotRunning
+	}
+	if max := a.config().MaxConcurrentRequests; max > 0 && atomic.LoadInt32(&instance.connCount) >= int32(max) {
+		return nil, ErrTooManyRequests
+	}
+	instance.Serve()
+
+	return instance, nil
+}
+
+func (a *App) StartNewInstance(requestedBy string) error {
+	_, err := a.startInstance(requestedBy, false)
+	return err
+}
+
+// startInstance starts a new instance, with on_exhausted wait a start without
+// free port is queued and started by instance updater once a port is released
+func (a *App) startInstance(requestedBy string, held bool) (*Instance, error) {
+	if a.backends != nil {
+		return nil, ErrBackendApp
+	}
+	if a.waitingForPort() != nil {
+		return nil, ErrWaitingForPort
+	}
+
+	newInstance, err := a.addInstance(requestedBy, held)
+	if err == ErrNoAvailablePorts && a.portPool.wait {
+		a.portWaitLock.Lock()
+		a.portWait = &portWait{requestedBy: requestedBy, held: held, since: time.Now()}
+		a.portWaitLock.Unlock()
+		a.portPool.setWaiting(a.config().Name, true)
+
+		log.Print(a.config().Name, ": No available ports, waiting for a port to start new instance")
+		return nil, ErrWaitingForPort
+	}
+	return newInstance, err
+}
+
+func (a *App) addInstance(requestedBy string, held bool) (*Instance, error) {
+	newInstance, err := NewInstance(a, atomic.AddUint32(&a.instanceId, 1), requestedBy)
+	if err != nil {
+		return nil, err
+	}
+	newInstance.held = held
+
 	a.instances = append(a.instances, newInstance)
+	return newInstance, nil
+}
+
+// portWait is a queued instance start
+type portWait struct {
+	requestedBy string
+	held        bool
+	since       time.Time
+}
+
+func (a *App) waitingForPort() *portWait {
+	a.portWaitLock.Lock()
+	defer a.portWaitLock.Unlock()
+	return a.portWait
+}
+
+// startWaiting starts queued instance once the pool has a free port, operation
+// waiting for the start gets the instance
+func (a *App) startWaiting() {
+	wait := a.waitingForPort()
+	if wait == nil || !a.portPool.available(a.config()) {
+		return
+	}
+
+	instance, err := a.addInstance(wait.requestedBy, wait.held)
+	if err == ErrNoAvailablePorts {
+		return
+	}
+
+	a.portWaitLock.Lock()
+	a.portWait = nil
+	a.portWaitLock.Unlock()
+	a.portPool.setWaiting(a.config().Name, false)
+
+	a.operationLock.Lock()
+	if op := a.operation; op != nil && op.instance == nil {
+		if err != nil {
+			a.operation = nil
+		} else {
+			op.instance = instance
+		}
+	}
+	a.operationLock.Unlock()
+
+	if err != nil {
+		log.Print(a.config().Name, ": Start new instance error:", err)
+		return
+	}
+	log.Printf("%s: Started instance %d on port %d after waiting %s for a port",
+		a.config().Name, instance.id, instance.internalPort, time.Since(wait.since))
+}
+
+// Deploy starts a new instance, held instances are not promoted
+// when serving but exposed on preview port until Promote
+func (a *App) Deploy(deploy *report.Deploy) error {
+	if deploy.Hold && a.config().PreviewPort == 0 {
+		return ErrPreviewPortRequired
+	}
+	version := a.version
+	if deploy.Version != "" {
+		if !versionPattern.MatchString(deploy.Version) {
+			return ErrInvalidVersion
+		}
+		version = deploy.Version
+	}
+
+	name := "deploy"
+	if version != "" {
+		name += " " + version
+	}
+
+	return a.exclusive(name, func() (*Instance, error) {
+		previousVersion := a.version
+		a.version = version
+
+		instance, err := a.startInstance(RequestedByDeploy, deploy.Hold)
+		if err != nil && err != ErrWaitingForPort {
+			a.version = previousVersion
+			return nil, err
+		}
+		a.recordDeploy(RequestedByDeploy, false)
+		return instance, err
+	})
+}
+
+// Rollback gracefully restarts app with version, command and environment of a previous deploy
+func (a *App) Rollback(rollback *report.Rollback) error {
+	record, err := a.deploys.Previous(a.version, rollback.To)
+	if err != nil {
+		return err
+	}
+
+	return a.exclusive("rollback "+record.Version, func() (*Instance, error) {
+		version, command, args, environment := a.version, a.command, a.args, a.environment
+		a.version = record.Version
+		a.command = record.Command
+		a.args = record.Args
+		a.environment = record.Environment
+
+		instance, err := a.startInstance(RequestedByRollback, false)
+		if err != nil && err != ErrWaitingForPort {
+			a.version, a.command, a.args, a.environment = version, command, args, environment
+			return nil, err
+		}
+		a.recordDeploy(RequestedByRollback, true)
+		return instance, err
+	})
+}
+
+func (a *App) recordDeploy(requestedBy string, rollback bool) {
+	a.deploys.Add(&report.DeployRecord{
+		Version:     a.version,
+		Command:     a.command,
+		Args:        a.args,
+		Environment: a.environment,
+		Time:        time.Now(),
+		RequestedBy: requestedBy,
+		Rollback:    rollback,
+	})
+}
+
+// hold keeps serving instance next to active one, replacing previously held instance
+func (a *App) hold(instance *Instance) {
+	a.activeInstanceLock.Lock()
+	previous := a.heldInstance
+	a.heldInstance = instance
+	a.activeInstanceLock.Unlock()
+
+	if previous != nil {
+		previous.Stop(StopReasonReplaced)
+	}
+
+	a.events.Emit(&Event{
+		Type:       EventDeployHeld,
+		App:        a.config().Name,
+		InstanceId: instance.id,
+	})
+}
+
+// Promote switches traffic to held instance
+func (a *App) Promote() error {
+	a.activeInstanceLock.Lock()
+	instance := a.heldInstance
+	a.heldInstance = nil
+	a.activeInstanceLock.Unlock()
+
+	if instance == nil || instance.status != InstanceStatusServing {
+		return ErrNoHeldInstance
+	}
+
+	a.promote(instance)
+	a.events.Emit(&Event{
+		Type:       EventDeployPromoted,
+		App:        a.config().Name,
+		InstanceId: instance.id,
+	})
+	return nil
+}
+
+func (a *App) findInstance(instanceId uint32) *Instance {
+	for _, instance := range a.instances {
+		if instance.id == instanceId {
+			return instance
+		}
+	}
 	return nil
 }
 
-func (a *App) StopInstances(instanceId int, kill bool) error {
+// SetHealth forces instance in or out of rotation, auto clears the override
+func (a *App) SetHealth(instanceId uint32, health string) error {
+	instance := a.findInstance(instanceId)
+	if instance == nil {
+		return ErrInvalidInstance
+	}
+
+	switch health {
+	case report.HealthHealthy, report.HealthUnhealthy:
+		instance.healthOverride = health
+	case report.HealthAuto:
+		instance.healthOverride = ""
+	default:
+		return ErrInvalidHealth
+	}
+	return nil
+}
+
+// Pause suspends automatic restarts and replacements of unhealthy instances,
+// for example while debugging a crashing instance
+func (a *App) Pause() {
+	atomic.CompareAndSwapInt64(&a.paused, 0, time.Now().Unix())
+}
+
+// Resume re-enables automatic restarts and replacements
+func (a *App) Resume() {
+	atomic.StoreInt64(&a.paused, 0)
+}
+
+func (a *App) isPaused() bool {
+	return atomic.LoadInt64(&a.paused) != 0
+}
+
+// quarantine holds app that used up its retries for quarantine_cooldown, it reports
+// when cooldown is over and retries can start again
+func (a *App) quarantine() bool {
+	since := atomic.LoadInt64(&a.quarantined)
+	if since == 0 {
+		atomic.StoreInt64(&a.quarantined, time.Now().Unix())
+		a.events.Emit(&Event{
+			Type:    EventQuarantined,
+			App:     a.config().Name,
+			Message: fmt.Sprintf("%d retries failed, retrying in %ds", a.config().MaxRetries, a.config().QuarantineCooldown),
+		})
+		return false
+	}
+	if time.Since(time.Unix(since, 0)) < time.Duration(a.config().QuarantineCooldown)*time.Second {
+		return false
+	}
+	a.endQuarantine("cooldown over")
+	return true
+}
+
+// endQuarantine releases quarantined app, it is a noop for other apps
+func (a *App) endQuarantine(reason string) {
+	if atomic.SwapInt64(&a.quarantined, 0) == 0 {
+		return
+	}
+	a.events.Emit(&Event{
+		Type:    EventQuarantineEnded,
+		App:     a.config().Name,
+		Message: reason,
+	})
+}
+
+func (a *App) StopInstances(instanceId int, kill bool, reason string) error {
 	stopped := false
 	for _, instance := range a.instances {
 		if instanceId > 0 && int(instance.id) != instanceId {
@@ -151,9 +632,9 @@ func (a *App) StopInstances(instanceId int, kill bool) error {
 		if instance.status == InstanceStatusServing || instance.status == InstanceStatusStarting {
 			stopped = true
 			if kill {
-				instance.Kill()
+				instance.Kill(reason)
 			} else {
-				instance.Stop()
+				instance.Stop(reason)
 			}
 		}
 	}
@@ -164,18 +645,56 @@ func (a *App) StopInstances(instanceId int, kill bool) error {
 }
 
 func (a *App) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	instance, err := a.reserveInstance()
+	if a.backends != nil {
+		a.serveBackend(rw, req)
+		return
+	}
+
+	reserve := a.reserveInstance
+	if held, _ := req.Context().Value(heldRouteKey{}).(bool); held {
+		reserve = a.reserveHeldInstance
+	}
+	if id := req.Header.Get(InstanceHeader); a.config().RoutingToken != "" && id != "" {
+		token := req.Header.Get(RoutingTokenHeader)
+		reserve = func() (*Instance, error) {
+			return a.reserveRequestedInstance(id, token)
+		}
+	}
+	req.Header.Del(RoutingTokenHeader)
+
+	instance, err := reserve()
+	// queue request until instance has a free slot or queue timeout
+	if err == ErrTooManyRequests && a.config().QueueTimeout > 0 {
+		instance, err = a.queueRequest(req, reserve)
+	}
 	defer func() {
 		if instance != nil {
 			instance.Done()
 		}
 	}()
 	if err != nil {
-		if err == ErrNoActiveInstances {
+		if err == ErrTooManyRequests {
+			rw.Header().Set("Retry-After", strconv.Itoa(a.config().RetryAfter))
 			rw.WriteHeader(503)
 			if err := req.Body.Close(); err != nil {
 				log.Print(err)
 			}
+		} else if err == ErrNoActiveInstances || err == ErrInstanceNotRunning {
+			rw.WriteHeader(503)
+			if err := req.Body.Close(); err != nil {
+				log.Print(err)
+			}
+		} else if err == context.Canceled {
+			// client went away while queued
+		} else if err == ErrUnauthorized || err == ErrInvalidInstance {
+			status := 401
+			if err == ErrInvalidInstance {
+				status = 404
+			}
+			rw.WriteHeader(status)
+			if err := req.Body.Close(); err != nil {
+				log.Print(err)
+			}
 		} else {
 			log.Print(err)
 		}
@@ -185,22 +704,123 @@ func (a *App) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	req.URL.Scheme = "http"
 	req.URL.Host = instance.internalHostPort
 
-	host, _, _ := net.SplitHostPort(req.RemoteAddr) //TODO parse real real ip, add fwd for
-	req.Header.Add("X-Real-IP", host)
+	req.Header.Set("X-Real-IP", clientIp(req))
 
-	a.rp.ServeHTTP(rw, req)
+	a.shadow(instance, req)
+	a.proxy(instance, rw, req)
 }
 
-func (a *App) ListenAndServe() error {
-	return http.ListenAndServe(a.externalHostPort, a)
+// serveBackend proxies request to a backend of backend app
+func (a *App) serveBackend(rw http.ResponseWriter, req *http.Request) {
+	b, err := a.backends.reserve()
+	if err != nil {
+		rw.WriteHeader(503)
+		if err := req.Body.Close(); err != nil {
+			log.Print(err)
+		}
+		return
+	}
+	defer a.backends.done(b)
+
+	req.URL.Scheme = "http"
+	req.URL.Host = b.hostPort
+
+	req.Header.Set("X-Real-IP", clientIp(req))
+
+	recorder := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+	a.reverseProxy().ServeHTTP(recorder, req)
+	if recorder.proxyErr != nil && recorder.proxyErrKind != ProxyErrorCanceled {
+		log.Printf("%s: backend %s: proxy %s error: %s", a.config().Name, b.hostPort, recorder.proxyErrKind, recorder.proxyErr)
+	}
+}
+
+// previewHandler serves held instance on app preview port
+type previewHandler struct {
+	app *App
+}
+
+func (h *previewHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	h.app.activeInstanceLock.Lock()
+	instance := h.app.heldInstance
+	if instance != nil {
+		instance.Serve()
+	}
+	h.app.activeInstanceLock.Unlock()
+
+	if instance == nil {
+		rw.WriteHeader(503)
+		return
+	}
+	defer instance.Done()
+
+	req = h.app.withClientIp(req)
+	req.URL.Scheme = "http"
+	req.URL.Host = instance.internalHostPort
+	h.app.proxy(instance, rw, req)
+}
+
+// Listen binds app external listener
+func (a *App) Listen() (net.Listener, error) {
+	return listen(a.externalHostPort, a.config().ReusePort)
+}
+
+// Serve serves app on bound or socket activated listener
+func (a *App) Serve(listener net.Listener) error {
+	return http.Serve(a.tlsListener(a.countConnections(listener)), http.HandlerFunc(a.serveRules))
+}
+
+// ListenPreview binds app preview listener
+func (a *App) ListenPreview() (net.Listener, error) {
+	return listen(hostPort(a.config().ExternalHost, a.config().PreviewPort), a.config().ReusePort)
+}
+
+// ServePreview serves held instances on preview listener
+func (a *App) ServePreview(listener net.Listener) error {
+	return http.Serve(a.tlsListener(a.countConnections(listener)), &previewHandler{app: a})
 }
 
 // Report returns report for rpc status commands
 func (a *App) Report(displayN int) *report.App {
 	appReport := &report.App{
-		Name: a.config.Name,
-		Host: a.config.ExternalHost,
-		Port: a.config.ExternalPort,
+		Name:    a.config().Name,
+		Host:    a.config().ExternalHost,
+		Port:    a.config().ExternalPort,
+		Version: a.version,
+
+		Connections:         atomic.LoadInt64(&a.conns.open),
+		AcceptedConnections: atomic.LoadInt64(&a.conns.accepted),
+		RejectedConnections: atomic.LoadInt64(&a.conns.rejected),
+		MaxConnections:      a.config().MaxConnections,
+	}
+	if active := a.activeInstance; active != nil {
+		appReport.Version = active.version
+	}
+	if op := a.currentOperation(); op != nil {
+		appReport.Operation = op.name
+		appReport.OperationSince = uint64(time.Since(op.start) / time.Second)
+	}
+	if paused := atomic.LoadInt64(&a.paused); paused != 0 {
+		appReport.Paused = true
+		appReport.PausedSince = uint64(time.Since(time.Unix(paused, 0)) / time.Second)
+	}
+	if quarantined := atomic.LoadInt64(&a.quarantined); quarantined != 0 {
+		appReport.Quarantined = true
+		appReport.QuarantinedSince = uint64(time.Since(time.Unix(quarantined, 0)) / time.Second)
+		appReport.QuarantineCooldown = uint64(a.config().QuarantineCooldown)
+	}
+	if a.tls != nil {
+		name, expires := a.tls.expiry()
+		appReport.Certificate = name
+		appReport.CertificateExpiresIn = int64(time.Until(expires) / time.Second)
+	}
+	if wait := a.waitingForPort(); wait != nil {
+		appReport.WaitingForPort = true
+		appReport.WaitingForPortSince = uint64(time.Since(wait.since) / time.Second)
+	}
+
+	if a.backends != nil {
+		appReport.Instances = a.backends.Report()
+		return appReport
 	}
 
 	from := 0
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hamaxx/gracevisor/common/report"
+)
+
+func TestDeployVersion(t *testing.T) {
+	app := &App{}
+	app.configValue.Store(&AppConfig{Name: "app"})
+
+	for _, version := range []string{"v1.2.3; rm -rf /", "$(id)", "--orphan=x", "-f", "../v1", ".hidden", "v1 2", "v1\n"} {
+		if err := app.Deploy(&report.Deploy{App: "app", Version: version}); err != ErrInvalidVersion {
+			t.Errorf("Deploy of version %q should fail with ErrInvalidVersion, got %v", version, err)
+		}
+	}
+	for _, version := range []string{"v1.2.3", "1.0.0-rc1", "release_2024.01", "a1b2c3d"} {
+		if !versionPattern.MatchString(version) {
+			t.Errorf("Version %q should be valid", version)
+		}
+	}
+}
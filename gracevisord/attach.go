@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hamaxx/gracevisor/common/report"
+)
+
+const (
+	// attachBuffer is number of latest output lines kept per instance for attach
+	attachBuffer = 1000
+
+	// attachPoll is how long attach waits for new output before replying
+	attachPoll = time.Second
+)
+
+var ErrNoInstanceOutput = errors.New("Instance has no output to attach to")
+
+// instanceOutput keeps latest stdout and stderr lines of an instance for
+// clients attached to it
+type instanceOutput struct {
+	lock    sync.Mutex
+	lines   [attachBuffer]report.OutputLine
+	next    uint64
+	pipes   int
+	changed chan struct{}
+}
+
+func newInstanceOutput(pipes int) *instanceOutput {
+	return &instanceOutput{
+		next:    1,
+		pipes:   pipes,
+		changed: make(chan struct{}),
+	}
+}
+
+// notify wakes waiting clients, must be called with lock held
+func (o *instanceOutput) notify() {
+	close(o.changed)
+	o.changed = make(chan struct{})
+}
+
+func (o *instanceOutput) write(stderr bool, line []byte) {
+	o.lock.Lock()
+	o.lines[o.next%attachBuffer] = report.OutputLine{Stderr: stderr, Line: string(line)}
+	o.next++
+	o.notify()
+	o.lock.Unlock()
+}
+
+// closePipe marks one output pipe closed, output ends when all are
+func (o *instanceOutput) closePipe() {
+	o.lock.Lock()
+	o.pipes--
+	o.notify()
+	o.lock.Unlock()
+}
+
+// read returns lines after since, waiting up to wait for new ones
+func (o *instanceOutput) read(since uint64, wait time.Duration) *report.AttachOutput {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if since == 0 || since >= o.next {
+		since = o.next - 1
+	}
+	if since+1 == o.next && o.pipes > 0 {
+		changed := o.changed
+		o.lock.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		}
+		o.lock.Lock()
+	}
+
+	output := &report.AttachOutput{Next: o.next - 1, Ended: o.pipes <= 0}
+	first := since + 1
+	if o.next > attachBuffer && first < o.next-attachBuffer {
+		output.Dropped = o.next - attachBuffer - first
+		first = o.next - attachBuffer
+	}
+	for seq := first; seq < o.next; seq++ {
+		line := o.lines[seq%attachBuffer]
+		output.Lines = append(output.Lines, &line)
+	}
+	return output
+}
+
+// Attach returns new output of instance, for following it in real time
+func (a *App) Attach(query *report.Attach) (*report.AttachOutput, error) {
+	instance := a.findInstance(query.InstanceId)
+	if instance == nil {
+		return nil, ErrInvalidInstance
+	}
+	if instance.instanceLogger == nil {
+		return nil, ErrNoInstanceOutput
+	}
+	return instance.instanceLogger.output.read(query.Since, attachPoll), nil
+}
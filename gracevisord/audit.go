@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/hamaxx/gracevisor/deps/lumberjack"
+)
+
+// AuditEntry describes one control-plane action
+type AuditEntry struct {
+	Time     time.Time   `json:"time"`
+	Command  string      `json:"command"`
+	Args     interface{} `json:"args"`
+	Identity string      `json:"identity"`
+	Source   string      `json:"source"`
+	Result   string      `json:"result"`
+}
+
+// AuditLog writes control-plane actions as json lines to a dedicated file
+type AuditLog struct {
+	writer io.Writer
+	mu     sync.Mutex
+}
+
+func NewAuditLog(config *LoggerConfig) *AuditLog {
+	if config.AuditLogFile == "" {
+		return &AuditLog{}
+	}
+	if err := createLogFile(config.AuditLogFile, config.FilePerm); err != nil {
+		log.Print("Audit log file error:", err)
+	}
+
+	return &AuditLog{
+		writer: &lumberjack.Logger{
+			Filename:   config.AuditLogFile,
+			MaxSize:    config.MaxLogSize,
+			MaxAge:     config.MaxLogAge,
+			MaxBackups: config.MaxLogsKept,
+		},
+	}
+}
+
+// Record writes audit entry, it is a noop if audit log is not configured
+func (a *AuditLog) Record(entry *AuditEntry) {
+	if a.writer == nil {
+		return
+	}
+
+	entry.Time = time.Now()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Print("Audit log marshal error:", err)
+		return
+	}
+	data = append(data, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.writer.Write(data); err != nil {
+		log.Print("Audit log write error:", err)
+	}
+}
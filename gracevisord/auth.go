@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const (
+	RoleReadOnly = iota + 1
+	RoleOperator
+	RoleAdmin
+)
+
+var Roles = map[string]int{
+	"read-only": RoleReadOnly,
+	"operator":  RoleOperator,
+	"admin":     RoleAdmin,
+}
+
+var (
+	ErrUnauthorized     = errors.New("Unauthorized")
+	ErrPermissionDenied = errors.New("Permission denied")
+)
+
+// authenticate maps request bearer token to identity and role.
+// When no tokens are configured every client is an anonymous admin.
+func authenticate(config *RpcConfig, req *http.Request) (string, int, error) {
+	if len(config.Tokens) == 0 {
+		return "", RoleAdmin, nil
+	}
+
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", 0, ErrUnauthorized
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+
+	for _, tokenConfig := range config.Tokens {
+		if subtle.ConstantTimeCompare([]byte(tokenConfig.Token), []byte(token)) == 1 {
+			return tokenConfig.Name, tokenConfig.Role, nil
+		}
+	}
+
+	return "", 0, ErrUnauthorized
+}
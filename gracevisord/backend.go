@@ -0,0 +1,207 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hamaxx/gracevisor/common/report"
+)
+
+const (
+	BackendStatusServing   = "serving"
+	BackendStatusUnhealthy = "unhealthy"
+	BackendStatusDraining  = "draining"
+)
+
+// backend is an externally managed host:port serving app traffic
+type backend struct {
+	id         uint32
+	hostPort   string
+	connCount  int32
+	healthy    bool
+	draining   bool
+	failures   int
+	lastChange time.Time
+}
+
+// BackendPool proxies app traffic to backends from a static list or discovery
+// registry, removed backends are drained before they are forgotten
+type BackendPool struct {
+	app      *App
+	registry Registry
+
+	backends []*backend
+	next     uint32
+	lastId   uint32
+	lock     sync.Mutex
+}
+
+func NewBackendPool(app *App, registry Registry) *BackendPool {
+	pool := &BackendPool{app: app, registry: registry}
+	pool.update(app.config().Backends)
+	pool.startUpdater()
+	return pool
+}
+
+func (p *BackendPool) startUpdater() {
+	go func() {
+		for tick := 0; ; tick++ {
+			config := p.app.config()
+			interval := config.HealthCheckInterval
+			if interval <= 0 {
+				interval = 1
+			}
+
+			if config.BackendService != "" {
+				hostPorts, err := p.registry.Lookup(config.BackendService)
+				if err != nil {
+					log.Print(config.Name, ": Backend lookup error:", err)
+				} else {
+					p.update(hostPorts)
+				}
+			}
+			if tick%interval == 0 {
+				p.checkHealth()
+			}
+			p.removeDrained()
+
+			time.Sleep(time.Second)
+		}
+	}()
+}
+
+// update adds new backends and starts draining backends not in hostPorts
+func (p *BackendPool) update(hostPorts []string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	current := map[string]bool{}
+	for _, hostPort := range hostPorts {
+		current[hostPort] = true
+	}
+
+	known := map[string]bool{}
+	for _, b := range p.backends {
+		known[b.hostPort] = true
+		if !current[b.hostPort] && !b.draining {
+			b.draining = true
+			b.lastChange = time.Now()
+		}
+	}
+
+	for _, hostPort := range hostPorts {
+		if known[hostPort] {
+			continue
+		}
+		known[hostPort] = true
+		p.lastId++
+		p.backends = append(p.backends, &backend{
+			id:         p.lastId,
+			hostPort:   hostPort,
+			healthy:    p.app.config().HealthCheck == "" && p.app.config().ReadinessCheck == "",
+			lastChange: time.Now(),
+		})
+	}
+}
+
+// checkHealth probes healthcheck and readiness paths of all backends,
+// backends are taken out of rotation after healthcheck_failures failed probes
+func (p *BackendPool) checkHealth() {
+	config := p.app.config()
+	if config.HealthCheck == "" && config.ReadinessCheck == "" {
+		return
+	}
+
+	p.lock.Lock()
+	backends := append([]*backend{}, p.backends...)
+	p.lock.Unlock()
+
+	for _, b := range backends {
+		if b.draining {
+			continue
+		}
+		ok := (config.HealthCheck == "" || probe(config, b.hostPort, config.HealthCheck)) &&
+			(config.ReadinessCheck == "" || probe(config, b.hostPort, config.ReadinessCheck))
+
+		p.lock.Lock()
+		if ok {
+			b.failures = 0
+		} else {
+			b.failures++
+		}
+		healthy := ok || (b.healthy && b.failures < config.HealthCheckFailures)
+		if healthy != b.healthy {
+			b.healthy = healthy
+			b.lastChange = time.Now()
+		}
+		p.lock.Unlock()
+	}
+}
+
+func (p *BackendPool) removeDrained() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	backends := p.backends[:0]
+	for _, b := range p.backends {
+		if b.draining && atomic.LoadInt32(&b.connCount) == 0 {
+			continue
+		}
+		backends = append(backends, b)
+	}
+	p.backends = backends
+}
+
+// reserve picks next healthy backend round robin for an active http request
+func (p *BackendPool) reserve() (*backend, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for range p.backends {
+		b := p.backends[int(p.next)%len(p.backends)]
+		p.next++
+		if b.healthy && !b.draining {
+			atomic.AddInt32(&b.connCount, 1)
+			return b, nil
+		}
+	}
+	return nil, ErrNoActiveInstances
+}
+
+func (p *BackendPool) done(b *backend) {
+	atomic.AddInt32(&b.connCount, -1)
+}
+
+// Report returns backends as instances for rpc status commands
+func (p *BackendPool) Report() []*report.Instance {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	instances := make([]*report.Instance, 0, len(p.backends))
+	for _, b := range p.backends {
+		host, portStr, _ := net.SplitHostPort(b.hostPort)
+		port, _ := strconv.ParseUint(portStr, 10, 16)
+
+		status := BackendStatusServing
+		if b.draining {
+			status = BackendStatusDraining
+		} else if !b.healthy {
+			status = BackendStatusUnhealthy
+		}
+
+		instances = append(instances, &report.Instance{
+			Id:                b.id,
+			Active:            b.healthy && !b.draining,
+			Host:              host,
+			Port:              uint16(port),
+			Status:            status,
+			SinceStatusChange: uint64(time.Since(b.lastChange) / time.Second),
+			ExitCode:          -1,
+		})
+	}
+	return instances
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheHeader tells clients if response came from app cache
+const CacheHeader = "X-Gracevisor-Cache"
+
+// cacheEntry is a cached response, it is served until expires and on upstream
+// errors until staleUntil
+type cacheEntry struct {
+	key        string
+	status     int
+	header     http.Header
+	body       []byte
+	stored     time.Time
+	expires    time.Time
+	staleUntil time.Time
+	elem       *list.Element
+}
+
+func (e *cacheEntry) size() int64 {
+	size := int64(len(e.key) + len(e.body))
+	for name, values := range e.header {
+		for _, value := range values {
+			size += int64(len(name) + len(value))
+		}
+	}
+	return size
+}
+
+func (e *cacheEntry) write(rw http.ResponseWriter, req *http.Request, state string) {
+	for name, values := range e.header {
+		rw.Header()[name] = values
+	}
+	rw.Header().Set("Age", strconv.Itoa(int(time.Since(e.stored)/time.Second)))
+	rw.Header().Set(CacheHeader, state)
+	rw.WriteHeader(e.status)
+	if req.Method != http.MethodHead {
+		rw.Write(e.body)
+	}
+}
+
+// responseCache is an in memory lru cache of app responses, it is kept across
+// config reloads so it keeps answering while instances are swapped
+type responseCache struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	lru     *list.List
+	size    int64
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{
+		entries: map[string]*cacheEntry{},
+		lru:     list.New(),
+	}
+}
+
+// get returns entry of key if it can still be served, fresh or stale
+func (c *responseCache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.staleUntil) {
+		c.remove(entry)
+		return nil
+	}
+	c.lru.MoveToFront(entry.elem)
+	return entry
+}
+
+// put stores entry and evicts least recently used entries over maxSize bytes
+func (c *responseCache) put(entry *cacheEntry, maxSize int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.entries[entry.key]; ok {
+		c.remove(old)
+	}
+	entry.elem = c.lru.PushFront(entry)
+	c.entries[entry.key] = entry
+	c.size += entry.size()
+	for c.size > maxSize && c.lru.Len() > 0 {
+		c.remove(c.lru.Back().Value.(*cacheEntry))
+	}
+}
+
+func (c *responseCache) remove(entry *cacheEntry) {
+	c.lru.Remove(entry.elem)
+	delete(c.entries, entry.key)
+	c.size -= entry.size()
+}
+
+// cacheControl parses Cache-Control directives, values of directives without one are empty
+func cacheControl(header http.Header) map[string]string {
+	directives := map[string]string{}
+	for _, part := range strings.Split(strings.Join(header.Values("Cache-Control"), ","), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name != "" {
+			directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+	return directives
+}
+
+// cacheable checks if request may be served from cache
+func (c *CacheConfig) cacheable(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" || req.Header.Get(InstanceHeader) != "" {
+		return false
+	}
+	if held, _ := req.Context().Value(heldRouteKey{}).(bool); held {
+		return false
+	}
+	for _, re := range c.PathRegexps {
+		if re.MatchString(req.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// ttl returns how long response may be cached, 0 if it must not be stored. Responses
+// may only vary by headers in cache key, cors adds Vary: Origin to all of them.
+func (c *CacheConfig) ttl(status int, header http.Header) time.Duration {
+	if status != http.StatusOK || header.Get("Set-Cookie") != "" {
+		return 0
+	}
+	for _, vary := range header.Values("Vary") {
+		for _, name := range strings.Split(vary, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" && !strings.EqualFold(name, "Accept-Encoding") && !strings.EqualFold(name, "Origin") {
+				return 0
+			}
+		}
+	}
+
+	directives := cacheControl(header)
+	for _, name := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[name]; ok {
+			return 0
+		}
+	}
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[name]; ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds <= 0 {
+				return 0
+			}
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return time.Duration(c.Ttl) * time.Second
+}
+
+// cacheWriter passes response to client and copies it for the cache, on upstream
+// errors it answers with stale entry instead
+type cacheWriter struct {
+	http.ResponseWriter
+	req     *http.Request
+	stale   *cacheEntry
+	maxBody int
+
+	status      int
+	header      http.Header
+	body        bytes.Buffer
+	tooLarge    bool
+	servedStale bool
+}
+
+func (w *cacheWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	if status >= 500 && w.stale != nil {
+		w.servedStale = true
+		for name := range w.ResponseWriter.Header() {
+			w.ResponseWriter.Header().Del(name)
+		}
+		w.stale.write(w.ResponseWriter, w.req, "STALE")
+		return
+	}
+	w.header = w.ResponseWriter.Header().Clone()
+	w.ResponseWriter.Header().Set(CacheHeader, "MISS")
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cacheWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.servedStale {
+		return len(data), nil
+	}
+	if !w.tooLarge {
+		if w.body.Len()+len(data) > w.maxBody {
+			w.tooLarge = true
+			w.body.Reset()
+		} else {
+			w.body.Write(data)
+		}
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *cacheWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok && !w.servedStale {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets reverse proxy hijack connection of upgraded requests
+func (w *cacheWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// serveCached answers cacheable requests from app cache, misses are proxied and
+// stored when Cache-Control allows it
+func (a *App) serveCached(rw http.ResponseWriter, req *http.Request) {
+	config := a.config().Cache
+	if config == nil || !config.cacheable(req) {
+		a.ServeHTTP(rw, req)
+		return
+	}
+
+	key := req.Host + " " + req.URL.RequestURI() + " " + req.Header.Get("Accept-Encoding") + " " + req.Header.Get("Origin")
+	entry := a.cache.get(key)
+	_, noCache := cacheControl(req.Header)["no-cache"]
+	if entry != nil && !noCache && time.Now().Before(entry.expires) {
+		entry.write(rw, req, "HIT")
+		return
+	}
+
+	w := &cacheWriter{ResponseWriter: rw, req: req, stale: entry, maxBody: config.MaxEntrySize * 1024}
+	a.ServeHTTP(w, req)
+	if w.servedStale || w.tooLarge || req.Method == http.MethodHead {
+		return
+	}
+	ttl := config.ttl(w.status, w.header)
+	if ttl == 0 {
+		return
+	}
+	now := time.Now()
+	a.cache.put(&cacheEntry{
+		key:        key,
+		status:     w.status,
+		header:     w.header,
+		body:       w.body.Bytes(),
+		stored:     now,
+		expires:    now.Add(ttl),
+		staleUntil: now.Add(ttl + time.Duration(config.StaleIfError)*time.Second),
+	}, int64(config.MaxSize)*1024*1024)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+const StopReasonCanaryFailed = "canary_failed"
+
+// useCanary decides if request should be routed to canary instance
+func (a *App) useCanary() bool {
+	return a.canaryInstance != nil && a.canaryInstance.inRotation() &&
+		rand.Float64()*100 < a.config().Canary.Percent
+}
+
+// startCanary makes new serving instance receive part of traffic next to active
+// instance, returns false if instance should be promoted right away
+func (a *App) startCanary(instance *Instance) bool {
+	active := a.activeInstance
+	if a.config().Canary == nil || active == nil || active.unhealthy || !active.inRotation() {
+		return false
+	}
+
+	a.activeInstanceLock.Lock()
+	previous := a.canaryInstance
+	a.canaryInstance = instance
+	a.activeInstanceLock.Unlock()
+
+	if previous != nil {
+		previous.Stop(StopReasonReplaced)
+	}
+
+	instance.canaryStart = time.Now()
+	a.events.Emit(&Event{
+		Type:       EventCanaryStarted,
+		App:        a.config().Name,
+		InstanceId: instance.id,
+	})
+	return true
+}
+
+// checkCanary promotes canary after bake time or rolls it back if its error rate is too high
+func (a *App) checkCanary(instance *Instance, status int) {
+	if status != InstanceStatusServing {
+		a.endCanary()
+		return
+	}
+
+	config := a.config().Canary
+	requests := atomic.LoadInt64(&instance.canaryRequests)
+	errors := atomic.LoadInt64(&instance.canaryErrors)
+
+	if requests >= config.MinRequests && float64(errors)*100 > float64(requests)*config.MaxErrorRate {
+		log.Printf("%s: canary %d failed with %d errors in %d requests", a.config().Name, instance.id, errors, requests)
+		a.endCanary()
+		instance.Stop(StopReasonCanaryFailed)
+		a.events.Emit(&Event{
+			Type:       EventCanaryFailed,
+			App:        a.config().Name,
+			InstanceId: instance.id,
+		})
+		return
+	}
+
+	if time.Since(instance.canaryStart) >= time.Duration(config.BakeTime)*time.Second {
+		a.endCanary()
+		a.promote(instance)
+		a.events.Emit(&Event{
+			Type:       EventCanaryPromoted,
+			App:        a.config().Name,
+			InstanceId: instance.id,
+		})
+	}
+}
+
+func (a *App) endCanary() {
+	a.activeInstanceLock.Lock()
+	a.canaryInstance = nil
+	a.activeInstanceLock.Unlock()
+}
+
+// recordCanary counts canary request result, 5xx responses are errors
+func (i *Instance) recordCanary(status int) {
+	atomic.AddInt64(&i.canaryRequests, 1)
+	if status >= 500 {
+		atomic.AddInt64(&i.canaryErrors, 1)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"time"
+)
+
+// cascadePoll is how often restart cascade checks if restart of an app is done
+const cascadePoll = time.Second
+
+var ErrRestartNotActive = errors.New("New instance did not become active")
+
+// dependents returns apps that restart with app directly or through other apps, every
+// app comes after all apps it restarts with
+func (a *App) dependents() []*App {
+	names := make([]string, 0, len(a.runningApps))
+	for name := range a.runningApps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	included := map[string]bool{a.config().Name: true}
+	for changed := true; changed; {
+		changed = false
+		for _, name := range names {
+			if included[name] {
+				continue
+			}
+			for _, with := range a.runningApps[name].config().RestartWith {
+				if included[with] {
+					included[name] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	done := map[string]bool{a.config().Name: true}
+	order := []*App{}
+	for progress := true; progress; {
+		progress = false
+		for _, name := range names {
+			if !included[name] || done[name] {
+				continue
+			}
+			ready := true
+			for _, with := range a.runningApps[name].config().RestartWith {
+				if included[with] && !done[with] {
+					ready = false
+				}
+			}
+			if ready {
+				done[name] = true
+				order = append(order, a.runningApps[name])
+				progress = true
+			}
+		}
+	}
+	return order
+}
+
+// restartDependents gracefully restarts dependents of app one after another once
+// restart of app is done, a failed restart stops the cascade
+func (a *App) restartDependents() {
+	dependents := a.dependents()
+	if len(dependents) == 0 {
+		return
+	}
+
+	go func() {
+		if !a.waitOperation() {
+			log.Printf("%s: restart failed, not restarting %d apps with restart_with", a.config().Name, len(dependents))
+			return
+		}
+		for _, dependent := range dependents {
+			err := dependent.exclusive("restart with "+a.config().Name, func() (*Instance, error) {
+				return dependent.startInstance(RequestedByCascade, false)
+			})
+			if err == nil && !dependent.waitOperation() {
+				err = ErrRestartNotActive
+			}
+			if err != nil {
+				log.Printf("%s: restart with %s failed, restart cascade stopped: %s", dependent.config().Name, a.config().Name, err)
+				return
+			}
+		}
+	}()
+}
+
+// waitOperation waits until current operation of app is over and reports if its
+// instance became active
+func (a *App) waitOperation() bool {
+	for a.currentOperation() != nil {
+		time.Sleep(cascadePoll)
+	}
+
+	a.operationLock.Lock()
+	op := a.operation
+	a.operationLock.Unlock()
+	a.activeInstanceLock.Lock()
+	active := a.activeInstance
+	a.activeInstanceLock.Unlock()
+	return op != nil && op.instance != nil && op.instance == active
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// ConfigErrors are all errors found in config, one per line
+type ConfigErrors []error
+
+func (e ConfigErrors) Error() string {
+	lines := make([]string, 0, len(e))
+	for _, err := range e {
+		lines = append(lines, err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e ConfigErrors) Unwrap() []error {
+	return e
+}
+
+// add appends err of option field, nil err is ignored
+func (e *ConfigErrors) add(field string, err error) {
+	if err == nil {
+		return
+	}
+	if field != "" {
+		err = &FieldError{Field: field, Err: err}
+	}
+	*e = append(*e, err)
+}
+
+// err returns nil without errors and the error itself if there is only one
+func (e ConfigErrors) err() error {
+	switch len(e) {
+	case 0:
+		return nil
+	case 1:
+		return e[0]
+	}
+	return e
+}
+
+// FieldError is an error of config option
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigError is a config error with file, line and app it was found in
+type ConfigError struct {
+	File string
+	Line int
+	App  string
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	location := e.File
+	if e.Line > 0 {
+		location = fmt.Sprintf("%s:%d", e.File, e.Line)
+	}
+	if e.App != "" {
+		location = strings.TrimPrefix(fmt.Sprintf("%s: %s", location, e.App), ": ")
+	}
+	if location == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %s", location, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// appError returns error located at name of app in its source file
+func appError(app *AppConfig, err error) *ConfigError {
+	return &ConfigError{File: app.source, Line: appLine(app), App: app.Name, Err: err}
+}
+
+// appLine finds line of app name option in yaml, toml or json app source file, 0 if it can't be found
+func appLine(app *AppConfig) int {
+	data, err := ioutil.ReadFile(app.source)
+	if err != nil || app.Name == "" {
+		return 0
+	}
+	nameRe := regexp.MustCompile(`^[\s-]*"?name"?\s*[:=]\s*["']?` + regexp.QuoteMeta(app.Name) + `["']?\s*,?\s*(#.*)?$`)
+	for i, line := range strings.Split(string(data), "\n") {
+		if nameRe.MatchString(line) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// checkConfig parses and cleans config dir like ParseConfing, but instead of
+// stopping at first error it returns errors of all files and apps
+func checkConfig(configPath string) []error {
+	fn := configFileName(configPath)
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return []error{err}
+	}
+
+	config := &Config{}
+	if err := parseConfigData(fn, data, config); err != nil {
+		return []error{&ConfigError{File: fn, Err: err}}
+	}
+	config.file = fn
+	for _, app := range config.Apps {
+		app.source = fn
+	}
+
+	if config.Source != nil {
+		if err := config.Source.clean(config); err != nil {
+			return []error{&ConfigError{File: fn, Err: fmt.Errorf("config_source: %s", err)}}
+		}
+		source := NewConfigSource(config.Source, config.StateDir)
+		data, err := source.Load()
+		if err != nil {
+			return []error{err}
+		}
+
+		fn = source.String()
+		config = &Config{}
+		if err := parseConfigData(fn, data, config); err != nil {
+			return []error{&ConfigError{File: fn, Err: err}}
+		}
+		config.Source = source.config
+		config.file = fn
+		for _, app := range config.Apps {
+			app.source = fn
+		}
+	}
+
+	errs := []error{}
+	for _, inc := range config.Include {
+		files, err := includePaths(inc)
+		if err != nil {
+			errs = append(errs, &ConfigError{File: fn, Err: fmt.Errorf("apps_include: %s", err)})
+			continue
+		}
+		for _, file := range files {
+			if err := config.includeFile(file); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if err := config.clean(config); err != nil {
+		if configErrs, ok := err.(ConfigErrors); ok {
+			return append(errs, configErrs...)
+		}
+		return append(errs, err)
+	}
+
+	return errs
+}
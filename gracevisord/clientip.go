@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIpKey struct{}
+
+// trusted checks if ip is in one of nets
+func trusted(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// deriveClientIp walks X-Forwarded-For from the right while hops are trusted proxies,
+// the first untrusted hop is the client. Peers that are not trusted are clients themselves.
+func deriveClientIp(nets []*net.IPNet, req *http.Request) string {
+	host := remoteHost(req)
+	ip := net.ParseIP(host)
+	if ip == nil || !trusted(nets, ip) {
+		return host
+	}
+
+	hops := []string{}
+	for _, header := range req.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// garbage can be forged by anyone before the last trusted proxy
+			break
+		}
+		ip = hop
+		if !trusted(nets, hop) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// withClientIp derives client ip once when request enters app and stores it in request
+// context, headers forwarded by untrusted peers are dropped so instances can't be fooled
+func (a *App) withClientIp(req *http.Request) *http.Request {
+	if _, ok := req.Context().Value(clientIpKey{}).(string); ok {
+		return req
+	}
+	nets := a.config().TrustedNets
+	ip := deriveClientIp(nets, req)
+	if peer := net.ParseIP(remoteHost(req)); peer == nil || !trusted(nets, peer) {
+		req.Header.Del("X-Forwarded-For")
+		req.Header.Del("X-Forwarded-Proto")
+	}
+	req.Header.Set("X-Real-IP", ip)
+	if req.TLS != nil {
+		req.Header.Set("X-Forwarded-Proto", "https")
+	} else if req.Header.Get("X-Forwarded-Proto") == "" {
+		// trusted proxies terminating tls keep their proto
+		req.Header.Set("X-Forwarded-Proto", "http")
+	}
+	return req.WithContext(context.WithValue(req.Context(), clientIpKey{}, ip))
+}
+
+// clientIp returns ip derived by withClientIp, or address of the peer
+func clientIp(req *http.Request) string {
+	if ip, ok := req.Context().Value(clientIpKey{}).(string); ok {
+		return ip
+	}
+	return remoteHost(req)
+}
+
+// remoteHost returns address of the peer without port
+func remoteHost(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
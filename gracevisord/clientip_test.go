@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithClientIpForwardedHeaders(t *testing.T) {
+	_, proxyNet, _ := net.ParseCIDR("10.0.0.0/8")
+	app := &App{}
+	app.configValue.Store(&AppConfig{Name: "app", TrustedNets: []*net.IPNet{proxyNet}})
+
+	request := func(remoteAddr string, secure bool) map[string]string {
+		req := httptest.NewRequest("GET", "http://app/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", "198.51.100.7")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		if secure {
+			req.TLS = &tls.ConnectionState{}
+		}
+		req = app.withClientIp(req)
+		return map[string]string{
+			"for":   req.Header.Get("X-Forwarded-For"),
+			"proto": req.Header.Get("X-Forwarded-Proto"),
+			"ip":    req.Header.Get("X-Real-IP"),
+		}
+	}
+
+	if h := request("203.0.113.1:1234", false); h["for"] != "" || h["proto"] != "http" || h["ip"] != "203.0.113.1" {
+		t.Error("Forwarded headers of untrusted peer should be replaced, got", h)
+	}
+	if h := request("203.0.113.1:1234", true); h["proto"] != "https" {
+		t.Error("Tls requests should be forwarded as https, got", h)
+	}
+	if h := request("10.0.0.2:1234", false); h["for"] != "198.51.100.7" || h["proto"] != "https" || h["ip"] != "198.51.100.7" {
+		t.Error("Forwarded headers of trusted proxy should be kept, got", h)
+	}
+}
@@ -1,51 +1,229 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"os/user"
 	"path"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"text/template"
+	"time"
 
 	"github.com/hamaxx/gracevisor/deps/yaml.v2"
 )
 
 var (
-	ErrInvalidPortRange  = errors.New("Invalid port range")
-	ErrNameRequired      = errors.New("Name must be specified for app")
-	ErrCommandRequired   = errors.New("Command must be specified for app")
-	ErrPortBadgeRequired = errors.New("App must have {port} in command or environment")
-	ErrInvalidStopSignal = errors.New("Invalid stop signal")
-	ErrInvalidUserId     = errors.New("invalid user id format")
+	ErrInvalidPortRange      = errors.New("Invalid port range")
+	ErrInvalidOnExhausted    = errors.New("On exhausted must be fail or wait")
+	ErrInvalidReclaimAfter   = errors.New("Reclaim after must not be negative")
+	ErrInvalidInternalPort   = errors.New("Internal ports must be unique and differ from external and preview port")
+	ErrInternalPortsStable   = errors.New("Internal ports and stable ports can't be used together")
+	ErrNameRequired          = errors.New("Name must be specified for app")
+	ErrInvalidName           = errors.New("Name must not contain / or \\ or be . or .., it is used in file names")
+	ErrCommandRequired       = errors.New("Command must be specified for app")
+	ErrPortBadgeRequired     = errors.New("App must have {port} in command or environment")
+	ErrInvalidAppType        = errors.New("Invalid app type")
+	ErrContainerPortRequired = errors.New("Container port must be specified for docker app")
+	ErrInvalidCommandArg     = errors.New("Command arguments must be strings")
+	ErrInvalidShell          = errors.New("Shell can only be used with a command string of a process app")
+	ErrInvalidNamespace      = errors.New("Invalid namespace")
+	ErrInvalidCapability     = errors.New("Invalid capability")
+	ErrInvalidNice           = errors.New("Nice must be between -20 and 19")
+	ErrInvalidIoniceClass    = errors.New("Invalid ionice class")
+	ErrInvalidIoniceLevel    = errors.New("Ionice level must be between 0 and 7")
+	ErrInvalidStopSignal     = errors.New("Invalid stop signal")
+	ErrStopStepTimeout       = errors.New("Stop signal steps before the last one need a timeout")
+	ErrInvalidReloadSignal   = errors.New("Invalid reload signal")
+	ErrInvalidProxy          = errors.New("Proxy must be http or none")
+	ErrInvalidHost           = errors.New("Host must be an ip address or a host name")
+	ErrBackendProxyRequired  = errors.New("Backend app must use http proxy")
+	ErrInvalidHealthStatus   = errors.New("Invalid healthcheck status code")
+	ErrInvalidUserId         = errors.New("invalid user id format")
+	ErrInvalidGroupId        = errors.New("invalid group id format")
+	ErrPatternRequired       = errors.New("Pattern must be specified for log trigger")
+	ErrWarmupPathsRequired   = errors.New("Paths must be specified for warmup")
+	ErrInvalidCanaryPercent  = errors.New("Canary percent must be between 0 and 100")
+	ErrInvalidErrorRate      = errors.New("Canary max error rate must be between 0 and 100")
+	ErrInvalidSlowStart      = errors.New("Slow start percent must be between 0 and 100")
+	ErrInvalidMiddleware     = errors.New("Middleware is not registered")
+	ErrMiddlewareProxy       = errors.New("Middleware requires http proxy")
+	ErrRuleActionRequired    = errors.New("Rule must have one of route, route_held, reject or rewrite")
+	ErrRouteHeldPreview      = errors.New("Route held rule requires preview port")
+	ErrRewritePathRequired   = errors.New("Rewrite rule must match a path")
+	ErrInvalidRejectStatus   = errors.New("Reject status must be between 400 and 599")
+	ErrRulesProxy            = errors.New("Rules require http proxy")
+	ErrInvalidErrorStatus    = errors.New("Proxy error status must be between 400 and 599")
+	ErrInvalidSanitizeLimit  = errors.New("Sanitize limits must not be negative")
+	ErrDebugHostLoopback     = errors.New("Debug host must be a loopback address")
+	ErrInvalidWatchdogLimit  = errors.New("Watchdog limits must not be negative")
+	ErrFetchUrlRequired      = errors.New("Url must be specified for fetch")
+	ErrVerifyCheckRequired   = errors.New("Command or path must be specified for verify")
+	ErrInvalidDiscoveryType  = errors.New("Discovery type must be consul or etcd")
+	ErrBackendsRequired      = errors.New("Backends or backend service must be specified for backend app")
+	ErrDiscoveryRequired     = errors.New("Backend service requires discovery config")
+	ErrInvalidFetchUrl       = errors.New("Fetch url must be http(s)://, s3:// or git+")
+	ErrInvalidSourceType     = errors.New("Config source type must be http, consul or etcd")
+	ErrSourceUrlRequired     = errors.New("Url must be specified for http config source")
+	ErrSourceKeyRequired     = errors.New("Key must be specified for consul and etcd config source")
+	ErrTokenRequired         = errors.New("Token must be specified for rpc token")
+	ErrInvalidRole           = errors.New("Invalid role")
+	ErrInvalidTrustedProxy   = errors.New("Trusted proxy must be an ip address or a cidr")
+	ErrInvalidClientIp       = errors.New("Client ip must be an ip address or a cidr")
+	ErrInvalidLogMode        = errors.New("Log mode must be octal permissions like 0640")
+	ErrInvalidLogGroupId     = errors.New("Invalid log group id format")
+	ErrInvalidQuarantine     = errors.New("Quarantine cooldown must not be negative")
+	ErrLogChownDaemonUser    = errors.New("Log chown can't be used with daemon user, gracevisord couldn't write the logs")
+	ErrUserDaemonUser        = errors.New("App user must match daemon user, gracevisord can't switch user after dropping privileges")
+	ErrInvalidDeployWindow   = errors.New("Deploy window must be days and a time range like mon-fri 09:00-17:00")
+	ErrStateExportTarget     = errors.New("Path or urls must be specified for state export")
+	ErrInvalidStateExport    = errors.New("State export interval and timeout must not be negative")
+	ErrInvalidNotifier       = errors.New("Notifier type is not registered")
+	ErrRequestLogEmpty       = errors.New("Request log needs slow threshold or sample rate")
+	ErrInvalidRequestLog     = errors.New("Request log slow threshold must not be negative and sample rate must be between 0 and 1")
+	ErrCachePathsRequired    = errors.New("Paths must be specified for cache")
+	ErrInvalidCacheLimit     = errors.New("Cache ttl, sizes and stale if error must not be negative")
+	ErrCacheProxy            = errors.New("Cache requires http proxy")
+	ErrCorsOriginsRequired   = errors.New("Origins must be specified for cors")
+	ErrCorsCredentialsAny    = errors.New("Cors credentials can't be allowed for any origin")
+	ErrInvalidCorsMaxAge     = errors.New("Cors max age must not be negative")
+	ErrCorsProxy             = errors.New("Cors requires http proxy")
+	ErrShadowPreview         = errors.New("Shadow requires preview port")
+	ErrShadowProxy           = errors.New("Shadow requires http proxy")
+	ErrTLSCertRequired       = errors.New("Cert file and key file or certificates must be specified for tls")
+	ErrInvalidTLSReload      = errors.New("Tls reload interval must not be negative")
+	ErrInvalidExpiryWarning  = errors.New("Tls expiry warning must not be negative")
+	ErrInvalidTLSVersion     = errors.New("Tls min version must be 1.0, 1.1, 1.2 or 1.3")
+	ErrInvalidCipherSuite    = errors.New("Unknown cipher suite")
+	ErrInvalidCurve          = errors.New("Curve must be X25519, P256, P384 or P521")
+	ErrInvalidClientAuth     = errors.New("Client auth must be none, request, require, verify_if_given or require_and_verify")
+	ErrClientCaRequired      = errors.New("Client ca file must be specified to verify client certificates")
+	ErrInvalidClientCa       = errors.New("No certificates found in client ca file")
+	ErrTLSProxy              = errors.New("Tls requires http proxy")
+	ErrVerifyClientCert      = errors.New("Verify path can't be checked when tls requires client certificates")
+	ErrInvalidMaxConnections = errors.New("Max connections must not be negative")
+	ErrInvalidProxyBuffer    = errors.New("Proxy buffer size must be between 1 and 1024 kilobytes")
+	ErrInvalidFlushInterval  = errors.New("Proxy flush interval must be -1 or more")
+	ErrInvalidShadowPercent  = errors.New("Shadow percent must be between 0 and 100")
+	ErrInvalidShadowLimit    = errors.New("Shadow body size, timeout and concurrency must not be negative")
 )
 
 const (
-	configFile = "gracevisor.yaml"
+	configName = "gracevisor"
+	configFile = configName + FormatYaml
 
 	defaultPortFrom = uint16(10000)
 	defaultPortTo   = uint16(11000)
 
+	PortsExhaustedFail = "fail"
+	PortsExhaustedWait = "wait"
+
+	defaultReclaimAfter = 10
+
 	defaultHost         = "localhost"
 	defaultRpcPort      = uint16(9001)
+	defaultDebugPort    = uint16(9002)
 	defaultExternalPort = uint16(8080)
 
+	defaultRole = "read-only"
+
+	ProxyHttp = "http"
+	ProxyNone = "none"
+
 	defaultStopSignal = "TERM"
 	defaultMaxRetries = 5
 
+	defaultHealthCheckStatus   = 200
+	defaultHealthCheckInterval = 5
+	defaultHealthCheckFailures = 3
+
+	defaultWarmupRequests    = 1
+	defaultWarmupConcurrency = 1
+	defaultWarmupTimeout     = 30
+	defaultFetchTimeout      = 300
+
+	defaultCanaryPercent      = 5
+	defaultCanaryBakeTime     = 60
+	defaultCanaryMaxErrorRate = 5
+	defaultCanaryMinRequests  = 10
+
+	defaultSlowStartDuration = 30
+	defaultSlowStartPercent  = 10
+
+	defaultShadowPercent       = 10
+	defaultShadowMaxBodySize   = 64
+	defaultShadowTimeout       = 10
+	defaultShadowMaxConcurrent = 10
+
+	defaultSanitizeMaxHeaders    = 100
+	defaultSanitizeMaxHeaderSize = 32 << 10
+	defaultSanitizeMaxUrlLength  = 8 << 10
+
+	defaultCacheTtl          = 60
+	defaultCacheMaxSize      = 64
+	defaultCacheMaxEntrySize = 1024
+	defaultCacheStaleIfError = 60
+
+	defaultWatchdogInterval      = 10
+	defaultWatchdogMaxGoroutines = 10000
+	defaultWatchdogMaxLag        = 1000
+	defaultWatchdogMaxOpenFiles  = 80
+
+	defaultVerifyTimeout = 10
+
+	defaultRetryAfter = 1
+
+	defaultTLSMinVersion = "1.2"
+	defaultTLSClientAuth = "none"
+
+	defaultTLSReloadInterval = 30
+	defaultTLSExpiryWarning  = 14
+
+	defaultProxyBufferSize = 32
+	maxProxyBufferSize     = 1024
+
+	defaultIoniceClass = "best-effort"
+	defaultCoreDirMode = os.FileMode(0755)
+
 	defaultLogFileName = "gracevisor.log"
 	defaultLogDir      = "/var/log/gracevisor"
 	defaultMaxLogSize  = 500
-	defaultLogFileMode = os.FileMode(0600)
+	defaultLogDirMode  = os.FileMode(0750)
+	defaultLogFileMode = os.FileMode(0640)
+
+	defaultWebhookTimeout = 5
+
+	defaultStateExportInterval = 10
+	defaultStateExportTimeout  = 5
+
+	defaultConsulAddress   = "http://localhost:8500"
+	defaultEtcdAddress     = "http://localhost:2379"
+	defaultDiscoveryPrefix = "/gracevisor/services/"
+	defaultDiscoveryTtl    = 15
+
+	defaultSourceInterval  = 30
+	defaultSourceCacheFile = "config_source.yaml"
+
+	defaultStateDir     = "/var/lib/gracevisor"
+	defaultStateDirMode = os.FileMode(0700)
+	defaultMaxHistory   = 100
+	defaultMaxDeploys   = 10
+	defaultReleasesDir  = "releases"
 )
 
 type UserConfig struct {
 	UserName string `yaml:"username"`
 	// GroupName string `yaml:"groupname"` TODO when os package will support group lookup
 
-	Uid uint32
+	Uid uint32 `yaml:"-"`
+	Gid uint32 `yaml:"-"`
 }
 
 func (c *UserConfig) clean(g *Config) error {
@@ -65,12 +243,24 @@ func (c *UserConfig) clean(g *Config) error {
 
 	c.Uid = uint32(uid)
 
+	gid, err := strconv.ParseUint(user.Gid, 10, 32)
+	if err != nil {
+		return ErrInvalidGroupId
+	}
+	c.Gid = uint32(gid)
+
 	return nil
 }
 
 type InternalPortsConfig struct {
 	From uint16 `yaml:"from"`
 	To   uint16 `yaml:"to"`
+
+	// OnExhausted is fail to reject new instances or wait to start them once a port is released
+	OnExhausted string `yaml:"on_exhausted"`
+
+	// ReclaimAfter is how many seconds port of exited instance is kept before it is reused
+	ReclaimAfter int `yaml:"reclaim_after"`
 }
 
 func (c *InternalPortsConfig) clean(g *Config) error {
@@ -82,120 +272,1358 @@ func (c *InternalPortsConfig) clean(g *Config) error {
 	if c.From >= c.To {
 		return ErrInvalidPortRange
 	}
-
+
+	if c.OnExhausted == "" {
+		c.OnExhausted = PortsExhaustedFail
+	}
+	if c.OnExhausted != PortsExhaustedFail && c.OnExhausted != PortsExhaustedWait {
+		return ErrInvalidOnExhausted
+	}
+
+	if c.ReclaimAfter < 0 {
+		return ErrInvalidReclaimAfter
+	}
+	if c.ReclaimAfter == 0 {
+		c.ReclaimAfter = defaultReclaimAfter
+	}
+
+	return nil
+}
+
+type AppConfig struct {
+	Name        string   `yaml:"name"`
+	Type        string   `yaml:"type"`
+	Command     string   `yaml:"command"`
+	Args        []string `yaml:"-"`
+	Shell       bool     `yaml:"shell"`
+	Version     string   `yaml:"version"`
+	Environment []string `yaml:"environment"`
+	EnvFile     string   `yaml:"env_file"`
+
+	InheritEnvironment bool     `yaml:"inherit_environment"`
+	PassEnvironment    []string `yaml:"pass_environment"`
+	Directory          string   `yaml:"directory"`
+	HealthCheck        string   `yaml:"healthcheck"`
+	ReadinessCheck     string   `yaml:"readiness_check"`
+	LivenessCheck      string   `yaml:"liveness_check"`
+
+	HealthCheckStatus     []int             `yaml:"healthcheck_status"`
+	HealthCheckBody       string            `yaml:"healthcheck_body"`
+	HealthCheckBodyRegexp *regexp.Regexp    `yaml:"-"`
+	HealthCheckHeaders    map[string]string `yaml:"healthcheck_headers"`
+	HealthCheckInterval   int               `yaml:"healthcheck_interval"`
+	HealthCheckFailures   int               `yaml:"healthcheck_failures"`
+
+	// ReportReadiness makes new instances wait for ready self report before serving
+	ReportReadiness bool `yaml:"report_readiness"`
+
+	StopSignal        os.Signal   `yaml:"-"`
+	StopSignalName    string      `yaml:"stop_signal"`
+	StopSignalSteps   []string    `yaml:"-"`
+	StopSteps         []*StopStep `yaml:"-"`
+	ReloadSignal      os.Signal   `yaml:"-"`
+	ReloadSignalName  string      `yaml:"reload_signal"`
+	MaxRetries        int         `yaml:"max_retries"`
+	StartTimeout      int         `yaml:"start_timeout"`
+	HeartbeatInterval int         `yaml:"heartbeat_interval"`
+	StopTimeout       int         `yaml:"stop_timeout"`
+
+	// QuarantineCooldown is seconds after used up retries before they start again,
+	// 0 gives up for good
+	QuarantineCooldown int `yaml:"quarantine_cooldown"`
+
+	// RestartWith are apps whose restarts also gracefully restart this app
+	RestartWith []string `yaml:"restart_with"`
+
+	// DeployWindows are time ranges when restarts and deploys don't need --force
+	DeployWindows      []string        `yaml:"deploy_windows"`
+	DeployWindowRanges []*DeployWindow `yaml:"-"`
+
+	InternalHost string `yaml:"internal_host"`
+	ExternalHost string `yaml:"external_host"`
+	ExternalPort uint16 `yaml:"external_port"`
+	PreviewPort  uint16 `yaml:"preview_port"`
+	Proxy        string `yaml:"proxy"`
+	ReusePort    bool   `yaml:"reuse_port"`
+
+	// TLS terminates tls on external and preview listeners
+	TLS *TLSConfig `yaml:"tls"`
+
+	// InternalPorts are fixed ports for instances instead of ports from port_range,
+	// StablePorts picks pool ports in the same order for every start of the app
+	InternalPorts []uint16 `yaml:"internal_ports"`
+	StablePorts   bool     `yaml:"stable_ports"`
+
+	MaxConnections        int `yaml:"max_connections"`
+	MaxConcurrentRequests int `yaml:"max_concurrent_requests"`
+	QueueTimeout          int `yaml:"queue_timeout"`
+	RetryAfter            int `yaml:"retry_after"`
+
+	// ProxyBufferSize is size of proxy copy buffers in kilobytes, ProxyFlushInterval is
+	// how often streamed responses are flushed in milliseconds, -1 flushes every write
+	ProxyBufferSize    int `yaml:"proxy_buffer_size"`
+	ProxyFlushInterval int `yaml:"proxy_flush_interval"`
+
+	RoutingToken string `yaml:"routing_token"`
+
+	ContainerPort uint16 `yaml:"container_port"`
+
+	Backends       []string `yaml:"backends"`
+	BackendService string   `yaml:"backend_service"`
+
+	Chroot     string   `yaml:"chroot"`
+	Namespaces []string `yaml:"namespaces"`
+	Cloneflags uintptr  `yaml:"-"`
+
+	DropCapabilities []string `yaml:"drop_capabilities"`
+	NoNewPrivs       bool     `yaml:"no_new_privs"`
+
+	Nice   int           `yaml:"nice"`
+	Ionice *IoniceConfig `yaml:"ionice"`
+
+	CoreDump *CoreDumpConfig `yaml:"core_dump"`
+
+	Fetch     *FetchConfig     `yaml:"fetch"`
+	Warmup    *WarmupConfig    `yaml:"warmup"`
+	Canary    *CanaryConfig    `yaml:"canary"`
+	Verify    *VerifyConfig    `yaml:"verify"`
+	SlowStart *SlowStartConfig `yaml:"slow_start"`
+	Shadow    *ShadowConfig    `yaml:"shadow"`
+
+	Logger      *LoggerConfig       `yaml:"logger"`
+	User        *UserConfig         `yaml:"user"`
+	LogTriggers []*LogTriggerConfig `yaml:"log_triggers"`
+	Middleware  []*MiddlewareConfig `yaml:"middleware"`
+	Rules       []*RuleConfig       `yaml:"rules"`
+	ProxyErrors *ProxyErrorsConfig  `yaml:"proxy_errors"`
+	Sanitize    *SanitizeConfig     `yaml:"sanitize"`
+	RequestLog  *RequestLogConfig   `yaml:"request_log"`
+	Cache       *CacheConfig        `yaml:"cache"`
+	Cors        *CorsConfig         `yaml:"cors"`
+
+	// X-Forwarded-For is honored only from trusted proxies, defaults to global list
+	TrustedProxies []string     `yaml:"trusted_proxies"`
+	TrustedNets    []*net.IPNet `yaml:"-"`
+
+	// file app was loaded from
+	source string
+}
+
+// UnmarshalYAML accepts command and stop_signal as a string or as a list,
+// Command of a list is its arguments joined with spaces
+func (c *AppConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw yaml.MapSlice
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	name := ""
+	for _, item := range raw {
+		if item.Key == "name" {
+			name = fmt.Sprint(item.Value)
+		}
+	}
+
+	for i, item := range raw {
+		list, ok := item.Value.([]interface{})
+		if !ok {
+			continue
+		}
+		switch item.Key {
+		case "command":
+			args, ok := yamlStrings(list)
+			if !ok {
+				return fmt.Errorf("app %s: command: %s", name, ErrInvalidCommandArg)
+			}
+			c.Args = args
+			raw[i].Value = strings.Join(args, " ")
+		case "stop_signal":
+			steps, ok := yamlStrings(list)
+			if !ok || len(steps) == 0 {
+				return fmt.Errorf("app %s: stop_signal: %s", name, ErrInvalidStopSignal)
+			}
+			c.StopSignalSteps = steps
+			raw[i].Value = steps[0]
+		}
+	}
+
+	data, err := yaml.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	type plain AppConfig
+	return yaml.Unmarshal(data, (*plain)(c))
+}
+
+// MarshalYAML writes command of apps with arguments and stop signal steps as lists
+func (c *AppConfig) MarshalYAML() (interface{}, error) {
+	type plain AppConfig
+	data, err := yaml.Marshal((*plain)(c))
+	if err != nil {
+		return nil, err
+	}
+	var raw yaml.MapSlice
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	for i := range raw {
+		if raw[i].Key == "command" && len(c.Args) > 0 {
+			raw[i].Value = c.Args
+		}
+		if raw[i].Key == "stop_signal" && len(c.StopSignalSteps) > 0 {
+			raw[i].Value = c.StopSignalSteps
+		}
+	}
+	return raw, nil
+}
+
+// yamlStrings converts list of yaml scalars to strings, false if list has other values
+func yamlStrings(list []interface{}) ([]string, bool) {
+	values := make([]string, len(list))
+	for i, value := range list {
+		switch value.(type) {
+		case []interface{}, map[interface{}]interface{}, yaml.MapSlice, nil:
+			return nil, false
+		}
+		values[i] = fmt.Sprint(value)
+	}
+	return values, true
+}
+
+// StopStep is a signal sent to stop the app and seconds to wait before the next step
+type StopStep struct {
+	Signal  os.Signal
+	Timeout int
+}
+
+func (c *AppConfig) clean(g *Config) error {
+	if c.Name == "" {
+		return &FieldError{"name", ErrNameRequired}
+	}
+	if strings.ContainsAny(c.Name, "/\\\x00") || c.Name == "." || c.Name == ".." {
+		return &FieldError{"name", ErrInvalidName}
+	}
+	errs := ConfigErrors{}
+
+	if c.Type == "" {
+		c.Type = AppTypeProcess
+	}
+	if c.Command == "" && c.Type != AppTypeBackend {
+		errs.add("command", ErrCommandRequired)
+	}
+	if c.Proxy == "" {
+		c.Proxy = ProxyHttp
+	}
+	switch c.Proxy {
+	case ProxyHttp:
+	case ProxyNone:
+		if c.Type == AppTypeBackend {
+			errs.add("proxy", ErrBackendProxyRequired)
+		}
+	default:
+		errs.add("proxy", ErrInvalidProxy)
+	}
+
+	switch c.Type {
+	case AppTypeProcess:
+		if c.Command != "" && c.Proxy != ProxyNone && !c.hasPortBadge() {
+			errs.add("command", ErrPortBadgeRequired)
+		}
+	case AppTypeDocker:
+		if c.ContainerPort == 0 {
+			errs.add("container_port", ErrContainerPortRequired)
+		}
+	case AppTypeBackend:
+		if len(c.Backends) == 0 && c.BackendService == "" {
+			errs.add("backends", ErrBackendsRequired)
+		}
+		if c.BackendService != "" && g.Discovery == nil {
+			errs.add("backend_service", ErrDiscoveryRequired)
+		}
+	default:
+		errs.add("type", ErrInvalidAppType)
+	}
+	if c.Shell && (c.Type != AppTypeProcess || len(c.Args) > 0) {
+		errs.add("shell", ErrInvalidShell)
+	}
+
+	if c.StopSignalName == "" {
+		c.StopSignalName = defaultStopSignal
+	}
+	if err := c.cleanStopSteps(); err != nil {
+		errs.add("stop_signal", err)
+	}
+	if c.ReloadSignalName != "" {
+		if signal, ok := Signals[c.ReloadSignalName]; ok {
+			c.ReloadSignal = signal
+		} else {
+			errs.add("reload_signal", ErrInvalidReloadSignal)
+		}
+	}
+
+	if c.MaxRetries == 0 {
+		c.MaxRetries = defaultMaxRetries
+	}
+	if c.QuarantineCooldown < 0 {
+		errs.add("quarantine_cooldown", ErrInvalidQuarantine)
+	}
+	c.DeployWindowRanges = nil
+	for _, s := range c.DeployWindows {
+		window, err := parseDeployWindow(s)
+		if err != nil {
+			errs.add("deploy_windows", err)
+			break
+		}
+		c.DeployWindowRanges = append(c.DeployWindowRanges, window)
+	}
+
+	if len(c.HealthCheckStatus) == 0 {
+		c.HealthCheckStatus = []int{defaultHealthCheckStatus}
+	}
+	for _, status := range c.HealthCheckStatus {
+		if status < 100 || status > 599 {
+			errs.add("healthcheck_status", ErrInvalidHealthStatus)
+			break
+		}
+	}
+	if c.HealthCheckInterval == 0 {
+		c.HealthCheckInterval = defaultHealthCheckInterval
+	}
+	if c.HealthCheckFailures <= 0 {
+		c.HealthCheckFailures = defaultHealthCheckFailures
+	}
+
+	if c.RetryAfter <= 0 {
+		c.RetryAfter = defaultRetryAfter
+	}
+	if c.MaxConnections < 0 {
+		errs.add("max_connections", ErrInvalidMaxConnections)
+	}
+	if c.TLS != nil {
+		if c.Proxy == ProxyNone {
+			errs.add("tls", ErrTLSProxy)
+		}
+		errs.add("tls", c.TLS.clean(g))
+	}
+	if c.ProxyBufferSize == 0 {
+		c.ProxyBufferSize = defaultProxyBufferSize
+	}
+	if c.ProxyBufferSize < 0 || c.ProxyBufferSize > maxProxyBufferSize {
+		errs.add("proxy_buffer_size", ErrInvalidProxyBuffer)
+	}
+	if c.ProxyFlushInterval < -1 {
+		errs.add("proxy_flush_interval", ErrInvalidFlushInterval)
+	}
+	c.HealthCheckBodyRegexp = nil
+	if c.HealthCheckBody != "" {
+		bodyRegexp, err := regexp.Compile(c.HealthCheckBody)
+		errs.add("healthcheck_body", err)
+		c.HealthCheckBodyRegexp = bodyRegexp
+	}
+
+	for i, name := range c.DropCapabilities {
+		name = strings.TrimPrefix(strings.ToUpper(name), "CAP_")
+		if _, ok := Capabilities[name]; !ok && name != "ALL" {
+			errs.add("drop_capabilities", ErrInvalidCapability)
+			break
+		}
+		c.DropCapabilities[i] = name
+	}
+
+	if c.Nice < -20 || c.Nice > 19 {
+		errs.add("nice", ErrInvalidNice)
+	}
+	if c.Ionice != nil {
+		errs.add("ionice", c.Ionice.clean(g))
+	}
+
+	if c.CoreDump != nil {
+		errs.add("core_dump", c.CoreDump.clean(g, c))
+	}
+
+	if c.Fetch != nil {
+		errs.add("fetch", c.Fetch.clean(g, c))
+	}
+	if c.Warmup != nil {
+		errs.add("warmup", c.Warmup.clean(g))
+	}
+	if c.Canary != nil {
+		errs.add("canary", c.Canary.clean(g))
+	}
+	if c.Verify != nil {
+		errs.add("verify", c.Verify.clean(g))
+		if c.Verify.Path != "" && c.TLS != nil && (c.TLS.ClientAuth == "require" || c.TLS.ClientAuth == "require_and_verify") {
+			errs.add("verify", ErrVerifyClientCert)
+		}
+	}
+	if c.SlowStart != nil {
+		errs.add("slow_start", c.SlowStart.clean(g))
+	}
+	if c.Shadow != nil {
+		if c.PreviewPort == 0 {
+			errs.add("shadow", ErrShadowPreview)
+		}
+		if c.Proxy == ProxyNone {
+			errs.add("shadow", ErrShadowProxy)
+		}
+		errs.add("shadow", c.Shadow.clean(g))
+	}
+
+	errs.add("", checkPlatform(c))
+
+	c.Cloneflags = 0
+	for _, name := range c.Namespaces {
+		flag, ok := Namespaces[name]
+		if !ok {
+			errs.add("namespaces", ErrInvalidNamespace)
+			break
+		}
+		c.Cloneflags |= flag
+	}
+
+	if c.InternalHost == "" {
+		c.InternalHost = defaultHost
+	}
+	if c.ExternalHost == "" {
+		c.ExternalHost = defaultHost
+	}
+	var err error
+	if c.InternalHost, err = cleanHost(c.InternalHost); err != nil {
+		errs.add("internal_host", err)
+	}
+	if c.ExternalHost, err = cleanHost(c.ExternalHost); err != nil {
+		errs.add("external_host", err)
+	}
+
+	if c.ExternalPort == 0 && c.Proxy != ProxyNone {
+		c.ExternalPort = defaultExternalPort
+	}
+
+	internalPorts := map[uint16]bool{}
+	for _, port := range c.InternalPorts {
+		if port == 0 || internalPorts[port] || port == c.ExternalPort || port == c.PreviewPort {
+			errs.add("internal_ports", ErrInvalidInternalPort)
+			break
+		}
+		internalPorts[port] = true
+	}
+	if len(c.InternalPorts) > 0 && c.StablePorts {
+		errs.add("stable_ports", ErrInternalPortsStable)
+	}
+
+	if c.Logger == nil {
+		c.Logger = &LoggerConfig{
+			LogDir:        g.Logger.LogDir,
+			MaxLogSize:    g.Logger.MaxLogSize,
+			MaxLogsKept:   g.Logger.MaxLogsKept,
+			MaxLogAge:     g.Logger.MaxLogAge,
+			MaxLogDirSize: g.Logger.MaxLogDirSize,
+		}
+	}
+	errs.add("logger", c.Logger.appClean(g, c))
+	if c.RequestLog != nil {
+		errs.add("request_log", c.RequestLog.clean(c))
+	}
+
+	if c.User == nil {
+		c.User = &UserConfig{}
+		if g.User != nil {
+			c.User.UserName = g.User.UserName
+		}
+	}
+	errs.add("user", c.User.clean(g))
+	if c.Logger.Chown && g.DaemonUser != nil && g.DaemonUser.UserName != "" {
+		errs.add("logger", ErrLogChownDaemonUser)
+	}
+	if c.User.UserName != "" && c.Type != AppTypeBackend && g.DaemonUser != nil && g.DaemonUser.UserName != "" &&
+		c.User.Uid != g.DaemonUser.Uid {
+		errs.add("user", ErrUserDaemonUser)
+	}
+
+	for i, trigger := range c.LogTriggers {
+		errs.add(fmt.Sprintf("log_triggers[%d]", i), trigger.clean(g))
+	}
+	if len(c.Middleware) > 0 && c.Proxy == ProxyNone {
+		errs.add("middleware", ErrMiddlewareProxy)
+	}
+	for i, middleware := range c.Middleware {
+		errs.add(fmt.Sprintf("middleware[%d]", i), middleware.clean(g))
+	}
+	if len(c.Rules) > 0 && c.Proxy == ProxyNone {
+		errs.add("rules", ErrRulesProxy)
+	}
+	for i, rule := range c.Rules {
+		errs.add(fmt.Sprintf("rules[%d]", i), rule.clean(g))
+		if rule.RouteHeld && c.PreviewPort == 0 {
+			errs.add(fmt.Sprintf("rules[%d]", i), ErrRouteHeldPreview)
+		}
+	}
+	if c.Sanitize != nil {
+		errs.add("sanitize", c.Sanitize.clean(g))
+	}
+	if c.Cache != nil {
+		if c.Proxy == ProxyNone {
+			errs.add("cache", ErrCacheProxy)
+		}
+		errs.add("cache", c.Cache.clean(g))
+	}
+	if c.Cors != nil {
+		if c.Proxy == ProxyNone {
+			errs.add("cors", ErrCorsProxy)
+		}
+		errs.add("cors", c.Cors.clean(g))
+	}
+	if c.ProxyErrors == nil {
+		c.ProxyErrors = &ProxyErrorsConfig{}
+	}
+	errs.add("proxy_errors", c.ProxyErrors.clean(g))
+	if c.TrustedProxies == nil {
+		c.TrustedNets = g.TrustedNets
+	} else {
+		nets, err := parseNets(c.TrustedProxies, ErrInvalidTrustedProxy)
+		c.TrustedNets = nets
+		errs.add("trusted_proxies", err)
+	}
+
+	return errs.err()
+}
+
+// cleanStopSteps parses stop_signal steps, a signal name optionally followed
+// by /timeout, steps without timeout wait stop_timeout
+func (c *AppConfig) cleanStopSteps() error {
+	names := c.StopSignalSteps
+	if len(names) == 0 {
+		names = []string{c.StopSignalName}
+	}
+
+	steps := make([]*StopStep, len(names))
+	for i, name := range names {
+		timeout := c.StopTimeout
+		if sep := strings.Index(name, "/"); sep >= 0 {
+			t, err := strconv.Atoi(name[sep+1:])
+			if err != nil || t <= 0 {
+				return ErrStopStepTimeout
+			}
+			name, timeout = name[:sep], t
+		}
+		signal, ok := Signals[name]
+		if !ok {
+			return ErrInvalidStopSignal
+		}
+		if timeout <= 0 && i < len(names)-1 {
+			return ErrStopStepTimeout
+		}
+		steps[i] = &StopStep{Signal: signal, Timeout: timeout}
+	}
+
+	c.StopSteps = steps
+	c.StopSignal = steps[0].Signal
+	return nil
+}
+
+// cleanHost strips brackets of ipv6 addresses like [::], which listens on ipv4 and ipv6
+func cleanHost(host string) (string, error) {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+		return host, ErrInvalidHost
+	}
+	if strings.ContainsAny(host, " /[]") {
+		return host, ErrInvalidHost
+	}
+	return host, nil
+}
+
+// hostPort joins host and port, ipv6 hosts are put in brackets
+func hostPort(host string, port uint16) string {
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+func (c *AppConfig) hasPortBadge() bool {
+	if strings.Contains(c.Command, PortBadge) {
+		return true
+	}
+
+	for _, env := range c.Environment {
+		if strings.Contains(env, PortBadge) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type IoniceConfig struct {
+	ClassName string `yaml:"class"`
+	Level     int    `yaml:"level"`
+
+	Class int `yaml:"-"`
+}
+
+func (c *IoniceConfig) clean(g *Config) error {
+	if c.ClassName == "" {
+		c.ClassName = defaultIoniceClass
+	}
+	class, ok := IoniceClasses[c.ClassName]
+	if !ok {
+		return ErrInvalidIoniceClass
+	}
+	c.Class = class
+
+	if c.Level < 0 || c.Level > 7 {
+		return ErrInvalidIoniceLevel
+	}
+
+	return nil
+}
+
+type CoreDumpConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	MaxSize int    `yaml:"max_size"`
+	Dir     string `yaml:"dir"`
+}
+
+func (c *CoreDumpConfig) clean(g *Config, a *AppConfig) error {
+	if !c.Enabled || c.Dir == "" {
+		return nil
+	}
+	return os.MkdirAll(c.Dir, defaultCoreDirMode)
+}
+
+type FetchConfig struct {
+	Url     string `yaml:"url"`
+	Ref     string `yaml:"ref"`
+	Dir     string `yaml:"dir"`
+	Timeout int    `yaml:"timeout"`
+}
+
+func (c *FetchConfig) clean(g *Config, a *AppConfig) error {
+	if c.Url == "" {
+		return ErrFetchUrlRequired
+	}
+	if fetchScheme(c.Url) == "" {
+		return ErrInvalidFetchUrl
+	}
+
+	if c.Timeout <= 0 {
+		c.Timeout = defaultFetchTimeout
+	}
+	if c.Dir == "" {
+		c.Dir = path.Join(g.StateDir, defaultReleasesDir, a.Name)
+	}
+	return nil
+}
+
+type WarmupConfig struct {
+	Paths       []string `yaml:"paths"`
+	Requests    int      `yaml:"requests"`
+	Concurrency int      `yaml:"concurrency"`
+	Timeout     int      `yaml:"timeout"`
+}
+
+func (c *WarmupConfig) clean(g *Config) error {
+	if len(c.Paths) == 0 {
+		return ErrWarmupPathsRequired
+	}
+	if c.Requests <= 0 {
+		c.Requests = defaultWarmupRequests
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = defaultWarmupConcurrency
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultWarmupTimeout
+	}
+	return nil
+}
+
+type CanaryConfig struct {
+	Percent      float64 `yaml:"percent"`
+	BakeTime     int     `yaml:"bake_time"`
+	MaxErrorRate float64 `yaml:"max_error_rate"`
+	MinRequests  int64   `yaml:"min_requests"`
+}
+
+func (c *CanaryConfig) clean(g *Config) error {
+	if c.Percent == 0 {
+		c.Percent = defaultCanaryPercent
+	}
+	if c.Percent < 0 || c.Percent > 100 {
+		return ErrInvalidCanaryPercent
+	}
+	if c.BakeTime <= 0 {
+		c.BakeTime = defaultCanaryBakeTime
+	}
+	if c.MaxErrorRate == 0 {
+		c.MaxErrorRate = defaultCanaryMaxErrorRate
+	}
+	if c.MaxErrorRate < 0 || c.MaxErrorRate > 100 {
+		return ErrInvalidErrorRate
+	}
+	if c.MinRequests <= 0 {
+		c.MinRequests = defaultCanaryMinRequests
+	}
+	return nil
+}
+
+type SlowStartConfig struct {
+	Duration int     `yaml:"duration"`
+	Percent  float64 `yaml:"percent"`
+}
+
+func (c *SlowStartConfig) clean(g *Config) error {
+	if c.Duration <= 0 {
+		c.Duration = defaultSlowStartDuration
+	}
+	if c.Percent == 0 {
+		c.Percent = defaultSlowStartPercent
+	}
+	if c.Percent < 0 || c.Percent > 100 {
+		return ErrInvalidSlowStart
+	}
+	return nil
+}
+
+// ShadowConfig mirrors part of requests to held instance, its responses are discarded.
+// Max body size is in kilobytes, timeout in seconds.
+type ShadowConfig struct {
+	Percent       float64 `yaml:"percent"`
+	MaxBodySize   int     `yaml:"max_body_size"`
+	Timeout       int     `yaml:"timeout"`
+	MaxConcurrent int     `yaml:"max_concurrent"`
+}
+
+func (c *ShadowConfig) clean(g *Config) error {
+	if c.Percent == 0 {
+		c.Percent = defaultShadowPercent
+	}
+	if c.Percent < 0 || c.Percent > 100 {
+		return ErrInvalidShadowPercent
+	}
+	if c.MaxBodySize < 0 || c.Timeout < 0 || c.MaxConcurrent < 0 {
+		return ErrInvalidShadowLimit
+	}
+	if c.MaxBodySize == 0 {
+		c.MaxBodySize = defaultShadowMaxBodySize
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultShadowTimeout
+	}
+	if c.MaxConcurrent == 0 {
+		c.MaxConcurrent = defaultShadowMaxConcurrent
+	}
+	return nil
+}
+
+type MiddlewareConfig struct {
+	Name    string            `yaml:"name"`
+	Options map[string]string `yaml:"options"`
+}
+
+func (c *MiddlewareConfig) clean(g *Config) error {
+	return checkMiddleware(c)
+}
+
+type RuleConfig struct {
+	Path      string            `yaml:"path"`
+	Method    string            `yaml:"method"`
+	Headers   map[string]string `yaml:"headers"`
+	Cookies   map[string]string `yaml:"cookies"`
+	ClientIps []string          `yaml:"client_ips"`
+
+	Route     string `yaml:"route"`
+	RouteHeld bool   `yaml:"route_held"`
+	Reject    int    `yaml:"reject"`
+	Rewrite   string `yaml:"rewrite"`
+
+	PathRegexp    *regexp.Regexp            `yaml:"-"`
+	HeaderRegexps map[string]*regexp.Regexp `yaml:"-"`
+	CookieRegexps map[string]*regexp.Regexp `yaml:"-"`
+	ClientNets    []*net.IPNet              `yaml:"-"`
+}
+
+func (c *RuleConfig) clean(g *Config) error {
+	actions := 0
+	for _, set := range []bool{c.Route != "", c.RouteHeld, c.Reject != 0, c.Rewrite != ""} {
+		if set {
+			actions++
+		}
+	}
+	if actions != 1 {
+		return ErrRuleActionRequired
+	}
+	if c.Reject != 0 && (c.Reject < 400 || c.Reject > 599) {
+		return ErrInvalidRejectStatus
+	}
+	if c.Rewrite != "" && c.Path == "" {
+		return ErrRewritePathRequired
+	}
+
+	c.PathRegexp = nil
+	if c.Path != "" {
+		re, err := regexp.Compile(c.Path)
+		if err != nil {
+			return &FieldError{"path", err}
+		}
+		c.PathRegexp = re
+	}
+
+	c.HeaderRegexps = make(map[string]*regexp.Regexp, len(c.Headers))
+	for name, pattern := range c.Headers {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return &FieldError{"headers." + name, err}
+		}
+		c.HeaderRegexps[name] = re
+	}
+
+	c.CookieRegexps = make(map[string]*regexp.Regexp, len(c.Cookies))
+	for name, pattern := range c.Cookies {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return &FieldError{"cookies." + name, err}
+		}
+		c.CookieRegexps[name] = re
+	}
+
+	c.ClientNets = nil
+	if len(c.ClientIps) > 0 {
+		nets, err := parseNets(c.ClientIps, ErrInvalidClientIp)
+		if err != nil {
+			return &FieldError{"client_ips", err}
+		}
+		c.ClientNets = nets
+	}
+	return nil
+}
+
+// RequestLogConfig logs proxied requests slower than slow_threshold milliseconds and
+// sample_rate share of the others
+type RequestLogConfig struct {
+	SlowThreshold int     `yaml:"slow_threshold"`
+	SampleRate    float64 `yaml:"sample_rate"`
+	File          string  `yaml:"file"`
+}
+
+func (c *RequestLogConfig) clean(a *AppConfig) error {
+	if c.SlowThreshold < 0 || c.SampleRate < 0 || c.SampleRate > 1 {
+		return ErrInvalidRequestLog
+	}
+	if c.SlowThreshold == 0 && c.SampleRate == 0 {
+		return ErrRequestLogEmpty
+	}
+	if c.File == "" {
+		c.File = path.Join(a.Logger.LogDir, fmt.Sprintf("app_%s.requests", a.Name))
+	}
+	return os.MkdirAll(path.Dir(c.File), a.Logger.DirPerm)
+}
+
+// CacheConfig caches responses to GET requests of paths in memory, for ttl seconds
+// unless Cache-Control of the response sets max-age. Sizes are in megabytes for the
+// whole cache and kilobytes for an entry, expired entries answer upstream errors
+// for stale_if_error seconds.
+type CacheConfig struct {
+	Paths        []string `yaml:"paths"`
+	Ttl          int      `yaml:"ttl"`
+	MaxSize      int      `yaml:"max_size"`
+	MaxEntrySize int      `yaml:"max_entry_size"`
+	StaleIfError int      `yaml:"stale_if_error"`
+
+	PathRegexps []*regexp.Regexp `yaml:"-"`
+}
+
+func (c *CacheConfig) clean(g *Config) error {
+	if len(c.Paths) == 0 {
+		return ErrCachePathsRequired
+	}
+	if c.Ttl < 0 || c.MaxSize < 0 || c.MaxEntrySize < 0 || c.StaleIfError < 0 {
+		return ErrInvalidCacheLimit
+	}
+	if c.Ttl == 0 {
+		c.Ttl = defaultCacheTtl
+	}
+	if c.MaxSize == 0 {
+		c.MaxSize = defaultCacheMaxSize
+	}
+	if c.MaxEntrySize == 0 {
+		c.MaxEntrySize = defaultCacheMaxEntrySize
+	}
+	if c.StaleIfError == 0 {
+		c.StaleIfError = defaultCacheStaleIfError
+	}
+
+	c.PathRegexps = nil
+	for _, pattern := range c.Paths {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return &FieldError{"paths", err}
+		}
+		c.PathRegexps = append(c.PathRegexps, re)
+	}
+	return nil
+}
+
+// CorsConfig is cors policy enforced by the proxy, origins are exact like
+// https://example.com, * or *.example.com for subdomains
+type CorsConfig struct {
+	Origins       []string `yaml:"origins"`
+	Methods       []string `yaml:"methods"`
+	Headers       []string `yaml:"headers"`
+	ExposeHeaders []string `yaml:"expose_headers"`
+	Credentials   bool     `yaml:"credentials"`
+	MaxAge        int      `yaml:"max_age"`
+}
+
+func (c *CorsConfig) clean(g *Config) error {
+	if len(c.Origins) == 0 {
+		return ErrCorsOriginsRequired
+	}
+	if c.Credentials && contains(c.Origins, "*") {
+		return ErrCorsCredentialsAny
+	}
+	if c.MaxAge < 0 {
+		return ErrInvalidCorsMaxAge
+	}
+	if len(c.Methods) == 0 {
+		c.Methods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	}
+	for i, method := range c.Methods {
+		c.Methods[i] = strings.ToUpper(method)
+	}
+	return nil
+}
+
+// SanitizeConfig limits requests before they are proxied
+type SanitizeConfig struct {
+	MaxHeaders    int  `yaml:"max_headers"`
+	MaxHeaderSize int  `yaml:"max_header_size"`
+	MaxUrlLength  int  `yaml:"max_url_length"`
+	NormalizePath bool `yaml:"normalize_path"`
+}
+
+func (c *SanitizeConfig) clean(g *Config) error {
+	if c.MaxHeaders < 0 || c.MaxHeaderSize < 0 || c.MaxUrlLength < 0 {
+		return ErrInvalidSanitizeLimit
+	}
+	if c.MaxHeaders == 0 {
+		c.MaxHeaders = defaultSanitizeMaxHeaders
+	}
+	if c.MaxHeaderSize == 0 {
+		c.MaxHeaderSize = defaultSanitizeMaxHeaderSize
+	}
+	if c.MaxUrlLength == 0 {
+		c.MaxUrlLength = defaultSanitizeMaxUrlLength
+	}
+	return nil
+}
+
+// ProxyErrorsConfig sets status codes returned when request can't be proxied to instance
+type ProxyErrorsConfig struct {
+	Dial    int `yaml:"dial"`
+	Timeout int `yaml:"timeout"`
+	Other   int `yaml:"other"`
+}
+
+func (c *ProxyErrorsConfig) clean(g *Config) error {
+	if c.Dial == 0 {
+		c.Dial = http.StatusBadGateway
+	}
+	if c.Timeout == 0 {
+		c.Timeout = http.StatusGatewayTimeout
+	}
+	if c.Other == 0 {
+		c.Other = http.StatusBadGateway
+	}
+	for _, status := range []int{c.Dial, c.Timeout, c.Other} {
+		if status < 400 || status > 599 {
+			return ErrInvalidErrorStatus
+		}
+	}
+	return nil
+}
+
+func (c *ProxyErrorsConfig) status(kind string) int {
+	switch kind {
+	case ProxyErrorDial:
+		return c.Dial
+	case ProxyErrorTimeout:
+		return c.Timeout
+	}
+	return c.Other
+}
+
+type VerifyConfig struct {
+	Command string `yaml:"command"`
+	Path    string `yaml:"path"`
+	Delay   int    `yaml:"delay"`
+	Timeout int    `yaml:"timeout"`
+}
+
+// TLSConfig is tls policy of app listeners, cipher suites are crypto/tls names
+// and apply to tls 1.2 and older
+type TLSConfig struct {
+	CertFile         string           `yaml:"cert_file"`
+	KeyFile          string           `yaml:"key_file"`
+	Certificates     []*TLSCertConfig `yaml:"certificates"`
+	ReloadInterval   int              `yaml:"reload_interval"`
+	MinVersion       string           `yaml:"min_version"`
+	CipherSuites     []string         `yaml:"cipher_suites"`
+	CurvePreferences []string         `yaml:"curve_preferences"`
+	ClientAuth       string           `yaml:"client_auth"`
+	ClientCaFile     string           `yaml:"client_ca_file"`
+	OcspStapling     bool             `yaml:"ocsp_stapling"`
+	ExpiryWarning    int              `yaml:"expiry_warning"`
+
+	Config *tls.Config `yaml:"-"`
+}
+
+// TLSCertConfig is a certificate served to clients asking for one of its names
+type TLSCertConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+func (c *TLSConfig) clean(g *Config) error {
+	if (c.CertFile == "") != (c.KeyFile == "") || len(c.certificates()) == 0 {
+		return ErrTLSCertRequired
+	}
+	for i, cert := range c.Certificates {
+		if cert.CertFile == "" || cert.KeyFile == "" {
+			return &FieldError{fmt.Sprintf("certificates[%d]", i), ErrTLSCertRequired}
+		}
+	}
+	if c.ReloadInterval < 0 {
+		return ErrInvalidTLSReload
+	}
+	if c.ReloadInterval == 0 {
+		c.ReloadInterval = defaultTLSReloadInterval
+	}
+	if c.ExpiryWarning < 0 {
+		return ErrInvalidExpiryWarning
+	}
+	if c.ExpiryWarning == 0 {
+		c.ExpiryWarning = defaultTLSExpiryWarning
+	}
+	if c.MinVersion == "" {
+		c.MinVersion = defaultTLSMinVersion
+	}
+	if _, ok := tlsVersions[c.MinVersion]; !ok {
+		return ErrInvalidTLSVersion
+	}
+	if c.ClientAuth == "" {
+		c.ClientAuth = defaultTLSClientAuth
+	}
+	if _, ok := tlsClientAuth[c.ClientAuth]; !ok {
+		return ErrInvalidClientAuth
+	}
+	if (c.ClientAuth == "verify_if_given" || c.ClientAuth == "require_and_verify") && c.ClientCaFile == "" {
+		return ErrClientCaRequired
+	}
+
+	config, err := c.build()
+	if err != nil {
+		return err
+	}
+	c.Config = config
+	return nil
+}
+
+func (c *VerifyConfig) clean(g *Config) error {
+	if c.Command == "" && c.Path == "" {
+		return ErrVerifyCheckRequired
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultVerifyTimeout
+	}
+	return nil
+}
+
+type LogTriggerConfig struct {
+	Pattern string `yaml:"pattern"`
+	Name    string `yaml:"name"`
+	Restart bool   `yaml:"restart"`
+
+	Regexp *regexp.Regexp `yaml:"-"`
+}
+
+func (c *LogTriggerConfig) clean(g *Config) error {
+	if c.Pattern == "" {
+		return ErrPatternRequired
+	}
+
+	re, err := regexp.Compile(c.Pattern)
+	if err != nil {
+		return &FieldError{"pattern", err}
+	}
+	c.Regexp = re
+
+	if c.Name == "" {
+		c.Name = c.Pattern
+	}
+
+	return nil
+}
+
+type EventsConfig struct {
+	Webhooks       []string          `yaml:"webhooks"`
+	WebhookTimeout int               `yaml:"webhook_timeout"`
+	Notifiers      []*NotifierConfig `yaml:"notifiers"`
+}
+
+func (c *EventsConfig) clean(g *Config) error {
+	if c.WebhookTimeout <= 0 {
+		c.WebhookTimeout = defaultWebhookTimeout
+	}
+
+	errs := ConfigErrors{}
+	for i, notifier := range c.Notifiers {
+		errs.add(fmt.Sprintf("notifiers[%d]", i), notifier.clean(c))
+	}
+	return errs.err()
+}
+
+// NotifierConfig delivers events of types in events and of apps in apps, all when
+// empty, with a notifier of registered type and a message rendered from template
+type NotifierConfig struct {
+	Type     string            `yaml:"type"`
+	Events   []string          `yaml:"events"`
+	Apps     []string          `yaml:"apps"`
+	Template string            `yaml:"template"`
+	Options  map[string]string `yaml:"options"`
+
+	MessageTemplate *template.Template `yaml:"-"`
+}
+
+func (c *NotifierConfig) clean(events *EventsConfig) error {
+	if _, err := newNotifier(c, time.Duration(events.WebhookTimeout)*time.Second); err != nil {
+		return err
+	}
+	tmpl, err := parseNotifierTemplate(c.Template)
+	if err != nil {
+		return &FieldError{"template", err}
+	}
+	c.MessageTemplate = tmpl
 	return nil
 }
 
-type AppConfig struct {
-	Name        string   `yaml:"name"`
-	Command     string   `yaml:"command"`
-	Environment []string `yaml:"environment"`
-	Directory   string   `yaml:"directory"`
-	HealthCheck string   `yaml:"healthcheck"`
+type DiscoveryConfig struct {
+	Type    string `yaml:"type"`
+	Address string `yaml:"address"`
+	Token   string `yaml:"token"`
+	Prefix  string `yaml:"prefix"`
+	Ttl     int    `yaml:"ttl"`
+}
 
-	StopSignal     os.Signal
-	StopSignalName string `yaml:"stop_signal"`
-	MaxRetries     int    `yaml:"max_retries"`
-	StartTimeout   int    `yaml:"start_timeout"`
-	StopTimeout    int    `yaml:"stop_timeout"`
+func (c *DiscoveryConfig) clean(g *Config) error {
+	switch c.Type {
+	case DiscoveryConsul:
+		if c.Address == "" {
+			c.Address = defaultConsulAddress
+		}
+	case DiscoveryEtcd:
+		if c.Address == "" {
+			c.Address = defaultEtcdAddress
+		}
+		if c.Prefix == "" {
+			c.Prefix = defaultDiscoveryPrefix
+		}
+	default:
+		return ErrInvalidDiscoveryType
+	}
+	c.Address = strings.TrimRight(c.Address, "/")
 
-	InternalHost string `yaml:"internal_host"`
-	ExternalHost string `yaml:"external_host"`
-	ExternalPort uint16 `yaml:"external_port"`
+	if c.Ttl <= 0 {
+		c.Ttl = defaultDiscoveryTtl
+	}
+	return nil
+}
 
-	Logger *LoggerConfig `yaml:"logger"`
-	User   *UserConfig   `yaml:"user"`
+type SourceConfig struct {
+	Type     string `yaml:"type"`
+	Url      string `yaml:"url"`
+	Key      string `yaml:"key"`
+	Address  string `yaml:"address"`
+	Token    string `yaml:"token"`
+	Interval int    `yaml:"interval"`
 }
 
-func (c *AppConfig) clean(g *Config) error {
-	if c.Name == "" {
-		return ErrNameRequired
+func (c *SourceConfig) clean(g *Config) error {
+	switch c.Type {
+	case SourceHttp:
+		if c.Url == "" {
+			return ErrSourceUrlRequired
+		}
+	case DiscoveryConsul, DiscoveryEtcd:
+		if c.Key == "" {
+			return ErrSourceKeyRequired
+		}
+		if c.Address == "" && c.Type == DiscoveryConsul {
+			c.Address = defaultConsulAddress
+		}
+		if c.Address == "" && c.Type == DiscoveryEtcd {
+			c.Address = defaultEtcdAddress
+		}
+	default:
+		return ErrInvalidSourceType
 	}
-	if c.Command == "" {
-		return ErrCommandRequired
+	c.Address = strings.TrimRight(c.Address, "/")
+	if c.Type == DiscoveryConsul {
+		c.Key = strings.TrimLeft(c.Key, "/")
 	}
 
-	if !c.hasPortBadge() {
-		return ErrPortBadgeRequired
+	if c.Interval <= 0 {
+		c.Interval = defaultSourceInterval
 	}
+	return nil
+}
 
-	if c.StopSignalName == "" {
-		c.StopSignalName = defaultStopSignal
+type SecretsConfig struct {
+	VaultAddress   string `yaml:"vault_address"`
+	VaultToken     string `yaml:"vault_token"`
+	VaultTokenFile string `yaml:"vault_token_file"`
+}
+
+func (c *SecretsConfig) clean(g *Config) error {
+	if c.VaultAddress == "" {
+		c.VaultAddress = os.Getenv("VAULT_ADDR")
 	}
-	signal, ok := Signals[c.StopSignalName]
-	if !ok {
-		return ErrInvalidStopSignal
+	if c.VaultToken == "" && c.VaultTokenFile == "" {
+		c.VaultToken = os.Getenv("VAULT_TOKEN")
 	}
-	c.StopSignal = signal
 
-	if c.MaxRetries == 0 {
-		c.MaxRetries = defaultMaxRetries
-	}
+	return nil
+}
 
-	if c.InternalHost == "" {
-		c.InternalHost = defaultHost
-	}
-	if c.ExternalHost == "" {
-		c.ExternalHost = defaultHost
-	}
+type RpcTokenConfig struct {
+	Token    string `yaml:"token"`
+	Name     string `yaml:"name"`
+	RoleName string `yaml:"role"`
 
-	if c.ExternalPort == 0 {
-		c.ExternalPort = defaultExternalPort
-	}
+	Role int `yaml:"-"`
+}
 
-	if c.Logger == nil {
-		c.Logger = &LoggerConfig{
-			LogDir:      g.Logger.LogDir,
-			MaxLogSize:  g.Logger.MaxLogSize,
-			MaxLogsKept: g.Logger.MaxLogsKept,
-			MaxLogAge:   g.Logger.MaxLogAge,
-		}
-	}
-	if err := c.Logger.appClean(g, c); err != nil {
-		return err
+func (c *RpcTokenConfig) clean(g *Config) error {
+	if c.Token == "" {
+		return ErrTokenRequired
 	}
 
-	if c.User == nil {
-		c.User = &UserConfig{}
-		if g.User != nil {
-			c.User.UserName = g.User.UserName
-		}
+	if c.RoleName == "" {
+		c.RoleName = defaultRole
 	}
-	if err := c.User.clean(g); err != nil {
-		return err
+	role, ok := Roles[c.RoleName]
+	if !ok {
+		return ErrInvalidRole
 	}
+	c.Role = role
 
 	return nil
 }
 
-func (c *AppConfig) hasPortBadge() bool {
-	if strings.Contains(c.Command, PortBadge) {
-		return true
+type RpcConfig struct {
+	Host   string            `yaml:"host"`
+	Port   uint16            `yaml:"port"`
+	Tokens []*RpcTokenConfig `yaml:"tokens"`
+}
+
+func (c *RpcConfig) clean(g *Config) error {
+	if c.Host == "" {
+		c.Host = defaultHost
+	}
+	var err error
+	if c.Host, err = cleanHost(c.Host); err != nil {
+		return &FieldError{"host", err}
 	}
 
-	for _, env := range c.Environment {
-		if strings.Contains(env, PortBadge) {
-			return true
+	if c.Port == 0 {
+		c.Port = defaultRpcPort
+	}
+
+	for _, token := range c.Tokens {
+		if err := token.clean(g); err != nil {
+			return &FieldError{"tokens", err}
 		}
 	}
 
-	return false
+	return nil
 }
 
-type RpcConfig struct {
+// DebugConfig enables pprof and expvar endpoints of gracevisord, they have no
+// authentication so they only listen on loopback
+type DebugConfig struct {
 	Host string `yaml:"host"`
 	Port uint16 `yaml:"port"`
 }
 
-func (c *RpcConfig) clean(g *Config) error {
+func (c *DebugConfig) clean(g *Config) error {
 	if c.Host == "" {
 		c.Host = defaultHost
 	}
+	var err error
+	if c.Host, err = cleanHost(c.Host); err != nil {
+		return &FieldError{"host", err}
+	}
+	if ip := net.ParseIP(c.Host); c.Host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return &FieldError{"host", ErrDebugHostLoopback}
+	}
 
 	if c.Port == 0 {
-		c.Port = defaultRpcPort
+		c.Port = defaultDebugPort
+	}
+	return nil
+}
+
+// StateExportConfig writes json snapshot of apps and instances to path and posts it
+// to urls every interval seconds
+type StateExportConfig struct {
+	Path     string   `yaml:"path"`
+	Urls     []string `yaml:"urls"`
+	Interval int      `yaml:"interval"`
+	Timeout  int      `yaml:"timeout"`
+}
+
+func (c *StateExportConfig) clean(g *Config) error {
+	if c.Path == "" && len(c.Urls) == 0 {
+		return ErrStateExportTarget
+	}
+	if c.Interval < 0 || c.Timeout < 0 {
+		return ErrInvalidStateExport
+	}
+	if c.Interval == 0 {
+		c.Interval = defaultStateExportInterval
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultStateExportTimeout
 	}
+	return nil
+}
+
+// WatchdogConfig sets thresholds of gracevisord own resource usage, zero memory is not checked
+type WatchdogConfig struct {
+	Interval      int  `yaml:"interval"`
+	MaxMemory     int  `yaml:"max_memory"`
+	MaxGoroutines int  `yaml:"max_goroutines"`
+	MaxOpenFiles  int  `yaml:"max_open_files"`
+	MaxLag        int  `yaml:"max_lag"`
+	Events        bool `yaml:"events"`
+}
 
+func (c *WatchdogConfig) clean(g *Config) error {
+	if c.Interval < 0 || c.MaxMemory < 0 || c.MaxGoroutines < 0 || c.MaxOpenFiles < 0 || c.MaxOpenFiles > 100 || c.MaxLag < 0 {
+		return ErrInvalidWatchdogLimit
+	}
+	if c.Interval == 0 {
+		c.Interval = defaultWatchdogInterval
+	}
+	if c.MaxGoroutines == 0 {
+		c.MaxGoroutines = defaultWatchdogMaxGoroutines
+	}
+	if c.MaxOpenFiles == 0 {
+		c.MaxOpenFiles = defaultWatchdogMaxOpenFiles
+	}
+	if c.MaxLag == 0 {
+		c.MaxLag = defaultWatchdogMaxLag
+	}
 	return nil
 }
 
@@ -204,10 +1632,45 @@ type LoggerConfig struct {
 	LogFile       string `yaml:"log_file"`
 	StdoutLogFile string `yaml:"stdout_log_file"`
 	StderrLogFile string `yaml:"stderr_log_file"`
+	AuditLogFile  string `yaml:"audit_log_file"`
+
+	MaxLogSize    int `yaml:"max_log_size"`
+	MaxLogsKept   int `yaml:"max_logs_kept"`
+	MaxLogAge     int `yaml:"max_log_age"`
+	MaxLogDirSize int `yaml:"max_log_dir_size"`
+
+	DirMode  string      `yaml:"dir_mode"`
+	FileMode string      `yaml:"file_mode"`
+	DirPerm  os.FileMode `yaml:"-"`
+	FilePerm os.FileMode `yaml:"-"`
+
+	// directory in log_dir owned by app user, for logs the app writes itself
+	ChildLogDir     bool   `yaml:"child_log_dir"`
+	ChildLogDirPath string `yaml:"-"`
+
+	// chown app log files to app user and group, gid is -1 for group of app user
+	Chown bool   `yaml:"chown"`
+	Group string `yaml:"group"`
+	Gid   int    `yaml:"-"`
+}
 
-	MaxLogSize  int `yaml:"max_log_size"`
-	MaxLogsKept int `yaml:"max_logs_kept"`
-	MaxLogAge   int `yaml:"max_log_age"`
+// cleanModes parses octal dir and file modes, unset modes are inherited from parent
+func (c *LoggerConfig) cleanModes(dirPerm os.FileMode, filePerm os.FileMode) error {
+	c.DirPerm, c.FilePerm = dirPerm, filePerm
+	for _, mode := range []struct {
+		value string
+		perm  *os.FileMode
+	}{{c.DirMode, &c.DirPerm}, {c.FileMode, &c.FilePerm}} {
+		if mode.value == "" {
+			continue
+		}
+		perm, err := strconv.ParseUint(mode.value, 8, 32)
+		if err != nil || perm > 0777 {
+			return ErrInvalidLogMode
+		}
+		*mode.perm = os.FileMode(perm)
+	}
+	return nil
 }
 
 func (c *LoggerConfig) globalClean(g *Config) error {
@@ -221,10 +1684,18 @@ func (c *LoggerConfig) globalClean(g *Config) error {
 	if c.MaxLogSize <= 0 {
 		c.MaxLogSize = defaultMaxLogSize
 	}
+	if err := c.cleanModes(defaultLogDirMode, defaultLogFileMode); err != nil {
+		return err
+	}
 
-	if err := os.MkdirAll(path.Dir(c.LogFile), defaultLogFileMode); err != nil {
+	if err := os.MkdirAll(path.Dir(c.LogFile), c.DirPerm); err != nil {
 		return err
 	}
+	if c.AuditLogFile != "" {
+		if err := os.MkdirAll(path.Dir(c.AuditLogFile), c.DirPerm); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -258,24 +1729,67 @@ func (c *LoggerConfig) appClean(g *Config, a *AppConfig) error {
 	if c.MaxLogAge == 0 {
 		c.MaxLogAge = g.Logger.MaxLogAge
 	}
+	if c.MaxLogDirSize == 0 {
+		c.MaxLogDirSize = g.Logger.MaxLogDirSize
+	}
+	if err := c.cleanModes(g.Logger.DirPerm, g.Logger.FilePerm); err != nil {
+		return err
+	}
 
-	if err := os.MkdirAll(path.Dir(c.StdoutLogFile), defaultLogFileMode); err != nil {
+	if err := os.MkdirAll(path.Dir(c.StdoutLogFile), c.DirPerm); err != nil {
 		return err
 	}
-	if err := os.MkdirAll(path.Dir(c.StderrLogFile), defaultLogFileMode); err != nil {
+	if err := os.MkdirAll(path.Dir(c.StderrLogFile), c.DirPerm); err != nil {
 		return err
 	}
+	c.ChildLogDirPath = ""
+	if c.ChildLogDir {
+		c.ChildLogDirPath = path.Join(c.LogDir, a.Name)
+	}
+
+	c.Gid = -1
+	if c.Group != "" {
+		group, err := user.LookupGroup(c.Group)
+		if err != nil {
+			return err
+		}
+		gid, err := strconv.ParseUint(group.Gid, 10, 32)
+		if err != nil {
+			return ErrInvalidLogGroupId
+		}
+		c.Gid = int(gid)
+	}
 
 	return nil
 }
 
 type Config struct {
-	PortRange *InternalPortsConfig `yaml:"port_range"`
-	Apps      []*AppConfig         `yaml:"apps"`
-	Rpc       *RpcConfig           `yaml:"rpc"`
-	Logger    *LoggerConfig        `yaml:"logger"`
-	User      *UserConfig          `yaml:"user"`
-	Include   []string             `yaml:"apps_include"`
+	PortRange  *InternalPortsConfig `yaml:"port_range"`
+	Apps       []*AppConfig         `yaml:"apps"`
+	Rpc        *RpcConfig           `yaml:"rpc"`
+	Logger     *LoggerConfig        `yaml:"logger"`
+	User       *UserConfig          `yaml:"user"`
+	DaemonUser *UserConfig          `yaml:"daemon_user"`
+	Events     *EventsConfig        `yaml:"events"`
+	Secrets    *SecretsConfig       `yaml:"secrets"`
+	Discovery  *DiscoveryConfig     `yaml:"discovery"`
+	Source     *SourceConfig        `yaml:"config_source"`
+	Debug      *DebugConfig         `yaml:"debug"`
+	Watchdog   *WatchdogConfig      `yaml:"watchdog"`
+	Export     *StateExportConfig   `yaml:"state_export"`
+	Include    []string             `yaml:"apps_include"`
+	Groups     map[string][]string  `yaml:"groups"`
+
+	StateDir   string `yaml:"state_dir"`
+	MaxHistory int    `yaml:"max_history"`
+	MaxDeploys int    `yaml:"max_deploys"`
+
+	TrustedProxies []string     `yaml:"trusted_proxies"`
+	TrustedNets    []*net.IPNet `yaml:"-"`
+
+	// file or source config was loaded from, source is watched for changes
+	file   string
+	source *ConfigSource
 }
 
 func (c *Config) clean(g *Config) error {
@@ -288,65 +1802,309 @@ func (c *Config) clean(g *Config) error {
 	if c.Logger == nil {
 		c.Logger = &LoggerConfig{}
 	}
-
-	if err := c.PortRange.clean(c); err != nil {
-		return err
+	if c.Events == nil {
+		c.Events = &EventsConfig{}
 	}
-	if err := c.Rpc.clean(c); err != nil {
-		return err
+	if c.Secrets == nil {
+		c.Secrets = &SecretsConfig{}
 	}
-	if err := c.Logger.globalClean(c); err != nil {
-		return err
+	if c.Watchdog == nil {
+		c.Watchdog = &WatchdogConfig{}
+	}
+	if c.StateDir == "" {
+		c.StateDir = defaultStateDir
+	}
+	errs := ConfigErrors{}
+	if c.MaxHistory <= 0 {
+		c.MaxHistory = defaultMaxHistory
+	}
+	if c.MaxDeploys <= 0 {
+		c.MaxDeploys = defaultMaxDeploys
+	}
+
+	errs.add("port_range", c.PortRange.clean(c))
+	errs.add("rpc", c.Rpc.clean(c))
+	errs.add("logger", c.Logger.globalClean(c))
+	errs.add("events", c.Events.clean(c))
+	errs.add("secrets", c.Secrets.clean(c))
+	if c.Discovery != nil {
+		errs.add("discovery", c.Discovery.clean(c))
 	}
 	if c.User != nil {
-		if err := c.User.clean(c); err != nil {
-			return err
+		errs.add("user", c.User.clean(c))
+	}
+	if c.DaemonUser != nil {
+		errs.add("daemon_user", c.DaemonUser.clean(c))
+	}
+	if c.Debug != nil {
+		errs.add("debug", c.Debug.clean(c))
+	}
+	errs.add("watchdog", c.Watchdog.clean(c))
+	if c.Export != nil {
+		errs.add("state_export", c.Export.clean(c))
+	}
+	nets, err := parseNets(c.TrustedProxies, ErrInvalidTrustedProxy)
+	c.TrustedNets = nets
+	errs.add("trusted_proxies", err)
+	for i, err := range errs {
+		errs[i] = &ConfigError{File: c.file, Err: err}
+	}
+
+	for _, app := range c.Apps {
+		err := app.clean(c)
+		if appErrs, ok := err.(ConfigErrors); ok {
+			for _, err := range appErrs {
+				errs = append(errs, appError(app, err))
+			}
+		} else if err != nil {
+			errs = append(errs, appError(app, err))
+		}
+	}
+	for _, err := range c.duplicateErrors() {
+		errs = append(errs, err)
+	}
+	for _, err := range c.groupErrors() {
+		errs = append(errs, &ConfigError{File: c.file, Err: &FieldError{"groups", err}})
+	}
+	for _, err := range c.routeErrors() {
+		errs = append(errs, err)
+	}
+	for _, err := range c.internalPortErrors() {
+		errs = append(errs, err)
+	}
+	for _, err := range c.restartWithErrors() {
+		errs = append(errs, err)
+	}
+	return errs.err()
+}
+
+// parseNets parses ip addresses and cidrs, a bare address matches only itself
+func parseNets(list []string, invalid error) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, item := range list {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, invalid
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, invalid
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// internalPortErrors checks that fixed internal ports are not shared with other apps
+func (c *Config) internalPortErrors() []*ConfigError {
+	errs := []*ConfigError{}
+	owners := map[uint16]*AppConfig{}
+	for _, app := range c.Apps {
+		owners[app.ExternalPort] = app
+		owners[app.PreviewPort] = app
+	}
+	delete(owners, 0)
+
+	for _, app := range c.Apps {
+		for _, port := range app.InternalPorts {
+			if owner, ok := owners[port]; ok && owner != app {
+				err := fmt.Errorf("Internal port %d is already used by app %s", port, owner.Name)
+				errs = append(errs, appError(app, &FieldError{"internal_ports", err}))
+			}
+			owners[port] = app
+		}
+	}
+	return errs
+}
+
+// restartWithErrors checks that restart_with names other known apps and has no cycles
+func (c *Config) restartWithErrors() []*ConfigError {
+	errs := []*ConfigError{}
+	apps := make(map[string]*AppConfig)
+	for _, app := range c.Apps {
+		apps[app.Name] = app
+	}
+
+	for _, app := range c.Apps {
+		for _, with := range app.RestartWith {
+			var err error
+			switch target, ok := apps[with]; {
+			case !ok:
+				err = fmt.Errorf("Restart with unknown app %s", with)
+			case target == app:
+				err = fmt.Errorf("App can't restart with itself")
+			case target.Type == AppTypeBackend || app.Type == AppTypeBackend:
+				err = fmt.Errorf("Backend apps can't be restarted")
+			}
+			if err != nil {
+				errs = append(errs, appError(app, &FieldError{"restart_with", err}))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	// an app restarting with itself through other apps would restart forever
+	for _, app := range c.Apps {
+		path := []string{app.Name}
+		seen := map[string]bool{}
+		var visit func(name string) bool
+		visit = func(name string) bool {
+			for _, with := range apps[name].RestartWith {
+				if with == app.Name {
+					path = append(path, with)
+					return true
+				}
+				if seen[with] {
+					continue
+				}
+				seen[with] = true
+				path = append(path, with)
+				if visit(with) {
+					return true
+				}
+				path = path[:len(path)-1]
+			}
+			return false
+		}
+		if visit(app.Name) {
+			err := fmt.Errorf("Restart cascade cycle %s", strings.Join(path, " -> "))
+			errs = append(errs, appError(app, &FieldError{"restart_with", err}))
+		}
+	}
+	return errs
+}
+
+// routeErrors checks that rules route to other apps with http proxy
+func (c *Config) routeErrors() []*ConfigError {
+	errs := []*ConfigError{}
+	apps := make(map[string]*AppConfig)
+	for _, app := range c.Apps {
+		apps[app.Name] = app
+	}
+
+	for _, app := range c.Apps {
+		for i, rule := range app.Rules {
+			if rule.Route == "" {
+				continue
+			}
+			target, ok := apps[rule.Route]
+			var err error
+			switch {
+			case !ok:
+				err = fmt.Errorf("Rule routes to unknown app %s", rule.Route)
+			case target == app:
+				err = fmt.Errorf("Rule routes to its own app")
+			case target.Proxy == ProxyNone:
+				err = fmt.Errorf("Rule routes to app %s without http proxy", rule.Route)
+			}
+			if err != nil {
+				errs = append(errs, appError(app, &FieldError{fmt.Sprintf("rules[%d]", i), err}))
+			}
+		}
+	}
+	return errs
+}
+
+// groupErrors checks that groups contain only known apps and don't shadow app names
+func (c *Config) groupErrors() []error {
+	errs := []error{}
+	names := make(map[string]bool)
+	for _, app := range c.Apps {
+		names[app.Name] = true
+	}
+
+	groups := make([]string, 0, len(c.Groups))
+	for group := range c.Groups {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	for _, group := range groups {
+		if names[group] {
+			errs = append(errs, fmt.Errorf("Group %s has the same name as an app", group))
+		}
+		for _, name := range c.Groups[group] {
+			if !names[name] {
+				errs = append(errs, fmt.Errorf("Group %s contains unknown app %s", group, name))
+			}
 		}
 	}
+	return errs
+}
 
-	usedPorts := make(map[uint16]bool)
+// duplicateErrors checks that apps don't share names and external or preview ports
+func (c *Config) duplicateErrors() []*ConfigError {
+	errs := []*ConfigError{}
+	usedAddrs := []hostPortOwner{}
 	usedNames := make(map[string]bool)
 	for _, app := range c.Apps {
-		if err := app.clean(c); err != nil {
-			return fmt.Errorf("%s: %s", app.Name, err)
+		if app.Proxy != ProxyNone {
+			if owner := addrOwner(usedAddrs, app.ExternalHost, app.ExternalPort); owner != nil {
+				errs = append(errs, appError(app, fmt.Errorf("Cannot use duplicate external address %s, used by app %s", hostPort(app.ExternalHost, app.ExternalPort), owner.Name)))
+			}
+			usedAddrs = append(usedAddrs, hostPortOwner{app.ExternalHost, app.ExternalPort, app})
 		}
 
-		_, used := usedPorts[app.ExternalPort]
-		if used {
-			return fmt.Errorf("%s: Cannot use duplicate external port %d", app.Name, app.ExternalPort)
+		if app.PreviewPort != 0 {
+			if owner := addrOwner(usedAddrs, app.ExternalHost, app.PreviewPort); owner != nil {
+				errs = append(errs, appError(app, fmt.Errorf("Cannot use duplicate preview address %s, used by app %s", hostPort(app.ExternalHost, app.PreviewPort), owner.Name)))
+			}
+			usedAddrs = append(usedAddrs, hostPortOwner{app.ExternalHost, app.PreviewPort, app})
 		}
-		usedPorts[app.ExternalPort] = true
 
-		_, used = usedNames[app.Name]
+		_, used := usedNames[app.Name]
 		if used {
-			return fmt.Errorf("%s: Cannot use duplicate app name %s", app.Name, app.Name)
+			errs = append(errs, appError(app, fmt.Errorf("Cannot use duplicate app name %s", app.Name)))
 		}
 		usedNames[app.Name] = true
 	}
+	return errs
+}
+
+// hostPortOwner is an external address bound by app
+type hostPortOwner struct {
+	host string
+	port uint16
+	app  *AppConfig
+}
+
+// addrOwner returns app already bound to host and port, wildcard hosts conflict with every host
+func addrOwner(used []hostPortOwner, host string, port uint16) *AppConfig {
+	for _, addr := range used {
+		if addr.port != port {
+			continue
+		}
+		if addr.host == host || wildcardHost(addr.host) || wildcardHost(host) {
+			return addr.app
+		}
+	}
 	return nil
 }
 
+// wildcardHost checks if host listens on all addresses
+func wildcardHost(host string) bool {
+	ip := net.ParseIP(host)
+	return host == "" || (ip != nil && ip.IsUnspecified())
+}
+
 func (c *Config) include(inc string) error {
-	fi, err := os.Stat(inc)
+	files, err := includePaths(inc)
 	if err != nil {
 		return err
 	}
 
-	if fi.IsDir() {
-		files, err := ioutil.ReadDir(inc)
-		if err != nil {
-			return fmt.Errorf("apps_include: %s", err)
-		}
-
-		for _, file := range files {
-			if !file.IsDir() {
-				if err := c.includeFile(path.Join(inc, file.Name())); err != nil {
-					return err
-				}
-			}
-		}
-	} else {
-		if err := c.includeFile(inc); err != nil {
+	for _, fn := range files {
+		if err := c.includeFile(fn); err != nil {
 			return err
 		}
 	}
@@ -354,12 +2112,36 @@ func (c *Config) include(inc string) error {
 	return nil
 }
 
+// includePaths returns files of apps_include entry, a folder or a file
+func includePaths(inc string) ([]string, error) {
+	fi, err := os.Stat(inc)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{inc}, nil
+	}
+
+	files, err := ioutil.ReadDir(inc)
+	if err != nil {
+		return nil, fmt.Errorf("apps_include: %s", err)
+	}
+
+	paths := []string{}
+	for _, file := range files {
+		if !file.IsDir() {
+			paths = append(paths, path.Join(inc, file.Name()))
+		}
+	}
+	return paths, nil
+}
+
 func (c *Config) includeFile(fn string) error {
-	if path.Base(fn) == configFile {
+	if isMainConfigFile(fn) || path.Clean(fn) == path.Clean(c.file) {
 		return nil
 	}
 
-	if !strings.HasSuffix(fn, ".yaml") {
+	if !isConfigFile(fn) {
 		return nil
 	}
 
@@ -369,36 +2151,93 @@ func (c *Config) includeFile(fn string) error {
 	}
 
 	app := &AppConfig{}
-	if err := yaml.Unmarshal(data, app); err != nil {
+	if err := parseConfigData(fn, data, app); err != nil {
 		return fmt.Errorf("%s: %s", fn, err)
 	}
 
+	app.source = fn
 	c.Apps = append(c.Apps, app)
 
 	return nil
 }
 
+// configFileName returns config file of configPath, which is either
+// a config file or a config dir with gracevisor.yaml, .toml or .json
+func configFileName(configPath string) string {
+	if fi, err := os.Stat(configPath); err == nil && fi.IsDir() {
+		return dirConfigFile(configPath)
+	}
+	if strings.HasSuffix(configPath, "/") {
+		return dirConfigFile(configPath)
+	}
+	return configPath
+}
+
+// ParseConfing reads config file or gracevisor config from config dir, if it has
+// config_source the rest of config is loaded from the source instead
 func ParseConfing(configPath string) (*Config, error) {
-	fn := path.Join(configPath, configFile)
+	fn := configFileName(configPath)
 	data, err := ioutil.ReadFile(fn)
 	if err != nil {
 		return nil, err
 	}
 
 	config := &Config{}
-	if err := yaml.Unmarshal(data, config); err != nil {
+	if err := parseConfigData(fn, data, config); err != nil {
 		return nil, fmt.Errorf("%s: %s", fn, err)
 	}
+	config.file = fn
+	for _, app := range config.Apps {
+		app.source = fn
+	}
+
+	if config.Source != nil {
+		if err := config.Source.clean(config); err != nil {
+			return nil, fmt.Errorf("config_source: %s", err)
+		}
+		source := NewConfigSource(config.Source, config.StateDir)
+		data, err := source.Load()
+		if err != nil {
+			return nil, err
+		}
+		config, err := parseSourceConfig(source, data)
+		if err != nil {
+			return nil, err
+		}
+		source.Save(data)
+		return config, nil
+	}
+
+	return config.load()
+}
+
+// parseSourceConfig parses config loaded from config source
+func parseSourceConfig(source *ConfigSource, data []byte) (*Config, error) {
+	config := &Config{}
+	if err := parseConfigData(source.String(), data, config); err != nil {
+		return nil, fmt.Errorf("%s: %s", source, err)
+	}
+	config.Source = source.config
+	config.source = source
+	config.file = source.String()
+	for _, app := range config.Apps {
+		app.source = source.String()
+	}
+
+	return config.load()
+}
 
-	for _, inc := range config.Include {
-		if err := config.include(inc); err != nil {
+// load includes app files and cleans config
+func (c *Config) load() (*Config, error) {
+	for _, inc := range c.Include {
+		if err := c.include(inc); err != nil {
 			return nil, err
 		}
 	}
 
-	if err := config.clean(config); err != nil {
+	if err := c.clean(c); err != nil {
 		return nil, err
 	}
 
-	return config, err
+	return c, nil
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func TestAppLinuxClean(t *testing.T) {
+	config := &Config{
+		Logger: &LoggerConfig{
+			LogDir:      "/tmp/log-test/",
+			MaxLogSize:  100,
+			MaxLogsKept: -1,
+			MaxLogAge:   -1,
+		},
+		User: &UserConfig{
+			UserName: "root",
+		},
+	}
+	appConfig := &AppConfig{
+		Name:    "demo",
+		Command: "../demoapp/demoapp --port={port}",
+	}
+
+	appConfig.Namespaces = []string{"mount", "pid"}
+	if err := appConfig.clean(config); err != nil {
+		t.Error("AppConfig.clean fails with valid namespaces:", err)
+	}
+	if appConfig.Cloneflags != syscall.CLONE_NEWNS|syscall.CLONE_NEWPID {
+		t.Error("Incorrect namespaces to clone flags conversion")
+	}
+	appConfig.Namespaces = []string{"network"}
+	if !errors.Is(appConfig.clean(config), ErrInvalidNamespace) {
+		t.Error("AppConfig.clean should fail with invalid namespace")
+	}
+	appConfig.Namespaces = nil
+
+	appConfig.DropCapabilities = []string{"cap_net_raw", "ALL"}
+	if err := appConfig.clean(config); err != nil {
+		t.Error("AppConfig.clean fails with valid capabilities:", err)
+	}
+	if appConfig.DropCapabilities[0] != "NET_RAW" {
+		t.Error("Incorrect capability name normalization:", appConfig.DropCapabilities[0])
+	}
+	appConfig.DropCapabilities = []string{"FLY"}
+	if !errors.Is(appConfig.clean(config), ErrInvalidCapability) {
+		t.Error("AppConfig.clean should fail with invalid capability")
+	}
+}
+
+func TestIoniceClean(t *testing.T) {
+	ioniceConfig := &IoniceConfig{}
+	if err := ioniceConfig.clean(nil); err != nil {
+		t.Error("IoniceConfig.clean fails for empty setting:", err)
+	}
+	if ioniceConfig.Class != IoniceClasses[defaultIoniceClass] {
+		t.Error("Incorrect default ionice class set:", ioniceConfig.Class)
+	}
+
+	ioniceConfig.ClassName = "sometimes"
+	if ioniceConfig.clean(nil) != ErrInvalidIoniceClass {
+		t.Error("IoniceConfig.clean should fail with invalid class")
+	}
+
+	ioniceConfig.ClassName = "idle"
+	ioniceConfig.Level = 8
+	if ioniceConfig.clean(nil) != ErrInvalidIoniceLevel {
+		t.Error("IoniceConfig.clean should fail with invalid level")
+	}
+}
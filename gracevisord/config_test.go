@@ -1,12 +1,32 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/user"
 	"path"
 	"strconv"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
+
+	"github.com/hamaxx/gracevisor/deps/yaml.v2"
 )
 
 func TestUserClean(t *testing.T) {
@@ -23,6 +43,10 @@ func TestUserClean(t *testing.T) {
 	if userConfig.Uid != uint32(currentUserId) {
 		t.Error("Incorrect user id")
 	}
+	currentGroupId, _ := strconv.Atoi(currentUser.Gid)
+	if userConfig.Gid != uint32(currentGroupId) {
+		t.Error("Incorrect group id")
+	}
 
 	userConfig.UserName = ""
 	if err := userConfig.clean(nil); err != nil {
@@ -62,6 +86,20 @@ func TestInternalPortsClean(t *testing.T) {
 	if err := internalPortsConfig.clean(nil); err != nil {
 		t.Error("Valid port range fails clean:", err)
 	}
+	if internalPortsConfig.OnExhausted != PortsExhaustedFail || internalPortsConfig.ReclaimAfter != defaultReclaimAfter {
+		t.Error("Incorrect default exhaustion values set")
+	}
+
+	internalPortsConfig.OnExhausted = "block"
+	if internalPortsConfig.clean(nil) != ErrInvalidOnExhausted {
+		t.Error("Invalid on_exhausted does not fail clean")
+	}
+
+	internalPortsConfig.OnExhausted = PortsExhaustedWait
+	internalPortsConfig.ReclaimAfter = -1
+	if internalPortsConfig.clean(nil) != ErrInvalidReclaimAfter {
+		t.Error("Negative reclaim_after does not fail clean")
+	}
 }
 
 func loggersEqual(l1 *LoggerConfig, l2 *LoggerConfig) bool {
@@ -123,20 +161,35 @@ func TestAppClean(t *testing.T) {
 	}
 
 	appConfig.Name = ""
-	if appConfig.clean(config) != ErrNameRequired {
+	if !errors.Is(appConfig.clean(config), ErrNameRequired) {
 		t.Error("AppConfig.clean should fail when no name")
 	}
+	for _, name := range []string{"../etc", "a/b", ".."} {
+		appConfig.Name = name
+		if !errors.Is(appConfig.clean(config), ErrInvalidName) {
+			t.Error("AppConfig.clean should fail with name", name)
+		}
+	}
 	appConfig.Name = "demo"
 
 	appConfig.Command = ""
-	if appConfig.clean(config) != ErrCommandRequired {
+	if !errors.Is(appConfig.clean(config), ErrCommandRequired) {
 		t.Error("AppConfig.clean should fail when no command")
 	}
 
 	appConfig.Command = "../demoapp/demoapp"
-	if appConfig.clean(config) != ErrPortBadgeRequired {
+	if !errors.Is(appConfig.clean(config), ErrPortBadgeRequired) {
 		t.Error("AppConfig.clean should fail when no {port} badge")
 	}
+	appConfig.Proxy = ProxyNone
+	if err := appConfig.clean(config); err != nil {
+		t.Error("AppConfig.clean should not require {port} badge without proxy:", err)
+	}
+	appConfig.Proxy = "tcp"
+	if !errors.Is(appConfig.clean(config), ErrInvalidProxy) {
+		t.Error("AppConfig.clean should fail with invalid proxy")
+	}
+	appConfig.Proxy = ""
 	appConfig.Command = "../demoapp/demoapp --port={port}"
 
 	appConfig.StopSignalName = "INT"
@@ -148,9 +201,752 @@ func TestAppClean(t *testing.T) {
 	}
 
 	appConfig.StopSignalName = "ThisIsNotASignalName"
-	if appConfig.clean(config) != ErrInvalidStopSignal {
+	if !errors.Is(appConfig.clean(config), ErrInvalidStopSignal) {
 		t.Error("AppConfig.clean should fail with invalid signal name")
 	}
+	appConfig.StopSignalName = ""
+
+	appConfig.StopSignalSteps = []string{"QUIT/10", "TERM/5", "KILL"}
+	if err := appConfig.clean(config); err != nil {
+		t.Error("AppConfig.clean fails with stop signal steps:", err)
+	}
+	if len(appConfig.StopSteps) != 3 || appConfig.StopSignal != syscall.SIGQUIT ||
+		appConfig.StopSteps[1].Timeout != 5 || appConfig.StopSteps[2].Signal != syscall.SIGKILL {
+		t.Error("Incorrect stop signal steps:", appConfig.StopSteps)
+	}
+	appConfig.StopSignalSteps = []string{"QUIT", "KILL"}
+	if !errors.Is(appConfig.clean(config), ErrStopStepTimeout) {
+		t.Error("AppConfig.clean should fail when stop step before last has no timeout")
+	}
+	appConfig.StopSignalSteps = nil
+
+	if len(appConfig.HealthCheckStatus) != 1 || appConfig.HealthCheckStatus[0] != defaultHealthCheckStatus {
+		t.Error("Incorrect default healthcheck status set:", appConfig.HealthCheckStatus)
+	}
+	if appConfig.HealthCheckInterval != defaultHealthCheckInterval {
+		t.Error("Incorrect default healthcheck interval set:", appConfig.HealthCheckInterval)
+	}
+	if appConfig.HealthCheckFailures != defaultHealthCheckFailures {
+		t.Error("Incorrect default healthcheck failures set:", appConfig.HealthCheckFailures)
+	}
+	appConfig.HealthCheckStatus = []int{200, 999}
+	if !errors.Is(appConfig.clean(config), ErrInvalidHealthStatus) {
+		t.Error("AppConfig.clean should fail with invalid healthcheck status")
+	}
+	appConfig.HealthCheckStatus = nil
+
+	appConfig.HealthCheckBody = `"status":\s*"ok"`
+	if err := appConfig.clean(config); err != nil {
+		t.Error("AppConfig.clean fails with valid healthcheck body:", err)
+	}
+	if !appConfig.HealthCheckBodyRegexp.MatchString(`{"status": "ok"}`) {
+		t.Error("Healthcheck body regexp does not match")
+	}
+	appConfig.HealthCheckBody = "("
+	if appConfig.clean(config) == nil {
+		t.Error("AppConfig.clean should fail with invalid healthcheck body")
+	}
+	appConfig.HealthCheckBody = ""
+
+	appConfig.InternalPorts = []uint16{9100, 9101}
+	if err := appConfig.clean(config); err != nil {
+		t.Error("AppConfig.clean fails with valid internal ports:", err)
+	}
+	appConfig.InternalPorts = []uint16{9100, 9100}
+	if !errors.Is(appConfig.clean(config), ErrInvalidInternalPort) {
+		t.Error("AppConfig.clean should fail with duplicate internal port")
+	}
+	appConfig.InternalPorts = []uint16{appConfig.ExternalPort}
+	if !errors.Is(appConfig.clean(config), ErrInvalidInternalPort) {
+		t.Error("AppConfig.clean should fail with internal port equal to external port")
+	}
+	appConfig.InternalPorts = []uint16{9100, 9101}
+	appConfig.StablePorts = true
+	if !errors.Is(appConfig.clean(config), ErrInternalPortsStable) {
+		t.Error("AppConfig.clean should fail with both internal and stable ports")
+	}
+	appConfig.InternalPorts = nil
+	appConfig.StablePorts = false
+
+	appConfig.QuarantineCooldown = -1
+	if !errors.Is(appConfig.clean(config), ErrInvalidQuarantine) {
+		t.Error("AppConfig.clean should fail with negative quarantine cooldown")
+	}
+	appConfig.QuarantineCooldown = 0
+
+	appConfig.DeployWindows = []string{"mon-fri 9:00-17:00", "fri-mon 22:00-06:00", "12:00-13:00"}
+	if err := appConfig.clean(config); err != nil || len(appConfig.DeployWindowRanges) != 3 {
+		t.Error("AppConfig.clean fails with valid deploy windows:", err)
+	}
+	for _, window := range []string{"weekdays 09:00-17:00", "mon 9-17", "mon 09:00-09:00", "mon 09:60-10:00"} {
+		appConfig.DeployWindows = []string{window}
+		if !errors.Is(appConfig.clean(config), ErrInvalidDeployWindow) {
+			t.Error("AppConfig.clean should fail with invalid deploy window", window)
+		}
+	}
+	appConfig.DeployWindows = nil
+
+	appConfig.Rules = []*RuleConfig{&RuleConfig{Headers: map[string]string{"X-Beta": "^1$"}, RouteHeld: true}}
+	if !errors.Is(appConfig.clean(config), ErrRouteHeldPreview) {
+		t.Error("AppConfig.clean should fail with route held rule without preview port")
+	}
+	appConfig.Rules = nil
+
+	if appConfig.ProxyBufferSize != defaultProxyBufferSize {
+		t.Error("Incorrect default proxy buffer size set:", appConfig.ProxyBufferSize)
+	}
+	appConfig.ProxyBufferSize = 2048
+	if !errors.Is(appConfig.clean(config), ErrInvalidProxyBuffer) {
+		t.Error("AppConfig.clean should fail with proxy buffer over 1024 kilobytes")
+	}
+	appConfig.ProxyBufferSize = 0
+	appConfig.ProxyFlushInterval = -2
+	if !errors.Is(appConfig.clean(config), ErrInvalidFlushInterval) {
+		t.Error("AppConfig.clean should fail with proxy flush interval under -1")
+	}
+	appConfig.ProxyFlushInterval = 0
+
+	appConfig.MaxConnections = -1
+	if !errors.Is(appConfig.clean(config), ErrInvalidMaxConnections) {
+		t.Error("AppConfig.clean should fail with negative max connections")
+	}
+	appConfig.MaxConnections = 0
+
+	appConfig.Shadow = &ShadowConfig{Percent: 50}
+	if !errors.Is(appConfig.clean(config), ErrShadowPreview) {
+		t.Error("AppConfig.clean should fail with shadow without preview port")
+	}
+	appConfig.Shadow = nil
+
+	appConfig.RequestLog = &RequestLogConfig{}
+	if !errors.Is(appConfig.clean(config), ErrRequestLogEmpty) {
+		t.Error("AppConfig.clean should fail with empty request log")
+	}
+	appConfig.RequestLog.SampleRate = 1.5
+	if !errors.Is(appConfig.clean(config), ErrInvalidRequestLog) {
+		t.Error("AppConfig.clean should fail with sample rate over 1")
+	}
+	appConfig.RequestLog = &RequestLogConfig{SlowThreshold: 500, SampleRate: 0.01}
+	if err := appConfig.clean(config); err != nil || appConfig.RequestLog.File != path.Join(appConfig.Logger.LogDir, "app_"+appConfig.Name+".requests") {
+		t.Error("AppConfig.clean fails with valid request log:", err, appConfig.RequestLog.File)
+	}
+	appConfig.RequestLog = nil
+
+	config.DaemonUser = &UserConfig{UserName: "nobody", Uid: 65534}
+	if !errors.Is(appConfig.clean(config), ErrUserDaemonUser) {
+		t.Error("AppConfig.clean should fail with user different from daemon user")
+	}
+	config.DaemonUser = nil
+
+	appConfig.Type = "vm"
+	if !errors.Is(appConfig.clean(config), ErrInvalidAppType) {
+		t.Error("AppConfig.clean should fail with invalid app type")
+	}
+
+	appConfig.Type = AppTypeDocker
+	appConfig.Command = "nginx:latest"
+	if !errors.Is(appConfig.clean(config), ErrContainerPortRequired) {
+		t.Error("AppConfig.clean should fail for docker app without container port")
+	}
+	appConfig.ContainerPort = 80
+	if err := appConfig.clean(config); err != nil {
+		t.Error("AppConfig.clean fails for docker app without {port} badge:", err)
+	}
+
+	appConfig.Type = AppTypeBackend
+	appConfig.Command = ""
+	if !errors.Is(appConfig.clean(config), ErrBackendsRequired) {
+		t.Error("AppConfig.clean should fail for backend app without backends")
+	}
+	appConfig.BackendService = "api"
+	if !errors.Is(appConfig.clean(config), ErrDiscoveryRequired) {
+		t.Error("AppConfig.clean should fail for backend service without discovery")
+	}
+	appConfig.BackendService = ""
+	appConfig.Backends = []string{"10.0.0.1:8080"}
+	if err := appConfig.clean(config); err != nil {
+		t.Error("AppConfig.clean fails for backend app without command:", err)
+	}
+}
+
+func TestFetchClean(t *testing.T) {
+	stateDir := t.TempDir()
+	config := &Config{StateDir: stateDir}
+	appConfig := &AppConfig{Name: "demo"}
+
+	fetchConfig := &FetchConfig{}
+	if fetchConfig.clean(config, appConfig) != ErrFetchUrlRequired {
+		t.Error("FetchConfig.clean should fail without url")
+	}
+
+	fetchConfig.Url = "ftp://example.com/app.tar.gz"
+	if fetchConfig.clean(config, appConfig) != ErrInvalidFetchUrl {
+		t.Error("FetchConfig.clean should fail with invalid url scheme")
+	}
+
+	for _, url := range []string{"https://example.com/app-{version}.tar.gz", "s3://bucket/app.zip", "git+https://example.com/app.git"} {
+		fetchConfig.Url = url
+		if err := fetchConfig.clean(config, appConfig); err != nil {
+			t.Error("FetchConfig.clean fails with valid url:", url, err)
+		}
+	}
+	if fetchConfig.Dir != path.Join(stateDir, "releases", "demo") {
+		t.Error("Incorrect default fetch dir set:", fetchConfig.Dir)
+	}
+}
+
+func TestUntarSymlinks(t *testing.T) {
+	archive := func(entries ...*tar.Header) io.Reader {
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		for _, header := range entries {
+			tw.WriteHeader(header)
+			if header.Typeflag == tar.TypeReg {
+				tw.Write(make([]byte, header.Size))
+			}
+		}
+		tw.Close()
+		return buf
+	}
+
+	for _, entries := range [][]*tar.Header{
+		{{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: "/etc"}},
+		{{Name: "up", Typeflag: tar.TypeSymlink, Linkname: "../.."}},
+		{
+			{Name: "inside", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "inside/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+		},
+	} {
+		dst, _ := ioutil.TempDir("", "untar-test")
+		defer os.RemoveAll(dst)
+		err := untar(archive(entries...), dst)
+		if err != ErrInvalidArchivePath && err != ErrInvalidArchiveLink {
+			t.Error("untar should reject symlink escaping release dir:", entries[len(entries)-1].Name, err)
+		}
+	}
+
+	dst, _ := ioutil.TempDir("", "untar-test")
+	defer os.RemoveAll(dst)
+	err := untar(archive(
+		&tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "bin/app", Typeflag: tar.TypeReg, Mode: 0755, Size: 1},
+		&tar.Header{Name: "bin/current", Typeflag: tar.TypeSymlink, Linkname: "./app"},
+		&tar.Header{Name: "bin/sub/../link", Typeflag: tar.TypeSymlink, Linkname: "../bin/app"},
+	), dst)
+	if err != nil {
+		t.Error("untar fails with symlinks inside release dir:", err)
+	}
+	if link, _ := os.Readlink(path.Join(dst, "bin/current")); link != "app" {
+		t.Error("Incorrect symlink target extracted:", link)
+	}
+}
+
+func TestWarmupClean(t *testing.T) {
+	warmupConfig := &WarmupConfig{}
+	if warmupConfig.clean(nil) != ErrWarmupPathsRequired {
+		t.Error("WarmupConfig.clean should fail without paths")
+	}
+
+	warmupConfig.Paths = []string{"/", "/search"}
+	if err := warmupConfig.clean(nil); err != nil {
+		t.Error("WarmupConfig.clean fails with valid paths:", err)
+	}
+	if warmupConfig.Requests != defaultWarmupRequests {
+		t.Error("Incorrect default warmup requests set:", warmupConfig.Requests)
+	}
+	if warmupConfig.Concurrency != defaultWarmupConcurrency {
+		t.Error("Incorrect default warmup concurrency set:", warmupConfig.Concurrency)
+	}
+	if warmupConfig.Timeout != defaultWarmupTimeout {
+		t.Error("Incorrect default warmup timeout set:", warmupConfig.Timeout)
+	}
+}
+
+func TestCanaryClean(t *testing.T) {
+	canaryConfig := &CanaryConfig{}
+	if err := canaryConfig.clean(nil); err != nil {
+		t.Error("Minimal canary config clean fails:", err)
+	}
+	if canaryConfig.Percent != defaultCanaryPercent {
+		t.Error("Incorrect default canary percent set:", canaryConfig.Percent)
+	}
+	if canaryConfig.BakeTime != defaultCanaryBakeTime {
+		t.Error("Incorrect default canary bake time set:", canaryConfig.BakeTime)
+	}
+	if canaryConfig.MaxErrorRate != defaultCanaryMaxErrorRate {
+		t.Error("Incorrect default canary max error rate set:", canaryConfig.MaxErrorRate)
+	}
+
+	canaryConfig.Percent = 150
+	if canaryConfig.clean(nil) != ErrInvalidCanaryPercent {
+		t.Error("CanaryConfig.clean should fail with invalid percent")
+	}
+	canaryConfig.Percent = 10
+
+	canaryConfig.MaxErrorRate = -1
+	if canaryConfig.clean(nil) != ErrInvalidErrorRate {
+		t.Error("CanaryConfig.clean should fail with invalid max error rate")
+	}
+}
+
+func TestVerifyClean(t *testing.T) {
+	verifyConfig := &VerifyConfig{}
+	if verifyConfig.clean(nil) != ErrVerifyCheckRequired {
+		t.Error("VerifyConfig.clean should fail without command or path")
+	}
+
+	verifyConfig.Path = "/health"
+	if err := verifyConfig.clean(nil); err != nil {
+		t.Error("VerifyConfig.clean fails with path:", err)
+	}
+	if verifyConfig.Timeout != defaultVerifyTimeout {
+		t.Error("Incorrect default verify timeout set:", verifyConfig.Timeout)
+	}
+}
+
+func TestSlowStartClean(t *testing.T) {
+	slowStartConfig := &SlowStartConfig{}
+	if err := slowStartConfig.clean(nil); err != nil {
+		t.Error("Minimal slow start config clean fails:", err)
+	}
+	if slowStartConfig.Duration != defaultSlowStartDuration {
+		t.Error("Incorrect default slow start duration set:", slowStartConfig.Duration)
+	}
+	if slowStartConfig.Percent != defaultSlowStartPercent {
+		t.Error("Incorrect default slow start percent set:", slowStartConfig.Percent)
+	}
+
+	slowStartConfig.Percent = -5
+	if slowStartConfig.clean(nil) != ErrInvalidSlowStart {
+		t.Error("SlowStartConfig.clean should fail with invalid percent")
+	}
+}
+
+func TestMiddlewareClean(t *testing.T) {
+	middlewareConfig := &MiddlewareConfig{Name: "missing"}
+	if middlewareConfig.clean(nil) != ErrInvalidMiddleware {
+		t.Error("MiddlewareConfig.clean should fail with unregistered middleware")
+	}
+
+	middlewareConfig.Name = "request_headers"
+	if middlewareConfig.clean(nil) == nil {
+		t.Error("MiddlewareConfig.clean should fail with invalid options")
+	}
+
+	middlewareConfig.Options = map[string]string{"X-Tenant": "acme"}
+	if err := middlewareConfig.clean(nil); err != nil {
+		t.Error("MiddlewareConfig.clean fails with valid options:", err)
+	}
+}
+
+func TestRuleClean(t *testing.T) {
+	ruleConfig := &RuleConfig{Path: "^/api/"}
+	if ruleConfig.clean(nil) != ErrRuleActionRequired {
+		t.Error("RuleConfig.clean should fail without action")
+	}
+
+	ruleConfig.Reject = 200
+	if ruleConfig.clean(nil) != ErrInvalidRejectStatus {
+		t.Error("RuleConfig.clean should fail with invalid reject status")
+	}
+
+	ruleConfig.Reject = 403
+	ruleConfig.Headers = map[string]string{"X-Tenant": "^acme$"}
+	if err := ruleConfig.clean(nil); err != nil {
+		t.Error("RuleConfig.clean fails with valid rule:", err)
+	}
+	if ruleConfig.PathRegexp == nil || ruleConfig.HeaderRegexps["X-Tenant"] == nil {
+		t.Error("RuleConfig.clean should compile path and header patterns")
+	}
+
+	rewriteConfig := &RuleConfig{Rewrite: "/v2/$1"}
+	if rewriteConfig.clean(nil) != ErrRewritePathRequired {
+		t.Error("RuleConfig.clean should fail with rewrite without path")
+	}
+
+	ipConfig := &RuleConfig{ClientIps: []string{"10.0.0.0/8", "::1"}, Reject: 403}
+	if err := ipConfig.clean(nil); err != nil || len(ipConfig.ClientNets) != 2 {
+		t.Error("RuleConfig.clean fails with valid client ips:", err)
+	}
+	ipConfig.ClientIps = []string{"10.0.0.0/33"}
+	if err, ok := ipConfig.clean(nil).(*FieldError); !ok || err.Err != ErrInvalidClientIp {
+		t.Error("RuleConfig.clean should fail with invalid client ip")
+	}
+
+	heldConfig := &RuleConfig{Cookies: map[string]string{"beta": "^1$"}, RouteHeld: true}
+	if err := heldConfig.clean(nil); err != nil || heldConfig.CookieRegexps["beta"] == nil {
+		t.Error("RuleConfig.clean fails with valid route held rule:", err)
+	}
+	heldConfig.Route = "beta"
+	if heldConfig.clean(nil) != ErrRuleActionRequired {
+		t.Error("RuleConfig.clean should fail with both route and route held")
+	}
+}
+
+func TestProxyErrorsClean(t *testing.T) {
+	proxyErrorsConfig := &ProxyErrorsConfig{}
+	if err := proxyErrorsConfig.clean(nil); err != nil {
+		t.Error("Minimal proxy errors config clean fails:", err)
+	}
+	if proxyErrorsConfig.status(ProxyErrorDial) != 502 || proxyErrorsConfig.status(ProxyErrorTimeout) != 504 {
+		t.Error("Incorrect default proxy error status set:", proxyErrorsConfig)
+	}
+
+	proxyErrorsConfig.Dial = 200
+	if proxyErrorsConfig.clean(nil) != ErrInvalidErrorStatus {
+		t.Error("ProxyErrorsConfig.clean should fail with invalid status")
+	}
+}
+
+func TestCacheClean(t *testing.T) {
+	cacheConfig := &CacheConfig{}
+	if cacheConfig.clean(nil) != ErrCachePathsRequired {
+		t.Error("CacheConfig.clean should fail without paths")
+	}
+
+	cacheConfig.Paths = []string{"^/static/"}
+	if err := cacheConfig.clean(nil); err != nil {
+		t.Error("Minimal cache config clean fails:", err)
+	}
+	if cacheConfig.Ttl != defaultCacheTtl || cacheConfig.MaxSize != defaultCacheMaxSize || len(cacheConfig.PathRegexps) != 1 {
+		t.Error("Incorrect default cache config set:", cacheConfig)
+	}
+
+	for header, ttl := range map[string]time.Duration{
+		"":                         time.Minute,
+		"public, max-age=300":      5 * time.Minute,
+		"max-age=300, s-maxage=10": 10 * time.Second,
+		"no-store":                 0,
+		"private, max-age=300":     0,
+		"max-age=0":                0,
+		`max-age="invalid"`:        0,
+	} {
+		if got := cacheConfig.ttl(200, http.Header{"Cache-Control": []string{header}}); got != ttl {
+			t.Error("Cache-Control", header, "ttl should be", ttl, "got", got)
+		}
+	}
+	if cacheConfig.ttl(200, http.Header{"Set-Cookie": []string{"a=b"}}) != 0 || cacheConfig.ttl(500, http.Header{}) != 0 {
+		t.Error("Responses with cookies and errors should not be cached")
+	}
+	if cacheConfig.ttl(200, http.Header{"Vary": []string{"Accept-Encoding", "Origin"}}) == 0 || cacheConfig.ttl(200, http.Header{"Vary": []string{"Cookie"}}) != 0 {
+		t.Error("Only responses varying by Accept-Encoding and Origin should be cached")
+	}
+
+	cacheConfig.Paths = []string{"("}
+	if _, ok := cacheConfig.clean(nil).(*FieldError); !ok {
+		t.Error("CacheConfig.clean should fail with invalid path")
+	}
+}
+
+// writeTestCert writes a self signed certificate for names and its key to dir
+func writeTestCert(t *testing.T, dir string, names ...string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := path.Join(dir, names[0]+".crt")
+	keyFile := path.Join(dir, names[0]+".key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestTLSClean(t *testing.T) {
+	tlsConfig := &TLSConfig{}
+	if tlsConfig.clean(nil) != ErrTLSCertRequired {
+		t.Error("TLSConfig.clean should fail without cert")
+	}
+
+	dir := t.TempDir()
+	tlsConfig.CertFile, tlsConfig.KeyFile = writeTestCert(t, dir, "example.com")
+	if err := tlsConfig.clean(nil); err != nil {
+		t.Error("Minimal tls config clean fails:", err)
+	}
+	if tlsConfig.Config == nil || tlsConfig.Config.MinVersion != tls.VersionTLS12 || tlsConfig.Config.ClientAuth != tls.NoClientCert {
+		t.Error("Incorrect default tls config set:", tlsConfig)
+	}
+
+	tlsConfig.MinVersion = "1.3"
+	tlsConfig.CipherSuites = []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}
+	tlsConfig.CurvePreferences = []string{"X25519", "P256"}
+	tlsConfig.ClientAuth = "request"
+	if err := tlsConfig.clean(nil); err != nil || len(tlsConfig.Config.CipherSuites) != 1 || len(tlsConfig.Config.CurvePreferences) != 2 {
+		t.Error("TLSConfig.clean fails with valid policy:", err)
+	}
+
+	tlsConfig.MinVersion = "1.4"
+	if tlsConfig.clean(nil) != ErrInvalidTLSVersion {
+		t.Error("TLSConfig.clean should fail with invalid min version")
+	}
+	tlsConfig.MinVersion = "1.2"
+	tlsConfig.CipherSuites = []string{"TLS_INVALID"}
+	if !errors.Is(tlsConfig.clean(nil), ErrInvalidCipherSuite) {
+		t.Error("TLSConfig.clean should fail with invalid cipher suite")
+	}
+	tlsConfig.CipherSuites = nil
+	tlsConfig.ClientAuth = "require_and_verify"
+	if tlsConfig.clean(nil) != ErrClientCaRequired {
+		t.Error("TLSConfig.clean should fail to verify client certs without client ca")
+	}
+	tlsConfig.ClientCaFile = tlsConfig.KeyFile
+	if !errors.Is(tlsConfig.clean(nil), ErrInvalidClientCa) {
+		t.Error("TLSConfig.clean should fail with client ca without certificates")
+	}
+	tlsConfig.ClientCaFile = tlsConfig.CertFile
+	if err := tlsConfig.clean(nil); err != nil || tlsConfig.Config.ClientCAs == nil {
+		t.Error("TLSConfig.clean fails with valid client ca:", err)
+	}
+
+	tlsConfig.KeyFile = path.Join(dir, "missing.key")
+	if _, ok := tlsConfig.clean(nil).(*FieldError); !ok {
+		t.Error("TLSConfig.clean should fail with missing key file")
+	}
+}
+
+func TestTLSCertificates(t *testing.T) {
+	dir := t.TempDir()
+	tlsConfig := &TLSConfig{Certificates: []*TLSCertConfig{&TLSCertConfig{CertFile: "a.crt"}}}
+	if !errors.Is(tlsConfig.clean(nil), ErrTLSCertRequired) {
+		t.Error("TLSConfig.clean should fail with certificate without key")
+	}
+
+	tlsConfig.CertFile, tlsConfig.KeyFile = writeTestCert(t, dir, "a.example.com")
+	certFile, keyFile := writeTestCert(t, dir, "b.example.com", "*.b.example.com")
+	tlsConfig.Certificates = []*TLSCertConfig{&TLSCertConfig{CertFile: certFile, KeyFile: keyFile}}
+	if err := tlsConfig.clean(nil); err != nil || len(tlsConfig.Config.Certificates) != 2 {
+		t.Fatal("TLSConfig.clean fails with certificates:", err)
+	}
+
+	for serverName, commonName := range map[string]string{
+		"a.example.com":     "a.example.com",
+		"b.example.com":     "b.example.com",
+		"www.b.example.com": "b.example.com",
+		"other.com":         "a.example.com",
+	} {
+		serverConn, clientConn := net.Pipe()
+		go tls.Server(serverConn, tlsConfig.Config).Handshake()
+		client := tls.Client(clientConn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err := client.Handshake(); err != nil {
+			t.Fatal("Tls handshake fails:", err)
+		}
+		if name := client.ConnectionState().PeerCertificates[0].Subject.CommonName; name != commonName {
+			t.Error("Server name", serverName, "should get certificate", commonName, "got", name)
+		}
+		clientConn.Close()
+		serverConn.Close()
+	}
+}
+
+func TestCors(t *testing.T) {
+	corsConfig := &CorsConfig{}
+	if corsConfig.clean(nil) != ErrCorsOriginsRequired {
+		t.Error("CorsConfig.clean should fail without origins")
+	}
+	corsConfig = &CorsConfig{Origins: []string{"*"}, Credentials: true}
+	if corsConfig.clean(nil) != ErrCorsCredentialsAny {
+		t.Error("CorsConfig.clean should fail with credentials for any origin")
+	}
+
+	corsConfig = &CorsConfig{Origins: []string{"https://app.example.com", "*.example.org"}, Methods: []string{"get", "put"},
+		Headers: []string{"Content-Type"}, Credentials: true, MaxAge: 600}
+	if err := corsConfig.clean(nil); err != nil || corsConfig.Methods[1] != "PUT" {
+		t.Error("CorsConfig.clean fails:", err, corsConfig.Methods)
+	}
+
+	handler := corsConfig.handler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Access-Control-Allow-Origin", "*")
+		rw.WriteHeader(http.StatusOK)
+	}))
+	serve := func(method, origin string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/", nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		req.Header.Set("Origin", origin)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	preflight := http.Header{"Access-Control-Request-Method": []string{"PUT"}, "Access-Control-Request-Headers": []string{"content-type"}}
+	rec := serve(http.MethodOptions, "https://api.example.org", preflight)
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Origin") != "https://api.example.org" ||
+		rec.Header().Get("Access-Control-Max-Age") != "600" || rec.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Error("Allowed preflight should be answered:", rec.Code, rec.Header())
+	}
+	preflight.Set("Access-Control-Request-Headers", "X-Secret")
+	if rec := serve(http.MethodOptions, "https://app.example.com", preflight); rec.Code != http.StatusForbidden {
+		t.Error("Preflight with not allowed header should be rejected:", rec.Code)
+	}
+	if rec := serve(http.MethodOptions, "https://evil-example.org", http.Header{"Access-Control-Request-Method": []string{"GET"}}); rec.Code != http.StatusForbidden {
+		t.Error("Preflight of not allowed origin should be rejected:", rec.Code)
+	}
+
+	rec = serve(http.MethodGet, "https://app.example.com", nil)
+	if values := rec.Header()["Access-Control-Allow-Origin"]; len(values) != 1 || values[0] != "https://app.example.com" {
+		t.Error("Allowed origin should replace instance cors headers:", rec.Header())
+	}
+	if rec := serve(http.MethodGet, "https://other.com", nil); rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Error("Not allowed origin should get no cors headers:", rec.Header())
+	}
+}
+
+func TestShadowClean(t *testing.T) {
+	shadowConfig := &ShadowConfig{}
+	if err := shadowConfig.clean(nil); err != nil {
+		t.Error("Empty shadow config clean fails:", err)
+	}
+	if shadowConfig.Percent != defaultShadowPercent || shadowConfig.MaxBodySize != defaultShadowMaxBodySize ||
+		shadowConfig.Timeout != defaultShadowTimeout || shadowConfig.MaxConcurrent != defaultShadowMaxConcurrent {
+		t.Error("Incorrect default shadow config set:", shadowConfig)
+	}
+
+	shadowConfig.Percent = 101
+	if shadowConfig.clean(nil) != ErrInvalidShadowPercent {
+		t.Error("ShadowConfig.clean should fail with percent over 100")
+	}
+	shadowConfig.Percent = 100
+	shadowConfig.Timeout = -1
+	if shadowConfig.clean(nil) != ErrInvalidShadowLimit {
+		t.Error("ShadowConfig.clean should fail with negative timeout")
+	}
+}
+
+func TestSanitizeClean(t *testing.T) {
+	sanitizeConfig := &SanitizeConfig{}
+	if err := sanitizeConfig.clean(nil); err != nil {
+		t.Error("Minimal sanitize config clean fails:", err)
+	}
+	if sanitizeConfig.MaxHeaders != defaultSanitizeMaxHeaders {
+		t.Error("Incorrect default sanitize max headers set:", sanitizeConfig.MaxHeaders)
+	}
+
+	sanitizeConfig.MaxUrlLength = -1
+	if sanitizeConfig.clean(nil) != ErrInvalidSanitizeLimit {
+		t.Error("SanitizeConfig.clean should fail with negative limit")
+	}
+}
+
+func TestWatchdogClean(t *testing.T) {
+	watchdogConfig := &WatchdogConfig{}
+	if err := watchdogConfig.clean(nil); err != nil {
+		t.Error("Minimal watchdog config clean fails:", err)
+	}
+	if watchdogConfig.Interval != defaultWatchdogInterval || watchdogConfig.MaxLag != defaultWatchdogMaxLag {
+		t.Error("Incorrect default watchdog config set:", watchdogConfig)
+	}
+
+	watchdogConfig.MaxOpenFiles = 120
+	if watchdogConfig.clean(nil) != ErrInvalidWatchdogLimit {
+		t.Error("WatchdogConfig.clean should fail with open files over 100%")
+	}
+}
+
+func TestStateExportClean(t *testing.T) {
+	exportConfig := &StateExportConfig{}
+	if exportConfig.clean(nil) != ErrStateExportTarget {
+		t.Error("StateExportConfig.clean should fail without path and urls")
+	}
+
+	exportConfig.Path = "/run/gracevisor/state.json"
+	if err := exportConfig.clean(nil); err != nil {
+		t.Error("Minimal state export config clean fails:", err)
+	}
+	if exportConfig.Interval != defaultStateExportInterval || exportConfig.Timeout != defaultStateExportTimeout {
+		t.Error("Incorrect default state export config set:", exportConfig)
+	}
+
+	exportConfig.Interval = -1
+	if exportConfig.clean(nil) != ErrInvalidStateExport {
+		t.Error("StateExportConfig.clean should fail with negative interval")
+	}
+}
+
+func TestNotifierClean(t *testing.T) {
+	events := &EventsConfig{}
+	if err := events.clean(nil); err != nil {
+		t.Error("Minimal events config clean fails:", err)
+	}
+
+	notifier := &NotifierConfig{Type: "pager"}
+	if notifier.clean(events) != ErrInvalidNotifier {
+		t.Error("NotifierConfig.clean should fail with unregistered type")
+	}
+	notifier.Type = "slack"
+	if err := notifier.clean(events); err == nil || !strings.Contains(err.Error(), ErrNotifierUrlRequired.Error()) {
+		t.Error("NotifierConfig.clean should fail without url:", err)
+	}
+
+	notifier.Options = map[string]string{"url": "https://hooks.example.com/T0/B0"}
+	notifier.Template = "{{.App"
+	if _, ok := notifier.clean(events).(*FieldError); !ok {
+		t.Error("NotifierConfig.clean should fail with invalid template")
+	}
+
+	notifier.Template = "{{.App}} {{.Type}}: {{.Message}}"
+	notifier.Events = []string{EventQuarantined}
+	notifier.Apps = []string{"api"}
+	if err := notifier.clean(events); err != nil {
+		t.Error("NotifierConfig.clean fails with valid notifier:", err)
+	}
+	event := &Event{Type: EventQuarantined, App: "api", Message: "retrying in 1m"}
+	if !notifier.matches(event) || notifier.matches(&Event{Type: EventQuarantined, App: "web"}) || notifier.matches(&Event{Type: EventWatchdog}) {
+		t.Error("Notifier should match only its events and apps")
+	}
+	if message, err := notifier.render(event); err != nil || message != "api quarantined: retrying in 1m" {
+		t.Error("Incorrect notifier message:", message, err)
+	}
+
+	notifier.Template = ""
+	if err := notifier.clean(events); err != nil {
+		t.Error("NotifierConfig.clean fails with default template:", err)
+	}
+	if message, _ := notifier.render(&Event{Type: EventHealthCheckFailed, App: "api", InstanceId: 3}); message != "healthcheck_failed api[3]" {
+		t.Error("Incorrect default notifier message:", message)
+	}
+}
+
+func TestLogTriggerClean(t *testing.T) {
+	triggerConfig := &LogTriggerConfig{}
+	if triggerConfig.clean(nil) != ErrPatternRequired {
+		t.Error("LogTriggerConfig.clean should fail without pattern")
+	}
+
+	triggerConfig.Pattern = "panic:"
+	if err := triggerConfig.clean(nil); err != nil {
+		t.Error("LogTriggerConfig.clean fails with valid pattern:", err)
+	}
+	if triggerConfig.Name != "panic:" {
+		t.Error("Incorrect default log trigger name set:", triggerConfig.Name)
+	}
+	if !triggerConfig.Regexp.MatchString("panic: runtime error") {
+		t.Error("Log trigger regexp does not match")
+	}
+
+	triggerConfig.Pattern = "("
+	if triggerConfig.clean(nil) == nil {
+		t.Error("LogTriggerConfig.clean should fail with invalid pattern")
+	}
 }
 
 func TestAppHasPortBadge(t *testing.T) {
@@ -191,6 +987,86 @@ func TestRpcClean(t *testing.T) {
 	if err := rpcConfig.clean(nil); err != nil {
 		t.Error("RpcConfig.clean fails with valid settings:", err)
 	}
+
+	rpcConfig.Tokens = []*RpcTokenConfig{
+		&RpcTokenConfig{Token: "secret"},
+	}
+	if err := rpcConfig.clean(nil); err != nil {
+		t.Error("RpcConfig.clean fails with valid token:", err)
+	}
+	if rpcConfig.Tokens[0].Role != RoleReadOnly {
+		t.Error("Incorrect default token role set:", rpcConfig.Tokens[0].Role)
+	}
+
+	rpcConfig.Tokens[0].RoleName = "root"
+	if rpcConfig.clean(nil) == nil {
+		t.Error("RpcConfig.clean should fail with invalid role")
+	}
+
+	rpcConfig.Tokens[0] = &RpcTokenConfig{RoleName: "admin"}
+	if rpcConfig.clean(nil) == nil {
+		t.Error("RpcConfig.clean should fail with empty token")
+	}
+}
+
+func TestDiscoveryClean(t *testing.T) {
+	discoveryConfig := &DiscoveryConfig{}
+	if discoveryConfig.clean(nil) != ErrInvalidDiscoveryType {
+		t.Error("DiscoveryConfig.clean should fail without type")
+	}
+
+	discoveryConfig.Type = DiscoveryConsul
+	if err := discoveryConfig.clean(nil); err != nil {
+		t.Error("DiscoveryConfig.clean fails with consul type:", err)
+	}
+	if discoveryConfig.Address != defaultConsulAddress {
+		t.Error("Incorrect default consul address set:", discoveryConfig.Address)
+	}
+	if discoveryConfig.Ttl != defaultDiscoveryTtl {
+		t.Error("Incorrect default discovery ttl set:", discoveryConfig.Ttl)
+	}
+
+	discoveryConfig = &DiscoveryConfig{Type: DiscoveryEtcd, Address: "http://etcd:2379/"}
+	if err := discoveryConfig.clean(nil); err != nil {
+		t.Error("DiscoveryConfig.clean fails with etcd type:", err)
+	}
+	if discoveryConfig.Address != "http://etcd:2379" {
+		t.Error("Discovery address should be stripped of trailing slash:", discoveryConfig.Address)
+	}
+	if discoveryConfig.Prefix != defaultDiscoveryPrefix {
+		t.Error("Incorrect default etcd prefix set:", discoveryConfig.Prefix)
+	}
+}
+
+func TestSourceClean(t *testing.T) {
+	sourceConfig := &SourceConfig{}
+	if sourceConfig.clean(nil) != ErrInvalidSourceType {
+		t.Error("SourceConfig.clean should fail without type")
+	}
+
+	sourceConfig.Type = SourceHttp
+	if sourceConfig.clean(nil) != ErrSourceUrlRequired {
+		t.Error("SourceConfig.clean should fail for http source without url")
+	}
+	sourceConfig.Url = "https://config.example.com/gracevisor.yaml"
+	if err := sourceConfig.clean(nil); err != nil {
+		t.Error("SourceConfig.clean fails with http url:", err)
+	}
+	if sourceConfig.Interval != defaultSourceInterval {
+		t.Error("Incorrect default config source interval set:", sourceConfig.Interval)
+	}
+
+	sourceConfig = &SourceConfig{Type: DiscoveryConsul}
+	if sourceConfig.clean(nil) != ErrSourceKeyRequired {
+		t.Error("SourceConfig.clean should fail for consul source without key")
+	}
+	sourceConfig.Key = "/gracevisor/web1"
+	if err := sourceConfig.clean(nil); err != nil {
+		t.Error("SourceConfig.clean fails with consul key:", err)
+	}
+	if sourceConfig.Address != defaultConsulAddress || sourceConfig.Key != "gracevisor/web1" {
+		t.Error("Incorrect consul config source defaults:", sourceConfig.Address, sourceConfig.Key)
+	}
 }
 
 func TestLoggerGlobalClean(t *testing.T) {
@@ -215,15 +1091,28 @@ func TestLoggerGlobalClean(t *testing.T) {
 		t.Error("LoggerConfig.globalClean did not create dir:", err)
 	}
 	os.Remove("/tmp/log-test/")
+
+	if loggerConfig.DirPerm != defaultLogDirMode || loggerConfig.FilePerm != defaultLogFileMode {
+		t.Error("Incorrect default log modes set:", loggerConfig.DirPerm, loggerConfig.FilePerm)
+	}
+	loggerConfig.FileMode = "0600"
+	if err := loggerConfig.globalClean(nil); err != nil || loggerConfig.FilePerm != 0600 {
+		t.Error("LoggerConfig.globalClean should parse file mode:", err, loggerConfig.FilePerm)
+	}
+	loggerConfig.DirMode = "0999"
+	if loggerConfig.globalClean(nil) != ErrInvalidLogMode {
+		t.Error("LoggerConfig.globalClean should fail with invalid dir mode")
+	}
 }
 
 func TestLoggerAppClean(t *testing.T) {
 	config := &Config{
 		Logger: &LoggerConfig{
-			LogDir:      "/tmp/log-test/",
-			MaxLogSize:  100,
-			MaxLogsKept: -1,
-			MaxLogAge:   -1,
+			LogDir:        "/tmp/log-test/",
+			MaxLogSize:    100,
+			MaxLogsKept:   -1,
+			MaxLogAge:     -1,
+			MaxLogDirSize: 1000,
 		},
 	}
 	appConfig := &AppConfig{
@@ -247,6 +1136,9 @@ func TestLoggerAppClean(t *testing.T) {
 	if loggerConfig.MaxLogAge != config.Logger.MaxLogAge {
 		t.Error("LoggerConfig.MaxLogAge not copied from global config")
 	}
+	if loggerConfig.MaxLogDirSize != config.Logger.MaxLogDirSize {
+		t.Error("LoggerConfig.MaxLogDirSize not copied from global config")
+	}
 
 	if loggerConfig.StdoutLogFile != "/tmp/log-test/app_demo.out" {
 		t.Error("Incorrect default stdout log file set:", loggerConfig.StdoutLogFile)
@@ -272,6 +1164,14 @@ func TestLoggerAppClean(t *testing.T) {
 	if _, err := os.Stat("/tmp/log-test/"); err != nil {
 		t.Error("LoggerConfig.appClean did not create dir:", err)
 	}
+	if loggerConfig.Gid != -1 {
+		t.Error("LoggerConfig.Gid should default to group of app user:", loggerConfig.Gid)
+	}
+
+	loggerConfig.Group = "gracevisor-missing-group"
+	if loggerConfig.appClean(config, appConfig) == nil {
+		t.Error("LoggerConfig.appClean should fail with unknown group")
+	}
 
 	os.Remove("/tmp/log-test/")
 }
@@ -304,6 +1204,29 @@ func TestConfigClean(t *testing.T) {
 	if config.Rpc == nil {
 		t.Error("config.Rpc should be initialized")
 	}
+	if config.StateDir != defaultStateDir {
+		t.Error("Incorrect default state dir set:", config.StateDir)
+	}
+	if config.MaxHistory != defaultMaxHistory {
+		t.Error("Incorrect default max history set:", config.MaxHistory)
+	}
+	if config.MaxDeploys != defaultMaxDeploys {
+		t.Error("Incorrect default max deploys set:", config.MaxDeploys)
+	}
+
+	config.TrustedProxies = []string{"127.0.0.1", "10.0.0.0/8"}
+	config.Apps[1].TrustedProxies = []string{}
+	if err := config.clean(nil); err != nil {
+		t.Error("Config.clean fails with trusted proxies:", err)
+	}
+	if len(config.Apps[0].TrustedNets) != 2 || len(config.Apps[1].TrustedNets) != 0 {
+		t.Error("Apps should inherit or override trusted proxies:", config.Apps[0].TrustedNets, config.Apps[1].TrustedNets)
+	}
+	config.TrustedProxies = []string{"localhost"}
+	if config.clean(nil) == nil {
+		t.Error("Config.clean should fail with invalid trusted proxy")
+	}
+	config.TrustedProxies = nil
 
 	config.Apps = []*AppConfig{
 		&AppConfig{
@@ -336,6 +1259,69 @@ func TestConfigClean(t *testing.T) {
 	if config.clean(nil) == nil {
 		t.Error("Config.clean should fail with apps with same ExternalPort")
 	}
+
+	config.Apps[0].ExternalHost = "127.0.0.1"
+	config.Apps[1].ExternalHost = "127.0.0.2"
+	if err := config.clean(nil); err != nil {
+		t.Error("Config.clean fails with apps on same port of different hosts:", err)
+	}
+	config.Apps[1].ExternalHost = "0.0.0.0"
+	if config.clean(nil) == nil {
+		t.Error("Config.clean should fail with app on same port of all hosts")
+	}
+}
+
+func TestConfigGroups(t *testing.T) {
+	config := &Config{
+		Apps: []*AppConfig{
+			&AppConfig{Name: "api"},
+			&AppConfig{Name: "frontend"},
+		},
+		Groups: map[string][]string{"web": {"api", "frontend"}},
+	}
+	if errs := config.groupErrors(); len(errs) != 0 {
+		t.Error("Group of known apps should be valid:", errs)
+	}
+
+	config.Groups["api"] = []string{"frontend"}
+	config.Groups["workers"] = []string{"queue"}
+	errs := config.groupErrors()
+	if len(errs) != 2 {
+		t.Fatal("Groups shadowing app or with unknown app should fail:", errs)
+	}
+	if errs[0].Error() != "Group api has the same name as an app" {
+		t.Error("Incorrect group error:", errs[0])
+	}
+	if errs[1].Error() != "Group workers contains unknown app queue" {
+		t.Error("Incorrect group error:", errs[1])
+	}
+}
+
+func TestConfigRestartWith(t *testing.T) {
+	config := &Config{
+		Apps: []*AppConfig{
+			&AppConfig{Name: "api"},
+			&AppConfig{Name: "cache", RestartWith: []string{"api"}},
+			&AppConfig{Name: "warmer", RestartWith: []string{"cache"}},
+		},
+	}
+	if errs := config.restartWithErrors(); len(errs) != 0 {
+		t.Error("Restart with known apps should be valid:", errs)
+	}
+
+	config.Apps[0].RestartWith = []string{"warmer"}
+	errs := config.restartWithErrors()
+	if len(errs) != 3 {
+		t.Fatal("Restart cascade cycle should fail for every app in it:", errs)
+	}
+	if !strings.Contains(errs[0].Error(), "Restart cascade cycle api -> warmer -> cache -> api") {
+		t.Error("Incorrect restart with error:", errs[0])
+	}
+
+	config.Apps[0].RestartWith = []string{"queue"}
+	if errs := config.restartWithErrors(); len(errs) != 1 {
+		t.Error("Restart with unknown app should fail:", errs)
+	}
 }
 
 func TestConfigIncludeFile(t *testing.T) {
@@ -403,4 +1389,169 @@ func TestParseConfig(t *testing.T) {
 	if len(config.Apps) != 3 {
 		t.Error("Sample config should load 3 apps.")
 	}
+
+	config, err = ParseConfing("../conf/gracevisor.yaml")
+	if err != nil {
+		t.Error("Parsing of sample config file failed:", err)
+	} else if len(config.Apps) != 3 {
+		t.Error("Sample config file should load 3 apps.")
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	if errs := checkConfig("/not/a/path"); len(errs) != 1 {
+		t.Error("Check of invalid path should fail with one error:", errs)
+	}
+
+	if errs := checkConfig("../conf"); len(errs) != 0 {
+		t.Error("Check of sample config failed:", errs)
+	}
+}
+
+func TestParseYamlStrict(t *testing.T) {
+	config := &Config{}
+	data := []byte("state_dir: /tmp\napps:\n  - name: web\n    command: ./web --port={port}\n    logger: {max_log_size: 10}\n")
+	if err := parseYaml(data, config); err != nil {
+		t.Error("parseYaml fails with valid options:", err)
+	}
+
+	data = []byte("apps:\n  - name: web\n    enviroment: [A=1]\n    logger: {max_log_sise: 10}\n")
+	err := parseYaml(data, config)
+	if err == nil || err.Error() != "app web: Unknown option enviroment; app web: Unknown option logger.max_log_sise" {
+		t.Error("parseYaml should fail with unknown options:", err)
+	}
+}
+
+func TestParseConfigFormats(t *testing.T) {
+	formats := map[string]string{
+		"gracevisor.yaml": "state_dir: /tmp\napps:\n  - name: web\n    command: ./web --port={port}\n    environment: [A=1]\n    stop_timeout: 5\n    logger: {max_log_size: 10}\n",
+		"gracevisor.toml": "state_dir = '/tmp' # comment\n\n[[apps]]\nname = \"web\"\ncommand = \"./web --port={port}\"\nenvironment = [\n  \"A=1\",\n]\nstop_timeout = 5\nlogger.max_log_size = 10\n",
+		"gracevisor.json": `{"state_dir": "/tmp", "apps": [{"name": "web", "command": "./web --port={port}", "environment": ["A=1"], "stop_timeout": 5, "logger": {"max_log_size": 10}}]}`,
+	}
+	for fn, data := range formats {
+		config := &Config{}
+		if err := parseConfigData(fn, []byte(data), config); err != nil {
+			t.Error(fn, "parsing failed:", err)
+			continue
+		}
+		if config.StateDir != "/tmp" || len(config.Apps) != 1 {
+			t.Error(fn, "should have state_dir and one app:", config)
+			continue
+		}
+		app := config.Apps[0]
+		if app.Name != "web" || app.Command != "./web --port={port}" || len(app.Environment) != 1 ||
+			app.StopTimeout != 5 || app.Logger == nil || app.Logger.MaxLogSize != 10 {
+			t.Error(fn, "app options not parsed:", app)
+		}
+	}
+
+	err := parseConfigData("gracevisor.toml", []byte("[[apps]]\nname = \"web\"\nenviroment = []\n"), &Config{})
+	if err == nil || err.Error() != "app web: Unknown option enviroment" {
+		t.Error("Unknown toml options should fail:", err)
+	}
+	err = parseConfigData("gracevisor.toml", []byte("state_dir = \"/tmp\"\nstate_dir = \"/var\"\n"), &Config{})
+	if err == nil || err.Error() != "toml: line 2: duplicate key state_dir" {
+		t.Error("Duplicate toml keys should fail with line:", err)
+	}
+}
+
+func TestDeployWindow(t *testing.T) {
+	app := &App{}
+	app.configValue.Store(&AppConfig{Name: "app", DeployWindows: []string{"mon-fri 09:00-17:00", "sat 22:00-06:00"}})
+	for _, s := range app.config().DeployWindows {
+		window, err := parseDeployWindow(s)
+		if err != nil {
+			t.Fatal("Deploy window", s, "should be valid:", err)
+		}
+		app.config().DeployWindowRanges = append(app.config().DeployWindowRanges, window)
+	}
+
+	// 2024-01-01 is a monday
+	for at, allowed := range map[string]bool{
+		"2024-01-01 09:00": true,
+		"2024-01-01 16:59": true,
+		"2024-01-01 17:00": false,
+		"2024-01-05 08:59": false,
+		"2024-01-06 12:00": false,
+		"2024-01-06 23:30": true,
+		"2024-01-07 05:59": true,
+		"2024-01-07 06:00": false,
+		"2024-01-01 03:00": false,
+	} {
+		when, _ := time.Parse("2006-01-02 15:04", at)
+		err := app.checkDeployWindow(when)
+		if (err == nil) != allowed || (err != nil && !errors.Is(err, ErrOutsideDeployWindow)) {
+			t.Error("Deploy at", at, "allowed should be", allowed, "got", err)
+		}
+	}
+}
+
+func TestCleanHost(t *testing.T) {
+	for host, expected := range map[string]string{"[::]": "::", "::1": "::1", "10.0.0.1": "10.0.0.1", "example.com": "example.com"} {
+		if cleaned, err := cleanHost(host); err != nil || cleaned != expected {
+			t.Error("Host", host, "should be cleaned to", expected, "got", cleaned, err)
+		}
+	}
+	for _, host := range []string{"[::", "localhost:80", "a b"} {
+		if _, err := cleanHost(host); err != ErrInvalidHost {
+			t.Error("Host", host, "should be invalid")
+		}
+	}
+	if hostPort("::", 8080) != "[::]:8080" || hostPort("localhost", 8080) != "localhost:8080" {
+		t.Error("Incorrect host port:", hostPort("::", 8080))
+	}
+}
+
+func TestCommandArgs(t *testing.T) {
+	config := &Config{Logger: &LoggerConfig{}}
+	app := &AppConfig{}
+	data := []byte("name: web\ncommand: [gunicorn, -b, ':{port}', 'app:app --x']\n")
+	if err := parseYaml(data, app); err != nil {
+		t.Fatal("Command list should parse:", err)
+	}
+	if len(app.Args) != 4 || app.Args[3] != "app:app --x" || app.Command != "gunicorn -b :{port} app:app --x" {
+		t.Error("Command list should be kept as arguments:", app.Args, app.Command)
+	}
+	if err := app.clean(config); err != nil {
+		t.Error("Command list with port badge should be valid:", err)
+	}
+
+	out, err := yaml.Marshal(app)
+	if err != nil || !strings.Contains(string(out), "command:\n- gunicorn\n") {
+		t.Error("Command list should be written as list:", string(out), err)
+	}
+
+	app.Shell = true
+	if !errors.Is(app.clean(config), ErrInvalidShell) {
+		t.Error("Shell should fail with command list.")
+	}
+
+	data = []byte("name: web\nstop_signal: [QUIT/10, KILL]\n")
+	if err := parseYaml(data, app); err != nil || len(app.StopSignalSteps) != 2 || app.StopSignalName != "QUIT/10" {
+		t.Error("Stop signal list should parse:", app.StopSignalSteps, err)
+	}
+
+	if err := parseYaml([]byte("name: web\ncommand: [a, {b: c}]\n"), &AppConfig{}); err == nil {
+		t.Error("Command list with non string arguments should fail.")
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	config := &Config{
+		StateDir: os.TempDir(),
+		Apps: []*AppConfig{
+			{Name: "web", Command: "./web", StopSignalName: "TREM", Nice: 40, source: "web.yaml"},
+		},
+	}
+	err := config.clean(config)
+	errs, ok := err.(ConfigErrors)
+	if !ok || len(errs) != 3 {
+		t.Fatal("Config.clean should return all app errors:", err)
+	}
+	if errs[0].Error() != "web.yaml: web: command: App must have {port} in command or environment" {
+		t.Error("Incorrect config error context:", errs[0])
+	}
+	if !errors.Is(err, ErrInvalidStopSignal) || !errors.Is(err, ErrInvalidNice) {
+		t.Error("Config errors should wrap app errors:", err)
+	}
 }
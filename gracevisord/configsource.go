@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	SourceHttp = "http"
+
+	sourceTimeout       = 10 * time.Second
+	sourceCacheFileMode = 0600
+)
+
+var ErrSourceKeyNotFound = errors.New("Config source key not found")
+
+// ConfigSource loads gracevisor.yaml from a remote url, consul or etcd key.
+// Last valid config is cached in state dir and used when source is unreachable.
+type ConfigSource struct {
+	config    *SourceConfig
+	client    *http.Client
+	cacheFile string
+
+	// etag and last are of last processed config, fetchedEtag of last fetched one
+	etag        string
+	fetchedEtag string
+	last        []byte
+}
+
+func NewConfigSource(config *SourceConfig, stateDir string) *ConfigSource {
+	if stateDir == "" {
+		stateDir = defaultStateDir
+	}
+	return &ConfigSource{
+		config:    config,
+		client:    &http.Client{Timeout: sourceTimeout},
+		cacheFile: path.Join(stateDir, defaultSourceCacheFile),
+	}
+}
+
+func (s *ConfigSource) String() string {
+	if s.config.Type == SourceHttp {
+		return s.config.Url
+	}
+	return fmt.Sprintf("%s %s", s.config.Type, s.config.Key)
+}
+
+// Load fetches config, falling back to cached config if source fails
+func (s *ConfigSource) Load() ([]byte, error) {
+	data, err := s.fetch()
+	if err == nil && data != nil {
+		s.Processed(data)
+		return data, nil
+	}
+	log.Print("Config source ", s, " error:", err, ", using cached config")
+
+	data, cacheErr := ioutil.ReadFile(s.cacheFile)
+	if cacheErr != nil {
+		return nil, fmt.Errorf("%s: %s", s, err)
+	}
+	s.last = data
+	return data, nil
+}
+
+// Changed fetches config and returns it if it differs from last processed config, it is
+// returned again until Processed is called
+func (s *ConfigSource) Changed() ([]byte, error) {
+	data, err := s.fetch()
+	if err != nil || data == nil || bytes.Equal(data, s.last) {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Processed records config as applied or rejected, unchanged source isn't reloaded again
+func (s *ConfigSource) Processed(data []byte) {
+	s.last = data
+	s.etag = s.fetchedEtag
+}
+
+// Save caches valid config for when source is unreachable
+func (s *ConfigSource) Save(data []byte) {
+	err := os.MkdirAll(path.Dir(s.cacheFile), defaultStateDirMode)
+	if err == nil {
+		err = ioutil.WriteFile(s.cacheFile, data, sourceCacheFileMode)
+	}
+	if err != nil {
+		log.Print("Config source cache error:", err)
+	}
+}
+
+// fetch returns nil data if http source is not modified since last fetch
+func (s *ConfigSource) fetch() ([]byte, error) {
+	switch s.config.Type {
+	case SourceHttp:
+		return s.fetchHttp()
+	case DiscoveryConsul:
+		return s.fetchConsul()
+	case DiscoveryEtcd:
+		return s.fetchEtcd()
+	}
+	return nil, ErrInvalidSourceType
+}
+
+func (s *ConfigSource) get(url string, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	return s.client.Do(req)
+}
+
+func (s *ConfigSource) fetchHttp() ([]byte, error) {
+	headers := map[string]string{}
+	if s.etag != "" {
+		headers["If-None-Match"] = s.etag
+	}
+	if s.config.Token != "" {
+		headers["Authorization"] = "Bearer " + s.config.Token
+	}
+
+	resp, err := s.get(s.config.Url, headers)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	s.fetchedEtag = resp.Header.Get("ETag")
+	return data, nil
+}
+
+func (s *ConfigSource) fetchConsul() ([]byte, error) {
+	headers := map[string]string{}
+	if s.config.Token != "" {
+		headers["X-Consul-Token"] = s.config.Token
+	}
+
+	resp, err := s.get(fmt.Sprintf("%s/v1/kv/%s?raw", s.config.Address, s.config.Key), headers)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrSourceKeyNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (s *ConfigSource) fetchEtcd() ([]byte, error) {
+	var headers map[string]string
+	if s.config.Token != "" {
+		headers = map[string]string{"Authorization": s.config.Token}
+	}
+
+	result := struct {
+		Kvs []struct {
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}{}
+	err := discoveryRequest(s.client, "POST", s.config.Address+"/v3/kv/range", headers, map[string]string{
+		"key": etcdKey(s.config.Key),
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Kvs) == 0 {
+		return nil, ErrSourceKeyNotFound
+	}
+	return base64.StdEncoding.DecodeString(result.Kvs[0].Value)
+}
+
+// startSourceWatcher polls config source and reloads apps when config changes
+func startSourceWatcher(source *ConfigSource, runningApps map[string]*App) {
+	go func() {
+		for range time.Tick(time.Duration(source.config.Interval) * time.Second) {
+			data, err := source.Changed()
+			if err != nil {
+				log.Print("Config source ", source, " error:", err)
+				continue
+			}
+			if data == nil {
+				continue
+			}
+
+			config, err := parseSourceConfig(source, data)
+			if err != nil {
+				log.Print("Config source ", source, " invalid config:", err)
+				source.Processed(data)
+				continue
+			}
+			source.Save(data)
+
+			log.Print("Config source ", source, " changed, reloading")
+			if err := reloadConfig(runningApps, config); err != nil {
+				// reload is retried on next poll
+				continue
+			}
+			source.Processed(data)
+		}
+	}()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// rejectTimeout limits how long a rejected connection is kept open to send its response
+	rejectTimeout = time.Second
+	// maxRejecting limits connections of a listener answered with 503 at once, over it
+	// rejected connections are closed right away
+	maxRejecting = 64
+)
+
+// connStats counts client connections of app external and preview listeners
+type connStats struct {
+	open     int64
+	accepted int64
+	rejected int64
+}
+
+// connListener counts open connections of app listener and rejects connections over
+// max_connections with 503, before they use a file descriptor for longer
+type connListener struct {
+	net.Listener
+	app       *App
+	rejecting chan struct{}
+}
+
+func (a *App) countConnections(listener net.Listener) net.Listener {
+	return &connListener{Listener: listener, app: a, rejecting: make(chan struct{}, maxRejecting)}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	stats := &l.app.conns
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		open := atomic.AddInt64(&stats.open, 1)
+		if max := l.app.config().MaxConnections; max > 0 && open > int64(max) {
+			atomic.AddInt64(&stats.open, -1)
+			atomic.AddInt64(&stats.rejected, 1)
+			l.reject(conn)
+			continue
+		}
+		atomic.AddInt64(&stats.accepted, 1)
+		return &countedConn{Conn: conn, stats: stats}, nil
+	}
+}
+
+// reject answers connection with 503 unless too many are being answered already
+func (l *connListener) reject(conn net.Conn) {
+	if l.app.config().TLS != nil {
+		// tls clients can't read a plain response
+		conn.Close()
+		return
+	}
+	select {
+	case l.rejecting <- struct{}{}:
+		go func() {
+			rejectConn(conn, l.app.config().RetryAfter)
+			<-l.rejecting
+		}()
+	default:
+		conn.Close()
+	}
+}
+
+// rejectConn answers connection over the limit with 503 and closes it
+func rejectConn(conn net.Conn, retryAfter int) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(rejectTimeout))
+	fmt.Fprintf(conn, "HTTP/1.1 503 Service Unavailable\r\nRetry-After: %d\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", retryAfter)
+	// read what client already sent, so closing doesn't reset the connection before
+	// client reads the response
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(conn, 64<<10))
+}
+
+// countedConn decrements open connections when it is closed, also when hijacked
+// connections of upgraded requests are closed by the proxy
+type countedConn struct {
+	net.Conn
+	stats *connStats
+	once  sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.stats.open, -1)
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hamaxx/gracevisor/deps/yaml.v2"
+)
+
+const ConvertSupervisord = "supervisord"
+
+var ErrInvalidConvertSource = errors.New("Only supervisord config can be converted")
+
+type convertedConfig struct {
+	Apps []*convertedApp `yaml:"apps"`
+}
+
+// convertedApp is an app entry of converted config, only set options are written
+type convertedApp struct {
+	Name               string           `yaml:"name"`
+	Command            string           `yaml:"command"`
+	Directory          string           `yaml:"directory,omitempty"`
+	Environment        []string         `yaml:"environment,omitempty"`
+	InheritEnvironment bool             `yaml:"inherit_environment"`
+	ExternalPort       uint16           `yaml:"external_port"`
+	StopSignalName     string           `yaml:"stop_signal,omitempty"`
+	StopTimeout        int              `yaml:"stop_timeout,omitempty"`
+	MaxRetries         int              `yaml:"max_retries,omitempty"`
+	User               *convertedUser   `yaml:"user,omitempty"`
+	Logger             *convertedLogger `yaml:"logger,omitempty"`
+}
+
+type convertedUser struct {
+	UserName string `yaml:"username"`
+}
+
+type convertedLogger struct {
+	StdoutLogFile string `yaml:"stdout_log_file,omitempty"`
+	StderrLogFile string `yaml:"stderr_log_file,omitempty"`
+}
+
+// iniSection is a section of supervisord ini file
+type iniSection struct {
+	name   string
+	values map[string]string
+}
+
+// parseIni parses supervisord flavour of ini, indented lines continue previous value
+func parseIni(r io.Reader) ([]*iniSection, error) {
+	sections := []*iniSection{}
+	var section *iniSection
+	lastKey := ""
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, " ;"); i >= 0 {
+			line = line[:i]
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, ";") || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			section = &iniSection{name: strings.TrimSpace(trimmed[1 : len(trimmed)-1]), values: map[string]string{}}
+			sections = append(sections, section)
+			lastKey = ""
+			continue
+		}
+		if section == nil {
+			return nil, fmt.Errorf("Option outside of section: %s", trimmed)
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if lastKey != "" {
+				section.values[lastKey] += " " + trimmed
+				continue
+			}
+		}
+
+		sep := strings.IndexAny(trimmed, "=:")
+		if sep < 0 {
+			return nil, fmt.Errorf("Invalid line in [%s]: %s", section.name, trimmed)
+		}
+		lastKey = strings.ToLower(strings.TrimSpace(trimmed[:sep]))
+		section.values[lastKey] = strings.TrimSpace(trimmed[sep+1:])
+	}
+	return sections, scanner.Err()
+}
+
+// parseSupervisordEnvironment parses KEY="val",KEY2=val2 into KEY=val pairs
+func parseSupervisordEnvironment(env string) []string {
+	pairs := []string{}
+	current := ""
+	quote := rune(0)
+	for _, c := range env {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == ',':
+			pairs = append(pairs, strings.TrimSpace(current))
+			current = ""
+		default:
+			current += string(c)
+		}
+	}
+	if strings.TrimSpace(current) != "" {
+		pairs = append(pairs, strings.TrimSpace(current))
+	}
+	return pairs
+}
+
+// convertSupervisord converts [program:x] sections into gracevisor apps,
+// options without gracevisor equivalent are reported as warnings
+func convertSupervisord(r io.Reader, warn func(string)) (*convertedConfig, error) {
+	sections, err := parseIni(r)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &convertedConfig{}
+
+	externalPort := defaultExternalPort
+	for _, section := range sections {
+		if section.name == "include" {
+			warn(fmt.Sprintf("[include] files %s are not converted, convert them separately", section.values["files"]))
+			continue
+		}
+		if !strings.HasPrefix(section.name, "program:") {
+			continue
+		}
+
+		name := strings.TrimPrefix(section.name, "program:")
+		values := section.values
+		app := &convertedApp{
+			Name:               name,
+			Command:            values["command"],
+			Directory:          values["directory"],
+			InheritEnvironment: true,
+			ExternalPort:       externalPort,
+		}
+		externalPort++
+
+		if env, ok := values["environment"]; ok {
+			app.Environment = parseSupervisordEnvironment(env)
+		}
+		if !strings.Contains(app.Command, PortBadge) {
+			app.Environment = append(app.Environment, "PORT="+PortBadge)
+			warn(fmt.Sprintf("%s: app must listen on internal port from $PORT, external port is %d", name, app.ExternalPort))
+		}
+
+		if user := values["user"]; user != "" {
+			app.User = &convertedUser{UserName: user}
+		}
+		if signal := strings.ToUpper(values["stopsignal"]); signal != "" {
+			app.StopSignalName = strings.TrimPrefix(signal, "SIG")
+		}
+		if wait, err := strconv.Atoi(values["stopwaitsecs"]); err == nil {
+			app.StopTimeout = wait
+		}
+		if retries, err := strconv.Atoi(values["startretries"]); err == nil && retries > 0 {
+			app.MaxRetries = retries
+		}
+		if autorestart := strings.ToLower(values["autorestart"]); autorestart == "false" {
+			app.MaxRetries = -1
+		}
+
+		logger := &convertedLogger{}
+		if stdout := values["stdout_logfile"]; stdout != "" && stdout != "AUTO" && stdout != "NONE" {
+			logger.StdoutLogFile = stdout
+		}
+		if stderr := values["stderr_logfile"]; stderr != "" && stderr != "AUTO" && stderr != "NONE" {
+			logger.StderrLogFile = stderr
+		}
+		if strings.ToLower(values["redirect_stderr"]) == "true" && logger.StdoutLogFile != "" {
+			logger.StderrLogFile = logger.StdoutLogFile
+		}
+		if logger.StdoutLogFile != "" || logger.StderrLogFile != "" {
+			app.Logger = logger
+		}
+
+		if numprocs, err := strconv.Atoi(values["numprocs"]); err == nil && numprocs > 1 {
+			warn(fmt.Sprintf("%s: numprocs %d is not supported, gracevisor runs one active instance", name, numprocs))
+		}
+		if strings.ToLower(values["autostart"]) == "false" {
+			warn(fmt.Sprintf("%s: autostart=false is not supported, app is started with gracevisord", name))
+		}
+
+		unknown := []string{}
+		for key, value := range values {
+			if strings.Contains(value, "%(") {
+				warn(fmt.Sprintf("%s: %s uses supervisord expansion %s, replace it manually", name, key, value))
+			}
+			switch key {
+			case "command", "directory", "environment", "user", "stopsignal", "stopwaitsecs", "startretries",
+				"autorestart", "stdout_logfile", "stderr_logfile", "redirect_stderr", "numprocs", "autostart":
+			default:
+				unknown = append(unknown, key)
+			}
+		}
+		if len(unknown) > 0 {
+			sort.Strings(unknown)
+			warn(fmt.Sprintf("%s: options not converted: %s", name, strings.Join(unknown, ", ")))
+		}
+
+		config.Apps = append(config.Apps, app)
+	}
+
+	return config, nil
+}
+
+// convertConfig writes gracevisor.yaml apps converted from other supervisor config to stdout
+func convertConfig(from string, fn string) error {
+	if from != ConvertSupervisord {
+		return ErrInvalidConvertSource
+	}
+
+	file, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	config, err := convertSupervisord(file, func(warning string) {
+		fmt.Fprintln(os.Stderr, "warning:", warning)
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %s", fn, err)
+	}
+
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const corePatternFile = "/proc/sys/kernel/core_pattern"
+
+// setCoreLimit sets RLIMIT_CORE of started process when core dumps are enabled
+func setCoreLimit(config *AppConfig, pid int) error {
+	if config.CoreDump == nil || !config.CoreDump.Enabled {
+		return nil
+	}
+
+	limit := syscall.Rlimit{Cur: ^uint64(0), Max: ^uint64(0)}
+	if config.CoreDump.MaxSize > 0 {
+		limit.Cur = uint64(config.CoreDump.MaxSize) * 1024 * 1024
+		limit.Max = limit.Cur
+	}
+
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), syscall.RLIMIT_CORE,
+		uintptr(unsafe.Pointer(&limit)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// readCorePattern returns kernel core pattern, used to tell where cores end up
+func readCorePattern() string {
+	data, err := ioutil.ReadFile(corePatternFile)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// coreDumpDir returns working dir of processes of app without directory, kernel writes
+// cores of relative core patterns to it. Absolute and piped patterns don't need one.
+func coreDumpDir(config *AppConfig) string {
+	if config.CoreDump == nil || !config.CoreDump.Enabled {
+		return ""
+	}
+	if pattern := readCorePattern(); strings.HasPrefix(pattern, "/") || strings.HasPrefix(pattern, "|") {
+		return ""
+	}
+	return config.CoreDump.Dir
+}
+
+// coreFileHint returns probable location of core produced by process pid of instance
+func (i *Instance) coreFileHint(pid int) string {
+	pattern := readCorePattern()
+	if pattern == "" {
+		return ""
+	}
+	if strings.HasPrefix(pattern, "|") {
+		helper := strings.Fields(pattern[1:])
+		if len(helper) == 0 {
+			return "piped to core helper"
+		}
+		return fmt.Sprintf("piped to %s", helper[0])
+	}
+
+	exe := filepath.Base(i.cmd.Path)
+	if len(exe) > 15 {
+		exe = exe[:15]
+	}
+	core := strings.NewReplacer(
+		"%%", "%",
+		"%p", fmt.Sprint(pid),
+		"%e", exe,
+	).Replace(pattern)
+
+	if !filepath.IsAbs(core) {
+		core = filepath.Join(i.cmd.Dir, core)
+	}
+	return core
+}
+
+// checkCoreDump records core file hint if exited process dumped core
+func (i *Instance) checkCoreDump(state *os.ProcessState) {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.CoreDump() {
+		i.coreDumped = true
+		i.coreFile = i.coreFileHint(state.Pid())
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// setCoreLimit is a noop, core_dump is rejected by checkPlatform outside linux
+func setCoreLimit(config *AppConfig, pid int) error {
+	return nil
+}
+
+// coreDumpDir returns no dir, core_dump is rejected outside linux
+func coreDumpDir(config *AppConfig) string {
+	return ""
+}
+
+// checkCoreDump is a noop, core files are only located on linux
+func (i *Instance) checkCoreDump(state *os.ProcessState) {}
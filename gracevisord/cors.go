@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// corsWriter replaces cors headers of instance responses with the ones of app policy,
+// so browsers don't get them twice
+type corsWriter struct {
+	http.ResponseWriter
+	header      http.Header
+	wroteHeader bool
+}
+
+func (w *corsWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		for name := range w.ResponseWriter.Header() {
+			if strings.HasPrefix(name, "Access-Control-") {
+				w.ResponseWriter.Header().Del(name)
+			}
+		}
+		for name, values := range w.header {
+			w.ResponseWriter.Header()[name] = values
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *corsWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *corsWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets reverse proxy hijack connection of upgraded requests
+func (w *corsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// allowsOrigin checks origin against origins of policy, *.example.com matches subdomains
+func (c *CorsConfig) allowsOrigin(origin string) bool {
+	for _, allowed := range c.Origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		if strings.HasPrefix(allowed, "*.") {
+			_, host, ok := strings.Cut(origin, "://")
+			if ok && strings.HasSuffix(strings.ToLower(host), strings.ToLower(allowed[1:])) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allowsHeaders checks headers of Access-Control-Request-Headers
+func (c *CorsConfig) allowsHeaders(requested string) bool {
+	for _, name := range strings.Split(requested, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" && !c.allowsHeader(name) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *CorsConfig) allowsHeader(name string) bool {
+	for _, allowed := range c.Headers {
+		if allowed == "*" || strings.EqualFold(allowed, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowOrigin is Access-Control-Allow-Origin of origin, policies allowing any origin
+// without credentials answer with *
+func (c *CorsConfig) allowOrigin(origin string) string {
+	if !c.Credentials && contains(c.Origins, "*") {
+		return "*"
+	}
+	return origin
+}
+
+// handler answers preflight requests and adds cors headers to responses of next,
+// responses to other origins get no cors headers so browsers block them
+func (c *CorsConfig) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		rw.Header().Add("Vary", "Origin")
+
+		requestMethod := req.Header.Get("Access-Control-Request-Method")
+		if req.Method == http.MethodOptions && requestMethod != "" {
+			rw.Header().Add("Vary", "Access-Control-Request-Method")
+			rw.Header().Add("Vary", "Access-Control-Request-Headers")
+			requestHeaders := req.Header.Get("Access-Control-Request-Headers")
+			if !c.allowsOrigin(origin) || !contains(c.Methods, requestMethod) || !c.allowsHeaders(requestHeaders) {
+				rw.WriteHeader(http.StatusForbidden)
+				return
+			}
+			rw.Header().Set("Access-Control-Allow-Origin", c.allowOrigin(origin))
+			rw.Header().Set("Access-Control-Allow-Methods", strings.Join(c.Methods, ", "))
+			if requestHeaders != "" {
+				// requested headers were checked, * isn't honored with credentials
+				rw.Header().Set("Access-Control-Allow-Headers", requestHeaders)
+			}
+			if c.Credentials {
+				rw.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			if c.MaxAge > 0 {
+				rw.Header().Set("Access-Control-Max-Age", strconv.Itoa(c.MaxAge))
+			}
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		header := http.Header{}
+		if !c.allowsOrigin(origin) {
+			// cors headers of instance are dropped too
+			next.ServeHTTP(&corsWriter{ResponseWriter: rw, header: header}, req)
+			return
+		}
+		header.Set("Access-Control-Allow-Origin", c.allowOrigin(origin))
+		if c.Credentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if len(c.ExposeHeaders) > 0 {
+			header.Set("Access-Control-Expose-Headers", strings.Join(c.ExposeHeaders, ", "))
+		}
+		next.ServeHTTP(&corsWriter{ResponseWriter: rw, header: header}, req)
+	})
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	runtimepprof "runtime/pprof"
+)
+
+// listenDebug binds loopback debug listener, before privileges are dropped
+func listenDebug(config *DebugConfig) (net.Listener, error) {
+	return net.Listen("tcp", hostPort(config.Host, config.Port))
+}
+
+// serveDebug serves pprof and expvar endpoints of gracevisord
+func serveDebug(listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	if err := http.Serve(listener, mux); err != nil {
+		log.Print("Debug server error:", err)
+	}
+}
+
+// goroutineDump returns stacks of all gracevisord goroutines
+func goroutineDump() (string, error) {
+	var buf bytes.Buffer
+	if err := runtimepprof.Lookup("goroutine").WriteTo(&buf, 2); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/hamaxx/gracevisor/common/report"
+)
+
+var (
+	ErrNoPreviousDeploy = errors.New("No previous deploy to roll back to")
+	ErrUnknownVersion   = errors.New("Version was not deployed recently")
+)
+
+// Deploys is a bounded on-disk log of deployed versions of an app
+type Deploys struct {
+	records *stateLog[*report.DeployRecord]
+	mu      sync.Mutex
+}
+
+func NewDeploys(stateDir string, appName string, maxRecords int) *Deploys {
+	records, err := loadStateLog[*report.DeployRecord](stateDir, "deploys", appName, maxRecords)
+	if err != nil {
+		log.Print(appName, ": Deploys load error:", err)
+	}
+
+	return &Deploys{records: records}
+}
+
+// Add appends record and persists deploys, records equal to the last one are skipped
+func (d *Deploys) Add(record *report.DeployRecord) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	items := d.records.items
+	if n := len(items); n > 0 && !record.Rollback && sameDeploy(items[n-1], record) {
+		return
+	}
+
+	if err := d.records.append(record); err != nil {
+		log.Print("Deploys save error:", err)
+	}
+}
+
+// Previous finds the newest deploy of version to, or the newest deploy
+// with a version different from current if to is empty
+func (d *Deploys) Previous(current string, to string) (*report.DeployRecord, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for n := len(d.records.items) - 1; n >= 0; n-- {
+		record := d.records.items[n]
+		if to != "" && record.Version == to {
+			return record, nil
+		}
+		if to == "" && record.Version != current {
+			return record, nil
+		}
+	}
+
+	if to != "" {
+		return nil, ErrUnknownVersion
+	}
+	return nil, ErrNoPreviousDeploy
+}
+
+// Records returns copy of recorded deploys, oldest first
+func (d *Deploys) Records() []*report.DeployRecord {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.records.copy()
+}
+
+func sameDeploy(a, b *report.DeployRecord) bool {
+	if a.Version != b.Version || a.Command != b.Command || len(a.Environment) != len(b.Environment) ||
+		len(a.Args) != len(b.Args) {
+		return false
+	}
+	for i := range a.Args {
+		if a.Args[i] != b.Args[i] {
+			return false
+		}
+	}
+	for i := range a.Environment {
+		if a.Environment[i] != b.Environment[i] {
+			return false
+		}
+	}
+	return true
+}
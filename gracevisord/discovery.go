@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DiscoveryConsul = "consul"
+	DiscoveryEtcd   = "etcd"
+
+	discoveryTimeout = 5 * time.Second
+)
+
+// Registry registers app external endpoints in a service discovery system
+type Registry interface {
+	// Register registers or refreshes app endpoint with its health
+	Register(app *App, healthy bool) error
+	Deregister(app *App) error
+	// Lookup returns healthy host:port endpoints of a service
+	Lookup(service string) ([]string, error)
+}
+
+func NewRegistry(config *DiscoveryConfig) Registry {
+	client := &http.Client{Timeout: discoveryTimeout}
+	switch config.Type {
+	case DiscoveryConsul:
+		return &ConsulRegistry{config: config, client: client}
+	case DiscoveryEtcd:
+		return &EtcdRegistry{config: config, client: client, leases: map[string]string{}}
+	}
+	return nil
+}
+
+// startDiscovery keeps apps with an active instance registered, health follows
+// rotation of active instance and registrations are refreshed every third of ttl
+func startDiscovery(config *DiscoveryConfig, registry Registry, runningApps map[string]*App) {
+	refresh := time.Duration(config.Ttl) * time.Second / 3
+
+	type registration struct {
+		healthy bool
+		time    time.Time
+	}
+	registered := map[string]*registration{}
+
+	go func() {
+		for range time.Tick(time.Second) {
+			for name, app := range runningApps {
+				if app.config().Proxy == ProxyNone {
+					continue
+				}
+				active := app.activeInstance
+				current, ok := registered[name]
+
+				if active == nil {
+					if ok {
+						if err := registry.Deregister(app); err != nil {
+							log.Print(name, ": Discovery deregister error:", err)
+							continue
+						}
+						delete(registered, name)
+					}
+					continue
+				}
+
+				healthy := active.inRotation() && !active.unhealthy
+				if ok && current.healthy == healthy && time.Since(current.time) < refresh {
+					continue
+				}
+				if err := registry.Register(app, healthy); err != nil {
+					log.Print(name, ": Discovery register error:", err)
+					continue
+				}
+				registered[name] = &registration{healthy: healthy, time: time.Now()}
+			}
+		}
+	}()
+}
+
+func discoveryRequest(client *http.Client, method string, url string, headers map[string]string, body interface{}, result interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New(resp.Status)
+	}
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
+
+// ConsulRegistry registers apps as consul agent services with a ttl check
+type ConsulRegistry struct {
+	config *DiscoveryConfig
+	client *http.Client
+}
+
+func (r *ConsulRegistry) headers() map[string]string {
+	if r.config.Token == "" {
+		return nil
+	}
+	return map[string]string{"X-Consul-Token": r.config.Token}
+}
+
+func (r *ConsulRegistry) serviceId(app *App) string {
+	return "gracevisor-" + app.config().Name
+}
+
+func (r *ConsulRegistry) Register(app *App, healthy bool) error {
+	id := r.serviceId(app)
+	ttl := fmt.Sprintf("%ds", r.config.Ttl)
+
+	service := map[string]interface{}{
+		"ID":      id,
+		"Name":    app.config().Name,
+		"Address": app.config().ExternalHost,
+		"Port":    app.config().ExternalPort,
+		"Check": map[string]interface{}{
+			"CheckID":                        id,
+			"TTL":                            ttl,
+			"DeregisterCriticalServiceAfter": fmt.Sprintf("%ds", r.config.Ttl*4),
+		},
+	}
+	if err := discoveryRequest(r.client, "PUT", r.config.Address+"/v1/agent/service/register", r.headers(), service, nil); err != nil {
+		return err
+	}
+
+	status := "pass"
+	if !healthy {
+		status = "fail"
+	}
+	return discoveryRequest(r.client, "PUT", fmt.Sprintf("%s/v1/agent/check/%s/%s", r.config.Address, status, id), r.headers(), nil, nil)
+}
+
+func (r *ConsulRegistry) Deregister(app *App) error {
+	return discoveryRequest(r.client, "PUT", fmt.Sprintf("%s/v1/agent/service/deregister/%s", r.config.Address, r.serviceId(app)), r.headers(), nil, nil)
+}
+
+func (r *ConsulRegistry) Lookup(service string) ([]string, error) {
+	entries := []struct {
+		Node struct {
+			Address string
+		}
+		Service struct {
+			Address string
+			Port    int
+		}
+	}{}
+	err := discoveryRequest(r.client, "GET", fmt.Sprintf("%s/v1/health/service/%s?passing", r.config.Address, url.PathEscape(service)), r.headers(), nil, &entries)
+	if err != nil {
+		return nil, err
+	}
+
+	hostPorts := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		hostPorts = append(hostPorts, net.JoinHostPort(host, strconv.Itoa(entry.Service.Port)))
+	}
+	return hostPorts, nil
+}
+
+// EtcdRegistry stores app endpoints as json under prefix using etcd v3 json api,
+// keys are attached to a lease so they expire if gracevisord dies
+type EtcdRegistry struct {
+	config *DiscoveryConfig
+	client *http.Client
+	leases map[string]string
+}
+
+type etcdEndpoint struct {
+	Host    string `json:"host"`
+	Port    uint16 `json:"port"`
+	Healthy bool   `json:"healthy"`
+}
+
+func (r *EtcdRegistry) headers() map[string]string {
+	if r.config.Token == "" {
+		return nil
+	}
+	return map[string]string{"Authorization": r.config.Token}
+}
+
+func etcdKey(key string) string {
+	return base64.StdEncoding.EncodeToString([]byte(key))
+}
+
+func (r *EtcdRegistry) Register(app *App, healthy bool) error {
+	name := app.config().Name
+
+	if lease, ok := r.leases[name]; ok {
+		err := discoveryRequest(r.client, "POST", r.config.Address+"/v3/lease/keepalive", r.headers(), map[string]string{"ID": lease}, nil)
+		if err != nil {
+			delete(r.leases, name)
+		}
+	}
+	if _, ok := r.leases[name]; !ok {
+		grant := struct {
+			ID string `json:"ID"`
+		}{}
+		err := discoveryRequest(r.client, "POST", r.config.Address+"/v3/lease/grant", r.headers(), map[string]int{"TTL": r.config.Ttl}, &grant)
+		if err != nil {
+			return err
+		}
+		r.leases[name] = grant.ID
+	}
+
+	value, err := json.Marshal(&etcdEndpoint{
+		Host:    app.config().ExternalHost,
+		Port:    app.config().ExternalPort,
+		Healthy: healthy,
+	})
+	if err != nil {
+		return err
+	}
+
+	return discoveryRequest(r.client, "POST", r.config.Address+"/v3/kv/put", r.headers(), map[string]string{
+		"key":   etcdKey(r.config.Prefix + name),
+		"value": base64.StdEncoding.EncodeToString(value),
+		"lease": r.leases[name],
+	}, nil)
+}
+
+func (r *EtcdRegistry) Deregister(app *App) error {
+	delete(r.leases, app.config().Name)
+	return discoveryRequest(r.client, "POST", r.config.Address+"/v3/kv/deleterange", r.headers(), map[string]string{
+		"key": etcdKey(r.config.Prefix + app.config().Name),
+	}, nil)
+}
+
+// Lookup returns healthy endpoints stored under prefix+service or prefix+service/*
+func (r *EtcdRegistry) Lookup(service string) ([]string, error) {
+	key := r.config.Prefix + service
+	result := struct {
+		Kvs []struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}{}
+	// '0' follows '/', range covers key and key/ children
+	err := discoveryRequest(r.client, "POST", r.config.Address+"/v3/kv/range", r.headers(), map[string]string{
+		"key":       etcdKey(key),
+		"range_end": etcdKey(key + "0"),
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	hostPorts := make([]string, 0, len(result.Kvs))
+	for _, kv := range result.Kvs {
+		name, err := base64.StdEncoding.DecodeString(kv.Key)
+		if err != nil || (string(name) != key && !strings.HasPrefix(string(name), key+"/")) {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err != nil {
+			continue
+		}
+		endpoint := &etcdEndpoint{}
+		if err := json.Unmarshal(value, endpoint); err != nil || !endpoint.Healthy {
+			continue
+		}
+		hostPorts = append(hostPorts, net.JoinHostPort(endpoint.Host, strconv.Itoa(int(endpoint.Port))))
+	}
+	return hostPorts, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AppTypeProcess = "process"
+	AppTypeDocker  = "docker"
+	AppTypeBackend = "backend"
+
+	dockerBinary = "docker"
+)
+
+// containerBoot is unique to this gracevisord run, instance ids start at 1 again after a
+// restart and containers left running by previous run would keep their names
+var containerBoot = strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 36)
+
+func (i *Instance) containerName() string {
+	return fmt.Sprintf("gracevisor-%s-%s-%d", i.app.config().Name, containerBoot, i.id)
+}
+
+// appPort is port the app listens on, docker apps listen on container port which is
+// published on internal port of instance
+func (i *Instance) appPort() uint16 {
+	if i.app.config().Type == AppTypeDocker {
+		return i.app.config().ContainerPort
+	}
+	return i.internalPort
+}
+
+// dockerCommand runs app image in a foreground container with instance port published,
+// so stop signals are proxied to the container and output goes to the app logger
+func dockerCommand(i *Instance, env []string) *exec.Cmd {
+	config := i.app.config()
+
+	publishHost := config.InternalHost
+	if publishHost == defaultHost {
+		publishHost = "127.0.0.1"
+	}
+	if strings.Contains(publishHost, ":") {
+		publishHost = "[" + publishHost + "]"
+	}
+
+	args := []string{
+		"run", "--rm",
+		"--name", i.containerName(),
+		"--sig-proxy=true",
+		"-p", fmt.Sprintf("%s:%d:%d", publishHost, i.internalPort, config.ContainerPort),
+	}
+	// pass only names on command line, values come from client environment
+	// so secrets do not show up in process list
+	for _, e := range env {
+		args = append(args, "-e", strings.SplitN(e, "=", 2)[0])
+	}
+
+	image, imageArgs := i.commandLine()
+	args = append(args, image)
+	args = append(args, imageArgs...)
+
+	cmd := exec.Command(dockerBinary, args...)
+	cmd.Dir = i.parseBadges(config.Directory)
+	cmd.Env = append(os.Environ(), env...)
+	return cmd
+}
+
+// killContainer kills instance container, killing docker client alone leaves it running
+func (i *Instance) killContainer() error {
+	return children.run(exec.Command(dockerBinary, "kill", i.containerName()).Run)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+const (
+	// doctorMinFileLimit is the open files limit below which doctor warns
+	doctorMinFileLimit = 4096
+)
+
+// doctor checks common causes of gracevisord and app failures and prints fixes
+type doctor struct {
+	w        io.Writer
+	failures int
+}
+
+func (d *doctor) ok(format string, args ...interface{}) {
+	fmt.Fprintf(d.w, "ok    %s\n", fmt.Sprintf(format, args...))
+}
+
+func (d *doctor) warn(fix string, format string, args ...interface{}) {
+	fmt.Fprintf(d.w, "warn  %s\n      fix: %s\n", fmt.Sprintf(format, args...), fix)
+}
+
+func (d *doctor) fail(fix string, format string, args ...interface{}) {
+	fmt.Fprintf(d.w, "FAIL  %s\n      fix: %s\n", fmt.Sprintf(format, args...), fix)
+	d.failures++
+}
+
+// runDoctor checks config, log dirs, users, commands, limits, ports and rpc listener,
+// healthchecks are probed when gracevisord is already running. It returns the number
+// of failed checks.
+func runDoctor(w io.Writer, configPath string) int {
+	d := &doctor{w: w}
+
+	if errs := checkConfig(configPath); len(errs) > 0 {
+		for _, err := range errs {
+			d.fail("correct the config, `gracevisord check` lists all errors", "config: %s", err)
+		}
+		return d.failures
+	}
+	config, err := ParseConfing(configPath)
+	if err != nil {
+		d.fail("correct the config, `gracevisord check` lists all errors", "config: %s", err)
+		return d.failures
+	}
+	d.ok("config %s", configPath)
+
+	running := d.checkRpc(config)
+	d.checkLogDirs(config)
+	d.checkUsers(config)
+	d.checkFileLimit(config)
+	d.checkPortRange(config, running)
+	d.checkExternalPorts(config, running)
+	if running {
+		d.checkHealth(config)
+	}
+
+	if d.failures > 0 {
+		fmt.Fprintf(w, "%d problems found\n", d.failures)
+	}
+	return d.failures
+}
+
+// checkRpc checks that rpc listener can be bound, a port in use by a listening
+// process is taken as running gracevisord
+func (d *doctor) checkRpc(config *Config) bool {
+	address := hostPort(config.Rpc.Host, config.Rpc.Port)
+	listener, err := net.Listen("tcp", address)
+	if err == nil {
+		listener.Close()
+		d.ok("rpc %s can be bound", address)
+		return false
+	}
+
+	conn, dialErr := net.Dial("tcp", address)
+	if dialErr != nil {
+		d.fail("choose another rpc port or host", "rpc %s can't be bound: %s", address, err)
+		return false
+	}
+	conn.Close()
+	d.ok("rpc %s is in use, gracevisord is probably running", address)
+	return true
+}
+
+// checkLogDirs checks that log files can be created in all log dirs
+func (d *doctor) checkLogDirs(config *Config) {
+	dirs := map[string]bool{config.Logger.LogDir: true, path.Dir(config.Logger.LogFile): true}
+	if config.Logger.AuditLogFile != "" {
+		dirs[path.Dir(config.Logger.AuditLogFile)] = true
+	}
+	for _, app := range config.Apps {
+		dirs[path.Dir(app.Logger.StdoutLogFile)] = true
+		dirs[path.Dir(app.Logger.StderrLogFile)] = true
+	}
+
+	sorted := []string{}
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Strings(sorted)
+	for _, dir := range sorted {
+		f, err := ioutil.TempFile(dir, ".gracevisor-doctor")
+		if err != nil {
+			d.fail("create the directory and make it writable by the user running gracevisord, or change logger log_dir",
+				"log dir %s is not writable: %s", dir, err)
+			continue
+		}
+		f.Close()
+		os.Remove(f.Name())
+		d.ok("log dir %s is writable", dir)
+	}
+}
+
+// checkUsers reports resolved users and checks that commands can be executed by them
+func (d *doctor) checkUsers(config *Config) {
+	if config.DaemonUser != nil && config.DaemonUser.UserName != "" {
+		if os.Geteuid() != 0 {
+			d.fail("start gracevisord as root or remove daemon_user", "daemon user %s needs gracevisord started as root", config.DaemonUser.UserName)
+		} else {
+			d.ok("daemon user %s (uid %d)", config.DaemonUser.UserName, config.DaemonUser.Uid)
+		}
+	}
+
+	for _, app := range config.Apps {
+		if app.User.UserName != "" {
+			if os.Geteuid() != 0 && uint32(os.Geteuid()) != app.User.Uid {
+				d.fail("start gracevisord as root or remove user of the app", "app %s user %s needs gracevisord started as root", app.Name, app.User.UserName)
+				continue
+			}
+			d.ok("app %s user %s (uid %d, gid %d)", app.Name, app.User.UserName, app.User.Uid, app.User.Gid)
+		}
+		if app.Type != AppTypeProcess || app.Shell || app.Fetch != nil {
+			continue
+		}
+
+		instance := &Instance{app: &App{command: app.Command, args: app.Args}, version: app.Version}
+		instance.app.configValue.Store(app)
+		cmdPath, _ := instance.commandLine()
+		resolved, err := checkExecutable(app, instance.parseBadges(app.Directory), cmdPath)
+		if err != nil {
+			d.fail("install the command or correct command, directory and user of the app", "app %s command: %s", app.Name, err)
+			continue
+		}
+		d.ok("app %s command %s", app.Name, resolved)
+	}
+}
+
+// checkFileLimit warns about low open files limit, every proxied connection needs two
+func (d *doctor) checkFileLimit(config *Config) {
+	soft, hard, err := openFileLimit()
+	if err != nil {
+		return
+	}
+	if soft < doctorMinFileLimit {
+		d.warn(fmt.Sprintf("raise it with `ulimit -n %d` or LimitNOFILE= in the systemd unit, hard limit is %d", doctorMinFileLimit, hard),
+			"open files limit %d is low for proxying", soft)
+		return
+	}
+	d.ok("open files limit %d", soft)
+}
+
+// checkPortRange counts ports of port_range that can't be bound, with gracevisord
+// running they are partly used by its instances
+func (d *doctor) checkPortRange(config *Config, running bool) {
+	hosts := map[string]bool{}
+	for _, app := range config.Apps {
+		hosts[app.InternalHost] = true
+	}
+	size := int(config.PortRange.To - config.PortRange.From)
+
+	for host := range hosts {
+		busy := 0
+		for port := config.PortRange.From; port < config.PortRange.To; port++ {
+			listener, err := net.Listen("tcp", hostPort(host, port))
+			if err != nil {
+				busy++
+				continue
+			}
+			listener.Close()
+		}
+
+		free := size - busy
+		switch {
+		case free < 2*len(config.Apps):
+			d.fail("stop processes using the range or choose another port_range", "port range %d-%d on %s has %d free ports, restarts of %d apps need %d",
+				config.PortRange.From, config.PortRange.To, host, free, len(config.Apps), 2*len(config.Apps))
+		case busy > 0 && !running:
+			d.warn("choose a port_range not used by other processes", "%d ports of port range %d-%d on %s are used by other processes",
+				busy, config.PortRange.From, config.PortRange.To, host)
+		default:
+			d.ok("port range %d-%d on %s has %d free ports", config.PortRange.From, config.PortRange.To, host, free)
+		}
+	}
+}
+
+// checkExternalPorts checks that external and preview ports can be bound, they are
+// bound by gracevisord itself when it is running
+func (d *doctor) checkExternalPorts(config *Config, running bool) {
+	if running {
+		return
+	}
+	for _, app := range config.Apps {
+		if app.Proxy == ProxyNone {
+			continue
+		}
+		for _, port := range []uint16{app.ExternalPort, app.PreviewPort} {
+			if port == 0 {
+				continue
+			}
+			address := hostPort(app.ExternalHost, port)
+			listener, err := listen(address, app.ReusePort)
+			if err != nil {
+				d.fail("stop the process using the port, choose another port or start gracevisord as root for ports below 1024",
+					"app %s can't listen on %s: %s", app.Name, address, err)
+				continue
+			}
+			listener.Close()
+			d.ok("app %s can listen on %s", app.Name, address)
+		}
+	}
+}
+
+// checkHealth probes healthchecks of running apps through their external address, tls
+// apps are probed over https without verifying their certificates
+func (d *doctor) checkHealth(config *Config) {
+	for _, app := range config.Apps {
+		if app.Proxy == ProxyNone || app.HealthCheck == "" {
+			continue
+		}
+		address := hostPort(app.ExternalHost, app.ExternalPort)
+		client, scheme := healthCheckClient, "http"
+		if app.TLS != nil {
+			if app.TLS.ClientAuth == "require" || app.TLS.ClientAuth == "require_and_verify" {
+				d.warn(fmt.Sprintf("probe https://%s%s with a client certificate", address, app.HealthCheck),
+					"app %s healthcheck skipped, client_auth %s requires client certificates", app.Name, app.TLS.ClientAuth)
+				continue
+			}
+			client, scheme = doctorTLSClient(app), "https"
+		}
+		if !probeWith(client, scheme, app, address, app.HealthCheck) {
+			d.fail(fmt.Sprintf("check `gracevisorctl status %s` and `gracevisorctl logs %s`", app.Name, app.Name),
+				"app %s healthcheck %s://%s%s failed", app.Name, scheme, address, app.HealthCheck)
+			continue
+		}
+		d.ok("app %s healthcheck %s://%s%s", app.Name, scheme, address, app.HealthCheck)
+	}
+}
+
+// doctorTLSClient is healthcheck client for tls apps, server name is taken from Host
+// healthcheck header so the certificate for it is served
+func doctorTLSClient(app *AppConfig) *http.Client {
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	for name, value := range app.HealthCheckHeaders {
+		if http.CanonicalHeaderKey(name) == "Host" {
+			if host, _, err := net.SplitHostPort(value); err == nil {
+				value = host
+			}
+			tlsConfig.ServerName = value
+		}
+	}
+	return &http.Client{
+		Timeout:   HealthCheckTimeout * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// dryRun prints what gracevisord would start for config without binding or starting
+// anything: listeners, internal ports from the pool, users and commands. It returns
+// the number of apps whose command can't be run.
+func dryRun(w io.Writer, config *Config) int {
+	portPool := NewPortPool(config.PortRange)
+	for _, appConfig := range config.Apps {
+		portPool.setFixed(appConfig.InternalPorts)
+	}
+
+	failed := 0
+	for _, appConfig := range config.Apps {
+		fmt.Fprintf(w, "app %s (%s)\n", appConfig.Name, appConfig.Type)
+		if appConfig.Proxy != ProxyNone {
+			fmt.Fprintf(w, "  listen %s\n", hostPort(appConfig.ExternalHost, appConfig.ExternalPort))
+			if appConfig.PreviewPort != 0 {
+				fmt.Fprintf(w, "  preview %s\n", hostPort(appConfig.ExternalHost, appConfig.PreviewPort))
+			}
+		}
+		if appConfig.Type == AppTypeBackend {
+			fmt.Fprintf(w, "  backends %s%s\n", strings.Join(appConfig.Backends, ", "), appConfig.BackendService)
+			continue
+		}
+
+		app := &App{version: appConfig.Version, command: appConfig.Command, args: appConfig.Args}
+		app.configValue.Store(appConfig)
+		instance := &Instance{app: app, version: appConfig.Version}
+		port, err := portPool.ReservePort(instance)
+		if err != nil {
+			fmt.Fprintf(w, "  internal port error: %s\n", err)
+			failed++
+			continue
+		}
+		instance.internalPort = port
+		fmt.Fprintf(w, "  internal port %d\n", port)
+
+		user := appConfig.User
+		if user.UserName != "" {
+			fmt.Fprintf(w, "  user %s (uid %d, gid %d)\n", user.UserName, user.Uid, user.Gid)
+		} else {
+			fmt.Fprintf(w, "  user of gracevisord (uid %d)\n", os.Getuid())
+		}
+
+		cmdPath, cmdArgs := instance.commandLine()
+		if appConfig.Type == AppTypeDocker {
+			cmdPath, cmdArgs = dockerBinary, append([]string{cmdPath}, cmdArgs...)
+		}
+		fmt.Fprintf(w, "  command %s\n", strings.TrimSpace(cmdPath+" "+strings.Join(cmdArgs, " ")))
+
+		if strings.Contains(cmdPath, ReleaseBadge) {
+			fmt.Fprintf(w, "  executable is fetched on start\n")
+			continue
+		}
+		resolved, err := checkExecutable(appConfig, instance.parseBadges(appConfig.Directory), cmdPath)
+		if err != nil {
+			fmt.Fprintf(w, "  executable error: %s\n", err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(w, "  executable %s\n", resolved)
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(w, "%d of %d apps can't be started\n", failed, len(config.Apps))
+	}
+	return failed
+}
+
+// checkExecutable resolves command like exec.Cmd does, relative to dir and chroot of
+// app, and checks that app user may execute it
+func checkExecutable(config *AppConfig, dir string, cmdPath string) (string, error) {
+	path := cmdPath
+	if !strings.Contains(cmdPath, string(filepath.Separator)) {
+		lookedUp, err := exec.LookPath(cmdPath)
+		if err != nil {
+			return "", err
+		}
+		path = lookedUp
+	} else if !filepath.IsAbs(path) && dir != "" {
+		path = filepath.Join(dir, path)
+	}
+	if config.Chroot != "" {
+		path = filepath.Join(config.Chroot, path)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if fi.IsDir() {
+		return "", fmt.Errorf("%s is a directory", path)
+	}
+
+	user := config.User
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	if user.UserName != "" {
+		uid, gid = user.Uid, user.Gid
+	}
+	if !executableBy(fi, uid, gid) {
+		return "", fmt.Errorf("%s is not executable by uid %d", path, uid)
+	}
+	return path, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/hamaxx/gracevisor/common/report"
+	"github.com/hamaxx/gracevisor/deps/yaml.v2"
+)
+
+const maskedValue = "******"
+
+var (
+	secretOptions  = map[string]bool{"token": true, "vault_token": true, "routing_token": true, "password": true}
+	urlOptions     = map[string]bool{"url": true, "address": true, "vault_address": true, "webhooks": true, "urls": true}
+	headerOptions  = map[string]bool{"healthcheck_headers": true, "headers": true}
+	secretEnvRegex = regexp.MustCompile(`(?i)pass|secret|token|key|credential`)
+)
+
+// dumpConfig returns resolved config as yaml with secrets masked, only app config if app is set
+func dumpConfig(config *Config, app *AppConfig) (string, error) {
+	var out interface{} = config
+	if app != nil {
+		out = app
+	}
+
+	data, err := yaml.Marshal(out)
+	if err != nil {
+		return "", err
+	}
+	tree := yaml.MapSlice{}
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return "", err
+	}
+
+	data, err = yaml.Marshal(maskSecrets(tree, ""))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// maskSecrets masks tokens, header values, url passwords and query parameters and
+// environment values that look like secrets, secret badges are kept as they are resolved
+// only when instances start
+func maskSecrets(value interface{}, key string) interface{} {
+	switch v := value.(type) {
+	case yaml.MapSlice:
+		for i, item := range v {
+			if header, ok := item.Value.(string); ok && headerOptions[key] {
+				v[i].Value = maskHeader(header)
+				continue
+			}
+			v[i].Value = maskSecrets(item.Value, fmt.Sprint(item.Key))
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = maskSecrets(item, key)
+		}
+		return v
+	case string:
+		switch {
+		case v == "":
+		case secretOptions[key]:
+			return maskedValue
+		case urlOptions[key]:
+			return maskUrl(v)
+		case key == "environment":
+			return maskEnvironment(v)
+		}
+	}
+	return value
+}
+
+// maskHeader masks header value unless it only references a secret
+func maskHeader(value string) string {
+	if value == "" || secretBadge.MatchString(value) {
+		return value
+	}
+	return maskedValue
+}
+
+// maskUrl masks password and query parameter values of url, webhooks and
+// similar urls often carry tokens in the query string
+func maskUrl(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok && password != "" {
+			raw = strings.Replace(raw, ":"+password+"@", ":"+maskedValue+"@", 1)
+		}
+	}
+	if u.RawQuery != "" {
+		params := strings.Split(u.RawQuery, "&")
+		for i, param := range params {
+			parts := strings.SplitN(param, "=", 2)
+			if len(parts) == 2 && parts[1] != "" && !secretBadge.MatchString(parts[1]) {
+				params[i] = parts[0] + "=" + maskedValue
+			}
+		}
+		raw = strings.Replace(raw, "?"+u.RawQuery, "?"+strings.Join(params, "&"), 1)
+	}
+	return raw
+}
+
+// maskEnvironment masks value of environment variable whose name looks like a secret
+func maskEnvironment(variable string) string {
+	parts := strings.SplitN(variable, "=", 2)
+	if len(parts) == 2 && secretEnvRegex.MatchString(parts[0]) && !secretBadge.MatchString(parts[1]) {
+		return parts[0] + "=" + maskedValue
+	}
+	return variable
+}
+
+// maskDeployRecords returns copies of deploy records with environment masked as in
+// config dumps, stored records keep their values for rollbacks
+func maskDeployRecords(records []*report.DeployRecord) []*report.DeployRecord {
+	masked := make([]*report.DeployRecord, len(records))
+	for i, record := range records {
+		copied := *record
+		copied.Environment = make([]string, len(record.Environment))
+		for j, variable := range record.Environment {
+			copied.Environment[j] = maskEnvironment(variable)
+		}
+		masked[i] = &copied
+	}
+	return masked
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	EventLogTrigger        = "log_trigger"
+	EventHeartbeatMissed   = "heartbeat_missed"
+	EventHealthCheckFailed = "healthcheck_failed"
+	EventCanaryStarted     = "canary_started"
+	EventCanaryPromoted    = "canary_promoted"
+	EventCanaryFailed      = "canary_failed"
+	EventDeployHeld        = "deploy_held"
+	EventDeployPromoted    = "deploy_promoted"
+	EventVerifyFailed      = "verify_failed"
+	EventReloadFailed      = "reload_failed"
+	EventWatchdog          = "watchdog"
+	EventQuarantined       = "quarantined"
+	EventQuarantineEnded   = "quarantine_ended"
+	EventReplaceRequested  = "replace_requested"
+
+	EventCertificateExpiring = "certificate_expiring"
+
+	eventQueueSize = 100
+)
+
+// Event is a notable thing that happened to an app or instance
+type Event struct {
+	Type       string    `json:"type"`
+	Name       string    `json:"name,omitempty"`
+	App        string    `json:"app,omitempty"`
+	InstanceId uint32    `json:"instance_id,omitempty"`
+	Message    string    `json:"message,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// Events logs events and delivers them to configured webhooks and notifiers
+type Events struct {
+	config    *EventsConfig
+	queue     chan *Event
+	client    *http.Client
+	notifiers []Notifier
+}
+
+func NewEvents(config *EventsConfig) *Events {
+	timeout := time.Duration(config.WebhookTimeout) * time.Second
+	e := &Events{
+		config: config,
+		queue:  make(chan *Event, eventQueueSize),
+		client: &http.Client{Timeout: timeout},
+	}
+	for _, notifierConfig := range config.Notifiers {
+		// options were checked with config
+		notifier, err := newNotifier(notifierConfig, timeout)
+		if err != nil {
+			log.Print("Notifier error:", err)
+		}
+		e.notifiers = append(e.notifiers, notifier)
+	}
+
+	go e.deliver()
+
+	return e
+}
+
+// Emit queues event for delivery, events are dropped if queue is full
+func (e *Events) Emit(event *Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	log.Printf("Event %s: %s[%d] %s %s", event.Type, event.App, event.InstanceId, event.Name, event.Message)
+
+	select {
+	case e.queue <- event:
+	default:
+		log.Print("Event queue full, dropping event ", event.Type)
+	}
+}
+
+// notify delivers event to notifiers configured for its type and app
+func (e *Events) notify(event *Event) {
+	for i, config := range e.config.Notifiers {
+		if e.notifiers[i] == nil || !config.matches(event) {
+			continue
+		}
+		message, err := config.render(event)
+		if err != nil {
+			log.Printf("Notifier %s template error: %s", config.Type, err)
+			continue
+		}
+		if err := e.notifiers[i].Notify(event, message); err != nil {
+			log.Printf("Notifier %s error: %s", config.Type, err)
+		}
+	}
+}
+
+func (e *Events) deliver() {
+	for event := range e.queue {
+		e.notify(event)
+		if len(e.config.Webhooks) == 0 {
+			continue
+		}
+
+		data, err := json.Marshal(event)
+		if err != nil {
+			log.Print("Event marshal error:", err)
+			continue
+		}
+
+		for _, webhook := range e.config.Webhooks {
+			resp, err := e.client.Post(webhook, "application/json", bytes.NewReader(data))
+			if err != nil {
+				log.Print("Webhook error:", err)
+				continue
+			}
+			if err := resp.Body.Close(); err != nil {
+				log.Print(err)
+			}
+			if resp.StatusCode >= 300 {
+				log.Printf("Webhook %s returned status %d", webhook, resp.StatusCode)
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"sync/atomic"
+	"time"
+
+	"github.com/hamaxx/gracevisor/common/report"
+)
+
+const (
+	defaultExecTimeout = 30 * time.Second
+	execMaxOutput      = 1 << 20
+)
+
+var ErrExecCommandRequired = errors.New("Command must be specified for exec")
+
+// execOutput keeps first execMaxOutput bytes of command output
+type execOutput struct {
+	bytes.Buffer
+}
+
+func (o *execOutput) Write(p []byte) (int, error) {
+	if room := execMaxOutput - o.Len(); room < len(p) {
+		if room > 0 {
+			o.Buffer.Write(p[:room])
+		}
+	} else {
+		o.Buffer.Write(p)
+	}
+	return len(p), nil
+}
+
+// Exec runs command with user, directory and environment of the active instance,
+// including its port, docker apps run it in the instance container
+func (a *App) Exec(command []string, timeout time.Duration) (*report.ExecResult, error) {
+	if a.backends != nil {
+		return nil, ErrBackendApp
+	}
+	if len(command) == 0 {
+		return nil, ErrExecCommandRequired
+	}
+	if timeout <= 0 {
+		timeout = defaultExecTimeout
+	}
+
+	a.activeInstanceLock.Lock()
+	instance := a.activeInstance
+	a.activeInstanceLock.Unlock()
+	if instance == nil {
+		return nil, ErrNoActiveInstances
+	}
+
+	var cmd *exec.Cmd
+	if a.config().Type == AppTypeDocker {
+		cmd = exec.Command(dockerBinary, append([]string{"exec", instance.containerName()}, command...)...)
+	} else {
+		name, err := lookPathEnv(command[0], instance.env, a.config().Chroot)
+		if err != nil {
+			return nil, err
+		}
+		dir := instance.parseBadges(a.config().Directory)
+		if a.config().needsExecShim() {
+			// shim changes to dir after chroot
+			shimPath, shimArgs, err := execShimCommand(a.config(), dir, name, command[1:])
+			if err != nil {
+				return nil, err
+			}
+			cmd = exec.Command(shimPath, shimArgs...)
+		} else {
+			cmd = exec.Command(name, command[1:]...)
+			cmd.Args[0] = command[0]
+			cmd.Dir = dir
+		}
+		cmd.Env = instance.env
+		cmd.SysProcAttr = sysProcAttr(a.config())
+	}
+
+	output := &execOutput{}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	timedOut := int32(0)
+	err := children.run(func() error {
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		timer := time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			cmd.Process.Kill()
+		})
+		defer timer.Stop()
+		return cmd.Wait()
+	})
+
+	result := &report.ExecResult{
+		Output:   output.String(),
+		TimedOut: atomic.LoadInt32(&timedOut) == 1,
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		result.ExitCode = exitErr.ExitCode()
+	} else if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
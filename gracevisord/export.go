@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	// StatePath serves state snapshot on rpc listener
+	StatePath = "/state"
+
+	stateExportFileMode = 0644
+)
+
+// StateExport is a json snapshot of all apps and instances of gracevisord for external
+// orchestration and dashboards
+type StateExport struct {
+	Host        string      `json:"host"`
+	Time        time.Time   `json:"time"`
+	Gracevisord string      `json:"gracevisord"`
+	Apps        []*AppState `json:"apps"`
+}
+
+type AppState struct {
+	Name           string            `json:"name"`
+	Serving        bool              `json:"serving"`
+	Version        string            `json:"version"`
+	Operation      string            `json:"operation,omitempty"`
+	Paused         bool              `json:"paused"`
+	Quarantined    bool              `json:"quarantined"`
+	WaitingForPort bool              `json:"waiting_for_port"`
+	Connections    ConnectionsState  `json:"connections"`
+	Certificate    *CertificateState `json:"certificate,omitempty"`
+	Instances      []*InstanceState  `json:"instances"`
+}
+
+type ConnectionsState struct {
+	Open     int64 `json:"open"`
+	Accepted int64 `json:"accepted"`
+	Rejected int64 `json:"rejected"`
+	Max      int   `json:"max,omitempty"`
+}
+
+type CertificateState struct {
+	Name      string `json:"name"`
+	ExpiresIn int64  `json:"expires_in"`
+}
+
+type InstanceState struct {
+	Id                uint32 `json:"id"`
+	Active            bool   `json:"active"`
+	Status            string `json:"status"`
+	Version           string `json:"version"`
+	Healthy           bool   `json:"healthy"`
+	Host              string `json:"host"`
+	Port              uint16 `json:"port"`
+	Pid               int    `json:"pid,omitempty"`
+	Uptime            uint64 `json:"uptime"`
+	SinceStatusChange uint64 `json:"since_status_change"`
+}
+
+// stateSnapshot collects state of all apps sorted by name, with the same instances
+// as gracevisorctl status
+func stateSnapshot(runningApps map[string]*App) *StateExport {
+	snapshot := &StateExport{
+		Time:        time.Now().UTC(),
+		Gracevisord: buildInfo().String(),
+		Apps:        []*AppState{},
+	}
+	snapshot.Host, _ = os.Hostname()
+
+	sortedApps := []*App{}
+	for _, app := range runningApps {
+		sortedApps = append(sortedApps, app)
+	}
+	sort.Sort(AppNameSort(sortedApps))
+
+	for _, app := range sortedApps {
+		appReport := app.Report(3)
+		appState := &AppState{
+			Name:           appReport.Name,
+			Version:        appReport.Version,
+			Operation:      appReport.Operation,
+			Paused:         appReport.Paused,
+			Quarantined:    appReport.Quarantined,
+			WaitingForPort: appReport.WaitingForPort,
+			Connections: ConnectionsState{
+				Open:     appReport.Connections,
+				Accepted: appReport.AcceptedConnections,
+				Rejected: appReport.RejectedConnections,
+				Max:      appReport.MaxConnections,
+			},
+			Instances: []*InstanceState{},
+		}
+		if appReport.Certificate != "" {
+			appState.Certificate = &CertificateState{Name: appReport.Certificate, ExpiresIn: appReport.CertificateExpiresIn}
+		}
+		for _, instanceReport := range appReport.Instances {
+			serving := instanceReport.Status == "serving"
+			if instanceReport.Active && serving {
+				appState.Serving = true
+			}
+			appState.Instances = append(appState.Instances, &InstanceState{
+				Id:                instanceReport.Id,
+				Active:            instanceReport.Active,
+				Status:            instanceReport.Status,
+				Version:           instanceReport.Version,
+				Healthy:           serving && !instanceReport.Unhealthy && !instanceReport.NotReady,
+				Host:              instanceReport.Host,
+				Port:              instanceReport.Port,
+				Pid:               instanceReport.Pid,
+				Uptime:            instanceReport.Uptime,
+				SinceStatusChange: instanceReport.SinceStatusChange,
+			})
+		}
+		snapshot.Apps = append(snapshot.Apps, appState)
+	}
+	return snapshot
+}
+
+// StateHandler serves state snapshot to clients with any rpc token
+type StateHandler struct {
+	runningApps map[string]*App
+	config      *RpcConfig
+}
+
+func (h *StateHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(rw, "405 must GET", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, _, err := authenticate(h.config, req); err != nil {
+		http.Error(rw, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	data, err := json.MarshalIndent(stateSnapshot(h.runningApps), "", "  ")
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(data)
+}
+
+// startStateExport writes state snapshot to path and posts it to urls every interval
+func startStateExport(config *StateExportConfig, runningApps map[string]*App) {
+	client := &http.Client{Timeout: time.Duration(config.Timeout) * time.Second}
+	export := func() {
+		data, err := json.MarshalIndent(stateSnapshot(runningApps), "", "  ")
+		if err != nil {
+			log.Print("State export marshal error:", err)
+			return
+		}
+
+		if config.Path != "" {
+			// readers never see a partly written snapshot
+			err := ioutil.WriteFile(config.Path+".tmp", data, stateExportFileMode)
+			if err == nil {
+				err = os.Rename(config.Path+".tmp", config.Path)
+			}
+			if err != nil {
+				log.Print("State export error:", err)
+			}
+		}
+
+		for _, url := range config.Urls {
+			resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+			if err != nil {
+				log.Print("State export error:", err)
+				continue
+			}
+			if err := resp.Body.Close(); err != nil {
+				log.Print(err)
+			}
+			if resp.StatusCode >= 300 {
+				log.Printf("State export %s returned status %d", url, resp.StatusCode)
+			}
+		}
+	}
+
+	go func() {
+		export()
+		for range time.Tick(time.Duration(config.Interval) * time.Second) {
+			export()
+		}
+	}()
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	ReleaseBadge = "{release}"
+
+	defaultReleaseName = "default"
+	releaseFileMode    = os.FileMode(0755)
+
+	s3Binary  = "aws"
+	gitBinary = "git"
+)
+
+var (
+	ErrInvalidArchivePath = errors.New("Archive entry outside of release dir")
+	ErrInvalidArchiveLink = errors.New("Archive symlink points outside of release dir")
+)
+
+func fetchScheme(url string) string {
+	switch {
+	case strings.HasPrefix(url, "http://"), strings.HasPrefix(url, "https://"):
+		return "http"
+	case strings.HasPrefix(url, "s3://"):
+		return "s3"
+	case strings.HasPrefix(url, "git+"):
+		return "git"
+	}
+	return ""
+}
+
+// fetchRelease makes sure release of instance version is in fetch dir and returns its path,
+// each version is fetched once into a temporary dir and renamed when complete. Without
+// version url may serve a different release every time, so it is fetched for every
+// instance and its release is named by checksum of what was fetched.
+func (i *Instance) fetchRelease() (string, error) {
+	config := i.app.config().Fetch
+	if i.version != "" && !versionPattern.MatchString(i.version) {
+		return "", ErrInvalidVersion
+	}
+
+	name := i.version
+	if name == "" {
+		name = defaultReleaseName
+	}
+	name = strings.Replace(name, "/", "_", -1)
+	if name == "." || name == ".." {
+		name = "_" + name
+	}
+
+	releaseDir := path.Join(config.Dir, name)
+	if _, err := os.Stat(releaseDir); err == nil && i.version != "" {
+		return releaseDir, nil
+	}
+
+	tmpDir := fmt.Sprintf("%s.%d.tmp", releaseDir, i.id)
+	os.RemoveAll(tmpDir)
+	defer os.RemoveAll(tmpDir)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Timeout)*time.Second)
+	defer cancel()
+
+	url := parseVersionBadge(config.Url, i.version)
+	checksum, err := fetch(ctx, url, parseVersionBadge(config.Ref, i.version), tmpDir)
+	if err != nil {
+		return "", fmt.Errorf("fetch %s: %s", url, err)
+	}
+
+	if i.version == "" {
+		releaseDir = path.Join(config.Dir, defaultReleaseName+"-"+checksum)
+		defer i.app.pruneDefaultReleases(releaseDir)
+		if _, err := os.Stat(releaseDir); err == nil {
+			return releaseDir, nil
+		}
+	}
+	if err := os.Rename(tmpDir, releaseDir); err != nil {
+		if _, statErr := os.Stat(releaseDir); statErr == nil {
+			// fetched by another instance meanwhile
+			return releaseDir, nil
+		}
+		return "", err
+	}
+	return releaseDir, nil
+}
+
+// pruneDefaultReleases removes releases fetched without version that no running
+// instance uses, keep is the release of the instance being started
+func (a *App) pruneDefaultReleases(keep string) {
+	dir := a.config().Fetch.Dir
+	used := map[string]bool{keep: true}
+	for _, instance := range a.instances {
+		if instance.status <= InstanceStatusStopping {
+			used[instance.release] = true
+		}
+	}
+
+	releases, err := filepath.Glob(path.Join(dir, defaultReleaseName+"-*"))
+	if err != nil {
+		return
+	}
+	for _, release := range releases {
+		if used[release] || strings.HasSuffix(release, ".tmp") || strings.HasSuffix(release, ".download") {
+			continue
+		}
+		if err := os.RemoveAll(release); err != nil {
+			log.Print(a.config().Name, ": Prune release error:", err)
+		}
+	}
+}
+
+// fetch fetches release at url into dst and returns its checksum, commit of git
+// releases or sha256 of downloaded file. Commands and download are stopped when ctx
+// is done.
+func fetch(ctx context.Context, url string, ref string, dst string) (string, error) {
+	scheme := fetchScheme(url)
+
+	if scheme == "git" {
+		repo := strings.TrimPrefix(url, "git+")
+		if err := run(exec.CommandContext(ctx, gitBinary, "clone", "--quiet", "--", repo, dst)); err != nil {
+			return "", err
+		}
+		if ref != "" {
+			// -- makes git read ref as a revision, never as a path
+			if err := run(exec.CommandContext(ctx, gitBinary, "-C", dst, "checkout", "--quiet", ref, "--")); err != nil {
+				return "", err
+			}
+		}
+		var out []byte
+		err := children.run(func() (err error) {
+			out, err = exec.CommandContext(ctx, gitBinary, "-C", dst, "rev-parse", "--short=16", "HEAD").Output()
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	if err := os.MkdirAll(dst, releaseFileMode); err != nil {
+		return "", err
+	}
+
+	download := dst + ".download"
+	defer os.Remove(download)
+
+	var err error
+	if scheme == "s3" {
+		err = run(exec.CommandContext(ctx, s3Binary, "s3", "cp", "--quiet", url, download))
+	} else {
+		err = downloadHttp(ctx, url, download)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	checksum, err := fileChecksum(download)
+	if err != nil {
+		return "", err
+	}
+	return checksum, unpack(download, path.Base(strings.SplitN(url, "?", 2)[0]), dst)
+}
+
+func fileChecksum(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16], nil
+}
+
+func run(cmd *exec.Cmd) error {
+	var out []byte
+	err := children.run(func() (err error) {
+		out, err = cmd.CombinedOutput()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func downloadHttp(ctx context.Context, url string, fn string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// unpack extracts tar, tar.gz and zip archives into dst, other files are copied into it
+func unpack(fn string, name string, dst string) error {
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		f, err := os.Open(fn)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		return untar(gz, dst)
+	case strings.HasSuffix(name, ".tar"):
+		f, err := os.Open(fn)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return untar(f, dst)
+	case strings.HasSuffix(name, ".zip"):
+		return unzip(fn, dst)
+	}
+
+	if err := os.Rename(fn, path.Join(dst, name)); err != nil {
+		return err
+	}
+	return os.Chmod(path.Join(dst, name), releaseFileMode)
+}
+
+func insideDir(dst string, target string) bool {
+	dst = filepath.Clean(dst)
+	return target == dst || strings.HasPrefix(target, dst+string(filepath.Separator))
+}
+
+// archivePath returns path of archive entry in dst. Entries are never written through
+// symlinks, earlier entries of archive could point them outside of release dir.
+func archivePath(dst string, name string) (string, error) {
+	target := filepath.Join(dst, name)
+	if !insideDir(dst, target) {
+		return "", ErrInvalidArchivePath
+	}
+
+	rel, err := filepath.Rel(filepath.Clean(dst), target)
+	if err != nil {
+		return "", ErrInvalidArchivePath
+	}
+	current := filepath.Clean(dst)
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", ErrInvalidArchivePath
+		}
+	}
+	return target, nil
+}
+
+// archiveLink returns relative link of symlink entry at target, links must stay in release
+// dir. Cleaned link only has leading .., which go up through real dirs of release.
+func archiveLink(dst string, target string, linkname string) (string, error) {
+	link := filepath.Clean(linkname)
+	if filepath.IsAbs(link) || !insideDir(dst, filepath.Join(filepath.Dir(target), link)) {
+		return "", ErrInvalidArchiveLink
+	}
+	return link, nil
+}
+
+func untar(r io.Reader, dst string) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target, err := archivePath(dst, header.Name)
+		if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, releaseFileMode)
+		case tar.TypeReg, tar.TypeRegA:
+			err = writeArchiveFile(target, tr, os.FileMode(header.Mode))
+		case tar.TypeSymlink:
+			var link string
+			if link, err = archiveLink(dst, target, header.Linkname); err == nil {
+				err = os.Symlink(link, target)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func unzip(fn string, dst string) error {
+	zr, err := zip.OpenReader(fn)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, file := range zr.File {
+		target, err := archivePath(dst, file.Name)
+		if err != nil {
+			return err
+		}
+
+		if file.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, releaseFileMode); err != nil {
+				return err
+			}
+			continue
+		}
+
+		r, err := file.Open()
+		if err != nil {
+			return err
+		}
+		err = writeArchiveFile(target, r, file.Mode())
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeArchiveFile(target string, r io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(path.Dir(target), releaseFileMode); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestFetchTimeout(t *testing.T) {
+	stalled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		select {
+		case <-stalled:
+		case <-req.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(stalled)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := fetch(ctx, server.URL+"/app.tar.gz", "", path.Join(t.TempDir(), "release"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("fetch from stalled server should fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetch should stop when its context is done")
+	}
+}
+
+func TestPruneDefaultReleases(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"default-running", "default-exited", "default-new", "v1.0.0"} {
+		if err := os.Mkdir(path.Join(dir, name), releaseFileMode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	app := &App{}
+	app.configValue.Store(&AppConfig{Name: "app", Fetch: &FetchConfig{Dir: dir}})
+	app.instances = []*Instance{
+		{release: path.Join(dir, "default-running"), status: InstanceStatusServing},
+		{release: path.Join(dir, "default-exited"), status: InstanceStatusExited},
+	}
+	app.pruneDefaultReleases(path.Join(dir, "default-new"))
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := map[string]bool{}
+	for _, entry := range entries {
+		kept[entry.Name()] = true
+	}
+	if !kept["default-running"] || !kept["default-new"] || !kept["v1.0.0"] || kept["default-exited"] {
+		t.Error("Only unversioned releases no running instance uses should be pruned, kept", kept)
+	}
+}
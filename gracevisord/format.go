@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/hamaxx/gracevisor/deps/yaml.v2"
+)
+
+const (
+	FormatYaml = ".yaml"
+	FormatToml = ".toml"
+	FormatJson = ".json"
+)
+
+var configFormats = []string{FormatYaml, FormatToml, FormatJson}
+
+// configFormat returns format of config file by its extension, yaml if unknown
+func configFormat(fn string) string {
+	ext := path.Ext(fn)
+	if i := strings.IndexAny(ext, "?#"); i >= 0 {
+		ext = ext[:i]
+	}
+	switch ext {
+	case FormatToml, FormatJson:
+		return ext
+	}
+	return FormatYaml
+}
+
+// isConfigFile returns true if fn has extension of a supported config format
+func isConfigFile(fn string) bool {
+	for _, format := range configFormats {
+		if strings.HasSuffix(fn, format) {
+			return true
+		}
+	}
+	return false
+}
+
+// isMainConfigFile returns true for gracevisor.yaml, gracevisor.toml and gracevisor.json
+func isMainConfigFile(fn string) bool {
+	base := path.Base(fn)
+	return isConfigFile(base) && strings.TrimSuffix(base, path.Ext(base)) == configName
+}
+
+// dirConfigFile returns existing gracevisor.yaml, gracevisor.toml or
+// gracevisor.json in dir, gracevisor.yaml if there is none
+func dirConfigFile(dir string) string {
+	for _, format := range configFormats {
+		fn := path.Join(dir, configName+format)
+		if _, err := os.Stat(fn); err == nil {
+			return fn
+		}
+	}
+	return path.Join(dir, configFile)
+}
+
+// parseConfigData decodes yaml, toml or json data of file fn into out,
+// other formats are converted to yaml to share strict option checking
+func parseConfigData(fn string, data []byte, out interface{}) error {
+	var tree interface{}
+	var err error
+	switch configFormat(fn) {
+	case FormatToml:
+		tree, err = parseToml(data)
+	case FormatJson:
+		tree, err = parseJson(data)
+	default:
+		return parseYaml(data, out)
+	}
+	if err != nil {
+		return err
+	}
+
+	if data, err = yaml.Marshal(tree); err != nil {
+		return err
+	}
+	return parseYaml(data, out)
+}
+
+// parseJson decodes json document keeping integers as ints
+func parseJson(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var tree interface{}
+	if err := decoder.Decode(&tree); err != nil {
+		return nil, errors.New("json: " + err.Error())
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("json: unexpected data after document")
+	}
+	return jsonNumbers(tree), nil
+}
+
+func jsonNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = jsonNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonNumbers(item)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return int(i)
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return value
+}
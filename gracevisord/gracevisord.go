@@ -1,21 +1,34 @@
 package main
 
 import (
+	"expvar"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"sync"
 
+	"github.com/hamaxx/gracevisor/common/report"
 	"github.com/hamaxx/gracevisor/deps/cli"
 	"github.com/hamaxx/gracevisor/deps/lumberjack"
 )
 
 var version = "dev"
 var commit = ""
+var buildDate = ""
+
+// buildInfo describes this gracevisord binary
+func buildInfo() *report.BuildInfo {
+	return report.NewBuildInfo(version, commit, buildDate)
+}
 
 var defaultConfigDir = "/etc/gracevisor/"
 
 func configureGracevisorLogger(config *LoggerConfig) {
+	if err := createLogFile(config.LogFile, config.FilePerm); err != nil {
+		log.Print("Log file error:", err)
+	}
 	writer := &lumberjack.Logger{
 		Filename:   config.LogFile,
 		MaxSize:    config.MaxLogSize,
@@ -26,32 +39,163 @@ func configureGracevisorLogger(config *LoggerConfig) {
 	log.SetOutput(writer)
 }
 
-func startApp(config *Config) {
-	portPool := NewPortPool(config.PortRange.From, config.PortRange.To)
+func startApp(config *Config, configPath string, initMode bool) {
+	log.Print("Starting gracevisord ", buildInfo())
+	expvar.Publish("build", expvar.Func(func() interface{} {
+		return buildInfo()
+	}))
+
+	if err := os.MkdirAll(config.StateDir, defaultStateDirMode); err != nil {
+		log.Fatal("State dir error:", err)
+	}
+
+	portPool := NewPortPool(config.PortRange)
+	for _, appConfig := range config.Apps {
+		portPool.setFixed(appConfig.InternalPorts)
+	}
+	portPool.publish()
+	events := NewEvents(config.Events)
+	secrets := NewSecrets(config.Secrets)
+
+	activation, err := activationListeners()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var registry Registry
+	if config.Discovery != nil {
+		registry = NewRegistry(config.Discovery)
+	}
+
+	reportUrl := fmt.Sprintf("http://%s%s", hostPort(config.Rpc.Host, config.Rpc.Port), ReportPath)
 	runningApps := map[string]*App{}
 
+	// bind all listeners before dropping privileges, apps can share a port on different hosts
+	listeners := map[string]net.Listener{}
+	for _, appConfig := range config.Apps {
+		history := NewHistory(config.StateDir, appConfig.Name, config.MaxHistory)
+		deploys := NewDeploys(config.StateDir, appConfig.Name, config.MaxDeploys)
+		app := NewApp(appConfig, portPool, events, history, deploys, secrets, reportUrl)
+		if appConfig.Type == AppTypeBackend {
+			app.backends = NewBackendPool(app, registry)
+		}
+		app.runningApps = runningApps
+		runningApps[app.config().Name] = app
+
+		if appConfig.Proxy == ProxyNone {
+			continue
+		}
+		externalHostPort := hostPort(appConfig.ExternalHost, appConfig.ExternalPort)
+		if listener, activated := activation[appConfig.ExternalPort]; activated {
+			listeners[externalHostPort] = listener
+		} else {
+			listener, err := app.Listen()
+			if err != nil {
+				log.Print("App listen error:", err)
+				continue
+			}
+			listeners[externalHostPort] = listener
+		}
+
+		if appConfig.PreviewPort != 0 {
+			previewHostPort := hostPort(appConfig.ExternalHost, appConfig.PreviewPort)
+			if listener, activated := activation[appConfig.PreviewPort]; activated {
+				listeners[previewHostPort] = listener
+			} else {
+				listener, err := app.ListenPreview()
+				if err != nil {
+					log.Print("App preview listen error:", err)
+					continue
+				}
+				listeners[previewHostPort] = listener
+			}
+		}
+	}
+
+	rpcListener, rpcHandler, err := NewRpcServer(runningApps, portPool, config, NewAuditLog(config.Logger))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var debugListener net.Listener
+	if config.Debug != nil {
+		if debugListener, err = listenDebug(config.Debug); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if config.DaemonUser != nil {
+		if err := dropPrivileges(config); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	appWg := sync.WaitGroup{}
+	// started is done when first instances of apps are started or failed to start
+	started := sync.WaitGroup{}
 	for _, appConfig := range config.Apps {
+		app := runningApps[appConfig.Name]
+		if appConfig.Proxy == ProxyNone {
+			if err := app.StartNewInstance(RequestedByAutostart); err != nil {
+				log.Print("Start new instance error:", err)
+			}
+			continue
+		}
+		listener, ok := listeners[hostPort(appConfig.ExternalHost, appConfig.ExternalPort)]
+		if !ok {
+			continue
+		}
+
+		if previewListener, ok := listeners[hostPort(appConfig.ExternalHost, appConfig.PreviewPort)]; ok && appConfig.PreviewPort != 0 {
+			go func() {
+				if err := app.ServePreview(previewListener); err != nil {
+					log.Print("App preview serve error:", err)
+				}
+			}()
+		}
+
 		appWg.Add(1)
-		app := NewApp(appConfig, portPool)
-		runningApps[app.config.Name] = app
+		started.Add(1)
 		go func() {
-			if err := app.StartNewInstance(); err != nil {
-				log.Print("Start new instance error:", err)
-				return
+			defer appWg.Done()
+			if app.backends == nil {
+				err := app.StartNewInstance(RequestedByAutostart)
+				started.Done()
+				if err != nil {
+					log.Print("Start new instance error:", err)
+					if err != ErrWaitingForPort {
+						return
+					}
+				}
+			} else {
+				started.Done()
 			}
-			if err := app.ListenAndServe(); err != nil {
-				log.Print("App listen and serve error:", err)
+			if err := app.Serve(listener); err != nil {
+				log.Print("App serve error:", err)
 			}
-			appWg.Done()
 		}()
 	}
 
-	rpcListener, err := NewRpcServer(runningApps, config.Rpc)
-	if err != nil {
-		log.Fatal(err)
+	startWatchdog(config.Watchdog, events)
+	if config.Export != nil {
+		startStateExport(config.Export, runningApps)
+	}
+	startSystemdNotifier(runningApps, &started)
+	if config.Discovery != nil {
+		startDiscovery(config.Discovery, registry, runningApps)
+	}
+	if config.source != nil {
+		startSourceWatcher(config.source, runningApps)
+	}
+	startReloader(configPath, runningApps)
+	if initMode {
+		startInitMode(runningApps)
+	}
+	if debugListener != nil {
+		go serveDebug(debugListener)
 	}
-	if err := http.Serve(rpcListener, nil); err != nil {
+
+	if err := http.Serve(rpcListener, rpcHandler); err != nil {
 		log.Print("Rpc server error:", err)
 	}
 
@@ -59,6 +203,10 @@ func startApp(config *Config) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == execShimArg {
+		runExecShim(os.Args[2:])
+	}
+
 	// solution for https://github.com/golang/go/issues/6785
 	http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost = 100
 
@@ -66,12 +214,120 @@ func main() {
 	app.Name = "gracevisord"
 	app.Usage = "gracevisor daemon"
 	app.Email = "jure@hamsworld.net"
-	app.Version = version
+	app.Version = buildInfo().String()
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
-			Name:  "conf",
-			Value: defaultConfigDir,
-			Usage: "path to config dir",
+			Name:   "conf, c",
+			Value:  defaultConfigDir,
+			Usage:  "path to config dir with gracevisor.yaml or to config file",
+			EnvVar: "GRACEVISOR_CONFIG",
+		},
+		cli.BoolFlag{
+			Name:  "init",
+			Usage: "run as container init: reap zombies and stop apps on TERM",
+		},
+		cli.BoolFlag{
+			Name:  "dump-config",
+			Usage: "print resolved config with secrets masked and exit",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "print listeners, ports, users and commands of apps without starting them and exit",
+		},
+	}
+	app.Commands = []cli.Command{
+		{
+			Name:  "convert",
+			Usage: "print gracevisor.yaml apps converted from supervisord config file",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "from",
+					Value: ConvertSupervisord,
+					Usage: "format of config file",
+				},
+			},
+			Action: func(c *cli.Context) {
+				if err := convertConfig(c.String("from"), c.Args().First()); err != nil {
+					log.Fatal(err)
+				}
+			},
+		},
+		{
+			Name:  "check",
+			Usage: "validate config dir and report all errors",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "conf, c",
+					Usage: "path to config dir or file, default is global --conf",
+				},
+			},
+			Action: func(c *cli.Context) {
+				configPath := c.String("conf")
+				if configPath == "" {
+					configPath = c.GlobalString("conf")
+				}
+
+				errs := checkConfig(configPath)
+				for _, err := range errs {
+					fmt.Fprintln(os.Stderr, err)
+				}
+				if len(errs) > 0 {
+					fmt.Fprintf(os.Stderr, "%d errors found in %s\n", len(errs), configPath)
+					os.Exit(1)
+				}
+				fmt.Println("Config", configPath, "is valid")
+			},
+		},
+		{
+			Name:  "doctor",
+			Usage: "check log dirs, users, commands, limits, ports and healthchecks and print fixes",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "conf, c",
+					Usage: "path to config dir or file, default is global --conf",
+				},
+			},
+			Action: func(c *cli.Context) {
+				configPath := c.String("conf")
+				if configPath == "" {
+					configPath = c.GlobalString("conf")
+				}
+				if runDoctor(os.Stdout, configPath) > 0 {
+					os.Exit(1)
+				}
+			},
+		},
+		{
+			Name:  "install-service",
+			Usage: "install systemd unit, upstart job or sysv init script starting gracevisord with --conf",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "type",
+					Usage: "systemd, upstart or sysv, default is detected",
+				},
+				cli.StringFlag{
+					Name:  "binary",
+					Usage: "path of gracevisord binary, default is this binary",
+				},
+				cli.StringFlag{
+					Name:  "user",
+					Usage: "user gracevisord runs as, default is root",
+				},
+				cli.StringFlag{
+					Name:  "root",
+					Usage: "install into root dir instead of /, for packaging",
+				},
+				cli.BoolFlag{
+					Name:  "uninstall",
+					Usage: "remove installed service",
+				},
+			},
+			Action: func(c *cli.Context) {
+				err := installService(c.String("type"), c.GlobalString("conf"), c.String("binary"), c.String("user"), c.String("root"), c.Bool("uninstall"))
+				if err != nil {
+					log.Fatal(err)
+				}
+			},
 		},
 	}
 	app.Action = func(c *cli.Context) {
@@ -80,8 +336,23 @@ func main() {
 			log.Fatal(err)
 		}
 
+		if c.Bool("dump-config") {
+			dump, err := dumpConfig(config, nil)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Print(dump)
+			return
+		}
+		if c.Bool("dry-run") {
+			if dryRun(os.Stdout, config) > 0 {
+				os.Exit(1)
+			}
+			return
+		}
+
 		configureGracevisorLogger(config.Logger)
-		startApp(config)
+		startApp(config, c.String("conf"), c.Bool("init"))
 	}
 	app.Run(os.Args)
 }
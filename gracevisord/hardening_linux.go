@@ -0,0 +1,221 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// execShimArg makes gracevisord act as exec shim instead of daemon
+	execShimArg = "__exec"
+
+	prSetNoNewPrivs = 38
+)
+
+var Capabilities = map[string]int{
+	"CHOWN":              0,
+	"DAC_OVERRIDE":       1,
+	"DAC_READ_SEARCH":    2,
+	"FOWNER":             3,
+	"FSETID":             4,
+	"KILL":               5,
+	"SETGID":             6,
+	"SETUID":             7,
+	"SETPCAP":            8,
+	"LINUX_IMMUTABLE":    9,
+	"NET_BIND_SERVICE":   10,
+	"NET_BROADCAST":      11,
+	"NET_ADMIN":          12,
+	"NET_RAW":            13,
+	"IPC_LOCK":           14,
+	"IPC_OWNER":          15,
+	"SYS_MODULE":         16,
+	"SYS_RAWIO":          17,
+	"SYS_CHROOT":         18,
+	"SYS_PTRACE":         19,
+	"SYS_PACCT":          20,
+	"SYS_ADMIN":          21,
+	"SYS_BOOT":           22,
+	"SYS_NICE":           23,
+	"SYS_RESOURCE":       24,
+	"SYS_TIME":           25,
+	"SYS_TTY_CONFIG":     26,
+	"MKNOD":              27,
+	"LEASE":              28,
+	"AUDIT_WRITE":        29,
+	"AUDIT_CONTROL":      30,
+	"SETFCAP":            31,
+	"MAC_OVERRIDE":       32,
+	"MAC_ADMIN":          33,
+	"SYSLOG":             34,
+	"WAKE_ALARM":         35,
+	"BLOCK_SUSPEND":      36,
+	"AUDIT_READ":         37,
+	"PERFMON":            38,
+	"BPF":                39,
+	"CHECKPOINT_RESTORE": 40,
+}
+
+// needsExecShim reports if app process has to be started through exec shim,
+// capabilities, no_new_privs and priorities can only be set from inside the new process
+func (c *AppConfig) needsExecShim() bool {
+	return c.NoNewPrivs || len(c.DropCapabilities) > 0 || c.Nice != 0 || c.Ionice != nil
+}
+
+// execShimCommand wraps command with gracevisord exec shim, which applies chroot,
+// nice and ionice, capabilities, no_new_privs and user in that order and execs the command.
+// Dir is directory of the command with badges parsed, shim changes to it after chroot.
+func execShimCommand(config *AppConfig, dir string, path string, args []string) (string, []string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return "", nil, err
+	}
+
+	shimArgs := []string{
+		execShimArg,
+		"-uid", fmt.Sprint(config.User.Uid),
+		"-gid", fmt.Sprint(config.User.Gid),
+		"-chroot", config.Chroot,
+		"-dir", dir,
+		"-drop-caps", strings.Join(config.DropCapabilities, ","),
+		fmt.Sprintf("-no-new-privs=%t", config.NoNewPrivs),
+		"-nice", fmt.Sprint(config.Nice),
+		"-ioprio", fmt.Sprint(ioprio(config)),
+		"--", path,
+	}
+
+	return self, append(shimArgs, args...), nil
+}
+
+func prctl(option, arg uintptr) error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, option, arg, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func capabilitiesToDrop(names string) ([]int, error) {
+	caps := []int{}
+	if names == "" {
+		return caps, nil
+	}
+
+	for _, name := range strings.Split(names, ",") {
+		if name != "ALL" {
+			caps = append(caps, Capabilities[name])
+			continue
+		}
+
+		data, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap")
+		if err != nil {
+			return nil, err
+		}
+		lastCap, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, err
+		}
+		for c := 0; c <= lastCap; c++ {
+			caps = append(caps, c)
+		}
+	}
+
+	return caps, nil
+}
+
+// runExecShim is executed in the app process before the app command, it never returns
+func runExecShim(args []string) {
+	flags := flag.NewFlagSet(execShimArg, flag.ExitOnError)
+	uid := flags.Int("uid", 0, "")
+	gid := flags.Int("gid", 0, "")
+	chroot := flags.String("chroot", "", "")
+	dir := flags.String("dir", "", "")
+	dropCaps := flags.String("drop-caps", "", "")
+	noNewPrivs := flags.Bool("no-new-privs", false, "")
+	nice := flags.Int("nice", 0, "")
+	ioprio := flags.Int("ioprio", 0, "")
+	flags.Parse(args)
+
+	// priorities, capability bounding set and no_new_privs are per thread, they have
+	// to be set on the thread that execs
+	runtime.LockOSThread()
+	if err := execShim(flags.Args(), *uid, *gid, *chroot, *dir, *dropCaps, *noNewPrivs, *nice, *ioprio); err != nil {
+		log.SetOutput(os.Stderr)
+		log.Fatal("gracevisor exec: ", err)
+	}
+}
+
+func execShim(command []string, uid, gid int, chroot, dir, dropCaps string, noNewPrivs bool, nice, ioprio int) error {
+	if len(command) == 0 {
+		return fmt.Errorf("no command")
+	}
+
+	if chroot != "" {
+		if err := syscall.Chroot(chroot); err != nil {
+			return err
+		}
+		if err := os.Chdir("/"); err != nil {
+			return err
+		}
+	}
+	if dir != "" {
+		if err := os.Chdir(dir); err != nil {
+			return err
+		}
+	}
+
+	// resolve command before dropping privileges, it may be unreadable afterwards
+	path, err := exec.LookPath(command[0])
+	if err != nil {
+		return err
+	}
+
+	// raising priority needs privileges gracevisord may drop below
+	if nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, nice); err != nil {
+			return fmt.Errorf("nice: %s", err)
+		}
+	}
+	if ioprio != 0 {
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(ioprio)); errno != 0 {
+			return fmt.Errorf("ionice: %s", errno)
+		}
+	}
+
+	caps, err := capabilitiesToDrop(dropCaps)
+	if err != nil {
+		return err
+	}
+	for _, c := range caps {
+		if err := prctl(syscall.PR_CAPBSET_DROP, uintptr(c)); err != nil && err != syscall.EINVAL {
+			return fmt.Errorf("drop capability %d: %s", c, err)
+		}
+	}
+
+	if noNewPrivs {
+		if err := prctl(prSetNoNewPrivs, 1); err != nil {
+			return fmt.Errorf("no_new_privs: %s", err)
+		}
+	}
+
+	if uid != 0 && uid != os.Getuid() {
+		if err := syscall.Setgroups([]int{}); err != nil {
+			return err
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return err
+		}
+		if err := syscall.Setuid(uid); err != nil {
+			return err
+		}
+	}
+
+	return syscall.Exec(path, command, os.Environ())
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExecShimCommand(t *testing.T) {
+	config := &AppConfig{Directory: "{release}/app", NoNewPrivs: true, Nice: 5, User: &UserConfig{Uid: 1000, Gid: 1000}}
+	_, args, err := execShimCommand(config, "/srv/releases/v1/app", "app", []string{"--port=8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flags := map[string]string{}
+	for i := 1; i < len(args) && args[i] != "--"; i++ {
+		if name, value, ok := strings.Cut(args[i], "="); ok {
+			flags[name] = value
+		} else {
+			flags[args[i]] = args[i+1]
+			i++
+		}
+	}
+	if flags["-dir"] != "/srv/releases/v1/app" {
+		t.Error("Shim should change to directory with parsed badges, got", flags["-dir"])
+	}
+	if flags["-nice"] != "5" || flags["-uid"] != "1000" || flags["-no-new-privs"] != "true" {
+		t.Error("Shim should get nice and user of app", flags)
+	}
+	if last := args[len(args)-2:]; last[0] != "app" || last[1] != "--port=8080" {
+		t.Error("Shim should exec command after --, got", args)
+	}
+}
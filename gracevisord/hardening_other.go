@@ -0,0 +1,33 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+)
+
+// execShimArg makes gracevisord act as exec shim instead of daemon
+const execShimArg = "__exec"
+
+// Capabilities are linux only, no names are valid on other platforms
+var Capabilities = map[string]int{}
+
+var ErrExecShimPlatform = errors.New("Exec shim is only supported on linux")
+
+// needsExecShim reports if app process has to be started through exec shim,
+// checkPlatform rejects the options that need it outside linux
+func (c *AppConfig) needsExecShim() bool {
+	return c.NoNewPrivs || len(c.DropCapabilities) > 0
+}
+
+func execShimCommand(config *AppConfig, dir string, path string, args []string) (string, []string, error) {
+	return "", nil, ErrExecShimPlatform
+}
+
+// runExecShim is never started outside linux, it exits to be safe
+func runExecShim(args []string) {
+	log.SetOutput(os.Stderr)
+	log.Fatal("gracevisor exec: ", ErrExecShimPlatform)
+}
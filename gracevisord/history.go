@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/hamaxx/gracevisor/common/report"
+)
+
+// History is a bounded on-disk log of finished instances of an app
+type History struct {
+	records *stateLog[*report.HistoryRecord]
+	mu      sync.Mutex
+}
+
+func NewHistory(stateDir string, appName string, maxRecords int) *History {
+	records, err := loadStateLog[*report.HistoryRecord](stateDir, "history", appName, maxRecords)
+	if err != nil {
+		log.Print(appName, ": History load error:", err)
+	}
+
+	return &History{records: records}
+}
+
+// Add appends record and persists history
+func (h *History) Add(record *report.HistoryRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := h.records.append(record); err != nil {
+		log.Print("History save error:", err)
+	}
+}
+
+// Records returns copy of recorded history, oldest first
+func (h *History) Records() []*report.HistoryRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.records.copy()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const (
+	StopReasonShutdown = "shutdown"
+
+	shutdownTimeout      = 30 * time.Second
+	shutdownPollInterval = 100 * time.Millisecond
+)
+
+// childProcesses tracks processes spawned by gracevisord. Init mode only reaps other
+// zombies, waiting for these would steal exit status from their os/exec owners.
+type childProcesses struct {
+	mu   sync.Mutex
+	pids map[int]bool
+	// running is number of commands being started or waited for by os/exec
+	running int
+}
+
+var children = &childProcesses{pids: map[int]bool{}}
+
+func (c *childProcesses) add(n int) {
+	c.mu.Lock()
+	c.running += n
+	c.mu.Unlock()
+}
+
+// run calls f, that starts a command and waits for it
+func (c *childProcesses) run(f func() error) error {
+	c.add(1)
+	defer c.add(-1)
+	return f()
+}
+
+// start starts long running command, its pid is tracked until exited is called
+func (c *childProcesses) start(cmd *exec.Cmd) error {
+	c.add(1)
+	defer c.add(-1)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.pids[cmd.Process.Pid] = true
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *childProcesses) exited(pid int) {
+	c.mu.Lock()
+	delete(c.pids, pid)
+	c.mu.Unlock()
+}
+
+// shutdown gracefully stops all running instances and waits for them to exit
+func shutdown(runningApps map[string]*App) {
+	for _, app := range runningApps {
+		if err := app.StopInstances(-1, false, StopReasonShutdown); err != nil && err != ErrInstanceNotRunning {
+			log.Print(app.config().Name, ": Shutdown error:", err)
+		}
+	}
+
+	deadline := time.Now().Add(shutdownTimeout)
+	for time.Now().Before(deadline) {
+		running := false
+		for _, app := range runningApps {
+			for _, instance := range app.instances {
+				if instance.status <= InstanceStatusStopping {
+					running = true
+				}
+			}
+		}
+		if !running {
+			return
+		}
+		time.Sleep(shutdownPollInterval)
+	}
+
+	log.Print("Shutdown timed out, killing instances")
+	for _, app := range runningApps {
+		app.StopInstances(-1, true, StopReasonShutdown)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build freebsd || openbsd
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// startInitMode stops all apps before exiting on TERM/INT. Orphaned zombies
+// are not reaped, BSD jails don't run gracevisord as pid 1.
+func startInitMode(runningApps map[string]*App) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		sig := <-sigChan
+		log.Print("Received ", sig, ", shutting down")
+		shutdown(runningApps)
+		os.Exit(0)
+	}()
+}
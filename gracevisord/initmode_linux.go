@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const reapInterval = 5 * time.Second
+
+// startInitMode makes gracevisord usable as container entrypoint (pid 1):
+// orphaned zombies are reaped and TERM/INT stop all apps before exiting
+func startInitMode(runningApps map[string]*App) {
+	sigChan := make(chan os.Signal, 10)
+	signal.Notify(sigChan, syscall.SIGCHLD, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		ticker := time.NewTicker(reapInterval)
+		for {
+			select {
+			case sig := <-sigChan:
+				if sig == syscall.SIGCHLD {
+					reapZombies()
+					continue
+				}
+				log.Print("Received ", sig, ", shutting down")
+				shutdown(runningApps)
+				os.Exit(0)
+			case <-ticker.C:
+				reapZombies()
+			}
+		}
+	}()
+}
+
+// reapZombies waits for exited children that gracevisord didn't spawn, usually orphans
+// reparented to gracevisord running as pid 1. While a command is started or waited for
+// its pid may not be known yet, zombies are reaped on next SIGCHLD or tick.
+func reapZombies() {
+	children.mu.Lock()
+	defer children.mu.Unlock()
+	if children.running > 0 {
+		return
+	}
+
+	procs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		log.Print("Reap zombies error:", err)
+		return
+	}
+
+	ppid := os.Getpid()
+
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(proc.Name())
+		if err != nil || children.pids[pid] {
+			continue
+		}
+
+		stat, err := ioutil.ReadFile("/proc/" + proc.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+
+		// format is "pid (comm) state ppid ...", comm can contain spaces
+		fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+		if len(fields) < 2 || fields[0] != "Z" || fields[1] != strconv.Itoa(ppid) {
+			continue
+		}
+
+		var status syscall.WaitStatus
+		if _, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil); err != nil {
+			log.Print("Reap zombie error:", err)
+		}
+	}
+}
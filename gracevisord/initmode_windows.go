@@ -0,0 +1,21 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+)
+
+// startInitMode stops all apps before exiting on interrupt, windows has no
+// zombies to reap
+func startInitMode(runningApps map[string]*App) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt)
+
+	go func() {
+		sig := <-sigChan
+		log.Print("Received ", sig, ", shutting down")
+		shutdown(runningApps)
+		os.Exit(0)
+	}()
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
@@ -27,9 +29,30 @@ const (
 	InstanceStatusTimedOut
 )
 
+const (
+	RequestedByAutostart   = "autostart"
+	RequestedByRetry       = "retry"
+	RequestedByRpc         = "rpc"
+	RequestedByLogTrigger  = "log_trigger"
+	RequestedByHeartbeat   = "heartbeat"
+	RequestedByHealthCheck = "healthcheck"
+	RequestedByDeploy      = "deploy"
+	RequestedByRollback    = "rollback"
+	RequestedByReload      = "reload"
+	RequestedByCascade     = "restart_with"
+	RequestedBySelf        = "self"
+
+	StopReasonRpc      = "rpc"
+	StopReasonReplaced = "replaced"
+)
+
 const (
 	HealthCheckTimeout = 1
+	HealthCheckMaxBody = 1 << 20
 	PortBadge          = "{port}"
+	VersionBadge       = "{version}"
+
+	shellBinary = "/bin/sh"
 )
 
 type Instance struct {
@@ -41,52 +64,142 @@ type Instance struct {
 	internalHostPort string
 	status           int
 	lastChange       time.Time
+	startTime        time.Time
+	requestedBy      string
+	version          string
+	release          string
+	env              []string
+	stopReason       string
+	recorded         bool
+
+	// stop signal step in progress and when it was sent in unix nanoseconds, zero while
+	// requests drain before the first signal
+	stopStep     int
+	stopStepTime int64
 
 	connWg    *sync.WaitGroup
 	connCount int32
 
+	restartTriggered int32
+
+	reportToken     string
+	lastHeartbeat   time.Time
+	reportedStatus  string
+	reportedMessage string
+	readyReported   bool
+	reportedReady   bool
+	unhealthy       bool
+	healthOverride  string
+	warmupState     int32
+
+	// probes of serving instance run on their own goroutine while probing is set,
+	// their results are read under probeLock
+	probing           int32
+	probeLock         sync.Mutex
+	notReady          bool
+	healthCheckFailed bool
+	lastHealthCheck   time.Time
+	healthFailures    int
+
+	held bool
+
+	canaryStart    time.Time
+	canaryRequests int64
+	canaryErrors   int64
+
+	slowStart time.Time
+
+	metrics instanceMetrics
+
 	cmd              *exec.Cmd
 	processErr       error
 	processExitState *os.ProcessState
+	coreDumped       bool
+	coreFile         string
+
+	// exited is when process exited in unix nanoseconds, its port is reclaimable since
+	exited int64
 
 	instanceLogger *InstanceLogger
 }
 
-func NewInstance(app *App, id uint32) (*Instance, error) {
-	port, err := app.portPool.ReserveNewPort()
+func NewInstance(app *App, id uint32, requestedBy string) (*Instance, error) {
+	instance := &Instance{
+		id:           id,
+		app:          app,
+		internalHost: app.config().InternalHost,
+		status:       InstanceStatusStarting,
+		connWg:       &sync.WaitGroup{},
+		lastChange:   time.Now(),
+		startTime:    time.Now(),
+		requestedBy:  requestedBy,
+		version:      app.version,
+	}
+
+	port, err := app.portPool.ReservePort(instance)
 	if err != nil {
 		return nil, err
 	}
+	instance.internalPort = port
+	instance.internalHostPort = hostPort(app.config().InternalHost, port)
 
-	instance := &Instance{
-		id:               id,
-		app:              app,
-		internalHost:     app.config.InternalHost,
-		internalPort:     port,
-		internalHostPort: fmt.Sprintf("%s:%d", app.config.InternalHost, port),
-		status:           InstanceStatusStarting,
-		connWg:           &sync.WaitGroup{},
-		lastChange:       time.Now(),
+	// instance that failed to start never gets a process to release its port
+	defer func() {
+		if instance.cmd == nil {
+			app.portPool.ReleasePort(port)
+		}
+	}()
+
+	instance.reportToken, err = newReportToken()
+	if err != nil {
+		return nil, err
 	}
 
-	cmdPath, cmdArgs := parseCommand(parsePortBadge(app.config.Command, port))
+	if app.config().Fetch != nil {
+		instance.release, err = instance.fetchRelease()
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	cmd := exec.Command(cmdPath, cmdArgs...)
-	cmd.Dir = app.config.Directory
+	env, err := instance.environment()
+	if err != nil {
+		return nil, err
+	}
+	instance.env = env
+
+	var cmd *exec.Cmd
+	if app.config().Type == AppTypeDocker {
+		cmd = dockerCommand(instance, env)
+	} else {
+		cmdPath, cmdArgs := instance.commandLine()
+		name, err := lookPathEnv(cmdPath, env, app.config().Chroot)
+		if err != nil {
+			return nil, err
+		}
 
-	for _, env := range app.config.Environment {
-		cmd.Env = append(cmd.Env, parsePortBadge(env, port))
+		cmd = exec.Command(name, cmdArgs...)
+		cmd.Args[0] = cmdPath
+		cmd.Dir = instance.parseBadges(app.config().Directory)
+		if cmd.Dir == "" {
+			cmd.Dir = coreDumpDir(app.config())
+		}
+		cmd.Env = env
 	}
 
-	// set credentials for setting uid
-	if app.config.User.Uid != 0 {
-		cmd.SysProcAttr = &syscall.SysProcAttr{
-			Credential: &syscall.Credential{
-				Uid: app.config.User.Uid,
-			},
+	if app.config().needsExecShim() {
+		shimPath, shimArgs, err := execShimCommand(app.config(), cmd.Dir, cmd.Path, cmd.Args[1:])
+		if err != nil {
+			return nil, err
 		}
+		// shim changes to dir after chroot, it may only exist inside the root
+		env := cmd.Env
+		cmd = exec.Command(shimPath, shimArgs...)
+		cmd.Env = env
 	}
 
+	cmd.SysProcAttr = sysProcAttr(app.config())
+
 	outPipe, err := cmd.StdoutPipe()
 	if err != nil {
 		return nil, err
@@ -96,13 +209,23 @@ func NewInstance(app *App, id uint32) (*Instance, error) {
 		return nil, err
 	}
 
-	err = cmd.Start()
+	err = children.start(cmd)
 	if err != nil {
 		return nil, err
 	}
 
 	instance.cmd = cmd
 
+	if err := trackProcess(cmd.Process); err != nil {
+		log.Print(app.config().Name, ": Track process error:", err)
+	}
+	if err := setPriority(app.config(), cmd.Process.Pid); err != nil {
+		log.Print(app.config().Name, ": Set priority error:", err)
+	}
+	if err := setCoreLimit(app.config(), cmd.Process.Pid); err != nil {
+		log.Print(app.config().Name, ": Set core limit error:", err)
+	}
+
 	// init logger
 	instance.instanceLogger, err = NewInstanceLogger(instance, outPipe, errPipe)
 	if err != nil {
@@ -113,45 +236,190 @@ func NewInstance(app *App, id uint32) (*Instance, error) {
 	go func() {
 		if instance.cmd.Process != nil {
 			state, err := instance.cmd.Process.Wait()
+			children.exited(instance.cmd.Process.Pid)
+			untrackProcess(instance.cmd.Process)
+			if state != nil {
+				instance.checkCoreDump(state)
+			}
 			instance.processErr = err
 			instance.processExitState = state
 		}
+		atomic.StoreInt64(&instance.exited, time.Now().UnixNano())
 	}()
 
 	return instance, nil
 }
 
+// exitTime returns when instance process exited, zero while it runs
+func (i *Instance) exitTime() time.Time {
+	exited := atomic.LoadInt64(&i.exited)
+	if exited == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, exited)
+}
+
+// environment returns instance environment from inherited variables, instance identity,
+// env_file and environment config, env_file is read on every start so it can change between restarts
+func (i *Instance) environment() ([]string, error) {
+	env := []string{}
+
+	if i.app.config().InheritEnvironment {
+		env = append(env, os.Environ()...)
+	} else {
+		for _, name := range i.app.config().PassEnvironment {
+			if value, ok := os.LookupEnv(name); ok {
+				env = append(env, name+"="+value)
+			}
+		}
+	}
+
+	env = append(env,
+		fmt.Sprintf("GRACEVISOR_APP=%s", i.app.config().Name),
+		fmt.Sprintf("GRACEVISOR_INSTANCE_ID=%d", i.id),
+		fmt.Sprintf("GRACEVISOR_PORT=%d", i.appPort()),
+		fmt.Sprintf("GRACEVISOR_REPORT_URL=%s", i.app.reportUrl),
+		fmt.Sprintf("GRACEVISOR_REPORT_TOKEN=%s", i.reportToken),
+	)
+	if dir := i.app.config().Logger.ChildLogDirPath; dir != "" {
+		env = append(env, fmt.Sprintf("GRACEVISOR_LOG_DIR=%s", dir))
+	}
+	if i.app.config().Proxy != ProxyNone {
+		env = append(env, fmt.Sprintf("GRACEVISOR_EXTERNAL_URL=%s://%s", i.app.externalScheme(), i.app.externalHostPort))
+	}
+
+	if i.app.config().EnvFile != "" {
+		fileEnv, err := parseEnvFile(i.app.config().EnvFile)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, fileEnv...)
+	}
+
+	env = append(env, i.app.environment...)
+
+	for j := range env {
+		value, err := i.app.secrets.Resolve(i.parseBadges(env[j]))
+		if err != nil {
+			return nil, err
+		}
+		env[j] = value
+	}
+
+	return env, nil
+}
+
+// parseEnvFile reads KEY=value lines, ignoring empty lines and # comments
+func parseEnvFile(fn string) ([]string, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	env := []string{}
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		sep := strings.Index(line, "=")
+		if sep <= 0 {
+			return nil, fmt.Errorf("%s:%d: invalid line", fn, n+1)
+		}
+
+		key := strings.TrimSpace(line[:sep])
+		value := strings.TrimSpace(line[sep+1:])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+
+		env = append(env, key+"="+value)
+	}
+
+	return env, nil
+}
+
 func parsePortBadge(input string, port uint16) string {
 	return strings.Replace(input, PortBadge, fmt.Sprint(port), -1)
 }
 
+func parseVersionBadge(input string, version string) string {
+	return strings.Replace(input, VersionBadge, version, -1)
+}
+
+// parseBadges replaces port, version and release badges with instance values
+func (i *Instance) parseBadges(input string) string {
+	input = strings.Replace(input, ReleaseBadge, i.release, -1)
+	return parseVersionBadge(parsePortBadge(input, i.appPort()), i.version)
+}
+
 func parseCommand(cmd string) (string, []string) {
 	command := strings.Split(cmd, " ")
 	return command[0], command[1:]
 }
 
-func (i *Instance) Stop() {
+// commandLine returns app command path and arguments with badges replaced,
+// argument lists are passed exactly, shell commands are run with /bin/sh -c
+func (i *Instance) commandLine() (string, []string) {
+	if len(i.app.args) > 0 {
+		args := make([]string, len(i.app.args))
+		for j, arg := range i.app.args {
+			args[j] = i.parseBadges(arg)
+		}
+		return args[0], args[1:]
+	}
+	if i.app.config().Shell {
+		return shellBinary, []string{"-c", i.parseBadges(i.app.command)}
+	}
+	return parseCommand(i.parseBadges(i.app.command))
+}
+
+// killProcess kills instance process and its container for docker apps
+func (i *Instance) killProcess() error {
+	if i.app.config().Type == AppTypeDocker {
+		if err := i.killContainer(); err != nil {
+			log.Print(i.app.config().Name, ": Kill container error:", err)
+		}
+	}
+	return killProcessTree(i.cmd.Process)
+}
+
+func (i *Instance) Stop(reason string) {
 	i.status = InstanceStatusStopping
+	i.stopReason = reason
 	i.lastChange = time.Now()
+	i.stopStep = 0
+	atomic.StoreInt64(&i.stopStepTime, 0)
 
 	// wait for all http requests to finish
 	go func() {
 		i.connWg.Wait()
-		if i.cmd.Process != nil {
-			if err := i.cmd.Process.Signal(i.app.config.StopSignal); err != nil {
-				log.Print("Stop signal error:", err)
-				return
-			}
-		}
+		i.sendFirstStopSignal()
 	}()
 
 }
 
-func (i *Instance) Kill() {
+// sendFirstStopSignal sends stop_signal once and starts the clock of the first stop step
+func (i *Instance) sendFirstStopSignal() {
+	if !atomic.CompareAndSwapInt64(&i.stopStepTime, 0, time.Now().UnixNano()) {
+		return
+	}
+	if i.cmd.Process != nil {
+		if err := signalProcess(i.cmd.Process, i.app.config().StopSignal); err != nil {
+			log.Print("Stop signal error:", err)
+		}
+	}
+}
+
+func (i *Instance) Kill(reason string) {
 	i.status = InstanceStatusStopping
+	i.stopReason = reason
 	i.lastChange = time.Now()
+	atomic.StoreInt64(&i.stopStepTime, i.lastChange.UnixNano())
 	if i.cmd.Process != nil {
-		i.processErr = i.cmd.Process.Kill()
+		i.processErr = i.killProcess()
 	}
 }
 
@@ -165,28 +433,180 @@ func (i *Instance) Serve() {
 func (i *Instance) Done() {
 	i.connWg.Done()
 	atomic.AddInt32(&i.connCount, -1)
+	if i.app.config().MaxConcurrentRequests > 0 {
+		i.app.queue.release()
+	}
+}
+
+var healthCheckClient = &http.Client{Timeout: HealthCheckTimeout * time.Second}
+
+// probe checks if http path of the instance returns expected status and body
+func (i *Instance) probe(path string) bool {
+	return probe(i.app.config(), i.internalHostPort, path)
+}
+
+func probe(config *AppConfig, hostPort string, path string) bool {
+	return probeWith(healthCheckClient, "http", config, hostPort, path)
+}
+
+// probeWith probes path with client, doctor uses it to probe tls apps over https
+func probeWith(client *http.Client, scheme string, config *AppConfig, hostPort string, path string) bool {
+	probeUrl := url.URL{
+		Scheme: scheme,
+		Host:   hostPort,
+		Path:   path,
+	}
+
+	req, err := http.NewRequest("GET", probeUrl.String(), nil)
+	if err != nil {
+		log.Print(err)
+		return false
+	}
+	for name, value := range config.HealthCheckHeaders {
+		if http.CanonicalHeaderKey(name) == "Host" {
+			req.Host = value
+		} else {
+			req.Header.Set(name, value)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	statusOk := false
+	for _, status := range config.HealthCheckStatus {
+		if resp.StatusCode == status {
+			statusOk = true
+			break
+		}
+	}
+	if !statusOk {
+		return false
+	}
+
+	if config.HealthCheckBodyRegexp != nil {
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, HealthCheckMaxBody))
+		if err != nil {
+			return false
+		}
+		return config.HealthCheckBodyRegexp.Match(body)
+	}
+
+	return true
 }
 
 func (i *Instance) healthCheck() bool {
-	if i.app.config.HealthCheck == "" {
+	if i.app.config().HealthCheck == "" {
+		return true
+	}
+	return i.probe(i.app.config().HealthCheck)
+}
+
+// reloadHealthy probes healthcheck every second after reload signal,
+// instance is unhealthy after healthcheck failures failed probes
+func (i *Instance) reloadHealthy() bool {
+	if i.app.config().HealthCheck == "" {
 		return true
 	}
 
-	healthCheckUrl := url.URL{
-		Scheme: "http",
-		Host:   i.internalHostPort,
-		Path:   i.app.config.HealthCheck,
+	for n := 0; n < i.app.config().HealthCheckFailures; n++ {
+		time.Sleep(time.Second)
+		if i.healthCheck() {
+			return true
+		}
 	}
+	return false
+}
 
-	resp, err := http.Get(healthCheckUrl.String())
-	if err != nil || resp.StatusCode != 200 {
+// inRotation reports if instance should receive requests,
+// health override from set-health takes precedence over readiness
+func (i *Instance) inRotation() bool {
+	switch i.healthOverride {
+	case report.HealthHealthy:
+		return true
+	case report.HealthUnhealthy:
 		return false
 	}
-	if err := resp.Body.Close(); err != nil {
-		log.Print(err)
+	return !i.probedNotReady() && i.reportedReadiness()
+}
+
+// probedNotReady reports if readiness check of instance failed
+func (i *Instance) probedNotReady() bool {
+	i.probeLock.Lock()
+	defer i.probeLock.Unlock()
+	return i.notReady
+}
+
+// probedUnhealthy reports if healthcheck or liveness check failed healthcheck failures times
+func (i *Instance) probedUnhealthy() bool {
+	i.probeLock.Lock()
+	defer i.probeLock.Unlock()
+	return i.healthCheckFailed
+}
+
+// startProbes runs probes of serving instance unless previous probes still run, so slow
+// probes don't stall the app updater
+func (i *Instance) startProbes() {
+	if !atomic.CompareAndSwapInt32(&i.probing, 0, 1) {
+		return
 	}
+	go func() {
+		i.checkProbes()
+		atomic.StoreInt32(&i.probing, 0)
+	}()
+}
 
-	return true
+// checkProbes updates readiness of serving instance every second, healthcheck
+// and liveness check are probed every healthcheck interval and fail the instance
+// after healthcheck failures consecutive failures
+func (i *Instance) checkProbes() {
+	config := i.app.config()
+
+	if config.ReadinessCheck != "" {
+		notReady := !i.probe(config.ReadinessCheck)
+		i.probeLock.Lock()
+		i.notReady = notReady
+		i.probeLock.Unlock()
+	}
+
+	continuous := config.HealthCheckInterval > 0
+	interval := config.HealthCheckInterval
+	if !continuous {
+		interval = defaultHealthCheckInterval
+	}
+	i.probeLock.Lock()
+	skip := i.healthCheckFailed || (!continuous && config.LivenessCheck == "") ||
+		time.Since(i.lastHealthCheck) < time.Duration(interval)*time.Second
+	if !skip {
+		i.lastHealthCheck = time.Now()
+	}
+	i.probeLock.Unlock()
+	if skip {
+		return
+	}
+
+	healthy := !continuous || i.healthCheck()
+	if healthy && config.LivenessCheck != "" {
+		healthy = i.probe(config.LivenessCheck)
+	}
+
+	i.probeLock.Lock()
+	defer i.probeLock.Unlock()
+	if healthy {
+		i.healthFailures = 0
+		return
+	}
+	i.healthFailures++
+	if i.healthFailures >= config.HealthCheckFailures {
+		i.healthCheckFailed = true
+	}
 }
 
 func (i *Instance) checkProcessStartupStatus() int {
@@ -195,9 +615,10 @@ func (i *Instance) checkProcessStartupStatus() int {
 		return InstanceStatusFailed
 	}
 
-	if i.app.config.StartTimeout > 0 && time.Since(i.lastChange) > time.Duration(i.app.config.StartTimeout)*time.Second {
+	if i.app.config().StartTimeout > 0 && !i.warmingUp() &&
+		time.Since(i.lastChange) > time.Duration(i.app.config().StartTimeout)*time.Second {
 		if i.cmd.Process != nil {
-			i.processErr = i.cmd.Process.Kill()
+			i.processErr = i.killProcess()
 		}
 		return InstanceStatusTimedOut
 	}
@@ -206,7 +627,7 @@ func (i *Instance) checkProcessStartupStatus() int {
 		return InstanceStatusStarting
 	}
 
-	if i.healthCheck() {
+	if i.healthCheck() && i.reportedReadiness() && i.warmedUp() {
 		return InstanceStatusServing
 	}
 	return InstanceStatusStarting
@@ -218,26 +639,61 @@ func (i *Instance) checkProcessStoppingStatus() int {
 		return InstanceStatusExited
 	}
 	if i.processExitState != nil {
-		if s, ok := i.processExitState.Sys().(int); ok && s == 9 {
+		if exitSignal(i.processExitState) == "KILL" {
 			return InstanceStatusKilled
 		}
 		return InstanceStatusStopped
 	}
 
-	if i.app.config.StopTimeout > 0 && time.Since(i.lastChange) > time.Duration(i.app.config.StopTimeout)*time.Second {
-		i.processErr = i.cmd.Process.Kill()
+	steps := i.app.config().StopSteps
+	if i.stopStep >= len(steps) {
+		return InstanceStatusStopping
+	}
+	step := steps[i.stopStep]
+	stepTime := atomic.LoadInt64(&i.stopStepTime)
+	if stepTime == 0 {
+		// requests still drain, stop_signal is sent without waiting for them once the
+		// first step times out, so a hanging request can't keep the instance running
+		if step.Timeout > 0 && time.Since(i.lastChange) > time.Duration(step.Timeout)*time.Second {
+			i.sendFirstStopSignal()
+		}
+		return InstanceStatusStopping
+	}
+	if step.Timeout > 0 && time.Since(time.Unix(0, stepTime)) > time.Duration(step.Timeout)*time.Second {
+		// escalate to next stop signal, kill after the last one
+		if i.stopStep+1 < len(steps) {
+			i.stopStep++
+			atomic.StoreInt64(&i.stopStepTime, time.Now().UnixNano())
+			i.sendStopSignal(steps[i.stopStep].Signal)
+			return InstanceStatusStopping
+		}
+		i.processErr = i.killProcess()
 		return InstanceStatusKilled
 	}
 
 	return InstanceStatusStopping
 }
 
+// sendStopSignal sends stop step signal, kill also kills the container of docker apps
+func (i *Instance) sendStopSignal(signal os.Signal) {
+	if signal == syscall.SIGKILL {
+		i.processErr = i.killProcess()
+		return
+	}
+	log.Printf("%s: Instance %d did not stop, sending %s", i.app.config().Name, i.id, signal)
+	if err := signalProcess(i.cmd.Process, signal); err != nil {
+		log.Print("Stop signal error:", err)
+	}
+}
+
 func (i *Instance) checkProcessRunningStatus() int {
 	if i.processErr != nil || i.cmd.Process == nil || i.processExitState != nil {
 		log.Printf("%s:%s", i.processExitState, i.processErr)
 		return InstanceStatusExited
 	}
 
+	i.startProbes()
+
 	return InstanceStatusServing
 }
 
@@ -262,9 +718,39 @@ func (i *Instance) UpdateStatus() int {
 			i.lastChange = time.Now()
 		}
 	}
+
+	if i.status > InstanceStatusStopping && !i.recorded {
+		i.recorded = true
+		i.app.history.Add(i.historyRecord())
+	}
+
 	return i.status
 }
 
+// historyRecord describes finished instance for app history
+func (i *Instance) historyRecord() *report.HistoryRecord {
+	record := &report.HistoryRecord{
+		InstanceId:  i.id,
+		StartTime:   i.startTime,
+		ExitTime:    i.lastChange,
+		ExitCode:    -1,
+		Status:      i.StatusString(),
+		Reason:      i.stopReason,
+		RequestedBy: i.requestedBy,
+		Version:     i.version,
+	}
+	if i.processExitState != nil {
+		record.ExitCode = i.processExitState.ExitCode()
+	}
+	if record.Reason == "" {
+		record.Reason = i.StatusString()
+	}
+	if i.coreDumped {
+		record.CoreFile = i.coreFile
+	}
+	return record
+}
+
 func (i *Instance) StatusString() string {
 	switch i.status {
 	case InstanceStatusServing:
@@ -294,12 +780,43 @@ func (i *Instance) Report() *report.Instance {
 		Host:              i.internalHost,
 		Port:              i.internalPort,
 		Status:            i.StatusString(),
+		Version:           i.version,
 		SinceStatusChange: uint64(time.Since(i.lastChange) / time.Second),
 	}
 
 	if i.processErr != nil {
 		instanceReport.Error = i.processErr.Error()
 	}
+	instanceReport.Unhealthy = i.unhealthy
+	instanceReport.NotReady = i.probedNotReady() || !i.reportedReadiness()
+	instanceReport.Canary = i == i.app.canaryInstance
+	instanceReport.SlowStart = i.app.slowStartShare(i)
+	instanceReport.Held = i == i.app.heldInstance
+	instanceReport.Standby = i == i.app.standbyInstance
+	instanceReport.HealthOverride = i.healthOverride
+	instanceReport.ReportedStatus = i.reportedStatus
+	instanceReport.ReportedMessage = i.reportedMessage
+	instanceReport.CoreDumped = i.coreDumped
+	instanceReport.CoreFile = i.coreFile
+	instanceReport.Connections = atomic.LoadInt32(&i.connCount)
+
+	instanceReport.StartTime = i.startTime
+	instanceReport.StopReason = i.stopReason
+	instanceReport.ExitCode = -1
+	if i.cmd.Process != nil {
+		instanceReport.Pid = i.cmd.Process.Pid
+	}
+	if state := i.processExitState; state != nil && i.status > InstanceStatusStopping {
+		instanceReport.ExitCode = state.ExitCode()
+		instanceReport.ExitSignal = exitSignal(state)
+		instanceReport.Uptime = uint64(i.lastChange.Sub(i.startTime) / time.Second)
+	} else {
+		instanceReport.Uptime = uint64(time.Since(i.startTime) / time.Second)
+		if instanceReport.Pid != 0 && state == nil {
+			instanceReport.Memory = processMemory(instanceReport.Pid)
+		}
+	}
+	i.metrics.report(instanceReport)
 
 	return instanceReport
 }
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// openFileLimit returns soft and hard open files limit of gracevisord
+func openFileLimit() (uint64, uint64, error) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0, 0, err
+	}
+	return uint64(limit.Cur), uint64(limit.Max), nil
+}
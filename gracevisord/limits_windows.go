@@ -0,0 +1,10 @@
+package main
+
+import "errors"
+
+var ErrFileLimitWindows = errors.New("Open files limit is not supported on windows")
+
+// openFileLimit fails, windows has no open files limit to check
+func openFileLimit() (uint64, uint64, error) {
+	return 0, 0, ErrFileLimitWindows
+}
@@ -0,0 +1,30 @@
+//go:build freebsd || openbsd
+
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// listen opens tcp listener, with reusePort SO_REUSEPORT is set so other
+// processes can bind the same address
+func listen(address string, reusePort bool) (net.Listener, error) {
+	if !reusePort {
+		return net.Listen("tcp", address)
+	}
+	config := net.ListenConfig{Control: reusePortControl}
+	return config.Listen(context.Background(), "tcp", address)
+}
+
+func reusePortControl(network, address string, conn syscall.RawConn) error {
+	var err error
+	controlErr := conn.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEPORT, 1)
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return err
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+var ErrReusePortWindows = errors.New("SO_REUSEPORT is not supported on windows")
+
+// listen opens tcp listener, windows has no SO_REUSEPORT so reusePort fails
+func listen(address string, reusePort bool) (net.Listener, error) {
+	if reusePort {
+		return nil, ErrReusePortWindows
+	}
+	return net.Listen("tcp", address)
+}
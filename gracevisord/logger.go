@@ -5,13 +5,24 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hamaxx/gracevisor/deps/lumberjack"
 )
 
+// rotatedLogTimeFormat is the timestamp format lumberjack uses for rotated files
+const rotatedLogTimeFormat = "2006-01-02T15-04-05.000"
+
+const logDirQuotaInterval = time.Minute
+
 var logLinePool = sync.Pool{}
 
 type LogLine struct {
@@ -43,71 +54,242 @@ type AppLogger struct {
 }
 
 func NewAppLogger(app *App) *AppLogger {
+	if err := prepareAppLogs(app.config()); err != nil {
+		log.Print(app.config().Name, ": Log files error:", err)
+	}
+
 	stdoutWriter := &lumberjack.Logger{
-		Filename:   app.config.Logger.StdoutLogFile,
-		MaxSize:    app.config.Logger.MaxLogSize,
-		MaxAge:     app.config.Logger.MaxLogAge,
-		MaxBackups: app.config.Logger.MaxLogsKept,
+		Filename:   app.config().Logger.StdoutLogFile,
+		MaxSize:    app.config().Logger.MaxLogSize,
+		MaxAge:     app.config().Logger.MaxLogAge,
+		MaxBackups: app.config().Logger.MaxLogsKept,
 	}
 
 	var stderrWriter io.WriteCloser
-	if app.config.Logger.StdoutLogFile == app.config.Logger.StderrLogFile {
+	if app.config().Logger.StdoutLogFile == app.config().Logger.StderrLogFile {
 		stderrWriter = stdoutWriter
 	} else {
 		stderrWriter = &lumberjack.Logger{
-			Filename:   app.config.Logger.StderrLogFile,
-			MaxSize:    app.config.Logger.MaxLogSize,
-			MaxAge:     app.config.Logger.MaxLogAge,
-			MaxBackups: app.config.Logger.MaxLogsKept,
+			Filename:   app.config().Logger.StderrLogFile,
+			MaxSize:    app.config().Logger.MaxLogSize,
+			MaxAge:     app.config().Logger.MaxLogAge,
+			MaxBackups: app.config().Logger.MaxLogsKept,
 		}
 	}
 
-	return &AppLogger{
+	al := &AppLogger{
 		app:          app,
 		stdoutWriter: stdoutWriter,
 		stderrWriter: stderrWriter,
 	}
+
+	if app.config().Logger.MaxLogDirSize > 0 {
+		go al.startLogDirQuota()
+	}
+
+	return al
+}
+
+// createLogFile creates log file with mode before lumberjack opens it, lumberjack keeps
+// mode and owner of the file when it rotates
+func createLogFile(fn string, mode os.FileMode) error {
+	f, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_APPEND, mode)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Chmod(fn, mode)
+}
+
+// prepareAppLogs applies log modes to app log files and creates child log dir owned by
+// app user, so an app running as that user can write its own logs there. With chown log
+// files get the same owner, so they can be read without root.
+func prepareAppLogs(config *AppConfig) error {
+	uid, gid := -1, config.Logger.Gid
+	if config.User.UserName != "" {
+		uid = int(config.User.Uid)
+		if gid < 0 {
+			gid = int(config.User.Gid)
+		}
+	}
+	chown := os.Geteuid() == 0 && (uid >= 0 || gid >= 0)
+
+	for _, fn := range []string{config.Logger.StdoutLogFile, config.Logger.StderrLogFile} {
+		if err := createLogFile(fn, config.Logger.FilePerm); err != nil {
+			return err
+		}
+		if chown && config.Logger.Chown {
+			if err := os.Chown(fn, uid, gid); err != nil {
+				return err
+			}
+		}
+	}
+
+	dir := config.Logger.ChildLogDirPath
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, config.Logger.DirPerm); err != nil {
+		return err
+	}
+	if err := os.Chmod(dir, config.Logger.DirPerm); err != nil {
+		return err
+	}
+	if chown {
+		return os.Chown(dir, uid, gid)
+	}
+	return nil
+}
+
+func (al *AppLogger) startLogDirQuota() {
+	ticker := time.NewTicker(logDirQuotaInterval)
+	for {
+		if err := al.enforceLogDirQuota(); err != nil {
+			log.Print(al.app.config().Name, ": Log quota error:", err)
+		}
+		<-ticker.C
+	}
+}
+
+// logFiles returns distinct log files the app writes to
+func (al *AppLogger) logFiles() []string {
+	config := al.app.config().Logger
+	if config.StdoutLogFile == config.StderrLogFile {
+		return []string{config.StdoutLogFile}
+	}
+	return []string{config.StdoutLogFile, config.StderrLogFile}
+}
+
+// enforceLogDirQuota deletes oldest rotated log files until all app logs fit into max_log_dir_size
+func (al *AppLogger) enforceLogDirQuota() error {
+	maxSize := int64(al.app.config().Logger.MaxLogDirSize) * 1024 * 1024
+
+	totalSize := int64(0)
+	rotated := []*rotatedLogFile{}
+	for _, fn := range al.logFiles() {
+		if fi, err := os.Stat(fn); err == nil {
+			totalSize += fi.Size()
+		}
+
+		files, err := rotatedLogFiles(fn)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			totalSize += file.size
+		}
+		rotated = append(rotated, files...)
+	}
+
+	sort.Sort(rotatedLogFileSort(rotated))
+
+	for _, file := range rotated {
+		if totalSize <= maxSize {
+			break
+		}
+		if err := os.Remove(file.path); err != nil {
+			return err
+		}
+		totalSize -= file.size
+	}
+
+	return nil
 }
 
 func (al *AppLogger) logStdout(logLine *LogLine) {
 	if err := logLine.WriteTo(al.stdoutWriter); err != nil {
-		log.Print(al.app.config.Name, ": Stdout write error:", err)
+		log.Print(al.app.config().Name, ": Stdout write error:", err)
 	}
 	logLinePool.Put(logLine)
 }
 
 func (al *AppLogger) logStderr(logLine *LogLine) {
 	if err := logLine.WriteTo(al.stderrWriter); err != nil {
-		log.Print(al.app.config.Name, ": Stderr write error:", err)
+		log.Print(al.app.config().Name, ": Stderr write error:", err)
 	}
 
 	logLinePool.Put(logLine)
 }
 
+type rotatedLogFile struct {
+	path      string
+	size      int64
+	timestamp time.Time
+}
+
+// rotatedLogFileSort sorts rotated files from oldest to newest
+type rotatedLogFileSort []*rotatedLogFile
+
+func (v rotatedLogFileSort) Len() int {
+	return len(v)
+}
+func (v rotatedLogFileSort) Swap(i, j int) {
+	v[i], v[j] = v[j], v[i]
+}
+func (v rotatedLogFileSort) Less(i, j int) bool {
+	return v[i].timestamp.Before(v[j].timestamp)
+}
+
+// rotatedLogFiles returns files rotated by lumberjack from log file fn
+func rotatedLogFiles(fn string) ([]*rotatedLogFile, error) {
+	dir := filepath.Dir(fn)
+	ext := filepath.Ext(fn)
+	prefix := strings.TrimSuffix(filepath.Base(fn), ext) + "-"
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	rotated := []*rotatedLogFile{}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+
+		timestamp, err := time.Parse(rotatedLogTimeFormat, name[len(prefix):len(name)-len(ext)])
+		if err != nil {
+			continue
+		}
+
+		rotated = append(rotated, &rotatedLogFile{
+			path:      filepath.Join(dir, name),
+			size:      file.Size(),
+			timestamp: timestamp,
+		})
+	}
+
+	return rotated, nil
+}
+
 type InstanceLogger struct {
 	instance *Instance
+	output   *instanceOutput
 }
 
 func NewInstanceLogger(instance *Instance, outPipe, errPipe io.ReadCloser) (*InstanceLogger, error) {
 	il := &InstanceLogger{
 		instance: instance,
+		output:   newInstanceOutput(2),
 	}
 
-	il.lineReader(outPipe, instance.app.appLogger.logStdout)
-	il.lineReader(errPipe, instance.app.appLogger.logStderr)
+	il.lineReader(outPipe, false, instance.app.appLogger.logStdout)
+	il.lineReader(errPipe, true, instance.app.appLogger.logStderr)
 
 	return il, nil
 }
 
-func (il *InstanceLogger) lineReader(pipe io.ReadCloser, writer func(*LogLine)) {
+func (il *InstanceLogger) lineReader(pipe io.ReadCloser, stderr bool, writer func(*LogLine)) {
 	rd := bufio.NewReader(pipe)
 	go func() {
+		defer il.output.closePipe()
 		for {
 			line, err := rd.ReadBytes('\n')
 			if err == io.EOF {
 				return
 			} else if err != nil {
-				log.Print(il.instance.app.config.Name, ": Read Error:", err)
+				log.Print(il.instance.app.config().Name, ": Read Error:", err)
 				return
 			}
 			if len(line) > 0 && line[len(line)-1] == '\n' {
@@ -116,9 +298,11 @@ func (il *InstanceLogger) lineReader(pipe io.ReadCloser, writer func(*LogLine))
 			if len(line) > 0 && line[len(line)-1] == '\r' {
 				line = line[0 : len(line)-1]
 			}
+			il.checkTriggers(line)
+			il.output.write(stderr, line)
 			ll, err := il.newLogLine(line)
 			if err != nil {
-				log.Print(il.instance.app.config.Name, ": Log write error:", err)
+				log.Print(il.instance.app.config().Name, ": Log write error:", err)
 				continue
 			}
 			writer(ll)
@@ -126,6 +310,33 @@ func (il *InstanceLogger) lineReader(pipe io.ReadCloser, writer func(*LogLine))
 	}()
 }
 
+// checkTriggers emits events for lines matching app log triggers
+func (il *InstanceLogger) checkTriggers(line []byte) {
+	instance := il.instance
+	app := instance.app
+
+	for _, trigger := range app.config().LogTriggers {
+		if !trigger.Regexp.Match(line) {
+			continue
+		}
+
+		app.events.Emit(&Event{
+			Type:       EventLogTrigger,
+			Name:       trigger.Name,
+			App:        app.config().Name,
+			InstanceId: instance.id,
+			Message:    string(line),
+		})
+
+		if trigger.Restart && !app.isPaused() && instance.status == InstanceStatusServing && atomic.CompareAndSwapInt32(&instance.restartTriggered, 0, 1) {
+			log.Print(app.config().Name, ": Log trigger restart: ", trigger.Name)
+			if err := app.StartNewInstance(RequestedByLogTrigger); err != nil {
+				log.Print(app.config().Name, ": Log trigger restart error:", err)
+			}
+		}
+	}
+}
+
 func (il *InstanceLogger) newLogLine(line []byte) (*LogLine, error) {
 	var logLine *LogLine
 
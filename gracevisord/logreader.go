@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hamaxx/gracevisor/common/report"
+)
+
+const (
+	logLineTimeFormat  = "2006-01-02 15:04:05.999999999 -0700 MST"
+	defaultLogLines    = 100
+	maxLogLineReadSize = 1024 * 1024
+)
+
+// parseLogLine parses instance id and time from line written by LogLine.WriteTo
+func parseLogLine(line []byte) (uint32, time.Time, bool) {
+	end := bytes.Index(line, []byte("] "))
+	if len(line) == 0 || line[0] != '[' || end < 0 {
+		return 0, time.Time{}, false
+	}
+
+	header := line[1:end]
+	sep := bytes.IndexByte(header, '/')
+	if sep < 0 {
+		return 0, time.Time{}, false
+	}
+
+	instanceId, err := strconv.ParseUint(string(header[:sep]), 10, 32)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+
+	// strip monotonic clock reading
+	timeStr := header[sep+1:]
+	if m := bytes.Index(timeStr, []byte(" m=")); m >= 0 {
+		timeStr = timeStr[:m]
+	}
+
+	t, err := time.Parse(logLineTimeFormat, string(timeStr))
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+
+	return uint32(instanceId), t, true
+}
+
+// ReadLogs returns last lines of current and rotated app logs matching query
+func (al *AppLogger) ReadLogs(query *report.LogQuery) ([]string, error) {
+	fn := al.app.config().Logger.StdoutLogFile
+	if query.Stderr {
+		fn = al.app.config().Logger.StderrLogFile
+	}
+
+	rotated, err := rotatedLogFiles(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var since time.Time
+	if query.Since > 0 {
+		since = time.Now().Add(-time.Duration(query.Since))
+	}
+
+	sort.Sort(rotatedLogFileSort(rotated))
+
+	paths := []string{}
+	for _, file := range rotated {
+		// skip files rotated before the requested period
+		if !since.IsZero() && file.timestamp.Before(since) {
+			continue
+		}
+		paths = append(paths, file.path)
+	}
+	paths = append(paths, fn)
+
+	maxLines := query.Lines
+	if maxLines <= 0 {
+		maxLines = defaultLogLines
+	}
+
+	// ring buffer of last maxLines lines
+	lines := make([]string, maxLines)
+	count := 0
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, maxLogLineReadSize)
+		for scanner.Scan() {
+			line := scanner.Bytes()
+
+			instanceId, t, ok := parseLogLine(line)
+			if !ok {
+				continue
+			}
+			if query.InstanceId > 0 && instanceId != query.InstanceId {
+				continue
+			}
+			if !since.IsZero() && t.Before(since) {
+				continue
+			}
+
+			lines[count%maxLines] = string(line)
+			count++
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if count <= maxLines {
+		return lines[:count], nil
+	}
+	start := count % maxLines
+	return append(lines[start:], lines[:start]...), nil
+}
@@ -0,0 +1,42 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// lookPathEnv resolves command name in PATH of env, the environment it is started with,
+// so apps find the same binaries as their shell would. Without PATH in env, PATH of
+// gracevisord is used. Paths are looked up inside chroot and returned as seen from it.
+func lookPathEnv(name string, env []string, chroot string) (string, error) {
+	if strings.Contains(name, "/") {
+		return name, nil
+	}
+
+	pathEnv, ok := "", false
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "PATH=") {
+			pathEnv, ok = kv[len("PATH="):], true
+		}
+	}
+	if !ok {
+		pathEnv = os.Getenv("PATH")
+	}
+
+	for _, dir := range filepath.SplitList(pathEnv) {
+		// relative entries would depend on directory of gracevisord
+		if !filepath.IsAbs(dir) {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		info, err := os.Stat(filepath.Join(chroot, path))
+		if err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return path, nil
+		}
+	}
+	return "", &exec.Error{Name: name, Err: exec.ErrNotFound}
+}
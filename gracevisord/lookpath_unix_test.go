@@ -0,0 +1,42 @@
+//go:build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLookPathEnv(t *testing.T) {
+	dir := t.TempDir()
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	if err := ioutil.WriteFile(path.Join(dir, "app"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(path.Join(dir, "root", "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "root", "bin", "tool"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	env := []string{"PATH=/nonexistent:" + dir}
+	if name, err := lookPathEnv("app", env, ""); err != nil || name != path.Join(dir, "app") {
+		t.Error("Command should be found in PATH of env, got", name, err)
+	}
+	if _, err := lookPathEnv("missing", env, ""); err == nil {
+		t.Error("Command missing from PATH of env should not be found")
+	}
+	if name, err := lookPathEnv("tool", []string{"PATH=/bin"}, path.Join(dir, "root")); err != nil || name != "/bin/tool" {
+		t.Error("Command should be found inside chroot, got", name, err)
+	}
+	os.Setenv("PATH", dir)
+	if name, err := lookPathEnv("app", []string{"HOME=/"}, ""); err != nil || name != path.Join(dir, "app") {
+		t.Error("Command should be found in PATH of gracevisord without PATH in env, got", name, err)
+	}
+	if name, _ := lookPathEnv("./app", env, ""); name != "./app" {
+		t.Error("Paths should not be looked up, got", name)
+	}
+}
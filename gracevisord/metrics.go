@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hamaxx/gracevisor/common/report"
+)
+
+// latencyWindow is number of latest requests latency percentiles are computed from
+const latencyWindow = 1000
+
+// statusRecorder records response status of proxied requests
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+
+	// set by app proxyError when request couldn't be proxied
+	proxyErr     error
+	proxyErrKind string
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets reverse proxy hijack connection of upgraded requests
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instanceMetrics counts requests proxied to an instance
+type instanceMetrics struct {
+	requests     int64
+	errors       int64
+	totalLatency int64
+
+	latencyLock sync.Mutex
+	latencies   []time.Duration
+	next        int
+}
+
+// record counts finished request, 5xx responses and proxy errors are errors
+func (m *instanceMetrics) record(status int, latency time.Duration) {
+	atomic.AddInt64(&m.requests, 1)
+	atomic.AddInt64(&m.totalLatency, int64(latency))
+	if status >= 500 {
+		atomic.AddInt64(&m.errors, 1)
+	}
+
+	m.latencyLock.Lock()
+	if len(m.latencies) < latencyWindow {
+		m.latencies = append(m.latencies, latency)
+	} else {
+		m.latencies[m.next] = latency
+		m.next = (m.next + 1) % latencyWindow
+	}
+	m.latencyLock.Unlock()
+}
+
+func (m *instanceMetrics) report(instanceReport *report.Instance) {
+	instanceReport.Requests = atomic.LoadInt64(&m.requests)
+	instanceReport.Errors = atomic.LoadInt64(&m.errors)
+	if instanceReport.Requests > 0 {
+		instanceReport.AvgLatency = time.Duration(atomic.LoadInt64(&m.totalLatency) / instanceReport.Requests)
+	}
+
+	m.latencyLock.Lock()
+	latencies := make([]time.Duration, len(m.latencies))
+	copy(latencies, m.latencies)
+	m.latencyLock.Unlock()
+
+	if len(latencies) == 0 {
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p int) time.Duration {
+		return latencies[(len(latencies)-1)*p/100]
+	}
+	instanceReport.P50Latency = percentile(50)
+	instanceReport.P95Latency = percentile(95)
+	instanceReport.P99Latency = percentile(99)
+}
+
+// proxy serves request reserved on instance and records its metrics
+func (a *App) proxy(instance *Instance, rw http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	recorder := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+	a.reverseProxy().ServeHTTP(recorder, req)
+	if recorder.proxyErr != nil && recorder.proxyErrKind != ProxyErrorCanceled {
+		log.Printf("%s: instance %d: proxy %s error: %s", a.config().Name, instance.id, recorder.proxyErrKind, recorder.proxyErr)
+	}
+
+	latency := time.Since(start)
+	instance.metrics.record(recorder.status, latency)
+	a.requestLog.record(a.config().RequestLog, instance, req, recorder.status, latency)
+	if instance == a.canaryInstance {
+		instance.recordCanary(recorder.status)
+	}
+}
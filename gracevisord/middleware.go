@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+var ErrHeadersRequired = errors.New("Options must set at least one header")
+
+// Middleware wraps next handler of app proxy chain, options are the ones set
+// for it in app config. It is also called when config is checked, so invalid
+// options should be returned as error.
+type Middleware func(next http.Handler, options map[string]string) (http.Handler, error)
+
+var middlewares = map[string]Middleware{}
+
+// RegisterMiddleware makes middleware available to app configs by name, call it
+// from init of a file compiled into gracevisord
+func RegisterMiddleware(name string, middleware Middleware) {
+	if _, ok := middlewares[name]; ok {
+		panic("middleware registered twice: " + name)
+	}
+	middlewares[name] = middleware
+}
+
+func init() {
+	RegisterMiddleware("request_headers", requestHeadersMiddleware)
+	RegisterMiddleware("response_headers", responseHeadersMiddleware)
+}
+
+// requestHeadersMiddleware sets options as headers of proxied requests, empty value removes header
+func requestHeadersMiddleware(next http.Handler, options map[string]string) (http.Handler, error) {
+	if len(options) == 0 {
+		return nil, ErrHeadersRequired
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		for name, value := range options {
+			if value == "" {
+				req.Header.Del(name)
+			} else {
+				req.Header.Set(name, value)
+			}
+		}
+		next.ServeHTTP(rw, req)
+	}), nil
+}
+
+// responseHeadersMiddleware sets options as headers of responses, also of the ones gracevisord
+// answers itself
+func responseHeadersMiddleware(next http.Handler, options map[string]string) (http.Handler, error) {
+	if len(options) == 0 {
+		return nil, ErrHeadersRequired
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		for name, value := range options {
+			rw.Header().Set(name, value)
+		}
+		next.ServeHTTP(rw, req)
+	}), nil
+}
+
+// middlewareChain wraps handler with app middleware, first configured is outermost
+func middlewareChain(handler http.Handler, configs []*MiddlewareConfig) (http.Handler, error) {
+	for i := len(configs) - 1; i >= 0; i-- {
+		middleware, ok := middlewares[configs[i].Name]
+		if !ok {
+			return nil, ErrInvalidMiddleware
+		}
+		var err error
+		if handler, err = middleware(handler, configs[i].Options); err != nil {
+			return nil, fmt.Errorf("middleware %s: %s", configs[i].Name, err)
+		}
+	}
+	return handler, nil
+}
+
+// checkMiddleware checks middleware is registered and accepts its options
+func checkMiddleware(config *MiddlewareConfig) error {
+	_, err := middlewareChain(http.NotFoundHandler(), []*MiddlewareConfig{config})
+	return err
+}
+
+// chainHandler serves app through its current middleware chain, replaced on config reload
+type chainHandler struct {
+	chain atomic.Value
+}
+
+func (h *chainHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	h.chain.Load().(http.Handler).ServeHTTP(rw, req)
+}
+
+// updateMiddleware builds middleware chain of app config, config was checked so it can't fail
+func (a *App) updateMiddleware() {
+	handler, err := middlewareChain(http.HandlerFunc(a.serveCached), a.config().Middleware)
+	if err != nil {
+		panic(err)
+	}
+	if a.config().Cors != nil {
+		handler = a.config().Cors.handler(handler)
+	}
+	a.middleware.chain.Store(handler)
+}
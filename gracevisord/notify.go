@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const defaultNotifierTemplate = "{{.Type}}{{if .App}} {{.App}}{{end}}{{if .InstanceId}}[{{.InstanceId}}]{{end}}{{if .Name}} {{.Name}}{{end}}{{if .Message}}: {{.Message}}{{end}}"
+
+var (
+	ErrNotifierUrlRequired     = errors.New("Options must set url")
+	ErrNotifierCommandRequired = errors.New("Options must set command")
+	ErrNotifierEmailRequired   = errors.New("Options must set smtp, from and to")
+)
+
+// Notifier delivers event with message rendered from template of its config
+type Notifier interface {
+	Notify(event *Event, message string) error
+}
+
+// NotifierFactory creates notifier from options set for it in events config. It is
+// also called when config is checked, so invalid options should be returned as error.
+type NotifierFactory func(options map[string]string, timeout time.Duration) (Notifier, error)
+
+var notifierFactories = map[string]NotifierFactory{}
+
+// RegisterNotifier makes notifier type available to events config, call it from init
+// of a file compiled into gracevisord
+func RegisterNotifier(name string, factory NotifierFactory) {
+	if _, ok := notifierFactories[name]; ok {
+		panic("notifier registered twice: " + name)
+	}
+	notifierFactories[name] = factory
+}
+
+func init() {
+	RegisterNotifier("webhook", newWebhookNotifier)
+	RegisterNotifier("slack", newSlackNotifier)
+	RegisterNotifier("email", newEmailNotifier)
+	RegisterNotifier("exec", newExecNotifier)
+}
+
+// newNotifier creates notifier of config type
+func newNotifier(config *NotifierConfig, timeout time.Duration) (Notifier, error) {
+	factory, ok := notifierFactories[config.Type]
+	if !ok {
+		return nil, ErrInvalidNotifier
+	}
+	notifier, err := factory(config.Options, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("notifier %s: %s", config.Type, err)
+	}
+	return notifier, nil
+}
+
+// matches checks if event is one of notifier events of one of its apps
+func (c *NotifierConfig) matches(event *Event) bool {
+	if len(c.Events) > 0 && !contains(c.Events, event.Type) {
+		return false
+	}
+	return len(c.Apps) == 0 || contains(c.Apps, event.App)
+}
+
+// render executes message template with event
+func (c *NotifierConfig) render(event *Event) (string, error) {
+	var buf bytes.Buffer
+	if err := c.MessageTemplate.Execute(&buf, event); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// postJson posts body as json and fails on non 2xx status
+func postJson(client *http.Client, url string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if err := resp.Body.Close(); err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// webhookNotifier posts event json with rendered message as text
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookNotifier(options map[string]string, timeout time.Duration) (Notifier, error) {
+	if options["url"] == "" {
+		return nil, ErrNotifierUrlRequired
+	}
+	return &webhookNotifier{url: options["url"], client: &http.Client{Timeout: timeout}}, nil
+}
+
+func (n *webhookNotifier) Notify(event *Event, message string) error {
+	return postJson(n.client, n.url, map[string]interface{}{"event": event, "text": message})
+}
+
+// slackNotifier posts message to a slack incoming webhook
+type slackNotifier struct {
+	url      string
+	channel  string
+	username string
+	client   *http.Client
+}
+
+func newSlackNotifier(options map[string]string, timeout time.Duration) (Notifier, error) {
+	if options["url"] == "" {
+		return nil, ErrNotifierUrlRequired
+	}
+	return &slackNotifier{
+		url:      options["url"],
+		channel:  options["channel"],
+		username: options["username"],
+		client:   &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (n *slackNotifier) Notify(event *Event, message string) error {
+	body := map[string]string{"text": message}
+	if n.channel != "" {
+		body["channel"] = n.channel
+	}
+	if n.username != "" {
+		body["username"] = n.username
+	}
+	return postJson(n.client, n.url, body)
+}
+
+// emailNotifier sends message over smtp, subject is the first line of message
+type emailNotifier struct {
+	addr     string
+	from     string
+	to       []string
+	username string
+	password string
+	timeout  time.Duration
+}
+
+func newEmailNotifier(options map[string]string, timeout time.Duration) (Notifier, error) {
+	if options["smtp"] == "" || options["from"] == "" || options["to"] == "" {
+		return nil, ErrNotifierEmailRequired
+	}
+	if _, _, err := net.SplitHostPort(options["smtp"]); err != nil {
+		return nil, err
+	}
+	to := []string{}
+	for _, addr := range strings.Split(options["to"], ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			to = append(to, addr)
+		}
+	}
+	return &emailNotifier{
+		addr:     options["smtp"],
+		from:     options["from"],
+		to:       to,
+		username: options["username"],
+		password: options["password"],
+		timeout:  timeout,
+	}, nil
+}
+
+func (n *emailNotifier) Notify(event *Event, message string) error {
+	subject, _, _ := strings.Cut(message, "\n")
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n", n.from, strings.Join(n.to, ", "), subject, event.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", strings.Replace(message, "\n", "\r\n", -1))
+
+	conn, err := net.DialTimeout("tcp", n.addr, n.timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(n.timeout))
+	host, _, _ := net.SplitHostPort(n.addr)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(nil); err != nil {
+			return err
+		}
+	}
+	if n.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", n.username, n.password, host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(n.from); err != nil {
+		return err
+	}
+	for _, addr := range n.to {
+		if err := client.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// execNotifier runs a shell command with message on stdin and event in environment
+type execNotifier struct {
+	command string
+	timeout time.Duration
+}
+
+func newExecNotifier(options map[string]string, timeout time.Duration) (Notifier, error) {
+	if options["command"] == "" {
+		return nil, ErrNotifierCommandRequired
+	}
+	return &execNotifier{command: options["command"], timeout: timeout}, nil
+}
+
+func (n *execNotifier) Notify(event *Event, message string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), n.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, shellBinary, "-c", n.command)
+	cmd.Stdin = strings.NewReader(message)
+	cmd.Env = append(os.Environ(),
+		"GRACEVISOR_EVENT_TYPE="+event.Type,
+		"GRACEVISOR_EVENT_NAME="+event.Name,
+		"GRACEVISOR_EVENT_APP="+event.App,
+		"GRACEVISOR_EVENT_INSTANCE_ID="+strconv.FormatUint(uint64(event.InstanceId), 10),
+		"GRACEVISOR_EVENT_MESSAGE="+event.Message,
+		"GRACEVISOR_EVENT_TIME="+event.Time.Format(time.RFC3339),
+	)
+	var out []byte
+	err := children.run(func() (err error) {
+		out, err = cmd.CombinedOutput()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// parseNotifierTemplate parses message template, default template is used when empty
+func parseNotifierTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = defaultNotifierTemplate
+	}
+	return template.New("message").Option("missingkey=error").Parse(text)
+}
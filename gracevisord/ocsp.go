@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ocspTimeout = 10 * time.Second
+	// ocspRetry is how long failed ocsp requests wait before they are sent again
+	ocspRetry = 5 * time.Minute
+	// ocspValidity is how long responses without next update are stapled
+	ocspValidity = 2 * time.Hour
+	// expiryWarningRepeat is how often certificate_expiring is emitted for a certificate
+	expiryWarningRepeat = 24 * time.Hour
+)
+
+var (
+	ErrOcspNoIssuer     = errors.New("Certificate chain has no issuer certificate")
+	ErrOcspNoResponder  = errors.New("Certificate has no ocsp responder")
+	ErrOcspRevoked      = errors.New("Ocsp responder reports certificate revoked")
+	ErrOcspUnknown      = errors.New("Ocsp responder doesn't know certificate")
+	ErrOcspBadResponse  = errors.New("Invalid ocsp response")
+	ErrOcspNoSingleResp = errors.New("Ocsp response has no status of certificate")
+	ErrOcspBadSignature = errors.New("Ocsp response isn't signed by issuer or its delegated responder")
+	ErrOcspExpired      = errors.New("Ocsp response is no longer valid")
+)
+
+var (
+	oidSha1              = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidOcspBasicResponse = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+
+	// ocspSignatureAlgorithms are signature algorithms of responses by oid
+	ocspSignatureAlgorithms = map[string]x509.SignatureAlgorithm{
+		"1.2.840.113549.1.1.5":  x509.SHA1WithRSA,
+		"1.2.840.113549.1.1.11": x509.SHA256WithRSA,
+		"1.2.840.113549.1.1.12": x509.SHA384WithRSA,
+		"1.2.840.113549.1.1.13": x509.SHA512WithRSA,
+		"1.2.840.10045.4.1":     x509.ECDSAWithSHA1,
+		"1.2.840.10045.4.3.2":   x509.ECDSAWithSHA256,
+		"1.2.840.10045.4.3.3":   x509.ECDSAWithSHA384,
+		"1.2.840.10045.4.3.4":   x509.ECDSAWithSHA512,
+		"1.3.101.112":           x509.PureEd25519,
+	}
+)
+
+// ocsp asn.1 structures of RFC 6960, only what stapling needs. Responses must be signed
+// by the issuer or by a responder certificate it issued for ocsp signing, so a spoofed
+// responder can't get a forged response stapled.
+type ocspCertId struct {
+	HashAlgorithm  pkix.AlgorithmIdentifier
+	IssuerNameHash []byte
+	IssuerKeyHash  []byte
+	SerialNumber   *big.Int
+}
+
+type ocspRequest struct {
+	TBSRequest struct {
+		RequestList []struct {
+			Cert ocspCertId
+		}
+	}
+}
+
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response struct {
+		ResponseType asn1.ObjectIdentifier
+		Response     []byte
+	} `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData struct {
+		Raw            asn1.RawContent
+		Version        int `asn1:"optional,default:0,explicit,tag:0"`
+		RawResponderID asn1.RawValue
+		ProducedAt     time.Time `asn1:"generalized"`
+		Responses      []ocspSingleResponse
+	}
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID  ocspCertId
+	Good    asn1.Flag `asn1:"tag:0,optional"`
+	Revoked struct {
+		RevocationTime time.Time       `asn1:"generalized"`
+		Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+	} `asn1:"tag:1,optional"`
+	Unknown          asn1.Flag        `asn1:"tag:2,optional"`
+	ThisUpdate       time.Time        `asn1:"generalized"`
+	NextUpdate       time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	SingleExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+// ocspStaple is the latest good ocsp response of a certificate
+type ocspStaple struct {
+	response   []byte
+	validUntil time.Time
+	refresh    time.Time
+}
+
+// leafCertificate returns parsed leaf of certificate chain
+func leafCertificate(cert *tls.Certificate) (*x509.Certificate, error) {
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+	return x509.ParseCertificate(cert.Certificate[0])
+}
+
+// ocspCertIdOf identifies leaf signed by issuer in ocsp requests and responses
+func ocspCertIdOf(leaf, issuer *x509.Certificate) (ocspCertId, error) {
+	var publicKeyInfo struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &publicKeyInfo); err != nil {
+		return ocspCertId{}, err
+	}
+	nameHash := sha1.Sum(issuer.RawSubject)
+	keyHash := sha1.Sum(publicKeyInfo.PublicKey.RightAlign())
+	return ocspCertId{
+		HashAlgorithm:  pkix.AlgorithmIdentifier{Algorithm: oidSha1, Parameters: asn1.NullRawValue},
+		IssuerNameHash: nameHash[:],
+		IssuerKeyHash:  keyHash[:],
+		SerialNumber:   leaf.SerialNumber,
+	}, nil
+}
+
+// fetchOcsp asks responder of certificate for its status, only good responses are
+// returned for stapling
+func fetchOcsp(client *http.Client, cert *tls.Certificate, leaf *x509.Certificate) (*ocspStaple, error) {
+	if len(leaf.OCSPServer) == 0 {
+		return nil, ErrOcspNoResponder
+	}
+	if len(cert.Certificate) < 2 {
+		return nil, ErrOcspNoIssuer
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, err
+	}
+	certId, err := ocspCertIdOf(leaf, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	request := ocspRequest{}
+	request.TBSRequest.RequestList = append(request.TBSRequest.RequestList, struct{ Cert ocspCertId }{certId})
+	data, err := asn1.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d", leaf.OCSPServer[0], resp.StatusCode)
+	}
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	single, err := parseOcsp(raw, certId, issuer)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	staple := &ocspStaple{response: raw, validUntil: single.NextUpdate, refresh: now.Add(time.Hour)}
+	if single.NextUpdate.IsZero() {
+		staple.validUntil = now.Add(ocspValidity)
+	} else if refresh := single.ThisUpdate.Add(single.NextUpdate.Sub(single.ThisUpdate) / 2); refresh.After(now) {
+		// refreshed halfway through validity, so a slow responder doesn't leave clients without staple
+		staple.refresh = refresh
+	}
+	return staple, nil
+}
+
+// parseOcsp returns good status of certId from response signed for issuer
+func parseOcsp(raw []byte, certId ocspCertId, issuer *x509.Certificate) (*ocspSingleResponse, error) {
+	var response ocspResponse
+	if rest, err := asn1.Unmarshal(raw, &response); err != nil || len(rest) > 0 {
+		return nil, ErrOcspBadResponse
+	}
+	if response.Status != 0 {
+		return nil, fmt.Errorf("Ocsp responder returned status %d", response.Status)
+	}
+	if !response.Response.ResponseType.Equal(oidOcspBasicResponse) {
+		return nil, ErrOcspBadResponse
+	}
+	var basic ocspBasicResponse
+	if _, err := asn1.Unmarshal(response.Response.Response, &basic); err != nil {
+		return nil, ErrOcspBadResponse
+	}
+	now := time.Now()
+	if err := verifyOcsp(&basic, issuer, now); err != nil {
+		return nil, err
+	}
+
+	for i := range basic.TBSResponseData.Responses {
+		single := &basic.TBSResponseData.Responses[i]
+		if single.CertID.SerialNumber == nil || single.CertID.SerialNumber.Cmp(certId.SerialNumber) != 0 ||
+			!bytes.Equal(single.CertID.IssuerNameHash, certId.IssuerNameHash) ||
+			!bytes.Equal(single.CertID.IssuerKeyHash, certId.IssuerKeyHash) {
+			continue
+		}
+		switch {
+		case bool(single.Good):
+			if !single.NextUpdate.IsZero() && now.After(single.NextUpdate) {
+				return nil, ErrOcspExpired
+			}
+			return single, nil
+		case bool(single.Unknown):
+			return nil, ErrOcspUnknown
+		default:
+			return nil, ErrOcspRevoked
+		}
+	}
+	return nil, ErrOcspNoSingleResp
+}
+
+// verifyOcsp checks signature of response by issuer, or by a certificate included in
+// response that issuer signed for ocsp signing and that is valid at now
+func verifyOcsp(basic *ocspBasicResponse, issuer *x509.Certificate, now time.Time) error {
+	algorithm, ok := ocspSignatureAlgorithms[basic.SignatureAlgorithm.Algorithm.String()]
+	if !ok {
+		return fmt.Errorf("Unsupported ocsp signature algorithm %s", basic.SignatureAlgorithm.Algorithm)
+	}
+	signed, signature := basic.TBSResponseData.Raw, basic.Signature.RightAlign()
+	if issuer.CheckSignature(algorithm, signed, signature) == nil {
+		return nil
+	}
+
+	for _, raw := range basic.Certificates {
+		responder, err := x509.ParseCertificate(raw.FullBytes)
+		if err != nil || now.Before(responder.NotBefore) || now.After(responder.NotAfter) ||
+			!ocspSigner(responder) || responder.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+		if responder.CheckSignature(algorithm, signed, signature) == nil {
+			return nil
+		}
+	}
+	return ErrOcspBadSignature
+}
+
+func ocspSigner(cert *x509.Certificate) bool {
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageOCSPSigning {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsState is tls config served on app listeners, built from app tls options with
+// stapled ocsp responses of its certificates
+type tlsState struct {
+	app    *App
+	client *http.Client
+
+	mu   sync.Mutex
+	base *tls.Config
+	// staples and warned are by certificate der
+	staples map[string]*ocspStaple
+	warned  map[string]time.Time
+	served  atomic.Value
+}
+
+func newTLSState(app *App, base *tls.Config) *tlsState {
+	s := &tlsState{
+		app:     app,
+		client:  &http.Client{Timeout: ocspTimeout},
+		staples: map[string]*ocspStaple{},
+		warned:  map[string]time.Time{},
+	}
+	s.update(base)
+	return s
+}
+
+func (s *tlsState) config() *tls.Config {
+	return s.served.Load().(*tls.Config)
+}
+
+// update serves base config of reloaded certificates or policy, staples of certificates
+// it still has are kept
+func (s *tlsState) update(base *tls.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.base = base
+	s.apply()
+}
+
+// apply staples valid responses to certificates of base config, mu must be held
+func (s *tlsState) apply() {
+	config := s.base.Clone()
+	config.Certificates = make([]tls.Certificate, len(s.base.Certificates))
+	copy(config.Certificates, s.base.Certificates)
+	now := time.Now()
+	for i := range config.Certificates {
+		staple, ok := s.staples[string(config.Certificates[i].Certificate[0])]
+		if ok && staple.response != nil && now.Before(staple.validUntil) {
+			config.Certificates[i].OCSPStaple = staple.response
+		}
+	}
+	s.served.Store(config)
+}
+
+// check emits certificate_expiring for certificates close to expiry and refreshes
+// their ocsp staples when stapling is enabled
+func (s *tlsState) check(config *TLSConfig) {
+	s.mu.Lock()
+	certs := s.base.Certificates
+	s.mu.Unlock()
+
+	now := time.Now()
+	stapled := false
+	for i := range certs {
+		cert := &certs[i]
+		leaf, err := leafCertificate(cert)
+		if err != nil {
+			continue
+		}
+		key := string(cert.Certificate[0])
+
+		expiresIn := leaf.NotAfter.Sub(now)
+		if expiresIn < time.Duration(config.ExpiryWarning)*24*time.Hour && now.Sub(s.warned[key]) >= expiryWarningRepeat {
+			s.warned[key] = now
+			message := fmt.Sprintf("expires %s in %s", leaf.NotAfter.Format(time.RFC3339), expiresIn.Truncate(time.Minute))
+			if expiresIn <= 0 {
+				message = fmt.Sprintf("expired %s", leaf.NotAfter.Format(time.RFC3339))
+			}
+			s.app.events.Emit(&Event{
+				Type:    EventCertificateExpiring,
+				Name:    certificateName(leaf),
+				App:     s.app.config().Name,
+				Message: message,
+			})
+		}
+
+		if !config.OcspStapling {
+			continue
+		}
+		if staple, ok := s.staples[key]; ok && now.Before(staple.refresh) {
+			continue
+		}
+		staple, err := fetchOcsp(s.client, cert, leaf)
+		if err != nil {
+			log.Printf("%s: certificate %s: ocsp error: %s", s.app.config().Name, certificateName(leaf), err)
+			staple = &ocspStaple{refresh: now.Add(ocspRetry)}
+			if previous, ok := s.staples[key]; ok {
+				// previous response is stapled until it is no longer valid
+				staple.response, staple.validUntil = previous.response, previous.validUntil
+			}
+		}
+		s.mu.Lock()
+		s.staples[key] = staple
+		s.mu.Unlock()
+		stapled = true
+	}
+
+	if stapled {
+		s.mu.Lock()
+		s.apply()
+		s.mu.Unlock()
+	}
+}
+
+// expiry returns certificate of served config that expires first
+func (s *tlsState) expiry() (string, time.Time) {
+	s.mu.Lock()
+	certs := s.base.Certificates
+	s.mu.Unlock()
+
+	name, first := "", time.Time{}
+	for i := range certs {
+		leaf, err := leafCertificate(&certs[i])
+		if err == nil && (first.IsZero() || leaf.NotAfter.Before(first)) {
+			name, first = certificateName(leaf), leaf.NotAfter
+		}
+	}
+	return name, first
+}
+
+func certificateName(leaf *x509.Certificate) string {
+	if leaf.Subject.CommonName != "" {
+		return leaf.Subject.CommonName
+	}
+	if len(leaf.DNSNames) > 0 {
+		return leaf.DNSNames[0]
+	}
+	return leaf.SerialNumber.String()
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type testOcspSigner struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestOcspSigner creates certificate signed by parent, or self signed if parent is nil
+func newTestOcspSigner(t *testing.T, template *x509.Certificate, parent *testOcspSigner) *testOcspSigner {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer := &testOcspSigner{cert: template, key: key}
+	if parent == nil {
+		parent = signer
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent.cert, &key.PublicKey, parent.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer.cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// sign encodes single response signed by signer, certificates are included in response
+func (s *testOcspSigner) sign(t *testing.T, single ocspSingleResponse, certs ...*x509.Certificate) []byte {
+	basic := ocspBasicResponse{SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}}}
+	basic.TBSResponseData.RawResponderID = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: []byte{4, 1, 0}}
+	basic.TBSResponseData.ProducedAt = time.Now().UTC().Truncate(time.Second)
+	basic.TBSResponseData.Responses = []ocspSingleResponse{single}
+	tbs, err := asn1.Marshal(basic.TBSResponseData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	basic.TBSResponseData.Raw = tbs
+	digest := sha256.Sum256(tbs)
+	signature, err := s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	basic.Signature = asn1.BitString{Bytes: signature, BitLength: len(signature) * 8}
+	for _, cert := range certs {
+		basic.Certificates = append(basic.Certificates, asn1.RawValue{FullBytes: cert.Raw})
+	}
+
+	basicDer, err := asn1.Marshal(basic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := ocspResponse{}
+	response.Response.ResponseType = oidOcspBasicResponse
+	response.Response.Response = basicDer
+	der, err := asn1.Marshal(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestParseOcsp(t *testing.T) {
+	issuer := newTestOcspSigner(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	leaf := newTestOcspSigner(t, &x509.Certificate{SerialNumber: big.NewInt(42), Subject: pkix.Name{CommonName: "example.com"}}, issuer)
+	responder := newTestOcspSigner(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "responder"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+	}, issuer)
+	unauthorized := newTestOcspSigner(t, &x509.Certificate{SerialNumber: big.NewInt(3), Subject: pkix.Name{CommonName: "server"}}, issuer)
+	rogue := newTestOcspSigner(t, &x509.Certificate{
+		SerialNumber: big.NewInt(4),
+		Subject:      pkix.Name{CommonName: "ca"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+	}, nil)
+
+	certId, err := ocspCertIdOf(leaf.cert, issuer.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	single := ocspSingleResponse{CertID: certId, Good: true, ThisUpdate: now, NextUpdate: now.Add(time.Hour)}
+
+	parsed, err := parseOcsp(issuer.sign(t, single), certId, issuer.cert)
+	if err != nil || !parsed.NextUpdate.Equal(now.Add(time.Hour)) {
+		t.Error("Good ocsp response signed by issuer parse fails:", err)
+	}
+	if _, err := parseOcsp(responder.sign(t, single, responder.cert), certId, issuer.cert); err != nil {
+		t.Error("Good ocsp response signed by delegated responder parse fails:", err)
+	}
+	for name, response := range map[string][]byte{
+		"responder certificate not included": responder.sign(t, single),
+		"responder without ocsp signing":     unauthorized.sign(t, single, unauthorized.cert),
+		"responder not issued by issuer":     rogue.sign(t, single, rogue.cert),
+	} {
+		if _, err := parseOcsp(response, certId, issuer.cert); err != ErrOcspBadSignature {
+			t.Error("Ocsp response with", name, "should fail with bad signature, got", err)
+		}
+	}
+
+	expired := single
+	expired.ThisUpdate, expired.NextUpdate = now.Add(-2*time.Hour), now.Add(-time.Hour)
+	if _, err := parseOcsp(issuer.sign(t, expired), certId, issuer.cert); err != ErrOcspExpired {
+		t.Error("Expired ocsp response should fail, got", err)
+	}
+	single.Good = false
+	single.Revoked.RevocationTime = now
+	if _, err := parseOcsp(issuer.sign(t, single), certId, issuer.cert); err != ErrOcspRevoked {
+		t.Error("Revoked ocsp response should fail, got", err)
+	}
+	single.CertID.SerialNumber = big.NewInt(43)
+	if _, err := parseOcsp(issuer.sign(t, single), certId, issuer.cert); err != ErrOcspNoSingleResp {
+		t.Error("Ocsp response of other certificate should fail, got", err)
+	}
+	if _, err := parseOcsp([]byte("garbage"), certId, issuer.cert); err != ErrOcspBadResponse {
+		t.Error("Invalid ocsp response should fail, got", err)
+	}
+}
+
+func TestFetchOcsp(t *testing.T) {
+	issuer := newTestOcspSigner(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	var response []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(response)
+	}))
+	defer server.Close()
+	leaf := newTestOcspSigner(t, &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		OCSPServer:   []string{server.URL},
+	}, issuer)
+
+	certId, err := ocspCertIdOf(leaf.cert, issuer.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	response = issuer.sign(t, ocspSingleResponse{CertID: certId, Good: true, ThisUpdate: now, NextUpdate: now.Add(time.Hour)})
+
+	cert := &tls.Certificate{Certificate: [][]byte{leaf.cert.Raw, issuer.cert.Raw}}
+	staple, err := fetchOcsp(server.Client(), cert, leaf.cert)
+	if err != nil {
+		t.Fatal("Ocsp fetch fails:", err)
+	}
+	if string(staple.response) != string(response) || !staple.validUntil.Equal(now.Add(time.Hour)) {
+		t.Error("Ocsp staple should hold response valid until next update:", staple)
+	}
+
+	if _, err := fetchOcsp(server.Client(), &tls.Certificate{Certificate: [][]byte{leaf.cert.Raw}}, leaf.cert); err != ErrOcspNoIssuer {
+		t.Error("Ocsp fetch without issuer should fail, got", err)
+	}
+}
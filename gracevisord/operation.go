@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrOperationInProgress = errors.New("Another restart or deploy is in progress")
+	ErrReloadNotSupported  = errors.New("App has no reload_signal configured")
+	ErrReloadHealthCheck   = errors.New("Healthcheck failed after reload, instance is replaced")
+	ErrReplaceNotActive    = errors.New("Only the active instance can request its replacement")
+	ErrReplacePaused       = errors.New("App is paused, replacement requests are ignored")
+)
+
+// operation is a restart, deploy or rollback requested over rpc
+type operation struct {
+	name     string
+	start    time.Time
+	instance *Instance
+}
+
+// inProgress reports if operation instance is still starting, held or in canary
+func (o *operation) inProgress(app *App) bool {
+	if o.instance == nil {
+		return true
+	}
+	if o.instance == app.activeInstance {
+		return false
+	}
+	return o.instance.status == InstanceStatusStarting || o.instance.status == InstanceStatusServing
+}
+
+// exclusive runs start unless another operation of the app is in progress,
+// operation lasts until started instance is promoted or fails
+func (a *App) exclusive(name string, start func() (*Instance, error)) error {
+	a.operationLock.Lock()
+	if current := a.operation; current != nil && current.inProgress(a) {
+		a.operationLock.Unlock()
+		return fmt.Errorf("%s: %s since %s", ErrOperationInProgress, current.name, current.start.Format(time.RFC3339))
+	}
+	op := &operation{
+		name:  name,
+		start: time.Now(),
+	}
+	a.operation = op
+	a.operationLock.Unlock()
+
+	instance, err := start()
+
+	a.operationLock.Lock()
+	defer a.operationLock.Unlock()
+	if err == ErrWaitingForPort {
+		// operation lasts until queued instance gets a port and is started
+		return err
+	}
+	if err != nil {
+		a.operation = nil
+		return err
+	}
+	op.instance = instance
+	return nil
+}
+
+// Restart starts a new instance that replaces active one once serving
+func (a *App) Restart() error {
+	err := a.exclusive("restart", func() (*Instance, error) {
+		return a.startInstance(RequestedByRpc, false)
+	})
+	if err == nil || err == ErrWaitingForPort {
+		a.restartDependents()
+	}
+	return err
+}
+
+// Replace starts a new instance that replaces active instance on its own request,
+// like a restart it is refused while another operation is in progress
+func (a *App) Replace(instance *Instance, message string) error {
+	a.activeInstanceLock.Lock()
+	active := a.activeInstance
+	a.activeInstanceLock.Unlock()
+	if instance != active {
+		return ErrReplaceNotActive
+	}
+	if a.isPaused() {
+		return ErrReplacePaused
+	}
+
+	name := fmt.Sprintf("replace requested by instance %d", instance.id)
+	err := a.exclusive(name, func() (*Instance, error) {
+		return a.startInstance(RequestedBySelf, false)
+	})
+	if err == nil || err == ErrWaitingForPort {
+		a.events.Emit(&Event{
+			Type:       EventReplaceRequested,
+			App:        a.config().Name,
+			InstanceId: instance.id,
+			Message:    message,
+		})
+	}
+	return err
+}
+
+// Reload sends reload_signal to active instance so it reloads in place, with
+// healthcheck configured the instance is replaced if it is not healthy after reload
+func (a *App) Reload() error {
+	if a.backends != nil {
+		return ErrBackendApp
+	}
+	if a.config().ReloadSignal == nil {
+		return ErrReloadNotSupported
+	}
+
+	return a.exclusive("reload", func() (*Instance, error) {
+		a.activeInstanceLock.Lock()
+		instance := a.activeInstance
+		a.activeInstanceLock.Unlock()
+		if instance == nil || instance.cmd.Process == nil {
+			return nil, ErrNoActiveInstances
+		}
+
+		if err := signalProcess(instance.cmd.Process, a.config().ReloadSignal); err != nil {
+			return nil, err
+		}
+		if !instance.reloadHealthy() {
+			a.replaceUnhealthy(instance, EventReloadFailed, RequestedByRpc)
+			return nil, ErrReloadHealthCheck
+		}
+		return instance, nil
+	})
+}
+
+// currentOperation returns in progress operation for reports
+func (a *App) currentOperation() *operation {
+	a.operationLock.Lock()
+	defer a.operationLock.Unlock()
+
+	if a.operation == nil || !a.operation.inProgress(a) {
+		return nil
+	}
+	return a.operation
+}
@@ -2,45 +2,163 @@ package main
 
 import (
 	"errors"
+	"expvar"
+	"hash/fnv"
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/hamaxx/gracevisor/common/report"
 )
 
-var ErrNoAvailablePorts = errors.New("No available ports")
+var (
+	ErrNoAvailablePorts = errors.New("No available ports")
+	ErrWaitingForPort   = errors.New("No available ports, instance will start when a port is released")
+)
 
 type PortPool struct {
 	portStart uint16
 	portEnd   uint16
 
+	// wait makes apps queue new instances instead of failing when pool is exhausted
+	wait         bool
+	reclaimAfter time.Duration
+
 	current uint16
 	mu      sync.Mutex
 
-	usedPorts map[uint16]struct{}
+	// usedPorts maps reserved ports to instances using them
+	usedPorts map[uint16]*Instance
+
+	// fixed are internal_ports of apps, never given to other apps
+	fixed map[uint16]bool
+
+	// waiting are apps with an instance waiting for port, with time since when
+	waiting map[string]time.Time
 }
 
-func NewPortPool(start, end uint16) *PortPool {
+func NewPortPool(config *InternalPortsConfig) *PortPool {
 	return &PortPool{
-		portStart: start,
-		portEnd:   end,
-		current:   start - 1,
-		usedPorts: make(map[uint16]struct{}, end-start),
+		portStart:    config.From,
+		portEnd:      config.To,
+		wait:         config.OnExhausted == PortsExhaustedWait,
+		reclaimAfter: time.Duration(config.ReclaimAfter) * time.Second,
+		current:      config.From - 1,
+		usedPorts:    make(map[uint16]*Instance, config.To-config.From),
+		fixed:        map[uint16]bool{},
+		waiting:      map[string]time.Time{},
 	}
 }
 
-func (p *PortPool) ReserveNewPort() (uint16, error) {
+// ReservePort reserves port for instance by port assignment of its app. Ports
+// of instances exited longer than reclaim_after are reused, when there are none
+// left ports of all exited instances are reclaimed.
+func (p *PortPool) ReservePort(instance *Instance) (uint16, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	pick := p.picker(instance.app.config())
+	p.reclaim(p.reclaimAfter)
+	port, ok := pick()
+	if !ok {
+		p.reclaim(0)
+		port, ok = pick()
+	}
+	if !ok {
+		return 0, ErrNoAvailablePorts
+	}
+
+	p.usedPorts[port] = instance
+	return port, nil
+}
+
+// available reports if a port can be reserved for app, apps waiting for a port
+// check it so they don't use up instance ids on failed starts
+func (p *PortPool) available(config *AppConfig) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.reclaim(0)
+	_, ok := p.picker(config)()
+	return ok
+}
+
+// picker returns port assignment of app: one of internal_ports, stable pool port
+// or any free pool port
+func (p *PortPool) picker(config *AppConfig) func() (uint16, bool) {
+	switch {
+	case len(config.InternalPorts) > 0:
+		// apps added by reload are excluded from the pool on first start
+		for _, port := range config.InternalPorts {
+			p.fixed[port] = true
+		}
+		return func() (uint16, bool) { return p.firstFree(config.InternalPorts) }
+	case config.StablePorts:
+		return func() (uint16, bool) { return p.stablePort(config.Name) }
+	}
+	return p.freePort
+}
+
+// setFixed excludes internal_ports of app from the pool
+func (p *PortPool) setFixed(ports []uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, port := range ports {
+		p.fixed[port] = true
+	}
+}
+
+func (p *PortPool) isFree(port uint16) bool {
+	_, used := p.usedPorts[port]
+	return !used && !p.fixed[port]
+}
+
+func (p *PortPool) freePort() (uint16, bool) {
 	for i := uint16(0); i < p.portEnd-p.portStart; i++ {
 		p.current = (p.current + 1) % (p.portEnd - p.portStart)
 		port := p.portStart + p.current
 
-		_, used := p.usedPorts[port]
-		if !used {
-			p.usedPorts[port] = struct{}{}
-			return port, nil
+		if p.isFree(port) {
+			return port, true
+		}
+	}
+	return 0, false
+}
+
+func (p *PortPool) firstFree(ports []uint16) (uint16, bool) {
+	for _, port := range ports {
+		if _, used := p.usedPorts[port]; !used {
+			return port, true
+		}
+	}
+	return 0, false
+}
+
+// stablePort returns the first free slot of app, slots are pool ports in order
+// from an offset seeded by app name, so instances get the same ports every start
+func (p *PortPool) stablePort(appName string) (uint16, bool) {
+	hash := fnv.New32a()
+	hash.Write([]byte(appName))
+
+	size := uint32(p.portEnd - p.portStart)
+	offset := hash.Sum32() % size
+	for slot := uint32(0); slot < size; slot++ {
+		port := p.portStart + uint16((offset+slot)%size)
+		if p.isFree(port) {
+			return port, true
+		}
+	}
+	return 0, false
+}
+
+// reclaim releases ports of instances that exited at least after ago
+func (p *PortPool) reclaim(after time.Duration) {
+	for port, instance := range p.usedPorts {
+		if exited := instance.exitTime(); !exited.IsZero() && time.Since(exited) >= after {
+			delete(p.usedPorts, port)
 		}
 	}
-	return 0, ErrNoAvailablePorts
 }
 
 func (p *PortPool) ReleasePort(port uint16) {
@@ -48,3 +166,50 @@ func (p *PortPool) ReleasePort(port uint16) {
 	delete(p.usedPorts, port)
 	p.mu.Unlock()
 }
+
+// setWaiting records if app has an instance waiting for a port
+func (p *PortPool) setWaiting(appName string, waiting bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !waiting {
+		delete(p.waiting, appName)
+	} else if _, ok := p.waiting[appName]; !ok {
+		p.waiting[appName] = time.Now()
+	}
+}
+
+// Report returns utilization of the pool, exited instances still holding
+// ports are reclaimable
+func (p *PortPool) Report() *report.PortPool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	poolReport := &report.PortPool{
+		From: p.portStart,
+		To:   p.portEnd,
+		Size: int(p.portEnd - p.portStart),
+	}
+	for port, instance := range p.usedPorts {
+		if port < p.portStart || port >= p.portEnd {
+			continue
+		}
+		if instance.exitTime().IsZero() {
+			poolReport.Used++
+		} else {
+			poolReport.Reclaimable++
+		}
+	}
+	for appName := range p.waiting {
+		poolReport.Waiting = append(poolReport.Waiting, appName)
+	}
+	sort.Strings(poolReport.Waiting)
+	return poolReport
+}
+
+// publish exposes pool utilization as port_pool expvar
+func (p *PortPool) publish() {
+	expvar.Publish("port_pool", expvar.Func(func() interface{} {
+		return p.Report()
+	}))
+}
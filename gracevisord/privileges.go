@@ -0,0 +1,74 @@
+//go:build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// dropPrivileges switches gracevisord to daemon user after privileged listeners are bound.
+// Log and state dirs with files already in them, app log dirs and audit and request logs
+// are handed over to daemon user so it can keep writing to them.
+func dropPrivileges(config *Config) error {
+	daemonUser := config.DaemonUser
+	if daemonUser.UserName == "" {
+		return nil
+	}
+
+	paths := []string{config.Logger.LogDir, config.StateDir, config.Logger.AuditLogFile}
+	for _, app := range config.Apps {
+		paths = append(paths, app.Logger.LogDir)
+		if app.RequestLog != nil {
+			paths = append(paths, app.RequestLog.File)
+		}
+	}
+	for _, root := range paths {
+		if root == "" {
+			continue
+		}
+		err := filepath.Walk(root, func(fn string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			return os.Lchown(fn, int(daemonUser.Uid), int(daemonUser.Gid))
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := syscall.Setgroups([]int{}); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(int(daemonUser.Gid)); err != nil {
+		return err
+	}
+	if err := syscall.Setuid(int(daemonUser.Uid)); err != nil {
+		return err
+	}
+
+	log.Print("Dropped privileges to user ", daemonUser.UserName)
+	return nil
+}
+
+// executableBy checks execute permission of file for uid and primary gid, supplementary
+// groups are not checked
+func executableBy(fi os.FileInfo, uid uint32, gid uint32) bool {
+	mode := fi.Mode().Perm()
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	switch {
+	case !ok || uid == 0:
+		return mode&0111 != 0
+	case stat.Uid == uid:
+		return mode&0100 != 0
+	case stat.Gid == gid:
+		return mode&0010 != 0
+	}
+	return mode&0001 != 0
+}
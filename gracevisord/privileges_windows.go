@@ -0,0 +1,21 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var ErrDaemonUserWindows = errors.New("Daemon user is not supported on windows, run gracevisord as the service account instead")
+
+// dropPrivileges fails if daemon user is configured, windows processes can't switch user
+func dropPrivileges(config *Config) error {
+	if config.DaemonUser.UserName != "" {
+		return ErrDaemonUserWindows
+	}
+	return nil
+}
+
+// executableBy is always true, windows has no execute permission bits
+func executableBy(fi os.FileInfo, uid uint32, gid uint32) bool {
+	return true
+}
@@ -0,0 +1,110 @@
+//go:build freebsd || openbsd
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// IoniceClasses and Namespaces are linux only, no names are valid on BSDs
+var IoniceClasses = map[string]int{}
+
+var Namespaces = map[string]uintptr{}
+
+var ErrUnsupportedBSD = errors.New("Not supported on BSD")
+
+// checkPlatform reports app options that need linux process isolation
+func checkPlatform(config *AppConfig) error {
+	var errs ConfigErrors
+	if len(config.Namespaces) > 0 {
+		errs.add("namespaces", ErrUnsupportedBSD)
+	}
+	if len(config.DropCapabilities) > 0 {
+		errs.add("drop_capabilities", ErrUnsupportedBSD)
+	}
+	if config.NoNewPrivs {
+		errs.add("no_new_privs", ErrUnsupportedBSD)
+	}
+	if config.Ionice != nil {
+		errs.add("ionice", ErrUnsupportedBSD)
+	}
+	if config.CoreDump != nil && config.CoreDump.Enabled {
+		errs.add("core_dump", ErrUnsupportedBSD)
+	}
+	return errs.err()
+}
+
+// trackProcess is called after instance process starts, BSDs need no tracking
+func trackProcess(process *os.Process) error {
+	return nil
+}
+
+// untrackProcess is called after instance process exits
+func untrackProcess(process *os.Process) {}
+
+func signalProcess(process *os.Process, sig os.Signal) error {
+	return process.Signal(sig)
+}
+
+func killProcessTree(process *os.Process) error {
+	return process.Kill()
+}
+
+// sysProcAttr returns process attributes for instance of app: user and chroot
+func sysProcAttr(config *AppConfig) *syscall.SysProcAttr {
+	attr := &syscall.SysProcAttr{
+		Chroot: config.Chroot,
+	}
+
+	// set credentials for setting uid, unless already running as that user
+	if config.User.Uid != 0 && config.User.Uid != uint32(os.Getuid()) {
+		attr.Credential = &syscall.Credential{
+			Uid: config.User.Uid,
+		}
+	}
+
+	return attr
+}
+
+// setPriority applies nice of app to started process
+func setPriority(config *AppConfig, pid int) error {
+	if config.Nice == 0 {
+		return nil
+	}
+	return syscall.Setpriority(syscall.PRIO_PROCESS, pid, config.Nice)
+}
+
+// exitSignal returns name of signal that terminated process, empty if it exited
+func exitSignal(state *os.ProcessState) string {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return ""
+	}
+	return signalName(status.Signal())
+}
+
+// sysctl reads raw value of mib into buf and returns its length
+func sysctl(mib []int32, buf []byte) (int, error) {
+	size := uintptr(len(buf))
+	_, _, errno := syscall.Syscall6(syscall.SYS___SYSCTL, uintptr(unsafe.Pointer(&mib[0])), uintptr(len(mib)),
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(size), nil
+}
+
+// fileLimit returns soft limit of open files, only known for gracevisord itself
+func fileLimit(pid int) uint64 {
+	var limit syscall.Rlimit
+	if pid != os.Getpid() {
+		return 0
+	}
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0
+	}
+	return uint64(limit.Cur)
+}
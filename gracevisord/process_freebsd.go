@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"unsafe"
+)
+
+const (
+	ctlKern      = 1
+	kernProc     = 14
+	kernProcPid  = 1
+	kernProcNfds = 43
+
+	// kinfoProcBufSize fits kinfo_proc of all architectures
+	kinfoProcBufSize = 2048
+)
+
+// kinfoProc is the beginning of struct kinfo_proc from sys/user.h up to ki_rssize
+type kinfoProc struct {
+	Structsize    int32
+	Layout        int32
+	Args          uintptr
+	Paddr         uintptr
+	Addr          uintptr
+	Tracep        uintptr
+	Textvp        uintptr
+	Fd            uintptr
+	Vmspace       uintptr
+	Wchan         uintptr
+	Pid           int32
+	Ppid          int32
+	Pgid          int32
+	Tpgid         int32
+	Sid           int32
+	Tsid          int32
+	Jobc          int16
+	SpareShort1   int16
+	TdevFreebsd11 uint32
+	Siglist       [4]uint32
+	Sigmask       [4]uint32
+	Sigignore     [4]uint32
+	Sigcatch      [4]uint32
+	Uid           uint32
+	Ruid          uint32
+	Svuid         uint32
+	Rgid          uint32
+	Svgid         uint32
+	Ngroups       int16
+	SpareShort2   int16
+	Groups        [16]uint32
+	Size          uintptr
+	Rssize        int
+}
+
+// processMemory returns resident memory of process in bytes, 0 if it can't be read
+func processMemory(pid int) uint64 {
+	buf := make([]byte, kinfoProcBufSize)
+	n, err := sysctl([]int32{ctlKern, kernProc, kernProcPid, int32(pid)}, buf)
+	if err != nil || n < int(unsafe.Sizeof(kinfoProc{})) {
+		return 0
+	}
+	proc := (*kinfoProc)(unsafe.Pointer(&buf[0]))
+	if proc.Pid != int32(pid) || proc.Rssize < 0 {
+		return 0
+	}
+	return uint64(proc.Rssize) * uint64(os.Getpagesize())
+}
+
+// openFiles returns number of open file descriptors of process and its soft limit,
+// limit is only known for gracevisord itself
+func openFiles(pid int) (int, uint64) {
+	buf := make([]byte, 4)
+	n, err := sysctl([]int32{ctlKern, kernProc, kernProcNfds, int32(pid)}, buf)
+	if err != nil || n != len(buf) {
+		return 0, 0
+	}
+	return int(*(*int32)(unsafe.Pointer(&buf[0]))), fileLimit(pid)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+var IoniceClasses = map[string]int{
+	"realtime":    1,
+	"best-effort": 2,
+	"idle":        3,
+}
+
+var Namespaces = map[string]uintptr{
+	"mount": syscall.CLONE_NEWNS,
+	"pid":   syscall.CLONE_NEWPID,
+	"ipc":   syscall.CLONE_NEWIPC,
+	"uts":   syscall.CLONE_NEWUTS,
+}
+
+// checkPlatform reports app options not supported on this platform, all are on linux
+func checkPlatform(config *AppConfig) error {
+	return nil
+}
+
+// trackProcess is called after instance process starts, linux needs no tracking
+func trackProcess(process *os.Process) error {
+	return nil
+}
+
+// untrackProcess is called after instance process exits
+func untrackProcess(process *os.Process) {}
+
+func signalProcess(process *os.Process, sig os.Signal) error {
+	return process.Signal(sig)
+}
+
+func killProcessTree(process *os.Process) error {
+	return process.Kill()
+}
+
+// sysProcAttr returns process attributes for instance of app: user, chroot and namespaces
+func sysProcAttr(config *AppConfig) *syscall.SysProcAttr {
+	attr := &syscall.SysProcAttr{
+		Cloneflags: config.Cloneflags,
+	}
+
+	// exec shim switches root and user itself
+	if config.needsExecShim() {
+		return attr
+	}
+
+	attr.Chroot = config.Chroot
+
+	// set credentials for setting uid, unless already running as that user
+	if config.User.Uid != 0 && config.User.Uid != uint32(os.Getuid()) {
+		attr.Credential = &syscall.Credential{
+			Uid: config.User.Uid,
+		}
+	}
+
+	return attr
+}
+
+// setPriority is a no-op on linux, exec shim applies nice and io priority before exec
+// so the app doesn't run its first instructions at gracevisord priority
+func setPriority(config *AppConfig, pid int) error {
+	return nil
+}
+
+// ioprio returns io priority of app for ioprio_set, 0 without ionice
+func ioprio(config *AppConfig) int {
+	if config.Ionice == nil {
+		return 0
+	}
+	return config.Ionice.Class<<ioprioClassShift | config.Ionice.Level
+}
+
+// exitSignal returns name of signal that terminated process, empty if it exited
+func exitSignal(state *os.ProcessState) string {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return ""
+	}
+	return signalName(status.Signal())
+}
+
+// processMemory returns resident memory of process in bytes, 0 if it can't be read
+func processMemory(pid int) uint64 {
+	data, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/statm")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0
+	}
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return pages * uint64(os.Getpagesize())
+}
+
+// openFiles returns number of open file descriptors of process and its soft limit,
+// limit is only known for gracevisord itself
+func openFiles(pid int) (int, uint64) {
+	fds, err := ioutil.ReadDir("/proc/" + strconv.Itoa(pid) + "/fd")
+	if err != nil {
+		return 0, 0
+	}
+	var limit syscall.Rlimit
+	if pid == os.Getpid() {
+		if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+			limit.Cur = 0
+		}
+	}
+	return len(fds), limit.Cur
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"unsafe"
+)
+
+const (
+	ctlKern     = 1
+	kernProc    = 66
+	kernProcPid = 1
+
+	// struct kinfo_proc from sys/sysctl.h has fixed size fields on all
+	// architectures, p_pid and p_vm_rssize are at fixed offsets
+	kinfoProcPidOffset    = 108
+	kinfoProcRssizeOffset = 384
+	kinfoProcPrefixSize   = kinfoProcRssizeOffset + 4
+)
+
+// processMemory returns resident memory of process in bytes, 0 if it can't be read
+func processMemory(pid int) uint64 {
+	buf := make([]byte, kinfoProcPrefixSize)
+	n, err := sysctl([]int32{ctlKern, kernProc, kernProcPid, int32(pid), kinfoProcPrefixSize, 1}, buf)
+	if err != nil || n < kinfoProcPrefixSize {
+		return 0
+	}
+	if *(*int32)(unsafe.Pointer(&buf[kinfoProcPidOffset])) != int32(pid) {
+		return 0
+	}
+	rssize := *(*int32)(unsafe.Pointer(&buf[kinfoProcRssizeOffset]))
+	if rssize < 0 {
+		return 0
+	}
+	return uint64(rssize) * uint64(os.Getpagesize())
+}
+
+// openFiles returns 0, OpenBSD doesn't report open files of a process
+func openFiles(pid int) (int, uint64) {
+	return 0, 0
+}
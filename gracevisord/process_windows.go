@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	createNewProcessGroup = 0x00000200
+	ctrlBreakEvent        = 1
+
+	processTerminate               = 0x0001
+	processVmRead                  = 0x0010
+	processSetInformation          = 0x0200
+	processSetQuota                = 0x0100
+	processQueryLimitedInformation = 0x1000
+
+	jobObjectExtendedLimitInformation = 9
+	jobObjectLimitKillOnJobClose      = 0x2000
+
+	idlePriorityClass        = 0x00000040
+	belowNormalPriorityClass = 0x00004000
+	normalPriorityClass      = 0x00000020
+	aboveNormalPriorityClass = 0x00008000
+	highPriorityClass        = 0x00000080
+
+	// killedExitCode is exit code of processes terminated with their job object
+	killedExitCode = 1
+)
+
+var (
+	kernel32 = syscall.NewLazyDLL("kernel32.dll")
+
+	procCreateJobObject          = kernel32.NewProc("CreateJobObjectW")
+	procSetInformationJobObject  = kernel32.NewProc("SetInformationJobObject")
+	procAssignProcessToJobObject = kernel32.NewProc("AssignProcessToJobObject")
+	procTerminateJobObject       = kernel32.NewProc("TerminateJobObject")
+	procGenerateConsoleCtrlEvent = kernel32.NewProc("GenerateConsoleCtrlEvent")
+	procSetPriorityClass         = kernel32.NewProc("SetPriorityClass")
+	procGetProcessMemoryInfo     = kernel32.NewProc("K32GetProcessMemoryInfo")
+	procGetProcessHandleCount    = kernel32.NewProc("GetProcessHandleCount")
+)
+
+var ErrUnsupportedWindows = errors.New("Not supported on windows")
+
+// IoniceClasses and Namespaces are linux only, no names are valid on windows
+var IoniceClasses = map[string]int{}
+
+var Namespaces = map[string]uintptr{}
+
+// jobs are job objects of running instance processes keyed by pid, closing
+// the handle kills the processes left in the job
+var (
+	jobs     = map[int]syscall.Handle{}
+	jobsLock sync.Mutex
+)
+
+type jobObjectBasicLimitInformation struct {
+	PerProcessUserTimeLimit int64
+	PerJobUserTimeLimit     int64
+	LimitFlags              uint32
+	MinimumWorkingSetSize   uintptr
+	MaximumWorkingSetSize   uintptr
+	ActiveProcessLimit      uint32
+	Affinity                uintptr
+	PriorityClass           uint32
+	SchedulingClass         uint32
+}
+
+type ioCounters struct {
+	ReadOperationCount  uint64
+	WriteOperationCount uint64
+	OtherOperationCount uint64
+	ReadTransferCount   uint64
+	WriteTransferCount  uint64
+	OtherTransferCount  uint64
+}
+
+type jobObjectExtendedLimit struct {
+	BasicLimitInformation jobObjectBasicLimitInformation
+	IoInfo                ioCounters
+	ProcessMemoryLimit    uintptr
+	JobMemoryLimit        uintptr
+	PeakProcessMemoryUsed uintptr
+	PeakJobMemoryUsed     uintptr
+}
+
+type processMemoryCounters struct {
+	Cb                         uint32
+	PageFaultCount             uint32
+	PeakWorkingSetSize         uintptr
+	WorkingSetSize             uintptr
+	QuotaPeakPagedPoolUsage    uintptr
+	QuotaPagedPoolUsage        uintptr
+	QuotaPeakNonPagedPoolUsage uintptr
+	QuotaNonPagedPoolUsage     uintptr
+	PagefileUsage              uintptr
+	PeakPagefileUsage          uintptr
+}
+
+// checkPlatform reports app options that need linux process isolation
+func checkPlatform(config *AppConfig) error {
+	var errs ConfigErrors
+	if config.Chroot != "" {
+		errs.add("chroot", ErrUnsupportedWindows)
+	}
+	if len(config.Namespaces) > 0 {
+		errs.add("namespaces", ErrUnsupportedWindows)
+	}
+	if len(config.DropCapabilities) > 0 {
+		errs.add("drop_capabilities", ErrUnsupportedWindows)
+	}
+	if config.NoNewPrivs {
+		errs.add("no_new_privs", ErrUnsupportedWindows)
+	}
+	if config.Ionice != nil {
+		errs.add("ionice", ErrUnsupportedWindows)
+	}
+	if config.CoreDump != nil && config.CoreDump.Enabled {
+		errs.add("core_dump", ErrUnsupportedWindows)
+	}
+	if config.ReusePort {
+		errs.add("reuse_port", ErrUnsupportedWindows)
+	}
+	if config.User != nil && config.User.UserName != "" {
+		errs.add("user", ErrUnsupportedWindows)
+	}
+	return errs.err()
+}
+
+// trackProcess puts started process into a new job object, so killing the
+// instance also kills all processes it started. Children started before the
+// process is assigned are not part of the job.
+func trackProcess(process *os.Process) error {
+	job, _, err := procCreateJobObject.Call(0, 0)
+	if job == 0 {
+		return err
+	}
+
+	info := jobObjectExtendedLimit{}
+	info.BasicLimitInformation.LimitFlags = jobObjectLimitKillOnJobClose
+	if ok, _, err := procSetInformationJobObject.Call(job, jobObjectExtendedLimitInformation,
+		uintptr(unsafe.Pointer(&info)), unsafe.Sizeof(info)); ok == 0 {
+		syscall.CloseHandle(syscall.Handle(job))
+		return err
+	}
+
+	handle, err := syscall.OpenProcess(processSetQuota|processTerminate, false, uint32(process.Pid))
+	if err != nil {
+		syscall.CloseHandle(syscall.Handle(job))
+		return err
+	}
+	defer syscall.CloseHandle(handle)
+
+	if ok, _, err := procAssignProcessToJobObject.Call(job, uintptr(handle)); ok == 0 {
+		syscall.CloseHandle(syscall.Handle(job))
+		return err
+	}
+
+	jobsLock.Lock()
+	jobs[process.Pid] = syscall.Handle(job)
+	jobsLock.Unlock()
+	return nil
+}
+
+// untrackProcess closes job object of exited process, which kills its leftover children
+func untrackProcess(process *os.Process) {
+	jobsLock.Lock()
+	job, ok := jobs[process.Pid]
+	delete(jobs, process.Pid)
+	jobsLock.Unlock()
+
+	if ok {
+		syscall.CloseHandle(job)
+	}
+}
+
+// signalProcess delivers TERM and INT as CTRL_BREAK_EVENT to the process group
+// of the instance, CTRL_C_EVENT can't be sent to a single group. It only
+// works when gracevisord shares a console with the app.
+func signalProcess(process *os.Process, sig os.Signal) error {
+	switch sig {
+	case syscall.SIGKILL:
+		return killProcessTree(process)
+	case syscall.SIGTERM, syscall.SIGINT:
+		if ok, _, err := procGenerateConsoleCtrlEvent.Call(ctrlBreakEvent, uintptr(process.Pid)); ok == 0 {
+			return err
+		}
+		return nil
+	}
+	return ErrUnsupportedWindows
+}
+
+// killProcessTree terminates job object of process with all its children,
+// processes that are not tracked are killed alone
+func killProcessTree(process *os.Process) error {
+	jobsLock.Lock()
+	job, ok := jobs[process.Pid]
+	jobsLock.Unlock()
+
+	if !ok {
+		return process.Kill()
+	}
+	if ok, _, err := procTerminateJobObject.Call(uintptr(job), killedExitCode); ok == 0 {
+		return err
+	}
+	return nil
+}
+
+// sysProcAttr starts instance in its own process group, so console control
+// events reach only the instance
+func sysProcAttr(config *AppConfig) *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		CreationFlags: createNewProcessGroup,
+	}
+}
+
+// priorityClass maps nice of app to the closest windows priority class
+func priorityClass(nice int) uintptr {
+	switch {
+	case nice <= -15:
+		return highPriorityClass
+	case nice < 0:
+		return aboveNormalPriorityClass
+	case nice == 0:
+		return normalPriorityClass
+	case nice < 10:
+		return belowNormalPriorityClass
+	}
+	return idlePriorityClass
+}
+
+// setPriority applies nice of app to started process as its priority class
+func setPriority(config *AppConfig, pid int) error {
+	if config.Nice == 0 {
+		return nil
+	}
+
+	handle, err := syscall.OpenProcess(processSetInformation, false, uint32(pid))
+	if err != nil {
+		return err
+	}
+	defer syscall.CloseHandle(handle)
+
+	if ok, _, err := procSetPriorityClass.Call(uintptr(handle), priorityClass(config.Nice)); ok == 0 {
+		return err
+	}
+	return nil
+}
+
+// exitSignal returns empty name, windows processes don't exit by signal
+func exitSignal(state *os.ProcessState) string {
+	return ""
+}
+
+// processMemory returns working set of process in bytes, 0 if it can't be read
+func processMemory(pid int) uint64 {
+	handle, err := syscall.OpenProcess(processQueryLimitedInformation|processVmRead, false, uint32(pid))
+	if err != nil {
+		return 0
+	}
+	defer syscall.CloseHandle(handle)
+
+	counters := processMemoryCounters{}
+	counters.Cb = uint32(unsafe.Sizeof(counters))
+	if ok, _, _ := procGetProcessMemoryInfo.Call(uintptr(handle), uintptr(unsafe.Pointer(&counters)),
+		uintptr(counters.Cb)); ok == 0 {
+		return 0
+	}
+	return uint64(counters.WorkingSetSize)
+}
+
+// openFiles returns number of open handles of process, windows has no handle
+// limit to compare it with so limit is always 0
+func openFiles(pid int) (int, uint64) {
+	handle, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return 0, 0
+	}
+	defer syscall.CloseHandle(handle)
+
+	var count uint32
+	if ok, _, _ := procGetProcessHandleCount.Call(uintptr(handle), uintptr(unsafe.Pointer(&count))); ok == 0 {
+		return 0, 0
+	}
+	return int(count), 0
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+)
+
+// bufferPool reuses proxy copy buffers of one size, so proxied bodies don't allocate
+// a new buffer for every request
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// bufferPools are shared by all apps with the same proxy buffer size, by size in bytes
+var bufferPools sync.Map
+
+// proxyBufferPool returns pool of buffers of size bytes
+func proxyBufferPool(size int) *bufferPool {
+	if pool, ok := bufferPools.Load(size); ok {
+		return pool.(*bufferPool)
+	}
+	pool, _ := bufferPools.LoadOrStore(size, &bufferPool{size: size})
+	return pool.(*bufferPool)
+}
+
+func (p *bufferPool) Get() []byte {
+	if buf, ok := p.pool.Get().(*[]byte); ok {
+		return *buf
+	}
+	return make([]byte, p.size)
+}
+
+func (p *bufferPool) Put(buf []byte) {
+	if cap(buf) != p.size {
+		return
+	}
+	buf = buf[:p.size]
+	p.pool.Put(&buf)
+}
+
+// updateProxy builds reverse proxy of app config, it is replaced on config reload so
+// buffer size and flush interval apply to new requests
+func (a *App) updateProxy() {
+	a.rp.Store(&httputil.ReverseProxy{
+		Director:      func(req *http.Request) {},
+		ErrorHandler:  a.proxyError,
+		BufferPool:    proxyBufferPool(a.config().ProxyBufferSize * 1024),
+		FlushInterval: time.Duration(a.config().ProxyFlushInterval) * time.Millisecond,
+	})
+}
+
+func (a *App) reverseProxy() *httputil.ReverseProxy {
+	return a.rp.Load().(*httputil.ReverseProxy)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// Kinds of errors proxying a request to an instance
+const (
+	ProxyErrorDial     = "dial"
+	ProxyErrorTimeout  = "timeout"
+	ProxyErrorCanceled = "canceled"
+	ProxyErrorOther    = "other"
+)
+
+// statusClientClosed is recorded for requests canceled by the client, it is not
+// sent since the client is gone and isn't counted as instance error
+const statusClientClosed = 499
+
+// proxyErrorKind tells if instance couldn't be reached, didn't answer in time or
+// the client gave up
+func proxyErrorKind(req *http.Request, err error) string {
+	if errors.Is(err, context.Canceled) || req.Context().Err() == context.Canceled {
+		return ProxyErrorCanceled
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return ProxyErrorDial
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return ProxyErrorTimeout
+	}
+	return ProxyErrorOther
+}
+
+// proxyError is ErrorHandler of app reverse proxy, it answers with status configured
+// for the kind of error and leaves logging to the caller that knows the instance
+func (a *App) proxyError(rw http.ResponseWriter, req *http.Request, err error) {
+	kind := proxyErrorKind(req, err)
+	if recorder, ok := rw.(*statusRecorder); ok {
+		recorder.proxyErr = err
+		recorder.proxyErrKind = kind
+	}
+
+	if kind == ProxyErrorCanceled {
+		if recorder, ok := rw.(*statusRecorder); ok {
+			recorder.status = statusClientClosed
+		}
+		return
+	}
+	rw.WriteHeader(a.config().ProxyErrors.status(kind))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// requestQueue wakes requests waiting for an instance slot of max_concurrent_requests,
+// freed channel is closed and replaced every time a slot may have been freed
+type requestQueue struct {
+	mu    sync.Mutex
+	freed chan struct{}
+}
+
+// wait returns channel closed when a slot is freed, take it before trying to reserve
+// so slots freed meanwhile are not missed
+func (q *requestQueue) wait() <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.freed == nil {
+		q.freed = make(chan struct{})
+	}
+	return q.freed
+}
+
+// release wakes waiting requests to try reserving again
+func (q *requestQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.freed != nil {
+		close(q.freed)
+		q.freed = nil
+	}
+}
+
+// queueRequest retries reserve whenever a slot is freed, until queue_timeout passes or
+// the client goes away
+func (a *App) queueRequest(req *http.Request, reserve func() (*Instance, error)) (*Instance, error) {
+	timer := time.NewTimer(time.Duration(a.config().QueueTimeout) * time.Second)
+	defer timer.Stop()
+
+	for {
+		freed := a.queue.wait()
+		instance, err := reserve()
+		if err != ErrTooManyRequests {
+			return instance, err
+		}
+		select {
+		case <-freed:
+		case <-timer.C:
+			return nil, ErrTooManyRequests
+		case <-req.Context().Done():
+			return nil, context.Canceled
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueueRequest(t *testing.T) {
+	app := &App{}
+	app.configValue.Store(&AppConfig{Name: "app", MaxConcurrentRequests: 1, QueueTimeout: 5})
+
+	free := int32(0)
+	served := &Instance{app: app}
+	reserve := func() (*Instance, error) {
+		if atomic.LoadInt32(&free) == 0 {
+			return nil, ErrTooManyRequests
+		}
+		return served, nil
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		instance, err := app.queueRequest(httptest.NewRequest("GET", "/", nil), reserve)
+		if err == nil && instance != served {
+			err = ErrInvalidInstance
+		}
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	atomic.StoreInt32(&free, 1)
+	app.queue.release()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error("Queued request should get freed slot, got", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Queued request should be woken when a slot is freed")
+	}
+
+	atomic.StoreInt32(&free, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		_, err := app.queueRequest(httptest.NewRequest("GET", "/", nil).WithContext(ctx), reserve)
+		done <- err
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Error("Request of disconnected client should leave the queue, got", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Request of disconnected client should not wait for queue timeout")
+	}
+
+	app.configValue.Store(&AppConfig{Name: "app", MaxConcurrentRequests: 1, QueueTimeout: 0})
+	if _, err := app.queueRequest(httptest.NewRequest("GET", "/", nil), reserve); err != ErrTooManyRequests {
+		t.Error("Request should be rejected after queue timeout, got", err)
+	}
+}
+
+func TestReserveHeldInstanceLimit(t *testing.T) {
+	app := &App{}
+	app.configValue.Store(&AppConfig{Name: "app", MaxConcurrentRequests: 1})
+	held := &Instance{app: app, status: InstanceStatusServing, connWg: &sync.WaitGroup{}}
+	app.heldInstance = held
+
+	instance, err := app.reserveHeldInstance()
+	if err != nil || instance != held {
+		t.Fatal("Held instance should be reserved, got", err)
+	}
+	if _, err := app.reserveHeldInstance(); err != ErrTooManyRequests {
+		t.Error("Held instance should be limited by max_concurrent_requests, got", err)
+	}
+	held.Done()
+	if instance, err := app.reserveHeldInstance(); err != nil || instance != held {
+		t.Error("Held instance should be reserved after its slot is freed, got", err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/hamaxx/gracevisor/deps/yaml.v2"
+)
+
+var ErrRestartRequired = errors.New("Changed type, external or preview port require gracevisord restart")
+
+// reloadLock serializes reloads of SIGHUP and config source watcher
+var reloadLock sync.Mutex
+
+// reloadConfig applies changed app configs with a graceful restart of changed apps,
+// added and removed apps and global options are applied on gracevisord restart.
+// It returns error of first app that didn't apply its config, changes that need a
+// gracevisord restart are not errors.
+func reloadConfig(runningApps map[string]*App, config *Config) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	var reloadErr error
+	reloaded := map[string]bool{}
+	for _, appConfig := range config.Apps {
+		reloaded[appConfig.Name] = true
+
+		app, ok := runningApps[appConfig.Name]
+		if !ok {
+			log.Print(appConfig.Name, ": New app requires gracevisord restart")
+			continue
+		}
+		if err := app.Reconfigure(appConfig); err != nil {
+			log.Print(appConfig.Name, ": Reload error:", err)
+			if err != ErrRestartRequired && reloadErr == nil {
+				reloadErr = err
+			}
+		}
+	}
+
+	for name := range runningApps {
+		if !reloaded[name] {
+			log.Print(name, ": Removed app requires gracevisord restart")
+		}
+	}
+	return reloadErr
+}
+
+// startReloader reloads config dir on SIGHUP
+func startReloader(configPath string, runningApps map[string]*App) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+
+	go func() {
+		for range sigChan {
+			config, err := ParseConfing(configPath)
+			if err != nil {
+				log.Print("Reload error:", err)
+				continue
+			}
+			reloadConfig(runningApps, config)
+		}
+	}()
+}
+
+func sameAppConfig(a *AppConfig, b *AppConfig) bool {
+	dataA, errA := yaml.Marshal(a)
+	dataB, errB := yaml.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(dataA, dataB)
+}
+
+// Reconfigure switches app to new config and gracefully restarts it, unchanged config
+// is ignored. Previous config is restored if the new instance can't be started.
+func (a *App) Reconfigure(config *AppConfig) error {
+	current := a.config()
+	if sameAppConfig(current, config) {
+		// certificates are reloaded also when their files changed without config changes
+		a.updateTLS(config)
+		return nil
+	}
+	if config.Type != current.Type || config.ExternalHost != current.ExternalHost ||
+		config.ExternalPort != current.ExternalPort || config.PreviewPort != current.PreviewPort ||
+		config.Proxy != current.Proxy || (config.TLS == nil) != (current.TLS == nil) {
+		return ErrRestartRequired
+	}
+
+	if a.backends != nil {
+		a.updateTLS(config)
+		a.setConfig(config)
+		if config.BackendService == "" {
+			a.backends.update(config.Backends)
+		}
+		return nil
+	}
+
+	return a.exclusive("reload", func() (*Instance, error) {
+		version, command, args, environment := a.version, a.command, a.args, a.environment
+		a.updateTLS(config)
+		a.setConfig(config)
+		a.command = config.Command
+		a.args = config.Args
+		a.environment = config.Environment
+		if config.Version != current.Version {
+			a.version = config.Version
+		}
+
+		instance, err := a.startInstance(RequestedByReload, false)
+		if err != nil && err != ErrWaitingForPort {
+			a.updateTLS(current)
+			a.setConfig(current)
+			a.version, a.command, a.args, a.environment = version, command, args, environment
+			return nil, err
+		}
+		a.recordDeploy(RequestedByReload, false)
+		return instance, err
+	})
+}
+
+// updateTLS switches tls listener of app to certificates and settings of config
+func (a *App) updateTLS(config *AppConfig) {
+	if config.TLS != nil && a.tls != nil {
+		a.tls.update(config.TLS.Config)
+	}
+}
+
+// setConfig switches app to config, proxy and middleware are rebuilt for it
+func (a *App) setConfig(config *AppConfig) {
+	a.configValue.Store(config)
+	a.updateProxy()
+	a.updateMiddleware()
+}
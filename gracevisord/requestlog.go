@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hamaxx/gracevisor/deps/lumberjack"
+)
+
+// RequestEntry is one slow or sampled proxied request
+type RequestEntry struct {
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	DurationMs float64   `json:"duration_ms"`
+	Instance   uint32    `json:"instance"`
+	Version    string    `json:"version,omitempty"`
+	ClientIp   string    `json:"client_ip"`
+	Slow       bool      `json:"slow"`
+}
+
+// RequestLog writes slow requests and a sample of the others as json lines, without
+// the cost of logging every request
+type RequestLog struct {
+	writer io.Writer
+	mu     sync.Mutex
+}
+
+func NewRequestLog(config *AppConfig) *RequestLog {
+	if config.RequestLog == nil {
+		return &RequestLog{}
+	}
+	if err := createLogFile(config.RequestLog.File, config.Logger.FilePerm); err != nil {
+		log.Print(config.Name, ": Request log file error:", err)
+	}
+
+	return &RequestLog{
+		writer: &lumberjack.Logger{
+			Filename:   config.RequestLog.File,
+			MaxSize:    config.Logger.MaxLogSize,
+			MaxAge:     config.Logger.MaxLogAge,
+			MaxBackups: config.Logger.MaxLogsKept,
+		},
+	}
+}
+
+// record writes request if it is slower than slow_threshold or picked by sample_rate
+func (r *RequestLog) record(config *RequestLogConfig, instance *Instance, req *http.Request, status int, latency time.Duration) {
+	if r.writer == nil || config == nil {
+		return
+	}
+	threshold := time.Duration(config.SlowThreshold) * time.Millisecond
+	slow := threshold > 0 && latency >= threshold
+	if !slow && (config.SampleRate <= 0 || rand.Float64() >= config.SampleRate) {
+		return
+	}
+
+	data, err := json.Marshal(&RequestEntry{
+		Time:       time.Now(),
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		Status:     status,
+		DurationMs: float64(latency) / float64(time.Millisecond),
+		Instance:   instance.id,
+		Version:    instance.version,
+		ClientIp:   clientIp(req),
+		Slow:       slow,
+	})
+	if err != nil {
+		log.Print("Request log marshal error:", err)
+		return
+	}
+	data = append(data, '\n')
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.writer.Write(data); err != nil {
+		log.Print("Request log write error:", err)
+	}
+}
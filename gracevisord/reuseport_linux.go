@@ -0,0 +1,6 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package main
+
+// SO_REUSEPORT is missing in syscall package on some architectures, mips uses a different value
+const soReusePort = 0xf
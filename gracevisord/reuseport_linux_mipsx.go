@@ -0,0 +1,6 @@
+//go:build linux && (mips || mipsle || mips64 || mips64le)
+
+package main
+
+// SO_REUSEPORT of mips linux
+const soReusePort = 0x200
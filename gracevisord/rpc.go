@@ -3,14 +3,23 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net"
+	"net/http"
 	"net/rpc"
+	"path"
 	"sort"
+	"strconv"
+	"time"
 
 	"github.com/hamaxx/gracevisor/common/report"
 )
 
-var ErrInvalidApp = errors.New("Invalid app")
+var (
+	ErrInvalidApp      = errors.New("Invalid app")
+	ErrInvalidProtocol = errors.New("Invalid protocol version")
+)
 
 type AppNameSort []*App
 
@@ -21,46 +30,314 @@ func (v AppNameSort) Swap(i, j int) {
 	v[i], v[j] = v[j], v[i]
 }
 func (v AppNameSort) Less(i, j int) bool {
-	return v[i].config.Name < v[j].config.Name
+	return v[i].config().Name < v[j].config().Name
 }
 
 type Rpc struct {
-	runningApps map[string]*App
+	runningApps  map[string]*App
+	portPool     *PortPool
+	auditLog     *AuditLog
+	daemonConfig *Config
+
+	identity   string
+	role       int
+	remoteAddr string
+}
+
+func (r *Rpc) authorize(role int) error {
+	if r.role < role {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+func (r *Rpc) audit(command string, args interface{}, err error) {
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+
+	r.auditLog.Record(&AuditEntry{
+		Command:  command,
+		Args:     args,
+		Identity: r.identity,
+		Source:   r.remoteAddr,
+		Result:   result,
+	})
+}
+
+func (r *Rpc) Restart(appName string, res *string) (err error) {
+	defer func() { r.audit("Restart", appName, err) }()
+
+	if err := r.authorize(RoleOperator); err != nil {
+		return err
+	}
+
+	app, ok := r.runningApps[appName]
+	if !ok {
+		return ErrInvalidApp
+	}
+	if err := app.checkDeployWindow(time.Now()); err != nil {
+		return err
+	}
+	return app.Restart()
 }
 
-func (r *Rpc) Restart(appName string, res *string) error {
+// ForceRestart restarts app even outside its deploy windows
+func (r *Rpc) ForceRestart(appName string, res *string) (err error) {
+	defer func() { r.audit("ForceRestart", appName, err) }()
+
+	if err := r.authorize(RoleOperator); err != nil {
+		return err
+	}
+
 	app, ok := r.runningApps[appName]
 	if !ok {
 		return ErrInvalidApp
 	}
-	return app.StartNewInstance()
+	return app.Restart()
 }
 
-func (r *Rpc) Start(appName string, res *string) error {
+func (r *Rpc) Reload(appName string, res *string) (err error) {
+	defer func() { r.audit("Reload", appName, err) }()
+
+	if err := r.authorize(RoleOperator); err != nil {
+		return err
+	}
+
 	app, ok := r.runningApps[appName]
 	if !ok {
 		return ErrInvalidApp
 	}
-	return app.StartNewInstance()
+	return app.Reload()
+}
+
+// Start starts app without active instance, apps that are already serving are restarted
+// only inside their deploy windows
+func (r *Rpc) Start(appName string, res *string) (err error) {
+	defer func() { r.audit("Start", appName, err) }()
+
+	if err := r.authorize(RoleOperator); err != nil {
+		return err
+	}
+
+	app, ok := r.runningApps[appName]
+	if !ok {
+		return ErrInvalidApp
+	}
+	app.activeInstanceLock.Lock()
+	active := app.activeInstance
+	app.activeInstanceLock.Unlock()
+	if active != nil {
+		if err := app.checkDeployWindow(time.Now()); err != nil {
+			return err
+		}
+	}
+	return app.Restart()
+}
+
+func (r *Rpc) Deploy(deploy *report.Deploy, res *string) (err error) {
+	defer func() { r.audit("Deploy", deploy, err) }()
+
+	if err := r.authorize(RoleOperator); err != nil {
+		return err
+	}
+
+	app, ok := r.runningApps[deploy.App]
+	if !ok {
+		return ErrInvalidApp
+	}
+	if !deploy.Force {
+		if err := app.checkDeployWindow(time.Now()); err != nil {
+			return err
+		}
+	}
+	return app.Deploy(deploy)
+}
+
+func (r *Rpc) Rollback(rollback *report.Rollback, res *string) (err error) {
+	defer func() { r.audit("Rollback", rollback, err) }()
+
+	if err := r.authorize(RoleOperator); err != nil {
+		return err
+	}
+
+	app, ok := r.runningApps[rollback.App]
+	if !ok {
+		return ErrInvalidApp
+	}
+	return app.Rollback(rollback)
 }
 
-func (r *Rpc) Stop(appName string, res *string) error {
+func (r *Rpc) Deploys(appName string, res *[]*report.DeployRecord) (err error) {
+	defer func() { r.audit("Deploys", appName, err) }()
+
+	// records hold commands and environment, same as config
+	if err := r.authorize(RoleOperator); err != nil {
+		return err
+	}
+
+	app, ok := r.runningApps[appName]
+	if !ok {
+		return ErrInvalidApp
+	}
+	*res = maskDeployRecords(app.deploys.Records())
+	return nil
+}
+
+// Config returns yaml of config daemon is running with, apps include reloaded changes
+func (r *Rpc) Config(appName string, res *string) (err error) {
+	defer func() { r.audit("Config", appName, err) }()
+
+	if err := r.authorize(RoleOperator); err != nil {
+		return err
+	}
+
+	if appName != "" {
+		app, ok := r.runningApps[appName]
+		if !ok {
+			return ErrInvalidApp
+		}
+		*res, err = dumpConfig(r.daemonConfig, app.config())
+		return err
+	}
+
+	config := *r.daemonConfig
+	config.Apps = make([]*AppConfig, 0, len(r.daemonConfig.Apps))
+	for _, appConfig := range r.daemonConfig.Apps {
+		if app, ok := r.runningApps[appConfig.Name]; ok {
+			appConfig = app.config()
+		}
+		config.Apps = append(config.Apps, appConfig)
+	}
+	*res, err = dumpConfig(&config, nil)
+	return err
+}
+
+func (r *Rpc) Promote(appName string, res *string) (err error) {
+	defer func() { r.audit("Promote", appName, err) }()
+
+	if err := r.authorize(RoleOperator); err != nil {
+		return err
+	}
+
+	app, ok := r.runningApps[appName]
+	if !ok {
+		return ErrInvalidApp
+	}
+	return app.Promote()
+}
+
+func (r *Rpc) Stop(appName string, res *string) (err error) {
+	defer func() { r.audit("Stop", appName, err) }()
+
+	if err := r.authorize(RoleOperator); err != nil {
+		return err
+	}
+
+	app, ok := r.runningApps[appName]
+	if !ok {
+		return ErrInvalidApp
+	}
+	return app.StopInstances(-1, false, StopReasonRpc)
+}
+
+func (r *Rpc) Pause(appName string, res *string) (err error) {
+	defer func() { r.audit("Pause", appName, err) }()
+
+	if err := r.authorize(RoleOperator); err != nil {
+		return err
+	}
+
+	app, ok := r.runningApps[appName]
+	if !ok {
+		return ErrInvalidApp
+	}
+	app.Pause()
+	return nil
+}
+
+func (r *Rpc) Resume(appName string, res *string) (err error) {
+	defer func() { r.audit("Resume", appName, err) }()
+
+	if err := r.authorize(RoleOperator); err != nil {
+		return err
+	}
+
 	app, ok := r.runningApps[appName]
 	if !ok {
 		return ErrInvalidApp
 	}
-	return app.StopInstances(-1, false)
+	app.Resume()
+	return nil
+}
+
+func (r *Rpc) Exec(execArgs *report.Exec, res *report.ExecResult) (err error) {
+	defer func() { r.audit("Exec", execArgs, err) }()
+
+	if err := r.authorize(RoleAdmin); err != nil {
+		return err
+	}
+
+	app, ok := r.runningApps[execArgs.App]
+	if !ok {
+		return ErrInvalidApp
+	}
+	result, err := app.Exec(execArgs.Command, execArgs.Timeout)
+	if err != nil {
+		return err
+	}
+	*res = *result
+	return nil
+}
+
+// Goroutines dumps stacks of gracevisord goroutines to diagnose hangs of the daemon
+func (r *Rpc) Goroutines(unused string, res *string) (err error) {
+	defer func() { r.audit("Goroutines", nil, err) }()
+
+	if err := r.authorize(RoleAdmin); err != nil {
+		return err
+	}
+
+	*res, err = goroutineDump()
+	return err
 }
 
-func (r *Rpc) Kill(appName string, res *string) error {
+func (r *Rpc) Kill(appName string, res *string) (err error) {
+	defer func() { r.audit("Kill", appName, err) }()
+
+	if err := r.authorize(RoleOperator); err != nil {
+		return err
+	}
+
 	app, ok := r.runningApps[appName]
 	if !ok {
 		return ErrInvalidApp
 	}
-	return app.StopInstances(-1, true)
+	return app.StopInstances(-1, true, StopReasonRpc)
+}
+
+func (r *Rpc) SetHealth(override *report.HealthOverride, res *string) (err error) {
+	defer func() { r.audit("SetHealth", override, err) }()
+
+	if err := r.authorize(RoleOperator); err != nil {
+		return err
+	}
+
+	app, ok := r.runningApps[override.App]
+	if !ok {
+		return ErrInvalidApp
+	}
+	return app.SetHealth(override.InstanceId, override.Health)
 }
 
-func (r *Rpc) Status(appName string, res *[]*report.App) error {
+func (r *Rpc) Status(appName string, res *[]*report.App) (err error) {
+	defer func() { r.audit("Status", appName, err) }()
+
+	if err := r.authorize(RoleReadOnly); err != nil {
+		return err
+	}
+
 	if appName != "" {
 		app, ok := r.runningApps[appName]
 		if !ok {
@@ -80,19 +357,220 @@ func (r *Rpc) Status(appName string, res *[]*report.App) error {
 	return nil
 }
 
-func NewRpcServer(runningApps map[string]*App, config *RpcConfig) (net.Listener, error) {
+// Ports returns utilization of internal port pool
+func (r *Rpc) Ports(unused string, res *report.PortPool) (err error) {
+	defer func() { r.audit("Ports", nil, err) }()
+
+	if err := r.authorize(RoleReadOnly); err != nil {
+		return err
+	}
+
+	*res = *r.portPool.Report()
+	return nil
+}
+
+// Version returns build info of gracevisord
+func (r *Rpc) Version(unused string, res *report.BuildInfo) (err error) {
+	defer func() { r.audit("Version", nil, err) }()
+
+	if err := r.authorize(RoleReadOnly); err != nil {
+		return err
+	}
+
+	*res = *buildInfo()
+	return nil
+}
 
+// Resolve expands app name, glob pattern like web-* or group from config into sorted app names
+func (r *Rpc) Resolve(target string, res *[]string) (err error) {
+	defer func() { r.audit("Resolve", target, err) }()
+
+	if err := r.authorize(RoleReadOnly); err != nil {
+		return err
+	}
+
+	if _, ok := r.runningApps[target]; ok {
+		*res = []string{target}
+		return nil
+	}
+	if group, ok := r.daemonConfig.Groups[target]; ok {
+		*res = append(*res, group...)
+		return nil
+	}
+
+	for name := range r.runningApps {
+		matched, err := path.Match(target, name)
+		if err != nil {
+			return err
+		}
+		if matched {
+			*res = append(*res, name)
+		}
+	}
+	if len(*res) == 0 {
+		return ErrInvalidApp
+	}
+	sort.Strings(*res)
+	return nil
+}
+
+func (r *Rpc) Logs(query *report.LogQuery, res *[]string) (err error) {
+	defer func() { r.audit("Logs", query, err) }()
+
+	if err := r.authorize(RoleReadOnly); err != nil {
+		return err
+	}
+
+	app, ok := r.runningApps[query.App]
+	if !ok {
+		return ErrInvalidApp
+	}
+
+	lines, err := app.appLogger.ReadLogs(query)
+	if err != nil {
+		return err
+	}
+	*res = lines
+	return nil
+}
+
+func (r *Rpc) Attach(query *report.Attach, res *report.AttachOutput) (err error) {
+	// attached clients poll, only audit the first call
+	if query.Since == 0 {
+		defer func() { r.audit("Attach", query, err) }()
+	}
+
+	if err := r.authorize(RoleReadOnly); err != nil {
+		return err
+	}
+
+	app, ok := r.runningApps[query.App]
+	if !ok {
+		return ErrInvalidApp
+	}
+	output, err := app.Attach(query)
+	if err != nil {
+		return err
+	}
+	*res = *output
+	return nil
+}
+
+func (r *Rpc) History(appName string, res *[]*report.HistoryRecord) (err error) {
+	defer func() { r.audit("History", appName, err) }()
+
+	if err := r.authorize(RoleReadOnly); err != nil {
+		return err
+	}
+
+	app, ok := r.runningApps[appName]
+	if !ok {
+		return ErrInvalidApp
+	}
+	*res = app.history.Records()
+	return nil
+}
+
+// RpcHandler serves each rpc connection with its own Rpc so calls know their source
+type RpcHandler struct {
+	runningApps  map[string]*App
+	portPool     *PortPool
+	auditLog     *AuditLog
+	config       *RpcConfig
+	daemonConfig *Config
+}
+
+func (h *RpcHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	r := &Rpc{
-		runningApps: runningApps,
+		runningApps:  h.runningApps,
+		portPool:     h.portPool,
+		auditLog:     h.auditLog,
+		daemonConfig: h.daemonConfig,
+		remoteAddr:   req.RemoteAddr,
+	}
+
+	identity, role, err := authenticate(h.config, req)
+	if err != nil {
+		r.audit("Connect", nil, err)
+		http.Error(rw, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	r.identity = identity
+	r.role = role
+
+	protocol, err := clientProtocol(req)
+	if err != nil {
+		r.audit("Connect", nil, err)
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if protocol < report.MinProtocolVersion {
+		err := fmt.Errorf("gracevisorctl protocol %d is too old for gracevisord version %s, it needs protocol %d or newer", protocol, version, report.MinProtocolVersion)
+		r.audit("Connect", nil, err)
+		http.Error(rw, err.Error(), http.StatusUpgradeRequired)
+		return
 	}
 
-	if err := rpc.Register(r); err != nil {
-		return nil, err
+	server := rpc.NewServer()
+	if err := server.Register(r); err != nil {
+		log.Print("Rpc register error:", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
 	}
-	rpc.HandleHTTP()
-	l, e := net.Listen("tcp", fmt.Sprintf("%s:%d", config.Host, config.Port))
+
+	// like rpc.Server.ServeHTTP, but connect response tells client our protocol
+	if req.Method != "CONNECT" {
+		http.Error(rw, "405 must CONNECT", http.StatusMethodNotAllowed)
+		return
+	}
+	conn, _, err := rw.(http.Hijacker).Hijack()
+	if err != nil {
+		log.Print("Rpc hijack error:", err)
+		return
+	}
+	io.WriteString(conn, fmt.Sprintf("HTTP/1.0 200 Connected to Go RPC\r\n%s: %d\r\n%s: %s\r\n\r\n",
+		report.ProtocolHeader, report.ProtocolVersion, report.VersionHeader, version))
+	server.ServeConn(conn)
+}
+
+// clientProtocol is protocol version sent by gracevisorctl, clients from before
+// versioning send none and speak protocol 1
+func clientProtocol(req *http.Request) (int, error) {
+	header := req.Header.Get(report.ProtocolHeader)
+	if header == "" {
+		return 1, nil
+	}
+	protocol, err := strconv.Atoi(header)
+	if err != nil || protocol < 1 {
+		return 0, ErrInvalidProtocol
+	}
+	return protocol, nil
+}
+
+// NewRpcServer binds rpc listener, rpc has its own mux so debug handlers registered
+// on the default one are never served on it
+func NewRpcServer(runningApps map[string]*App, portPool *PortPool, daemonConfig *Config, auditLog *AuditLog) (net.Listener, http.Handler, error) {
+	config := daemonConfig.Rpc
+
+	mux := http.NewServeMux()
+	mux.Handle(ReportPath, &ReportHandler{
+		runningApps: runningApps,
+	})
+	mux.Handle(StatePath, &StateHandler{
+		runningApps: runningApps,
+		config:      config,
+	})
+	mux.Handle(rpc.DefaultRPCPath, &RpcHandler{
+		runningApps:  runningApps,
+		portPool:     portPool,
+		auditLog:     auditLog,
+		config:       config,
+		daemonConfig: daemonConfig,
+	})
+
+	l, e := net.Listen("tcp", hostPort(config.Host, config.Port))
 	if e != nil {
-		return nil, e
+		return nil, nil, e
 	}
-	return l, nil
+	return l, mux, nil
 }
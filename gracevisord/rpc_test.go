@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/hamaxx/gracevisor/common/report"
+)
+
+func newTestRpc(t *testing.T, role int, audit *bytes.Buffer) *Rpc {
+	app := &App{deploys: NewDeploys(t.TempDir(), "app", 10)}
+	app.configValue.Store(&AppConfig{Name: "app"})
+	app.deploys.Add(&report.DeployRecord{Version: "v1", Environment: []string{"DB_PASSWORD=hunter2"}})
+
+	return &Rpc{
+		runningApps: map[string]*App{"app": app},
+		auditLog:    &AuditLog{writer: audit},
+		identity:    "test",
+		role:        role,
+	}
+}
+
+func TestRpcRoles(t *testing.T) {
+	audit := &bytes.Buffer{}
+	var res string
+	var deploys []*report.DeployRecord
+	var execResult report.ExecResult
+
+	readOnly := newTestRpc(t, RoleReadOnly, audit)
+	for command, err := range map[string]error{
+		"Deploy":   readOnly.Deploy(&report.Deploy{App: "app", Version: "v2"}, &res),
+		"Rollback": readOnly.Rollback(&report.Rollback{App: "app"}, &res),
+		"Deploys":  readOnly.Deploys("app", &deploys),
+		"Config":   readOnly.Config("app", &res),
+		"Restart":  readOnly.Restart("app", &res),
+		"Exec":     readOnly.Exec(&report.Exec{App: "app", Command: []string{"id"}}, &execResult),
+	} {
+		if err != ErrPermissionDenied {
+			t.Errorf("%s should be denied to read-only role, got %v", command, err)
+		}
+	}
+
+	operator := newTestRpc(t, RoleOperator, audit)
+	if err := operator.Exec(&report.Exec{App: "app", Command: []string{"id"}}, &execResult); err != ErrPermissionDenied {
+		t.Error("Exec should be denied to operator role, got", err)
+	}
+	if err := operator.Goroutines("", &res); err != ErrPermissionDenied {
+		t.Error("Goroutines should be denied to operator role, got", err)
+	}
+	if err := operator.Deploy(&report.Deploy{App: "app", Version: "v2; rm -rf /"}, &res); err != ErrInvalidVersion {
+		t.Error("Deploy of invalid version should fail, got", err)
+	}
+	if err := operator.Deploy(&report.Deploy{App: "missing", Version: "v2"}, &res); err != ErrInvalidApp {
+		t.Error("Deploy of unknown app should fail, got", err)
+	}
+	if err := operator.Deploys("app", &deploys); err != nil || len(deploys) != 1 {
+		t.Fatal("Deploys should be allowed to operator role:", err)
+	}
+	if deploys[0].Environment[0] != "DB_PASSWORD="+maskedValue {
+		t.Error("Deploys should mask secret environment, got", deploys[0].Environment)
+	}
+
+	denied := 0
+	for _, line := range strings.Split(strings.TrimSpace(audit.String()), "\n") {
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal("Audit entry should be json:", err)
+		}
+		if entry.Identity != "test" {
+			t.Error("Audit entry should record identity:", line)
+		}
+		if entry.Result == ErrPermissionDenied.Error() {
+			denied++
+		}
+	}
+	if denied != 8 {
+		t.Error("Every denied call should be audited, got", denied)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// match checks request against all matchers of rule
+func (c *RuleConfig) match(req *http.Request) bool {
+	if c.Method != "" && !strings.EqualFold(c.Method, req.Method) {
+		return false
+	}
+	if c.PathRegexp != nil && !c.PathRegexp.MatchString(req.URL.Path) {
+		return false
+	}
+	for name, re := range c.HeaderRegexps {
+		if !re.MatchString(req.Header.Get(name)) {
+			return false
+		}
+	}
+	for name, re := range c.CookieRegexps {
+		value := ""
+		if cookie, err := req.Cookie(name); err == nil {
+			value = cookie.Value
+		}
+		if !re.MatchString(value) {
+			return false
+		}
+	}
+	if c.ClientNets != nil && !trusted(c.ClientNets, net.ParseIP(clientIp(req))) {
+		return false
+	}
+	return true
+}
+
+// heldRouteKey marks requests that route_held rule sends to the held instance
+type heldRouteKey struct{}
+
+// serveRules applies app rules in order, rewrites continue with the next rule, route
+// and reject end them. Requests routed to another app skip rules of that app.
+func (a *App) serveRules(rw http.ResponseWriter, req *http.Request) {
+	if !a.sanitizeRequest(rw, req) {
+		return
+	}
+	req = a.withClientIp(req)
+
+	for _, rule := range a.config().Rules {
+		if !rule.match(req) {
+			continue
+		}
+
+		switch {
+		case rule.Reject != 0:
+			rw.WriteHeader(rule.Reject)
+			if err := req.Body.Close(); err != nil {
+				log.Print(err)
+			}
+			return
+		case rule.Route != "":
+			target, ok := a.runningApps[rule.Route]
+			if !ok {
+				// routes to apps added by reload work after gracevisord restart
+				rw.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			target.middleware.ServeHTTP(rw, req)
+			return
+		case rule.RouteHeld:
+			a.middleware.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), heldRouteKey{}, true)))
+			return
+		default:
+			req.URL.Path = rule.PathRegexp.ReplaceAllString(req.URL.Path, rule.Rewrite)
+			req.URL.RawPath = ""
+		}
+	}
+	a.middleware.ServeHTTP(rw, req)
+}
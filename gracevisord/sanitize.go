@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// sanitizeRequest checks request against app sanitize limits before it is routed,
+// rejected requests are answered and false is returned. Malformed Transfer-Encoding
+// is already rejected by net/http and hop-by-hop headers are removed by the proxy.
+func (a *App) sanitizeRequest(rw http.ResponseWriter, req *http.Request) bool {
+	config := a.config().Sanitize
+	if config == nil {
+		return true
+	}
+
+	status := 0
+	switch {
+	case len(req.RequestURI) > config.MaxUrlLength:
+		status = http.StatusRequestURITooLong
+	case strings.ContainsAny(req.URL.Path, "\x00\r\n"):
+		status = http.StatusBadRequest
+	default:
+		count, size := 0, 0
+		for name, values := range req.Header {
+			for _, value := range values {
+				count++
+				size += len(name) + len(value)
+			}
+		}
+		if count > config.MaxHeaders || size > config.MaxHeaderSize {
+			status = http.StatusRequestHeaderFieldsTooLarge
+		}
+	}
+	if status != 0 {
+		rw.WriteHeader(status)
+		if err := req.Body.Close(); err != nil {
+			log.Print(err)
+		}
+		return false
+	}
+
+	if config.NormalizePath && req.URL.Path != "" {
+		cleaned := path.Clean("/" + req.URL.Path)
+		if strings.HasSuffix(req.URL.Path, "/") && cleaned != "/" {
+			cleaned += "/"
+		}
+		if cleaned != req.URL.Path {
+			req.URL.Path = cleaned
+			req.URL.RawPath = ""
+		}
+	}
+	return true
+}
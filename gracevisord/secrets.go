@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const vaultTimeout = 10 * time.Second
+
+var (
+	ErrInvalidSecretProvider = errors.New("Invalid secret provider")
+	ErrSecretNotFound        = errors.New("Secret not found")
+)
+
+// secretBadge matches {secret:provider:reference} in environment values
+var secretBadge = regexp.MustCompile(`\{secret:([a-z]+):([^}]+)\}`)
+
+// SecretProvider resolves secret reference to its value
+type SecretProvider interface {
+	Secret(ref string) (string, error)
+}
+
+// FileSecretProvider reads secret from file, ignoring trailing newline
+type FileSecretProvider struct{}
+
+func (p *FileSecretProvider) Secret(ref string) (string, error) {
+	data, err := ioutil.ReadFile(ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// EnvSecretProvider reads secret from gracevisord environment
+type EnvSecretProvider struct{}
+
+func (p *EnvSecretProvider) Secret(ref string) (string, error) {
+	value, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	return value, nil
+}
+
+// VaultSecretProvider reads secret field from vault kv engine, reference format is path#field
+type VaultSecretProvider struct {
+	config *SecretsConfig
+	client *http.Client
+}
+
+func (p *VaultSecretProvider) token() (string, error) {
+	if p.config.VaultTokenFile != "" {
+		return (&FileSecretProvider{}).Secret(p.config.VaultTokenFile)
+	}
+	return p.config.VaultToken, nil
+}
+
+func (p *VaultSecretProvider) Secret(ref string) (string, error) {
+	sep := strings.LastIndex(ref, "#")
+	if sep < 0 {
+		return "", fmt.Errorf("vault reference must be path#field")
+	}
+	secretPath, field := ref[:sep], ref[sep+1:]
+
+	token, err := p.token()
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimRight(p.config.VaultAddress, "/")+"/v1/"+secretPath, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned status %d", resp.StatusCode)
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", err
+	}
+
+	// kv version 2 nests values under data.data
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+
+	value, ok := data[field].(string)
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	return value, nil
+}
+
+// Secrets resolves secret badges with registered providers
+type Secrets struct {
+	providers map[string]SecretProvider
+}
+
+func NewSecrets(config *SecretsConfig) *Secrets {
+	return &Secrets{
+		providers: map[string]SecretProvider{
+			"file": &FileSecretProvider{},
+			"env":  &EnvSecretProvider{},
+			"vault": &VaultSecretProvider{
+				config: config,
+				client: &http.Client{Timeout: vaultTimeout},
+			},
+		},
+	}
+}
+
+// Resolve replaces secret badges in value, errors never contain secret values
+func (s *Secrets) Resolve(value string) (string, error) {
+	var resolveErr error
+
+	resolved := secretBadge.ReplaceAllStringFunc(value, func(badge string) string {
+		match := secretBadge.FindStringSubmatch(badge)
+		provider, ok := s.providers[match[1]]
+		if !ok {
+			resolveErr = ErrInvalidSecretProvider
+			return ""
+		}
+
+		secret, err := provider.Secret(match[2])
+		if err != nil && resolveErr == nil {
+			resolveErr = fmt.Errorf("secret %s:%s: %s", match[1], match[2], err)
+		}
+		return secret
+	})
+
+	return resolved, resolveErr
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/hamaxx/gracevisor/common/report"
+)
+
+const (
+	ReportPath = "/report"
+
+	reportTokenSize = 16
+)
+
+func newReportToken() (string, error) {
+	token := make([]byte, reportTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// ReportHandler receives instance self reports
+type ReportHandler struct {
+	runningApps map[string]*App
+}
+
+func (h *ReportHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(rw, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	heartbeat := &report.Heartbeat{}
+	if err := json.NewDecoder(req.Body).Decode(heartbeat); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch heartbeat.Status {
+	case "", report.HeartbeatStarting, report.HeartbeatServing, report.HeartbeatStopping:
+	default:
+		http.Error(rw, "Invalid status", http.StatusBadRequest)
+		return
+	}
+
+	app, ok := h.runningApps[heartbeat.App]
+	if !ok {
+		http.Error(rw, ErrInvalidApp.Error(), http.StatusNotFound)
+		return
+	}
+
+	instance := app.findInstance(heartbeat.InstanceId)
+	if instance == nil {
+		http.Error(rw, ErrInvalidInstance.Error(), http.StatusNotFound)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(instance.reportToken), []byte(heartbeat.Token)) != 1 {
+		http.Error(rw, ErrUnauthorized.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	instance.heartbeat(heartbeat)
+
+	if heartbeat.Replace {
+		if err := app.Replace(instance, heartbeat.Message); err != nil && err != ErrWaitingForPort {
+			http.Error(rw, err.Error(), http.StatusConflict)
+			return
+		}
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (i *Instance) heartbeat(heartbeat *report.Heartbeat) {
+	i.lastHeartbeat = time.Now()
+	i.reportedStatus = heartbeat.Status
+	i.reportedMessage = heartbeat.Message
+	if heartbeat.Ready != nil {
+		i.readyReported = true
+		i.reportedReady = *heartbeat.Ready
+	}
+}
+
+// reportedReadiness reports if instance is ready by its own reports, instance
+// that never reported readiness is ready unless app has report_readiness
+func (i *Instance) reportedReadiness() bool {
+	if !i.readyReported {
+		return !i.app.config().ReportReadiness
+	}
+	return i.reportedReady
+}
+
+// heartbeatMissed reports if serving instance did not report within heartbeat interval
+func (i *Instance) heartbeatMissed() bool {
+	interval := i.app.config().HeartbeatInterval
+	if interval <= 0 || i.status != InstanceStatusServing {
+		return false
+	}
+
+	last := i.lastHeartbeat
+	if last.Before(i.lastChange) {
+		last = i.lastChange
+	}
+	return time.Since(last) > time.Duration(interval)*time.Second
+}
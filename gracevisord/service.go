@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"text/template"
+)
+
+const (
+	ServiceSystemd = "systemd"
+	ServiceUpstart = "upstart"
+	ServiceSysv    = "sysv"
+
+	serviceName = "gracevisor"
+)
+
+var ErrInvalidServiceType = errors.New("Service type must be systemd, upstart or sysv")
+
+var serviceFiles = map[string]string{
+	ServiceSystemd: "/etc/systemd/system/" + serviceName + ".service",
+	ServiceUpstart: "/etc/init/" + serviceName + ".conf",
+	ServiceSysv:    "/etc/init.d/" + serviceName,
+}
+
+var serviceHints = map[string]string{
+	ServiceSystemd: "systemctl daemon-reload && systemctl enable --now " + serviceName,
+	ServiceUpstart: "start " + serviceName,
+	ServiceSysv:    "update-rc.d " + serviceName + " defaults && service " + serviceName + " start",
+}
+
+var serviceTemplates = map[string]string{
+	ServiceSystemd: `[Unit]
+Description=Gracevisor - a process control system built for the web
+After=network.target
+
+[Service]
+ExecStart={{.Binary}} --conf {{.ConfigPath}}
+ExecReload=/bin/kill -HUP $MAINPID
+{{if .User}}User={{.User}}
+{{end}}Type=notify
+NotifyAccess=main
+WatchdogSec=30
+Restart=on-failure
+
+[Install]
+WantedBy=multi-user.target
+`,
+	ServiceUpstart: `description "Gracevisor - a process control system built for the web"
+
+start on (local-filesystems and net-device-up)
+stop on runlevel [!2345]
+
+respawn
+{{if .User}}setuid {{.User}}
+{{end}}
+exec {{.Binary}} --conf {{.ConfigPath}}
+`,
+	ServiceSysv: `#!/bin/sh
+
+### BEGIN INIT INFO
+# Provides:          gracevisor
+# Required-Start:    $local_fs $remote_fs $network $syslog
+# Required-Stop:     $local_fs $remote_fs $network $syslog
+# Default-Start:     2 3 4 5
+# Default-Stop:      0 1 6
+# Short-Description: Gracevisor
+# Description:       Gracevisor - a process control system built for the web
+### END INIT INFO
+
+NAME="gracevisor"
+PIDFILE="/var/run/$NAME.pid"
+APPBIN="{{.Binary}}"
+APPARGS="--conf {{.ConfigPath}}"
+
+set -e
+. /lib/lsb/init-functions
+
+case "$1" in
+  start)
+    printf "Starting '$NAME'... "
+    start-stop-daemon --start --background --make-pidfile --pidfile $PIDFILE {{if .User}}--chuid {{.User}} {{end}}--exec "$APPBIN" -- $APPARGS || true
+    printf "done\n"
+    ;;
+  stop)
+    printf "Stopping '$NAME'... "
+    start-stop-daemon --stop --retry TERM/30/KILL/5 --pidfile $PIDFILE || true
+    rm -f $PIDFILE
+    printf "done\n"
+    ;;
+  reload)
+    start-stop-daemon --stop --signal HUP --pidfile $PIDFILE
+    ;;
+  restart)
+    $0 stop
+    $0 start
+    ;;
+  status)
+    status_of_proc -p $PIDFILE "$APPBIN" $NAME && exit 0 || exit $?
+    ;;
+  *)
+    echo "Usage: $NAME {start|stop|reload|restart|status}" >&2
+    exit 1
+    ;;
+esac
+
+exit 0
+`,
+}
+
+// detectServiceType returns init system of this host
+func detectServiceType() string {
+	if fi, err := os.Stat("/run/systemd/system"); err == nil && fi.IsDir() {
+		return ServiceSystemd
+	}
+	if fi, err := os.Stat("/etc/init"); err == nil && fi.IsDir() {
+		return ServiceUpstart
+	}
+	return ServiceSysv
+}
+
+// installService writes init script for gracevisord started with configPath,
+// binary defaults to running gracevisord and root prefixes installed path for packaging
+func installService(serviceType string, configPath string, binary string, user string, root string, uninstall bool) error {
+	if serviceType == "" {
+		serviceType = detectServiceType()
+	}
+	serviceTemplate, ok := serviceTemplates[serviceType]
+	if !ok {
+		return ErrInvalidServiceType
+	}
+	fn := path.Join(root, serviceFiles[serviceType])
+
+	if uninstall {
+		if err := os.Remove(fn); err != nil {
+			return err
+		}
+		fmt.Println("Removed", fn)
+		return nil
+	}
+
+	// validate config before installing service that would fail to start
+	if _, err := ParseConfing(configPath); err != nil {
+		return err
+	}
+
+	var err error
+	if binary == "" {
+		if binary, err = os.Executable(); err != nil {
+			return err
+		}
+	}
+	if configPath, err = filepath.Abs(configPath); err != nil {
+		return err
+	}
+
+	tmpl, err := template.New(serviceType).Parse(serviceTemplate)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Dir(fn), 0755); err != nil {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if serviceType == ServiceSysv {
+		mode = 0755
+	}
+	file, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = tmpl.Execute(file, map[string]string{
+		"Binary":     binary,
+		"ConfigPath": configPath,
+		"User":       user,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Installed", fn)
+	if root == "" {
+		fmt.Println("Start it with:", serviceHints[serviceType])
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ShadowHeader marks requests mirrored to held instance, so apps can skip side effects
+const ShadowHeader = "X-Gracevisor-Shadow"
+
+// hop by hop headers are not forwarded to shadow instance, like reverse proxy drops them
+var shadowHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+}
+
+type shadowBody struct {
+	io.Reader
+	io.Closer
+}
+
+// reserveShadowInstance reserves held instance for a mirrored request, if app shadows
+// traffic and request is picked by shadow percent
+func (a *App) reserveShadowInstance(config *ShadowConfig, served *Instance) *Instance {
+	if rand.Float64()*100 >= config.Percent {
+		return nil
+	}
+	a.activeInstanceLock.Lock()
+	defer a.activeInstanceLock.Unlock()
+
+	instance := a.heldInstance
+	if instance == nil || instance == served || instance.status != InstanceStatusServing {
+		return nil
+	}
+	instance.Serve()
+	return instance
+}
+
+// shadow sends a copy of request to held instance in background and discards its
+// response. Request body is buffered up to max body size, larger requests, upgrades
+// and requests over max concurrent mirrored requests are not mirrored.
+func (a *App) shadow(served *Instance, req *http.Request) {
+	config := a.config().Shadow
+	if config == nil || req.Header.Get("Upgrade") != "" {
+		return
+	}
+	maxBody := int64(config.MaxBodySize) * 1024
+	if req.ContentLength > maxBody {
+		return
+	}
+	instance := a.reserveShadowInstance(config, served)
+	if instance == nil {
+		return
+	}
+	if atomic.AddInt32(&a.shadowCount, 1) > int32(config.MaxConcurrent) {
+		atomic.AddInt32(&a.shadowCount, -1)
+		instance.Done()
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBody+1))
+	if err != nil || int64(len(body)) > maxBody {
+		// proxied request still gets the whole body
+		req.Body = &shadowBody{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		atomic.AddInt32(&a.shadowCount, -1)
+		instance.Done()
+		return
+	}
+	req.Body = &shadowBody{bytes.NewReader(body), req.Body}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Timeout)*time.Second)
+	mirror := req.Clone(ctx)
+	mirror.RequestURI = ""
+	mirror.URL.Scheme = "http"
+	mirror.URL.Host = instance.internalHostPort
+	mirror.Body = ioutil.NopCloser(bytes.NewReader(body))
+	mirror.ContentLength = int64(len(body))
+	for _, name := range shadowHopHeaders {
+		mirror.Header.Del(name)
+	}
+	mirror.Header.Set(ShadowHeader, "1")
+
+	go func() {
+		defer atomic.AddInt32(&a.shadowCount, -1)
+		defer instance.Done()
+		defer cancel()
+
+		start := time.Now()
+		status := http.StatusBadGateway
+		resp, err := http.DefaultTransport.RoundTrip(mirror)
+		if err == nil {
+			_, err = io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			status = resp.StatusCode
+		}
+		if err != nil {
+			log.Printf("%s: instance %d: shadow error: %s", a.config().Name, instance.id, err)
+		}
+		instance.metrics.record(status, time.Since(start))
+	}()
+}
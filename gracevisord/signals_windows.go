@@ -0,0 +1,11 @@
+package main
+
+import "syscall"
+
+// Signals supported on windows, TERM and INT are delivered as CTRL_BREAK_EVENT
+// and KILL terminates the job object of the instance with all its children
+var Signals = map[string]syscall.Signal{
+	"INT":  syscall.SIGINT,
+	"KILL": syscall.SIGKILL,
+	"TERM": syscall.SIGTERM,
+}
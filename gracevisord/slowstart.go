@@ -0,0 +1,63 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// slowStartPercent returns part of traffic the promoted active instance gets,
+// ramping from slow start percent to 100 over slow start duration
+func (a *App) slowStartPercent() float64 {
+	config := a.config().SlowStart
+	if config == nil || a.rampInstance == nil || a.activeInstance == nil {
+		return 100
+	}
+	elapsed := time.Since(a.activeInstance.slowStart).Seconds()
+	percent := config.Percent + (100-config.Percent)*elapsed/float64(config.Duration)
+	if percent > 100 {
+		return 100
+	}
+	return percent
+}
+
+// useRampInstance decides if request should still be routed to previous active instance
+func (a *App) useRampInstance() bool {
+	return a.rampInstance != nil && a.rampInstance.status == InstanceStatusServing &&
+		a.rampInstance.inRotation() && rand.Float64()*100 >= a.slowStartPercent()
+}
+
+// slowStartShare returns percentage of traffic instance gets during slow start, 0 if none is in progress
+func (a *App) slowStartShare(instance *Instance) float64 {
+	if a.rampInstance == nil {
+		return 0
+	}
+	switch instance {
+	case a.activeInstance:
+		return a.slowStartPercent()
+	case a.rampInstance:
+		return 100 - a.slowStartPercent()
+	}
+	return 0
+}
+
+// checkSlowStart stops previous active instance once promoted instance gets all traffic
+func (a *App) checkSlowStart(instance *Instance, status int) {
+	if status != InstanceStatusServing {
+		a.endSlowStart()
+		return
+	}
+	if a.slowStartPercent() < 100 {
+		return
+	}
+
+	a.endSlowStart()
+	if instance != a.standbyInstance {
+		instance.Stop(StopReasonReplaced)
+	}
+}
+
+func (a *App) endSlowStart() {
+	a.activeInstanceLock.Lock()
+	a.rampInstance = nil
+	a.activeInstanceLock.Unlock()
+}
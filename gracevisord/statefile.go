@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+const stateFileMode = os.FileMode(0600)
+
+// stateLog is a bounded list of records of an app persisted as json in state dir.
+// File is replaced atomically on every append so a crash never leaves it half written.
+// It isn't safe for concurrent use, owners guard it with their own mutex.
+type stateLog[T any] struct {
+	fn         string
+	maxRecords int
+
+	items []T
+}
+
+// loadStateLog reads records saved in state dir, log is returned empty along with error
+// if file can't be read
+func loadStateLog[T any](stateDir string, kind string, appName string, maxRecords int) (*stateLog[T], error) {
+	l := &stateLog[T]{
+		fn:         path.Join(stateDir, fmt.Sprintf("%s_%s.json", kind, appName)),
+		maxRecords: maxRecords,
+	}
+
+	data, err := ioutil.ReadFile(l.fn)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &l.items)
+	}
+	if err != nil {
+		l.items = nil
+	}
+	return l, err
+}
+
+// append adds record, drops the oldest ones over the limit and saves the file
+func (l *stateLog[T]) append(record T) error {
+	l.items = append(l.items, record)
+	if len(l.items) > l.maxRecords {
+		l.items = l.items[len(l.items)-l.maxRecords:]
+	}
+
+	data, err := json.Marshal(l.items)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(l.fn+".tmp", data, stateFileMode); err != nil {
+		return err
+	}
+	return os.Rename(l.fn+".tmp", l.fn)
+}
+
+// copy returns copy of records, oldest first
+func (l *stateLog[T]) copy() []T {
+	records := make([]T, len(l.items))
+	copy(records, l.items)
+	return records
+}
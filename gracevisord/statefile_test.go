@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/hamaxx/gracevisor/common/report"
+)
+
+func TestStateLog(t *testing.T) {
+	dir := t.TempDir()
+
+	history := NewHistory(dir, "app", 2)
+	for _, id := range []uint32{1, 2, 3} {
+		history.Add(&report.HistoryRecord{InstanceId: id})
+	}
+	deploys := NewDeploys(dir, "app", 2)
+	deploys.Add(&report.DeployRecord{Version: "v1"})
+	deploys.Add(&report.DeployRecord{Version: "v1"})
+
+	records := NewHistory(dir, "app", 2).Records()
+	if len(records) != 2 || records[0].InstanceId != 2 || records[1].InstanceId != 3 {
+		t.Error("History should keep newest records after reload:", records)
+	}
+	if deploys := NewDeploys(dir, "app", 2).Records(); len(deploys) != 1 {
+		t.Error("Deploys should skip repeated deploy:", deploys)
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "history_broken.json"), []byte("[{"), stateFileMode); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadStateLog[*report.HistoryRecord](dir, "history", "broken", 2); err == nil {
+		t.Error("loadStateLog should fail with invalid file")
+	}
+	if l, err := loadStateLog[*report.HistoryRecord](dir, "history", "missing", 2); err != nil || len(l.copy()) != 0 {
+		t.Error("loadStateLog should return empty log for missing file:", err)
+	}
+}
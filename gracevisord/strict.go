@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/hamaxx/gracevisor/deps/yaml.v2"
+)
+
+// parseYaml unmarshals data into out and fails on options out doesn't have,
+// so typos are not silently ignored
+func parseYaml(data []byte, out interface{}) error {
+	if err := yaml.Unmarshal(data, out); err != nil {
+		return err
+	}
+
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	unknown := unknownOptions(raw, reflect.TypeOf(out), "", "")
+	if len(unknown) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(unknown, "; "))
+}
+
+// yamlFields maps yaml option names of struct type to field types
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+// unknownOptions walks raw yaml along type t and describes options t doesn't have,
+// app is the context of options under apps and prefix is the path of nested options
+func unknownOptions(raw interface{}, t reflect.Type, app string, prefix string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	unknown := []string{}
+	switch t.Kind() {
+	case reflect.Struct:
+		values, ok := raw.(map[interface{}]interface{})
+		if !ok {
+			return nil
+		}
+		fields := yamlFields(t)
+
+		if t == reflect.TypeOf(AppConfig{}) {
+			app = fmt.Sprintf("app %v: ", values["name"])
+			prefix = ""
+		}
+
+		keys := []string{}
+		for key := range values {
+			keys = append(keys, fmt.Sprint(key))
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			fieldType, ok := fields[key]
+			if !ok {
+				unknown = append(unknown, fmt.Sprintf("%sUnknown option %s%s", app, prefix, key))
+				continue
+			}
+			unknown = append(unknown, unknownOptions(values[key], fieldType, app, prefix+key+".")...)
+		}
+	case reflect.Slice:
+		values, ok := raw.([]interface{})
+		if !ok {
+			return nil
+		}
+		for _, value := range values {
+			unknown = append(unknown, unknownOptions(value, t.Elem(), app, prefix)...)
+		}
+	}
+	return unknown
+}
@@ -0,0 +1,142 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	systemdStatusInterval = time.Second
+
+	// sdListenFdsStart is the first file descriptor passed by socket activation
+	sdListenFdsStart = 3
+)
+
+// sdNotify sends state to systemd, it is a noop when not started by systemd with Type=notify
+func sdNotify(state string) error {
+	socketAddr := os.Getenv("NOTIFY_SOCKET")
+	if socketAddr == "" {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketAddr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// activationListeners returns listeners passed by systemd socket activation keyed by port
+func activationListeners() (map[uint16]net.Listener, error) {
+	listeners := map[uint16]net.Listener{}
+
+	if pid := os.Getenv("LISTEN_PID"); pid == "" || pid != strconv.Itoa(os.Getpid()) {
+		return listeners, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return listeners, nil
+	}
+
+	// do not pass activation variables to apps
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	for fd := sdListenFdsStart; fd < sdListenFdsStart+nfds; fd++ {
+		syscall.CloseOnExec(fd)
+
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd))
+		listener, err := net.FileListener(file)
+		if err != nil {
+			return nil, fmt.Errorf("socket activation fd %d: %s", fd, err)
+		}
+		file.Close()
+
+		addr, ok := listener.Addr().(*net.TCPAddr)
+		if !ok {
+			return nil, fmt.Errorf("socket activation fd %d: not a tcp socket", fd)
+		}
+		listeners[uint16(addr.Port)] = listener
+	}
+
+	return listeners, nil
+}
+
+// watchdogInterval returns systemd watchdog interval if watchdog is enabled for this process
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// startSystemdNotifier reports app counts to systemd, signals readiness once listeners are
+// bound and apps are started and sends watchdog keepalives. Readiness doesn't wait for
+// apps to serve, one crash looping app would keep the service from ever starting.
+func startSystemdNotifier(runningApps map[string]*App, started *sync.WaitGroup) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+
+	if interval := watchdogInterval(); interval > 0 {
+		go func() {
+			ticker := time.NewTicker(interval / 2)
+			for range ticker.C {
+				if err := sdNotify("WATCHDOG=1"); err != nil {
+					log.Print("Systemd watchdog error:", err)
+				}
+			}
+		}()
+	}
+
+	go func() {
+		started.Wait()
+		ticker := time.NewTicker(systemdStatusInterval)
+
+		ready := false
+		lastStatus := ""
+		for {
+			serving := 0
+			for _, app := range runningApps {
+				app.activeInstanceLock.Lock()
+				if app.activeInstance != nil {
+					serving++
+				}
+				app.activeInstanceLock.Unlock()
+			}
+
+			state := fmt.Sprintf("STATUS=Serving %d/%d apps", serving, len(runningApps))
+			if !ready {
+				ready = true
+				state += "\nREADY=1"
+			}
+
+			if state != lastStatus {
+				if err := sdNotify(state); err != nil {
+					log.Print("Systemd notify error:", err)
+				}
+				lastStatus = state
+			}
+
+			<-ticker.C
+		}
+	}()
+}
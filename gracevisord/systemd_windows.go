@@ -0,0 +1,14 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// activationListeners returns no listeners, there is no socket activation on windows
+func activationListeners() (map[uint16]net.Listener, error) {
+	return map[uint16]net.Listener{}, nil
+}
+
+// startSystemdNotifier is a noop, windows services are not managed by systemd
+func startSystemdNotifier(runningApps map[string]*App, started *sync.WaitGroup) {}
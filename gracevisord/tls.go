@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+var tlsClientAuth = map[string]tls.ClientAuthType{
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require":            tls.RequireAnyClientCert,
+	"verify_if_given":    tls.VerifyClientCertIfGiven,
+	"require_and_verify": tls.RequireAndVerifyClientCert,
+}
+
+// tlsCipherSuite looks up cipher suite by its crypto/tls name, insecure suites are
+// accepted too for policies that still need them
+func tlsCipherSuite(name string) (uint16, bool) {
+	for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, suite := range suites {
+			if suite.Name == name {
+				return suite.ID, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// certificates lists cert_file first, it is served to clients without a matching
+// server name, then certificates picked by server name
+func (c *TLSConfig) certificates() []*TLSCertConfig {
+	certs := []*TLSCertConfig{}
+	if c.CertFile != "" {
+		certs = append(certs, &TLSCertConfig{CertFile: c.CertFile, KeyFile: c.KeyFile})
+	}
+	return append(certs, c.Certificates...)
+}
+
+// build loads certificates and client ca of tls config and applies its policy
+func (c *TLSConfig) build() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tlsVersions[c.MinVersion],
+		ClientAuth: tlsClientAuth[c.ClientAuth],
+	}
+
+	// crypto/tls picks the first certificate valid for client server name
+	for _, certConfig := range c.certificates() {
+		cert, err := tls.LoadX509KeyPair(certConfig.CertFile, certConfig.KeyFile)
+		if err != nil {
+			return nil, &FieldError{"certificates", err}
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+
+	for _, name := range c.CipherSuites {
+		id, ok := tlsCipherSuite(name)
+		if !ok {
+			return nil, &FieldError{"cipher_suites", ErrInvalidCipherSuite}
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+	for _, name := range c.CurvePreferences {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return nil, &FieldError{"curve_preferences", ErrInvalidCurve}
+		}
+		config.CurvePreferences = append(config.CurvePreferences, curve)
+	}
+
+	if c.ClientCaFile != "" {
+		data, err := ioutil.ReadFile(c.ClientCaFile)
+		if err != nil {
+			return nil, &FieldError{"client_ca_file", err}
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(data) {
+			return nil, &FieldError{"client_ca_file", ErrInvalidClientCa}
+		}
+	}
+	return config, nil
+}
+
+// tlsListener terminates tls of app listener, current policy and certificates are used
+// for every handshake so they change on config reload without dropping connections
+func (a *App) tlsListener(listener net.Listener) net.Listener {
+	if a.config().TLS == nil {
+		return listener
+	}
+	return tls.NewListener(listener, &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return a.tls.config(), nil
+		},
+	})
+}
+
+// certsModified returns latest modification time of certificate and key files
+func certsModified(config *TLSConfig) time.Time {
+	latest := time.Time{}
+	for _, certConfig := range config.certificates() {
+		for _, fn := range []string{certConfig.CertFile, certConfig.KeyFile} {
+			if info, err := os.Stat(fn); err == nil && info.ModTime().After(latest) {
+				latest = info.ModTime()
+			}
+		}
+	}
+	return latest
+}
+
+// watchCertificates reloads tls config of app when its certificate or key files change,
+// so renewed certificates are served without a config reload, and checks their expiry
+// and ocsp staples
+func (a *App) watchCertificates() {
+	modified := certsModified(a.config().TLS)
+	a.tls.check(a.config().TLS)
+	for {
+		config := a.config().TLS
+		time.Sleep(time.Duration(config.ReloadInterval) * time.Second)
+
+		if latest := certsModified(config); !latest.Equal(modified) {
+			tlsConfig, err := config.build()
+			if err != nil {
+				// certificate may be written before its key, retried on next check
+				log.Print(a.config().Name, ": Tls certificates reload error:", err)
+			} else {
+				modified = latest
+				a.tls.update(tlsConfig)
+				log.Print(a.config().Name, ": Reloaded tls certificates")
+			}
+		}
+		a.tls.check(config)
+	}
+}
+
+// externalScheme is scheme of app external url
+func (a *App) externalScheme() string {
+	if a.config().TLS != nil {
+		return "https"
+	}
+	return "http"
+}
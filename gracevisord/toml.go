@@ -0,0 +1,477 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var tomlDateRe = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}|^\d{2}:\d{2}:\d{2}`)
+
+// tomlParser decodes toml documents into maps and slices, the same shape
+// generic yaml decoding produces, so config options are checked only once
+type tomlParser struct {
+	data []rune
+	pos  int
+}
+
+// parseToml decodes toml tables, arrays of tables, dotted keys, strings,
+// numbers, booleans, arrays and inline tables; dates are kept as strings
+func parseToml(data []byte) (map[string]interface{}, error) {
+	p := &tomlParser{data: []rune(string(data))}
+	root := map[string]interface{}{}
+	if err := p.parse(root); err != nil {
+		return nil, fmt.Errorf("toml: line %d: %s", p.line(), err)
+	}
+	return root, nil
+}
+
+func (p *tomlParser) line() int {
+	return strings.Count(string(p.data[:p.pos]), "\n") + 1
+}
+
+func (p *tomlParser) eof() bool {
+	return p.pos >= len(p.data)
+}
+
+func (p *tomlParser) peek() rune {
+	if p.eof() {
+		return 0
+	}
+	return p.data[p.pos]
+}
+
+func (p *tomlParser) hasPrefix(prefix string) bool {
+	return strings.HasPrefix(string(p.data[p.pos:]), prefix)
+}
+
+func (p *tomlParser) expect(s string) error {
+	if !p.hasPrefix(s) {
+		return fmt.Errorf("expected %q", s)
+	}
+	p.pos += len([]rune(s))
+	return nil
+}
+
+// skipSpace skips spaces and tabs on current line
+func (p *tomlParser) skipSpace() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.pos++
+	}
+}
+
+func (p *tomlParser) skipComment() {
+	if p.peek() == '#' {
+		for !p.eof() && p.peek() != '\n' {
+			p.pos++
+		}
+	}
+}
+
+// skipBlank skips whitespace, newlines and comments
+func (p *tomlParser) skipBlank() {
+	for !p.eof() {
+		p.skipSpace()
+		p.skipComment()
+		if p.peek() != '\n' && p.peek() != '\r' {
+			return
+		}
+		p.pos++
+	}
+}
+
+// endLine expects nothing but a comment till end of line
+func (p *tomlParser) endLine() error {
+	p.skipSpace()
+	p.skipComment()
+	if p.hasPrefix("\r\n") || p.hasPrefix("\n") || p.eof() {
+		return nil
+	}
+	return fmt.Errorf("unexpected %q after value", p.peek())
+}
+
+func (p *tomlParser) parse(root map[string]interface{}) error {
+	current := root
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return nil
+		}
+
+		var err error
+		if p.hasPrefix("[[") {
+			p.pos += 2
+			current, err = p.header(root, "]]", true)
+		} else if p.hasPrefix("[") {
+			p.pos++
+			current, err = p.header(root, "]", false)
+		} else {
+			err = p.keyValue(current)
+		}
+		if err != nil {
+			return err
+		}
+		if err := p.endLine(); err != nil {
+			return err
+		}
+	}
+}
+
+// header parses [table] or [[array of tables]] and returns the table
+// following key values belong to
+func (p *tomlParser) header(root map[string]interface{}, end string, array bool) (map[string]interface{}, error) {
+	p.skipSpace()
+	keys, err := p.key()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(end); err != nil {
+		return nil, err
+	}
+
+	table, err := p.descend(root, keys[:len(keys)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := keys[len(keys)-1]
+
+	if array {
+		tables, ok := table[last].([]interface{})
+		if _, exists := table[last]; exists && !ok {
+			return nil, fmt.Errorf("%s is not an array of tables", strings.Join(keys, "."))
+		}
+		next := map[string]interface{}{}
+		table[last] = append(tables, next)
+		return next, nil
+	}
+
+	switch value := table[last].(type) {
+	case nil:
+		next := map[string]interface{}{}
+		table[last] = next
+		return next, nil
+	case map[string]interface{}:
+		return value, nil
+	}
+	return nil, fmt.Errorf("%s is not a table", strings.Join(keys, "."))
+}
+
+// descend walks keys from table creating missing tables, arrays of tables
+// continue in their last table
+func (p *tomlParser) descend(table map[string]interface{}, keys []string) (map[string]interface{}, error) {
+	for i, key := range keys {
+		switch value := table[key].(type) {
+		case nil:
+			next := map[string]interface{}{}
+			table[key] = next
+			table = next
+		case map[string]interface{}:
+			table = value
+		case []interface{}:
+			if len(value) == 0 {
+				return nil, fmt.Errorf("%s is not a table", strings.Join(keys[:i+1], "."))
+			}
+			last, ok := value[len(value)-1].(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s is not a table", strings.Join(keys[:i+1], "."))
+			}
+			table = last
+		default:
+			return nil, fmt.Errorf("%s is not a table", strings.Join(keys[:i+1], "."))
+		}
+	}
+	return table, nil
+}
+
+func (p *tomlParser) keyValue(table map[string]interface{}) error {
+	keys, err := p.key()
+	if err != nil {
+		return err
+	}
+	if err := p.expect("="); err != nil {
+		return err
+	}
+	p.skipSpace()
+	value, err := p.value()
+	if err != nil {
+		return err
+	}
+
+	table, err = p.descend(table, keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	if _, exists := table[last]; exists {
+		return fmt.Errorf("duplicate key %s", strings.Join(keys, "."))
+	}
+	table[last] = value
+	return nil
+}
+
+// key parses bare, quoted and dotted keys
+func (p *tomlParser) key() ([]string, error) {
+	keys := []string{}
+	for {
+		p.skipSpace()
+		var key string
+		var err error
+		switch p.peek() {
+		case '"':
+			key, err = p.basicString()
+		case '\'':
+			key, err = p.literalString()
+		default:
+			start := p.pos
+			for !p.eof() && (unicode.IsLetter(p.peek()) || unicode.IsDigit(p.peek()) || p.peek() == '_' || p.peek() == '-') {
+				p.pos++
+			}
+			if start == p.pos {
+				return nil, fmt.Errorf("expected key, got %q", p.peek())
+			}
+			key = string(p.data[start:p.pos])
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+
+		p.skipSpace()
+		if p.peek() != '.' {
+			return keys, nil
+		}
+		p.pos++
+	}
+}
+
+func (p *tomlParser) value() (interface{}, error) {
+	switch {
+	case p.hasPrefix(`"""`):
+		return p.multilineString(`"""`, true)
+	case p.hasPrefix("'''"):
+		return p.multilineString("'''", false)
+	case p.peek() == '"':
+		return p.basicString()
+	case p.peek() == '\'':
+		return p.literalString()
+	case p.peek() == '[':
+		return p.array()
+	case p.peek() == '{':
+		return p.inlineTable()
+	}
+
+	start := p.pos
+	for !p.eof() && !strings.ContainsRune(" \t\r\n,]}#", p.peek()) {
+		p.pos++
+	}
+	token := string(p.data[start:p.pos])
+	// date and time may be separated by space
+	if tomlDateRe.MatchString(token) && len(token) == 10 && p.peek() == ' ' &&
+		p.pos+1 < len(p.data) && unicode.IsDigit(p.data[p.pos+1]) {
+		p.pos++
+		for !p.eof() && !strings.ContainsRune(" \t\r\n,]}#", p.peek()) {
+			p.pos++
+		}
+		token = string(p.data[start:p.pos])
+	}
+
+	switch token {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "":
+		return nil, fmt.Errorf("expected value, got %q", p.peek())
+	}
+	if tomlDateRe.MatchString(token) {
+		return token, nil
+	}
+
+	number := strings.Replace(token, "_", "", -1)
+	if strings.HasPrefix(number, "0o") {
+		number = "0" + number[2:]
+	}
+	if i, err := strconv.ParseInt(number, 0, 64); err == nil {
+		return int(i), nil
+	}
+	if f, err := strconv.ParseFloat(number, 64); err == nil {
+		return f, nil
+	}
+	return nil, fmt.Errorf("invalid value %s", token)
+}
+
+func (p *tomlParser) array() ([]interface{}, error) {
+	p.pos++
+	values := []interface{}{}
+	for {
+		p.skipBlank()
+		if p.peek() == ']' {
+			p.pos++
+			return values, nil
+		}
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		p.skipBlank()
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+		default:
+			return nil, fmt.Errorf("expected , or ] in array, got %q", p.peek())
+		}
+	}
+}
+
+func (p *tomlParser) inlineTable() (map[string]interface{}, error) {
+	p.pos++
+	table := map[string]interface{}{}
+	p.skipSpace()
+	if p.peek() == '}' {
+		p.pos++
+		return table, nil
+	}
+	for {
+		if err := p.keyValue(table); err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case '}':
+			p.pos++
+			return table, nil
+		default:
+			return nil, fmt.Errorf("expected , or } in inline table, got %q", p.peek())
+		}
+	}
+}
+
+func (p *tomlParser) literalString() (string, error) {
+	p.pos++
+	start := p.pos
+	for !p.eof() && p.peek() != '\'' {
+		if p.peek() == '\n' {
+			return "", fmt.Errorf("unterminated string")
+		}
+		p.pos++
+	}
+	if p.eof() {
+		return "", fmt.Errorf("unterminated string")
+	}
+	s := string(p.data[start:p.pos])
+	p.pos++
+	return s, nil
+}
+
+func (p *tomlParser) basicString() (string, error) {
+	p.pos++
+	s := []rune{}
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", fmt.Errorf("unterminated string")
+		}
+		c := p.peek()
+		p.pos++
+		switch c {
+		case '"':
+			return string(s), nil
+		case '\\':
+			r, err := p.escape()
+			if err != nil {
+				return "", err
+			}
+			s = append(s, r...)
+		default:
+			s = append(s, c)
+		}
+	}
+}
+
+// multilineString parses multi-line basic and literal strings, newline after opening
+// quotes is trimmed and in basic strings line ending backslash joins lines
+func (p *tomlParser) multilineString(quotes string, basic bool) (string, error) {
+	p.pos += 3
+	if p.hasPrefix("\r\n") {
+		p.pos += 2
+	} else if p.hasPrefix("\n") {
+		p.pos++
+	}
+
+	s := []rune{}
+	for {
+		if p.eof() {
+			return "", fmt.Errorf("unterminated string")
+		}
+		if p.hasPrefix(quotes) {
+			p.pos += 3
+			return string(s), nil
+		}
+		c := p.peek()
+		p.pos++
+		if !basic || c != '\\' {
+			s = append(s, c)
+			continue
+		}
+
+		rest := p.pos
+		for rest < len(p.data) && (p.data[rest] == ' ' || p.data[rest] == '\t' || p.data[rest] == '\r') {
+			rest++
+		}
+		if rest < len(p.data) && p.data[rest] == '\n' {
+			p.pos = rest
+			for !p.eof() && unicode.IsSpace(p.peek()) {
+				p.pos++
+			}
+			continue
+		}
+		r, err := p.escape()
+		if err != nil {
+			return "", err
+		}
+		s = append(s, r...)
+	}
+}
+
+func (p *tomlParser) escape() ([]rune, error) {
+	if p.eof() {
+		return nil, fmt.Errorf("unterminated string")
+	}
+	c := p.peek()
+	p.pos++
+	switch c {
+	case 'b':
+		return []rune{'\b'}, nil
+	case 't':
+		return []rune{'\t'}, nil
+	case 'n':
+		return []rune{'\n'}, nil
+	case 'f':
+		return []rune{'\f'}, nil
+	case 'r':
+		return []rune{'\r'}, nil
+	case '"', '\\':
+		return []rune{c}, nil
+	case 'u', 'U':
+		size := 4
+		if c == 'U' {
+			size = 8
+		}
+		if p.pos+size > len(p.data) {
+			return nil, fmt.Errorf("invalid unicode escape")
+		}
+		code, err := strconv.ParseUint(string(p.data[p.pos:p.pos+size]), 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid unicode escape")
+		}
+		p.pos += size
+		return []rune{rune(code)}, nil
+	}
+	return nil, fmt.Errorf("invalid escape \\%c", c)
+}
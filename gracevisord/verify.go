@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const StopReasonVerifyFailed = "verify_failed"
+
+// verifyPromotion checks app external endpoint after instance was promoted,
+// previous instance is kept on standby and switched back if verification fails
+func (a *App) verifyPromotion(instance *Instance, previous *Instance) {
+	config := a.config().Verify
+
+	time.Sleep(time.Duration(config.Delay) * time.Second)
+
+	err := a.verify(instance)
+	if err == nil {
+		a.activeInstanceLock.Lock()
+		if a.standbyInstance == previous {
+			a.standbyInstance = nil
+		}
+		ramping := previous != nil && a.rampInstance == previous
+		a.activeInstanceLock.Unlock()
+
+		// previous instance still ramping down is stopped when slow start ends
+		if previous != nil && !ramping {
+			previous.Stop(StopReasonReplaced)
+		}
+		return
+	}
+
+	log.Printf("%s: verification of instance %d failed: %s", a.config().Name, instance.id, err)
+
+	rolledBack := false
+	a.activeInstanceLock.Lock()
+	if a.standbyInstance == previous {
+		a.standbyInstance = nil
+	}
+	if previous != nil && a.activeInstance == instance && previous.status == InstanceStatusServing {
+		a.activeInstance = previous
+		a.version = previous.version
+		a.rampInstance = nil
+		rolledBack = true
+	}
+	a.activeInstanceLock.Unlock()
+
+	if rolledBack {
+		instance.Stop(StopReasonVerifyFailed)
+	}
+
+	a.events.Emit(&Event{
+		Type:       EventVerifyFailed,
+		App:        a.config().Name,
+		InstanceId: instance.id,
+		Message:    fmt.Sprintf("%s, rolled back: %t", err, rolledBack),
+	})
+}
+
+// verify runs verification command and http check against app external endpoint
+func (a *App) verify(instance *Instance) error {
+	config := a.config().Verify
+	timeout := time.Duration(config.Timeout) * time.Second
+	externalUrl := fmt.Sprintf("%s://%s", a.externalScheme(), a.externalHostPort)
+
+	if config.Path != "" {
+		// certificate is for public names, not for external host
+		client := &http.Client{Timeout: timeout, Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+		resp, err := client.Get(externalUrl + config.Path)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return errors.New(resp.Status)
+		}
+	}
+
+	if config.Command != "" {
+		cmd := exec.Command(shellBinary, "-c", config.Command)
+		cmd.Dir = instance.parseBadges(a.config().Directory)
+		cmd.Env = append(os.Environ(),
+			fmt.Sprintf("GRACEVISOR_APP=%s", a.config().Name),
+			fmt.Sprintf("GRACEVISOR_INSTANCE_ID=%d", instance.id),
+			fmt.Sprintf("GRACEVISOR_VERSION=%s", instance.version),
+			fmt.Sprintf("GRACEVISOR_EXTERNAL_URL=%s", externalUrl),
+		)
+
+		done := make(chan error, 1)
+		go func() {
+			done <- run(cmd)
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				return err
+			}
+		case <-time.After(timeout):
+			if cmd.Process != nil {
+				cmd.Process.Kill()
+			}
+			return errors.New("verification command timed out")
+		}
+	}
+
+	return nil
+}
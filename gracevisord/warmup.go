@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	warmupNone = iota
+	warmupRunning
+	warmupDone
+)
+
+// warmingUp reports if warmup requests were started, start_timeout doesn't apply to them
+func (i *Instance) warmingUp() bool {
+	return atomic.LoadInt32(&i.warmupState) != warmupNone
+}
+
+// warmedUp starts warmup requests on first call and reports if they are finished,
+// instances without warmup config are always warmed up
+func (i *Instance) warmedUp() bool {
+	if i.app.config().Warmup == nil {
+		return true
+	}
+
+	switch atomic.LoadInt32(&i.warmupState) {
+	case warmupNone:
+		atomic.StoreInt32(&i.warmupState, warmupRunning)
+		go func() {
+			i.warmup()
+			atomic.StoreInt32(&i.warmupState, warmupDone)
+		}()
+	case warmupDone:
+		return true
+	}
+	return false
+}
+
+// warmup sends requests to every warmup path with configured concurrency,
+// responses are discarded and failures only logged
+func (i *Instance) warmup() {
+	config := i.app.config().Warmup
+	// own client, cold paths are expected to take longer than a healthcheck
+	client := &http.Client{Timeout: time.Duration(config.Timeout) * time.Second}
+
+	urls := make(chan string)
+	failed := int32(0)
+
+	wg := &sync.WaitGroup{}
+	for n := 0; n < config.Concurrency; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for warmupUrl := range urls {
+				resp, err := client.Get(warmupUrl)
+				if err != nil {
+					atomic.AddInt32(&failed, 1)
+					continue
+				}
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		}()
+	}
+
+	for _, path := range config.Paths {
+		warmupUrl := url.URL{
+			Scheme: "http",
+			Host:   i.internalHostPort,
+			Path:   path,
+		}
+		for n := 0; n < config.Requests; n++ {
+			urls <- warmupUrl.String()
+		}
+	}
+	close(urls)
+	wg.Wait()
+
+	if failed > 0 {
+		log.Printf("%s: %d of %d warmup requests failed", i.app.config().Name, failed, len(config.Paths)*config.Requests)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"time"
+)
+
+// watchdog tracks gracevisord own resource usage and warns when it crosses thresholds,
+// to catch leaks of the daemon before they take down apps
+type watchdog struct {
+	config *WatchdogConfig
+	events *Events
+
+	// metrics over their threshold, warnings are only logged when crossed
+	exceeded map[string]bool
+
+	memory     expvar.Int
+	openFiles  expvar.Int
+	lag        expvar.Int
+	goroutines expvar.Int
+}
+
+func startWatchdog(config *WatchdogConfig, events *Events) {
+	w := &watchdog{
+		config:   config,
+		events:   events,
+		exceeded: map[string]bool{},
+	}
+
+	stats := new(expvar.Map)
+	stats.Set("memory", &w.memory)
+	stats.Set("open_files", &w.openFiles)
+	stats.Set("lag_ms", &w.lag)
+	stats.Set("goroutines", &w.goroutines)
+	expvar.Publish("watchdog", stats)
+
+	interval := time.Duration(config.Interval) * time.Second
+	go func() {
+		last := time.Now()
+		for now := range time.Tick(interval) {
+			// ticks delayed by a busy scheduler or gc show up as lag
+			lag := now.Sub(last) - interval
+			if lag < 0 {
+				lag = 0
+			}
+			last = now
+			w.check(lag)
+		}
+	}()
+}
+
+func (w *watchdog) check(lag time.Duration) {
+	pid := os.Getpid()
+	memory := processMemory(pid)
+	openFiles, fileLimit := openFiles(pid)
+	goroutines := runtime.NumGoroutine()
+
+	w.memory.Set(int64(memory))
+	w.openFiles.Set(int64(openFiles))
+	w.lag.Set(int64(lag / time.Millisecond))
+	w.goroutines.Set(int64(goroutines))
+
+	w.threshold("memory", w.config.MaxMemory > 0 && memory > uint64(w.config.MaxMemory)<<20,
+		fmt.Sprintf("resident memory %dMB over %dMB", memory>>20, w.config.MaxMemory))
+	w.threshold("goroutines", goroutines > w.config.MaxGoroutines,
+		fmt.Sprintf("%d goroutines over %d", goroutines, w.config.MaxGoroutines))
+	w.threshold("open_files", fileLimit > 0 && uint64(openFiles)*100 > fileLimit*uint64(w.config.MaxOpenFiles),
+		fmt.Sprintf("%d open files over %d%% of limit %d", openFiles, w.config.MaxOpenFiles, fileLimit))
+	w.threshold("lag", lag > time.Duration(w.config.MaxLag)*time.Millisecond,
+		fmt.Sprintf("lag %s over %dms", lag, w.config.MaxLag))
+}
+
+// threshold warns when metric crosses its threshold and when it recovers
+func (w *watchdog) threshold(metric string, exceeded bool, message string) {
+	if exceeded == w.exceeded[metric] {
+		return
+	}
+	w.exceeded[metric] = exceeded
+	if !exceeded {
+		log.Print("Watchdog: ", metric, " back under threshold")
+		return
+	}
+
+	if w.config.Events {
+		w.events.Emit(&Event{
+			Type:    EventWatchdog,
+			Name:    metric,
+			Message: message,
+		})
+	} else {
+		log.Print("Watchdog: ", message)
+	}
+}
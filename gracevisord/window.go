@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrOutsideDeployWindow = errors.New("Outside deploy windows")
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// DeployWindow is a daily time range on some weekdays, ranges that end before they
+// start run past midnight and belong to the day they start on
+type DeployWindow struct {
+	Days [7]bool
+	From int
+	To   int
+}
+
+// parseDeployWindow parses windows like "mon-fri 09:00-17:00", "sat,sun 22:00-06:00"
+// or "* 10:00-16:00", days can be left out for every day
+func parseDeployWindow(s string) (*DeployWindow, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 1 {
+		fields = []string{"*", fields[0]}
+	}
+	if len(fields) != 2 {
+		return nil, ErrInvalidDeployWindow
+	}
+	window := &DeployWindow{}
+
+	for _, part := range strings.Split(strings.ToLower(fields[0]), ",") {
+		if part == "*" {
+			for day := range window.Days {
+				window.Days[day] = true
+			}
+			continue
+		}
+		bounds := strings.SplitN(part, "-", 2)
+		from, ok := weekdays[bounds[0]]
+		if !ok {
+			return nil, ErrInvalidDeployWindow
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, ok = weekdays[bounds[1]]; !ok {
+				return nil, ErrInvalidDeployWindow
+			}
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			window.Days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+
+	times := strings.SplitN(fields[1], "-", 2)
+	if len(times) != 2 {
+		return nil, ErrInvalidDeployWindow
+	}
+	var err error
+	if window.From, err = parseClock(times[0]); err != nil {
+		return nil, err
+	}
+	if window.To, err = parseClock(times[1]); err != nil {
+		return nil, err
+	}
+	if window.From == window.To {
+		return nil, ErrInvalidDeployWindow
+	}
+	return window, nil
+}
+
+// parseClock parses HH:MM into minutes since midnight, 24:00 is the end of the day
+func parseClock(s string) (int, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || len(parts[1]) != 2 {
+		return 0, ErrInvalidDeployWindow
+	}
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, ErrInvalidDeployWindow
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil || hours < 0 || minutes < 0 || minutes > 59 || hours*60+minutes > 24*60 {
+		return 0, ErrInvalidDeployWindow
+	}
+	return hours*60 + minutes, nil
+}
+
+// contains checks if t is inside the window
+func (w *DeployWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.From < w.To {
+		return w.Days[t.Weekday()] && minute >= w.From && minute < w.To
+	}
+	if minute >= w.From {
+		return w.Days[t.Weekday()]
+	}
+	return minute < w.To && w.Days[(t.Weekday()+6)%7]
+}
+
+// checkDeployWindow refuses restarts and deploys of app outside its deploy windows,
+// apps without windows can be deployed any time
+func (a *App) checkDeployWindow(t time.Time) error {
+	if len(a.config().DeployWindowRanges) == 0 {
+		return nil
+	}
+	for _, window := range a.config().DeployWindowRanges {
+		if window.contains(t) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w %s of app %s at %s, pass --force to override", ErrOutsideDeployWindow,
+		strings.Join(a.config().DeployWindows, ", "), a.config().Name, t.Format("Mon 15:04 MST"))
+}
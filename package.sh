@@ -64,8 +64,9 @@ do_build() {
         echo "Unable to retrieve current commit -- aborting"
         cleanup_exit 1
     fi
+    build_date=`date -u +%Y-%m-%dT%H:%M:%SZ`
 
-    go install -a -ldflags="-X main.version $version -X main.commit $commit" ./...
+    go install -a -ldflags="-X main.version=$version -X main.commit=$commit -X main.buildDate=$build_date" ./...
     if [ $? -ne 0 ]; then
         echo "Build failed, unable to create package -- aborting"
         cleanup_exit 1